@@ -0,0 +1,295 @@
+// Implements sharding proxy of key-value storage servers.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/arsenalzp/keyvalstore/internal/proxy"
+	"github.com/arsenalzp/keyvalstore/internal/server/acl"
+	"github.com/arsenalzp/keyvalstore/internal/server/admin"
+	"github.com/arsenalzp/keyvalstore/internal/server/errors"
+	"github.com/arsenalzp/keyvalstore/internal/server/logger"
+	"github.com/arsenalzp/keyvalstore/internal/server/metrics"
+	"github.com/arsenalzp/keyvalstore/internal/server/ocsp"
+	"github.com/arsenalzp/keyvalstore/internal/server/revocation"
+)
+
+const helpMessage string = `
+Usage of proxy:
+
+The following environment variables are required:
+SERVER_CERT - path to a certificate the proxy serves clients with
+SERVER_KEY - path to a private key of the proxy certificate
+ROOTCA_CERT - path to a root CA certificate of clients and shard servers
+PROXY_SHARDS - comma-separated shard servers in "name=host:port" format
+PROXY_CERT - path to a client certificate the proxy connects to shard servers with
+PROXY_KEY - path to a private key of the proxy client certificate
+CRL_PATH - path to a CRL file of client certificates, it's optional if SERVICE_OCSP_POLICY is set
+
+The following environment variables are optional:
+PROXY_ADDR - address to listen on, 0.0.0.0:6840 by default
+PROXY_VNODES - number of virtual nodes of every shard on the hash ring, 128 by default;
+               it must be the same on every proxy of the shards
+PROXY_SERVER_NAME - name to verify certificates of shard servers against,
+                    host of the shard address by default
+PROXY_TIMEOUT - default timeout of a request, 10s by default
+PROXY_IDLE_TIMEOUT - close connections without requests within the timeout, 5m by default
+PROXY_ADMIN_ADDR - address of plain-HTTP admin listener serving /metrics, /healthz
+                   and /shards, e.g. 127.0.0.1:9200; a shard is added by POST to /shards
+PROXY_ADMIN_TOKEN_FILE - path to a file of the bearer token required by POST to /shards,
+                         shards can't be added if it isn't set
+SERVICE_ACL_CONFIG - path to a JSON file of permissions of client certificate identities
+                     on key prefixes, it's reloaded on SIGHUP; shards see the proxy certificate
+                     only, so permissions of clients are checked by the proxy
+SERVICE_OCSP_POLICY - check client certificates by OCSP: soft or hard
+SERVICE_OCSP_URL - URL of the OCSP responder, AIA of the client certificate is used by default
+SERVICE_LOG_FORMAT - log output format: text (default) or json
+SERVICE_LOG_LEVEL - log level: debug, info (default), warn or error
+`
+
+const (
+	defaultAddr        = "0.0.0.0:6840"
+	defaultIdleTimeout = 5 * time.Minute  // timeout for closing idle connections
+	handshakeTimeout   = 10 * time.Second // timeout for TLS handshake
+	dialTimeout        = 10 * time.Second // timeout for connecting to a shard server
+)
+
+func init() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "%s\n", helpMessage)
+	}
+}
+
+func main() {
+	flag.Parse()
+
+	if err := logger.Init(os.Stderr, os.Getenv("SERVICE_LOG_FORMAT"), os.Getenv("SERVICE_LOG_LEVEL"), true); err != nil {
+		fatal("unable to initialize logger", err)
+	}
+
+	rootCACertData, err := os.ReadFile(os.Getenv("ROOTCA_CERT"))
+	if err != nil {
+		fatal("unable to read TLS files", err)
+	}
+
+	caPool := x509.NewCertPool()
+	if ok := caPool.AppendCertsFromPEM(rootCACertData); !ok {
+		fatal("unable to load root CA", errors.New("unable to append CAcert into CAPool", errors.CAPoolLoadErr, nil))
+	}
+
+	serverCrt, err := tls.LoadX509KeyPair(os.Getenv("SERVER_CERT"), os.Getenv("SERVER_KEY"))
+	if err != nil {
+		fatal("unable to load certificate or key", errors.New("unable to load server certificate", errors.KeyCertLoadErr, err))
+	}
+
+	clientCrt, err := tls.LoadX509KeyPair(os.Getenv("PROXY_CERT"), os.Getenv("PROXY_KEY"))
+	if err != nil {
+		fatal("unable to load certificate or key", errors.New("unable to load proxy client certificate", errors.KeyCertLoadErr, err))
+	}
+
+	shards, err := proxy.ParseShards(os.Getenv("PROXY_SHARDS"))
+	if err != nil {
+		fatal("invalid shards", err)
+	}
+
+	vnodes, err := envInt("PROXY_VNODES", proxy.DefaultVNodes)
+	if err != nil {
+		fatal("invalid number of virtual nodes", err)
+	}
+
+	p, err := proxy.New(shards, vnodes, dialer(clientCrt, caPool, os.Getenv("PROXY_SERVER_NAME")))
+	if err != nil {
+		fatal("invalid shards", err)
+	}
+
+	if p.Timeout, err = envDuration("PROXY_TIMEOUT", proxy.DefaultTimeout); err != nil {
+		fatal("invalid timeout", err)
+	}
+
+	if p.IdleTimeout, err = envDuration("PROXY_IDLE_TIMEOUT", defaultIdleTimeout); err != nil {
+		fatal("invalid timeout", err)
+	}
+
+	if path, ok := os.LookupEnv("SERVICE_ACL_CONFIG"); ok {
+		if p.ACL, err = loadACL(path); err != nil {
+			fatal("invalid access control lists", err)
+		}
+	}
+
+	// client certificates are checked for revocation the same way as by servers
+	verifier := &revocation.Verifier{CRLPath: os.Getenv("CRL_PATH")}
+	if policy, ok := os.LookupEnv("SERVICE_OCSP_POLICY"); ok {
+		op, err := ocsp.ParsePolicy(policy)
+		if err != nil {
+			fatal("invalid OCSP policy", err)
+		}
+		verifier.OCSP = ocsp.New(os.Getenv("SERVICE_OCSP_URL"), op)
+	}
+
+	if verifier.CRLPath == "" && verifier.OCSP == nil {
+		fatal("invalid revocation config", errors.New("CRL_PATH or SERVICE_OCSP_POLICY is required", errors.SrvStartErr, nil))
+	}
+
+	if adminAddr, ok := os.LookupEnv("PROXY_ADMIN_ADDR"); ok {
+		adminSrv := admin.New(adminAddr, metrics.Default)
+		if path, ok := os.LookupEnv("PROXY_ADMIN_TOKEN_FILE"); ok {
+			if adminSrv.Token, err = admin.LoadToken(path); err != nil {
+				fatal("invalid admin config", err)
+			}
+		}
+		adminSrv.HandleProtected("/shards", p.Handler())
+		adminSrv.Handle("/loglevel", logger.LevelHandler())
+		if _, err := adminSrv.Start(); err != nil {
+			fatal("unable to start admin server", err)
+		}
+		defer adminSrv.Stop()
+
+		slog.Info("starting admin server", "addr", adminAddr)
+	}
+
+	addr := defaultAddr
+	if v, ok := os.LookupEnv("PROXY_ADDR"); ok {
+		addr = v
+	}
+
+	lsnr, err := net.Listen("tcp", addr)
+	if err != nil {
+		fatal("unable to start proxy", errors.New("network error", errors.NetworkInitErr, err))
+	}
+
+	tlsConf := &tls.Config{
+		ClientAuth:            tls.RequireAndVerifyClientCert,
+		MinVersion:            tls.VersionTLS13,
+		Certificates:          []tls.Certificate{serverCrt},
+		ClientCAs:             caPool,
+		VerifyPeerCertificate: verifier.Verify,
+	}
+
+	slog.Info("starting proxy", "addr", addr, "shards", len(shards))
+
+	for {
+		conn, err := lsnr.Accept()
+		if err != nil {
+			err = errors.New("network error", errors.NetworkCallErr, err)
+			slog.Error("unable to accept connection", "error", err, "code", errors.Code(err))
+			continue
+		}
+
+		go func(conn net.Conn) {
+			tlsConn := tls.Server(conn, tlsConf)
+
+			ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+			err := tlsConn.HandshakeContext(ctx)
+			cancel()
+			if err != nil {
+				metrics.HandshakeFailures.Inc()
+				err = errors.New("network error", errors.HandshakeErr, err)
+				slog.Warn("TLS handshake failed", "remote_addr", conn.RemoteAddr().String(), "error", err, "code", errors.Code(err))
+				conn.Close()
+				return
+			}
+
+			p.HandleCon(context.Background(), tlsConn)
+		}(conn)
+	}
+}
+
+// Dial shard servers by TLS with the client certificate of the proxy,
+// servers are verified by the root CA
+func dialer(crt tls.Certificate, caPool *x509.CertPool, serverName string) proxy.Dialer {
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		conf := &tls.Config{
+			MinVersion:   tls.VersionTLS13,
+			Certificates: []tls.Certificate{crt},
+			RootCAs:      caPool,
+			ServerName:   serverName,
+		}
+
+		if conf.ServerName == "" {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			conf.ServerName = host
+		}
+
+		d := &tls.Dialer{NetDialer: &net.Dialer{Timeout: dialTimeout}, Config: conf}
+		return d.DialContext(ctx, "tcp", addr)
+	}
+}
+
+// Load access control lists from the config file and reload them on SIGHUP
+func loadACL(path string) (*acl.Policy, error) {
+	cfg, err := acl.LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := acl.New(cfg)
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+
+	go func() {
+		for range sigCh {
+			cfg, err := acl.LoadConfig(path)
+			if err != nil {
+				slog.Error("unable to reload access control lists", "path", path, "error", err, "code", errors.Code(err))
+				continue
+			}
+
+			policy.SetConfig(cfg)
+			slog.Info("access control lists reloaded", "path", path)
+		}
+	}()
+
+	return policy, nil
+}
+
+// Get integer value of the env variable, def is returned if it isn't set
+func envInt(name string, def int) (int, error) {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return def, nil
+	}
+
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", name, err)
+	}
+
+	return i, nil
+}
+
+// Get duration value of the env variable, def is returned if it isn't set
+func envDuration(name string, def time.Duration) (time.Duration, error) {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return def, nil
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", name, err)
+	}
+
+	return d, nil
+}
+
+// Log the error and exit
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err, "code", errors.Code(err))
+	os.Exit(1)
+}
@@ -5,56 +5,181 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
+	"time"
 
+	"github.com/arsenalzp/keyvalstore/internal/server/acl"
+	"github.com/arsenalzp/keyvalstore/internal/server/admin"
+	"github.com/arsenalzp/keyvalstore/internal/server/audit"
+	"github.com/arsenalzp/keyvalstore/internal/server/crypt"
 	"github.com/arsenalzp/keyvalstore/internal/server/errors"
 	hndlr "github.com/arsenalzp/keyvalstore/internal/server/handler" // import handlers
+	"github.com/arsenalzp/keyvalstore/internal/server/identity"
+	"github.com/arsenalzp/keyvalstore/internal/server/limits"
+	"github.com/arsenalzp/keyvalstore/internal/server/logger"
+	"github.com/arsenalzp/keyvalstore/internal/server/metrics"
+	"github.com/arsenalzp/keyvalstore/internal/server/ocsp"
+	"github.com/arsenalzp/keyvalstore/internal/server/pubsub"
+	"github.com/arsenalzp/keyvalstore/internal/server/raft"
+	"github.com/arsenalzp/keyvalstore/internal/server/ratelimit"
+	"github.com/arsenalzp/keyvalstore/internal/server/replication"
 	"github.com/arsenalzp/keyvalstore/internal/server/storage"
+	"github.com/arsenalzp/keyvalstore/internal/server/storage/changelog"
+	"github.com/arsenalzp/keyvalstore/internal/server/storage/entity"
+	"github.com/arsenalzp/keyvalstore/internal/server/storage/migrate"
+	"github.com/arsenalzp/keyvalstore/internal/server/storage/quota"
+	"github.com/arsenalzp/keyvalstore/internal/server/storage/tenant"
+	"github.com/arsenalzp/keyvalstore/internal/server/webhook"
 )
 
 const helpMessage string = `
 Usage of server:
 
 The following environment variables are required:
-CRL_PATH - path to a CRL file
+CRL_PATH - path to a CRL file, it's optional if SERVICE_OCSP_POLICY is set
 SERVER_CERT - path to a server's certificate
 SERVER_KEY - path to a server private key
 ROOTCA_CERT - path to a root CA certificate
-SERVICE_STORAGE - set an underlying storage (hash table or sqlite)
+SERVICE_STORAGE - set an underlying storage (hash table or sqlite), it can be migrated
+                  to another one on /storage of the admin listener
 SERVICE_PORT - set TCP port to listen on
 SERVICE_NIC - set NIC for binding
+
+The following environment variables are optional:
+SERVICE_ADMIN_ADDR - address of plain-HTTP admin listener serving /metrics, /healthz,
+                     /readyz, /loglevel, /quotas, /replication and /cluster, e.g. 127.0.0.1:9100
+SERVICE_ADMIN_TOKEN_FILE - path to a file of the bearer token required by admin requests changing
+                           the state of the server, e.g. adding cluster members, webhooks or migrating the storage; they are refused
+                           if it isn't set
+SERVICE_LOG_FORMAT - log output format: text (default) or json
+SERVICE_LOG_LEVEL - log level: debug, info (default), warn or error;
+                    it can be changed at runtime by PUT request to /loglevel
+SERVICE_LOG_HASH_KEYS - log hashes of keys instead of keys, true by default;
+                        set to false to log keys in cleartext
+SERVICE_MAX_CONNS - maximum number of concurrent connections, unlimited by default
+SERVICE_MAX_CONNS_PER_CLIENT - maximum number of concurrent connections of a client certificate,
+                               unlimited by default
+SERVICE_IDLE_TIMEOUT - close connections without requests within the timeout, 5m by default
+SERVICE_WRITE_TIMEOUT - timeout for sending a response, 30s by default
+SERVICE_OP_TIMEOUT - default timeout of a storage operation, 10s by default
+SERVICE_MAX_OP_TIMEOUT - upper bound of a client-supplied operation timeout, 1m by default
+SERVICE_RATELIMIT_CONFIG - path to a JSON file of read and write rate limits per client
+                           certificate identity or group, it's reloaded on SIGHUP
+SERVICE_ACL_CONFIG - path to a JSON file of permissions of client certificate identities
+                     on key prefixes, it's reloaded on SIGHUP; all commands are allowed
+                     to any client if it isn't set
+SERVICE_TENANT_FIELD - client certificate field (O, OU or CN) of the client tenant;
+                       if it's set, keys of every tenant are isolated from other tenants
+SERVICE_QUOTA_CONFIG - path to a JSON file of limits on number of keys and total bytes stored
+                       per tenant or client certificate identity, it's reloaded on SIGHUP;
+                       usage is reported on /quotas of the admin listener
+SERVICE_AUDIT_LOG - path to the tamper-evident audit log of SET, SEC, DEL, INC, IMP and EXP commands,
+                    it can be verified by "keyval audit verify" command
+SERVICE_AUDIT_KEY_FILE - path to a file of base64-encoded HMAC key (at least 32 bytes) chaining
+                         entries of the audit log, it's required with SERVICE_AUDIT_LOG
+SERVICE_AUDIT_FAIL_OPEN - set to true to run and acknowledge operations which can't be recorded
+                          into the audit log, they are failed without being applied by default
+SERVICE_MASTER_KEY_FILE - path to a file of master keys encrypting values of sqlite storage,
+                          the Raft log and snapshots and the webhook queue,
+                          one "id:base64-key" per line, the first key is the primary one
+SERVICE_MASTER_KEYS - comma-separated master keys in "id:base64-key" format,
+                      it's used if SERVICE_MASTER_KEY_FILE isn't set
+SERVICE_REPLICATION_ENABLED - set to true to stream changes to replicas, the replica certificate
+                              has to be granted replicate permission by SERVICE_ACL_CONFIG
+SERVICE_WATCH_ENABLED - set to true to serve WATCH command
+SERVICE_CHANGELOG_SIZE - number of the last changes kept in memory for replicas catching up,
+                         10000 by default; replicas which are further behind receive a snapshot
+SERVICE_REPLICA_OF - address of the primary server, the server runs as its read-only replica
+SERVICE_REPLICA_CERT - path to a client certificate the replica connects to the primary with
+SERVICE_REPLICA_KEY - path to a private key of the replica client certificate
+SERVICE_REPLICA_SERVER_NAME - name to verify the primary certificate against,
+                              host of SERVICE_REPLICA_OF by default
+SERVICE_CLUSTER_ID - ID of the member, the server runs as a member of the Raft cluster;
+                     writes are accepted by the leader, followers redirect clients to it
+SERVICE_CLUSTER_ADDR - address of the Raft listener of the member, e.g. 127.0.0.1:7001
+SERVICE_CLUSTER_PEERS - comma-separated initial members in "id=raft-addr=client-addr" format,
+                        a new member is started with the existing ones and added by
+                        "keyval cluster add" command
+SERVICE_CLUSTER_DIR - directory of the Raft log and snapshots of the member, "cluster" by default
+SERVICE_CLUSTER_CERT - path to a client certificate the member connects to other members with
+SERVICE_CLUSTER_CA - path to a CA certificate of member client certificates, the Raft listener
+                     accepts only them; without it members have to be granted cluster permission
+                     by SERVICE_ACL_CONFIG, the member doesn't start if neither is set
+SERVICE_CLUSTER_KEY - path to a private key of the member client certificate
+SERVICE_CLUSTER_ELECTION_TIMEOUT - election timeout of the member, 1s by default
+SERVICE_CLUSTER_SNAPSHOT_ENTRIES - number of applied entries the Raft log is compacted after,
+                                   10000 by default
+SERVICE_OCSP_POLICY - check client certificates by OCSP: soft (accept certificates if their
+                      status can't be obtained) or hard (reject them)
+SERVICE_OCSP_URL - URL of the OCSP responder, AIA of the client certificate is used by default
+SERVICE_PUBSUB_BUFFER - number of messages buffered per subscriber of channels, 128 by default
+SERVICE_PUBSUB_SLOW_POLICY - policy of subscribers with the full buffer: drop (default) drops
+                             their messages, disconnect closes their connections
+SERVICE_STORAGE_STATE - path to the file recording the storage migrated to, storage.state by
+                        default; the server doesn't start if SERVICE_STORAGE differs from it
+SERVICE_WEBHOOK_DIR - directory of registered webhooks, their delivery queue and dead-letter log,
+                      webhooks are notified of mutations and managed on /webhooks of the admin listener
+SERVICE_WEBHOOK_MAX_ATTEMPTS - number of delivery attempts before the dead-letter log, 10 by default
+SERVICE_WEBHOOK_TIMEOUT - timeout of a delivery attempt, 10s by default
+SERVICE_WEBHOOK_BACKOFF - delay after the first failed attempt, it's doubled on every next one, 1s by default
+SERVICE_WEBHOOK_MAX_BACKOFF - upper bound of the delay between attempts, 5m by default
 `
 
+const (
+	statsTimeout        = 5 * time.Second  // timeout for collecting storage statistics
+	handshakeTimeout    = 10 * time.Second // timeout for TLS handshake
+	defaultIdleTimeout  = 5 * time.Minute  // timeout for closing idle connections
+	defaultWriteTimeout = 30 * time.Second // timeout for sending a response
+	defaultMaxOpTimeout = time.Minute      // upper bound of a client-supplied operation timeout
+)
+
 func init() {
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "%s\n", helpMessage)
 	}
-	flag.Parse()
 }
 
 func main() {
+	flag.Parse()
+
+	// keys are hashed in logs unless it's explicitly disabled
+	hashKeys, err := envBool("SERVICE_LOG_HASH_KEYS", true)
+	if err != nil {
+		fatal("unable to initialize logger", err)
+	}
+
+	err = logger.Init(os.Stderr, os.Getenv("SERVICE_LOG_FORMAT"), os.Getenv("SERVICE_LOG_LEVEL"), hashKeys)
+	if err != nil {
+		fatal("unable to initialize logger", err)
+	}
+
 	// Read a server certificate
 	serverCertData, err := os.ReadFile(os.Getenv("SERVER_CERT"))
 	if err != nil {
-		log.Fatal(err)
+		fatal("unable to read TLS files", err)
 		return
 	}
 
 	// Read a server private key
 	serverPrivKeyData, err := os.ReadFile(os.Getenv("SERVER_KEY"))
 	if err != nil {
-		log.Fatal(err)
+		fatal("unable to read TLS files", err)
 		return
 	}
 
 	// Read CA certificate
 	rootCACertData, err := os.ReadFile(os.Getenv("ROOTCA_CERT"))
 	if err != nil {
-		log.Fatal(err)
+		fatal("unable to read TLS files", err)
 		return
 	}
 
@@ -62,7 +187,7 @@ func main() {
 	if stringPort, ok := os.LookupEnv("SERVICE_PORT"); ok {
 		intPort, err := strconv.Atoi(stringPort)
 		if err != nil {
-			log.Fatal(err)
+			fatal("invalid SERVICE_PORT", err)
 			return
 		}
 		port = intPort
@@ -77,41 +202,621 @@ func main() {
 		Port:           port,
 	}
 
+	if policy, ok := os.LookupEnv("SERVICE_OCSP_POLICY"); ok {
+		p, err := ocsp.ParsePolicy(policy)
+		if err != nil {
+			fatal("invalid OCSP policy", err)
+		}
+		srv.OCSP = ocsp.New(os.Getenv("SERVICE_OCSP_URL"), p)
+	}
+
 	defer srv.Stop()
 
-	strg, err := storage.NewStrg(os.Getenv("SERVICE_STORAGE"))
+	// master keys also encrypt the Raft log and the webhook queue
+	keys, err := crypt.LoadKeyring()
 	if err != nil {
-		log.Fatal(err) // followed by os.Exit(1)
+		fatal("unable to load master keys", err)
+	}
+
+	kind := os.Getenv("SERVICE_STORAGE")
+	statePath := "storage.state"
+	if v, ok := os.LookupEnv("SERVICE_STORAGE_STATE"); ok {
+		statePath = v
+	}
+	if err := migrate.CheckState(statePath, kind); err != nil {
+		fatal("storage was migrated", err)
+	}
+
+	backend, err := storage.NewStrg(kind)
+	if err != nil {
+		fatal("unable to initialize storage", err)
+	}
+
+	// the storage can be migrated to another kind without restart
+	strg := migrate.New(kind, backend, storage.NewStrg)
+	strg.StatePath = statePath
+
+	// re-encrypt values by the primary master key in background
+	if rw, ok := backend.(storage.Rewrapper); ok {
+		go func() {
+			n, err := rw.Rewrap(context.Background())
+			if err != nil {
+				slog.Error("unable to re-encrypt storage", "error", err, "code", errors.Code(err))
+				return
+			}
+
+			if n > 0 {
+				slog.Info("storage re-encrypted by the primary master key", "rows", n)
+			}
+		}()
 	}
 
 	lsnr, err := srv.Start()
 	if err != nil {
-		log.Fatal(err) // followed by os.Exit(1)
+		fatal("unable to start server", err)
+	}
+
+	limiter := &limits.ConnLimiter{}
+	h := &hndlr.ConnHandler{Limiter: limiter}
+
+	err = loadLimits(h, limiter)
+	if err != nil {
+		fatal("invalid connection limits", err)
+	}
+
+	if path, ok := os.LookupEnv("SERVICE_RATELIMIT_CONFIG"); ok {
+		h.RateLimiter, err = loadRateLimits(path)
+		if err != nil {
+			fatal("invalid rate limits", err)
+		}
+	}
+
+	if path, ok := os.LookupEnv("SERVICE_ACL_CONFIG"); ok {
+		h.ACL, err = loadACL(path)
+		if err != nil {
+			fatal("invalid access control lists", err)
+		}
+	}
+
+	if field, ok := os.LookupEnv("SERVICE_TENANT_FIELD"); ok {
+		h.TenantField, err = tenant.ParseField(field)
+		if err != nil {
+			fatal("invalid tenant field", err)
+		}
+	}
+
+	if path, ok := os.LookupEnv("SERVICE_QUOTA_CONFIG"); ok {
+		h.Quota, err = loadQuota(path, strg, h.TenantField != "")
+		if err != nil {
+			fatal("invalid storage quotas", err)
+		}
+	}
+
+	if path, ok := os.LookupEnv("SERVICE_AUDIT_LOG"); ok {
+		key, err := audit.LoadKey(os.Getenv("SERVICE_AUDIT_KEY_FILE"))
+		if err != nil {
+			fatal("unable to open audit log", err)
+		}
+
+		h.Audit, err = audit.Open(path, key)
+		if err != nil {
+			fatal("unable to open audit log", err)
+		}
+		defer h.Audit.Close()
+
+		h.AuditFailOpen, err = envBool("SERVICE_AUDIT_FAIL_OPEN", false)
+		if err != nil {
+			fatal("invalid audit log config", errors.New("invalid fail open flag", errors.AuditErr, err))
+		}
+	}
+
+	// messages of channels are delivered to subscribers connected to the server
+	pubsubBuffer, err := envInt("SERVICE_PUBSUB_BUFFER", pubsub.DefaultBuffer)
+	if err != nil {
+		fatal("invalid publish/subscribe config", errors.New("invalid buffer", errors.PubSubCfgErr, err))
+	}
+
+	pubsubPolicy, err := pubsub.ParsePolicy(os.Getenv("SERVICE_PUBSUB_SLOW_POLICY"))
+	if err != nil {
+		fatal("invalid publish/subscribe config", err)
+	}
+	h.PubSub = pubsub.New(pubsubBuffer, pubsubPolicy)
+
+	h.Replication, err = envBool("SERVICE_REPLICATION_ENABLED", false)
+	if err != nil {
+		fatal("invalid replication config", errors.New("invalid replication flag", errors.ReplicationErr, err))
+	}
+
+	h.Watch, err = envBool("SERVICE_WATCH_ENABLED", false)
+	if err != nil {
+		fatal("invalid watch config", errors.New("invalid watch flag", errors.WatchErr, err))
+	}
+
+	webhookDir, webhooks := os.LookupEnv("SERVICE_WEBHOOK_DIR")
+
+	// mutations of the storage are published to replicas, watchers and
+	// webhooks by the change log; it serializes mutations, so the storage
+	// is wrapped only if any of them is enabled
+	var base storage.Storage = strg
+	if h.Quota != nil {
+		// usage of namespaces is counted by writes applied to the storage,
+		// so writes of Raft and replication are counted as well
+		base = h.Quota.Count(strg, namespaceSplit(h.TenantField != ""))
+	}
+	if h.Replication || h.Watch || webhooks {
+		history, err := envInt("SERVICE_CHANGELOG_SIZE", changelog.DefaultHistory)
+		if err != nil {
+			fatal("invalid change log size", err)
+		}
+		h.Changes = changelog.New(base, history)
+		base = h.Changes
+	}
+
+	var hooks *webhook.Dispatcher
+	if webhooks {
+		hooks, err = newWebhooks(webhookDir, keys)
+		if err != nil {
+			fatal("invalid webhook config", err)
+		}
+		defer hooks.Close()
+
+		go hooks.Run(context.Background(), h.Changes)
+	}
+
+	var replica *replication.Replica
+	if primary, ok := os.LookupEnv("SERVICE_REPLICA_OF"); ok {
+		replica, err = newReplica(primary, rootCACertData, base)
+		if err != nil {
+			fatal("invalid replication config", err)
+		}
+		h.ReadOnly = true
+
+		go replica.Run(context.Background())
+	}
+
+	// writes of clients are replicated through the Raft log of the cluster
+	clientStrg := base
+	var member *raft.Node
+	if id, ok := os.LookupEnv("SERVICE_CLUSTER_ID"); ok {
+		if replica != nil {
+			fatal("invalid cluster config", errors.New("cluster member can't be a replica", errors.ClusterCfgErr, nil))
+		}
+
+		member, err = newMember(id, srv, rootCACertData, h, base, keys)
+		if err != nil {
+			fatal("invalid cluster config", err)
+		}
+		clientStrg = member.Storage()
+
+		go member.Run(context.Background())
+	}
+
+	if adminAddr, ok := os.LookupEnv("SERVICE_ADMIN_ADDR"); ok {
+		registerStorageMetrics(strg)
+
+		adminSrv := admin.New(adminAddr, metrics.Default)
+		if path, ok := os.LookupEnv("SERVICE_ADMIN_TOKEN_FILE"); ok {
+			if adminSrv.Token, err = admin.LoadToken(path); err != nil {
+				fatal("invalid admin config", err)
+			}
+		}
+		if srv.CrlPath != "" {
+			adminSrv.AddCheck("crl", srv.CheckCRL)
+		}
+		adminSrv.AddCheck("storage", func(ctx context.Context) (string, error) {
+			return "", storage.Ping(ctx, strg)
+		})
+		adminSrv.Handle("/loglevel", logger.LevelHandler())
+		adminSrv.HandleProtected("/storage", strg.Handler())
+		if replica != nil {
+			adminSrv.AddCheck("replication", replica.Check)
+			adminSrv.Handle("/replication", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(replica.Status())
+			}))
+		}
+		if h.Quota != nil {
+			adminSrv.Handle("/quotas", h.Quota.Handler())
+		}
+		if hooks != nil {
+			adminSrv.HandleProtected("/webhooks", hooks.Handler())
+		}
+		if member != nil {
+			adminSrv.AddCheck("cluster", member.Check)
+			adminSrv.HandleProtected("/cluster", member.AdminHandler())
+			adminSrv.HandleProtected("/cluster/members", member.AdminHandler())
+		}
+		if _, err := adminSrv.Start(); err != nil {
+			fatal("unable to start admin server", err)
+		}
+		defer adminSrv.Stop()
+
+		slog.Info("starting admin server", "addr", adminAddr)
 	}
 
 	for {
 		conn, err := lsnr.Accept()
 		if err != nil {
 			err = errors.New("network error", errors.NetworkCallErr, err)
-			log.Println(err)
+			slog.Error("unable to accept connection", "error", err, "code", errors.Code(err))
+			continue
+		}
+
+		if err := limiter.Acquire(); err != nil {
+			metrics.RejectedConns.Inc("global")
+			slog.Warn("connection rejected", "remote_addr", conn.RemoteAddr().String(), "error", err, "code", errors.Code(err))
+			conn.Close()
 			continue
 		}
 
-		tlsConn := tls.Server(conn, srv.GetTlsConf())
+		go func(conn net.Conn) {
+			defer limiter.Release()
+
+			ctx := context.Background()
+
+			tlsConn := tls.Server(conn, srv.GetTlsConf())
+
+			hsCtx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+			err := tlsConn.HandshakeContext(hsCtx)
+			cancel()
+			if err != nil {
+				metrics.HandshakeFailures.Inc()
+				err = errors.New("network error", errors.HandshakeErr, err)
+				slog.Warn("TLS handshake failed", "remote_addr", conn.RemoteAddr().String(), "error", err, "code", errors.Code(err))
+				conn.Close()
+				return
+			}
+
+			h.HandleCon(ctx, tlsConn, clientStrg)
+		}(conn)
+	}
+}
+
+// Load connection limits and timeouts from env variables
+func loadLimits(h *hndlr.ConnHandler, limiter *limits.ConnLimiter) error {
+	var err error
+
+	if limiter.Max, err = envInt("SERVICE_MAX_CONNS", 0); err != nil {
+		return err
+	}
+
+	if limiter.MaxPerClient, err = envInt("SERVICE_MAX_CONNS_PER_CLIENT", 0); err != nil {
+		return err
+	}
+
+	if h.IdleTimeout, err = envDuration("SERVICE_IDLE_TIMEOUT", defaultIdleTimeout); err != nil {
+		return err
+	}
+
+	if h.WriteTimeout, err = envDuration("SERVICE_WRITE_TIMEOUT", defaultWriteTimeout); err != nil {
+		return err
+	}
+
+	if h.OpTimeout, err = envDuration("SERVICE_OP_TIMEOUT", 0); err != nil {
+		return err
+	}
+
+	if h.MaxOpTimeout, err = envDuration("SERVICE_MAX_OP_TIMEOUT", defaultMaxOpTimeout); err != nil {
+		return err
+	}
+
+	return nil
+}
 
-		err = tlsConn.Handshake()
+// Create webhook dispatcher configured by env variables
+func newWebhooks(dir string, keys *crypt.Keyring) (*webhook.Dispatcher, error) {
+	cfg := webhook.Config{Dir: dir, Keys: keys}
+	var err error
+
+	if cfg.MaxAttempts, err = envInt("SERVICE_WEBHOOK_MAX_ATTEMPTS", webhook.DefaultMaxAttempts); err != nil {
+		return nil, err
+	}
+
+	if cfg.Timeout, err = envDuration("SERVICE_WEBHOOK_TIMEOUT", webhook.DefaultTimeout); err != nil {
+		return nil, err
+	}
+
+	if cfg.Backoff, err = envDuration("SERVICE_WEBHOOK_BACKOFF", webhook.DefaultBackoff); err != nil {
+		return nil, err
+	}
+
+	if cfg.MaxBackoff, err = envDuration("SERVICE_WEBHOOK_MAX_BACKOFF", webhook.DefaultMaxBackoff); err != nil {
+		return nil, err
+	}
+
+	return webhook.New(cfg)
+}
+
+// Load rate limits from the config file and reload them on SIGHUP
+func loadRateLimits(path string) (*ratelimit.Limiter, error) {
+	cfg, err := ratelimit.LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	rl := ratelimit.New(cfg)
+
+	onReload("rate limits", path, func() error {
+		cfg, err := ratelimit.LoadConfig(path)
 		if err != nil {
-			err = errors.New("network error", errors.NetworkCallErr, err)
-			log.Println(err)
-			continue
+			return err
 		}
 
-		ctx := context.Background()
+		rl.SetConfig(cfg)
+		return nil
+	})
+
+	return rl, nil
+}
+
+// Load access control lists from the config file and reload them on SIGHUP
+func loadACL(path string) (*acl.Policy, error) {
+	cfg, err := acl.LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := acl.New(cfg)
+
+	onReload("access control lists", path, func() error {
+		cfg, err := acl.LoadConfig(path)
 		if err != nil {
-			err = errors.New("network error", errors.NetworkCallErr, err)
-			log.Println(err)
+			return err
 		}
 
-		go hndlr.HandleCon(ctx, tlsConn, strg)
+		policy.SetConfig(cfg)
+		return nil
+	})
+
+	return policy, nil
+}
+
+// Split stored keys into namespace and key,
+// all the keys belong to the shared keyspace if tenants aren't isolated
+func namespaceSplit(isolated bool) func(string) (string, string) {
+	if isolated {
+		return tenant.Split
+	}
+
+	return func(key string) (string, string) { return "", key }
+}
+
+// Load storage quotas from the config file and reload them on SIGHUP
+// Initial usage of namespaces is calculated from the content of the storage
+func loadQuota(path string, strg storage.Storage, isolated bool) (*quota.Tracker, error) {
+	cfg, err := quota.LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	tracker := quota.New(cfg)
+	if err := tracker.Load(context.Background(), strg, namespaceSplit(isolated)); err != nil {
+		return nil, err
+	}
+
+	onReload("storage quotas", path, func() error {
+		cfg, err := quota.LoadConfig(path)
+		if err != nil {
+			return err
+		}
+
+		tracker.SetConfig(cfg)
+		return nil
+	})
+
+	return tracker, nil
+}
+
+// Create replica of the primary server, the replica is authenticated
+// by its client certificate, the primary is verified by the root CA
+func newReplica(primary string, rootCACertData []byte, strg storage.Storage) (*replication.Replica, error) {
+	crt, err := tls.LoadX509KeyPair(os.Getenv("SERVICE_REPLICA_CERT"), os.Getenv("SERVICE_REPLICA_KEY"))
+	if err != nil {
+		return nil, errors.New("unable to load replica certificate or key", errors.KeyCertLoadErr, err)
+	}
+
+	caPool, err := createCAPool(rootCACertData)
+	if err != nil {
+		return nil, err
+	}
+
+	serverName, ok := os.LookupEnv("SERVICE_REPLICA_SERVER_NAME")
+	if !ok {
+		if serverName, _, err = net.SplitHostPort(primary); err != nil {
+			return nil, errors.New("invalid primary address", errors.ReplicationErr, err)
+		}
+	}
+
+	return &replication.Replica{
+		Primary: primary,
+		TLS: &tls.Config{
+			MinVersion:   tls.VersionTLS13,
+			Certificates: []tls.Certificate{crt},
+			RootCAs:      caPool,
+			ServerName:   serverName,
+		},
+		Storage: strg,
+	}, nil
+}
+
+// Create member of the cluster and start its Raft listener, members are
+// authenticated by client certificates issued by the root CA and authorized
+// by the cluster permission if access control lists are set
+func newMember(id string, srv Server, rootCACertData []byte, h *hndlr.ConnHandler, strg storage.Storage, keys *crypt.Keyring) (*raft.Node, error) {
+	cfg := raft.Config{ID: id, Dir: os.Getenv("SERVICE_CLUSTER_DIR"), Keys: keys}
+	if cfg.Dir == "" {
+		cfg.Dir = "cluster"
+	}
+
+	members, err := raft.ParseMembers(os.Getenv("SERVICE_CLUSTER_PEERS"))
+	if err != nil {
+		return nil, err
+	}
+	cfg.Members = members
+
+	if cfg.ElectionTimeout, err = envDuration("SERVICE_CLUSTER_ELECTION_TIMEOUT", raft.DefaultElectionTimeout); err != nil {
+		return nil, err
+	}
+
+	if cfg.SnapshotEntries, err = envInt("SERVICE_CLUSTER_SNAPSHOT_ENTRIES", raft.DefaultSnapshotEntries); err != nil {
+		return nil, err
+	}
+
+	// the Raft listener accepts certificates of the cluster CA only,
+	// or members have to be granted cluster permission by ACL
+	clusterCA, separateCA := os.LookupEnv("SERVICE_CLUSTER_CA")
+	if !separateCA && h.ACL == nil {
+		return nil, errors.New("cluster members aren't authorized, SERVICE_CLUSTER_CA or SERVICE_ACL_CONFIG is required", errors.ClusterCfgErr, nil)
 	}
+
+	if h.ACL != nil {
+		cfg.Authorize = func(peer identity.Identity) bool {
+			return h.ACL.Granted(peer, acl.Cluster)
+		}
+	}
+
+	crt, err := tls.LoadX509KeyPair(os.Getenv("SERVICE_CLUSTER_CERT"), os.Getenv("SERVICE_CLUSTER_KEY"))
+	if err != nil {
+		return nil, errors.New("unable to load cluster certificate or key", errors.KeyCertLoadErr, err)
+	}
+
+	caPool, err := createCAPool(rootCACertData)
+	if err != nil {
+		return nil, err
+	}
+
+	node, err := raft.New(cfg, strg, &tls.Config{
+		MinVersion:   tls.VersionTLS13,
+		Certificates: []tls.Certificate{crt},
+		RootCAs:      caPool,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	lsnrConf := srv.GetTlsConf()
+	if separateCA {
+		data, err := os.ReadFile(clusterCA)
+		if err != nil {
+			return nil, errors.New("unable to load cluster CA certificate", errors.CAcertLoadErr, err)
+		}
+
+		clusterPool, err := createCAPool(data)
+		if err != nil {
+			return nil, err
+		}
+
+		lsnrConf = lsnrConf.Clone()
+		lsnrConf.ClientCAs = clusterPool
+	}
+
+	addr := os.Getenv("SERVICE_CLUSTER_ADDR")
+	lsnr, err := tls.Listen("tcp", addr, lsnrConf)
+	if err != nil {
+		return nil, errors.New("unable to start Raft listener", errors.NetworkCallErr, err)
+	}
+
+	go func() {
+		err := (&http.Server{Handler: node.Handler(), ReadHeaderTimeout: handshakeTimeout}).Serve(lsnr)
+		fatal("Raft listener failed", err)
+	}()
+
+	slog.Info("starting cluster member", "id", id, "addr", addr, "members", len(members))
+
+	return node, nil
+}
+
+// Call reload of the config file on every SIGHUP,
+// the previous config is kept if reload fails
+func onReload(name, path string, reload func() error) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+
+	go func() {
+		for range sigCh {
+			if err := reload(); err != nil {
+				slog.Error("unable to reload "+name, "path", path, "error", err, "code", errors.Code(err))
+				continue
+			}
+
+			slog.Info(name+" reloaded", "path", path)
+		}
+	}()
+}
+
+// Get integer value of the env variable, def is returned if it isn't set
+func envInt(name string, def int) (int, error) {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return def, nil
+	}
+
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", name, err)
+	}
+
+	return i, nil
+}
+
+// Get boolean value of the env variable, def is returned if it isn't set
+func envBool(name string, def bool) (bool, error) {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return def, nil
+	}
+
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", name, err)
+	}
+
+	return b, nil
+}
+
+// Get duration value of the env variable, def is returned if it isn't set
+func envDuration(name string, def time.Duration) (time.Duration, error) {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return def, nil
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", name, err)
+	}
+
+	return d, nil
+}
+
+// Register metrics of the underlying storage size
+func registerStorageMetrics(strg *migrate.Storage) {
+	collect := func(value func(entity.Stats) uint64) func() []metrics.Sample {
+		return func() []metrics.Sample {
+			ctx, cancel := context.WithTimeout(context.Background(), statsTimeout)
+			defer cancel()
+
+			stats, err := storage.Stats(ctx, strg)
+			if err != nil {
+				slog.Warn("unable to collect storage statistics", "error", err, "code", errors.Code(err))
+				return nil
+			}
+
+			return []metrics.Sample{{Labels: []string{strg.Kind()}, Value: float64(value(stats))}}
+		}
+	}
+
+	metrics.Default.Register(metrics.NewGaugeFunc("keyval_storage_keys",
+		"Number of keys in the underlying storage.",
+		collect(func(s entity.Stats) uint64 { return s.Keys }), "backend"))
+
+	metrics.Default.Register(metrics.NewGaugeFunc("keyval_storage_bytes",
+		"Approximate size of keys and values in the underlying storage.",
+		collect(func(s entity.Stats) uint64 { return s.Bytes }), "backend"))
+}
+
+// Log the error and exit
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err, "code", errors.Code(err))
+	os.Exit(1)
 }
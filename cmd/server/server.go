@@ -1,16 +1,18 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
-	"crypto/x509/pkix"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"os"
 	"time"
 
 	"github.com/arsenalzp/keyvalstore/internal/server/errors"
+	"github.com/arsenalzp/keyvalstore/internal/server/ocsp"
+	"github.com/arsenalzp/keyvalstore/internal/server/revocation"
 	"github.com/arsenalzp/keyvalstore/internal/server/storage"
 )
 
@@ -25,6 +27,7 @@ type Server struct {
 	Address        string
 	Port           int
 	Storage        *storage.Storage
+	OCSP           *ocsp.Checker // OCSP checker of client certificates, disabled if nil
 	lsnr           net.Listener
 }
 
@@ -35,7 +38,7 @@ func (s *Server) Start() (net.Listener, error) {
 		return nil, err
 	}
 
-	if s.CrlPath == "" || s.ServerCrtData == nil || s.ServerKeyData == nil || s.RootCACertData == nil {
+	if (s.CrlPath == "" && s.OCSP == nil) || s.ServerCrtData == nil || s.ServerKeyData == nil || s.RootCACertData == nil {
 		err = errors.New("configuration error", errors.SrvStartErr, err)
 		return nil, err
 	}
@@ -53,25 +56,25 @@ func (s *Server) Start() (net.Listener, error) {
 		return nil, err
 	}
 
-	log.Printf("starting server on port %d\n", s.Port)
+	slog.Info("starting server", "addr", s.Address)
 
 	return s.lsnr, nil
 }
 
 func (s *Server) Stop() {
 	if s.lsnr == nil {
-		log.Println("stopping the server...")
+		slog.Info("stopping the server...")
 		return
 	}
 
 	err := s.lsnr.Close()
 	if err != nil {
 		err = errors.New("unable to start server", errors.SrvStopErr, err)
-		log.Fatalf("failed to stop the server: %s\n", err)
-		return
+		slog.Error("failed to stop the server", "error", err, "code", errors.Code(err))
+		os.Exit(1)
 	}
 
-	log.Println("stopping the server...")
+	slog.Info("stopping the server...")
 }
 
 // initNetwork initialize network configuration
@@ -114,58 +117,25 @@ func (s *Server) initTLS() (*tls.Config, error) {
 	}
 
 	tlsConf := &tls.Config{
-		ClientAuth:   tls.RequireAndVerifyClientCert,
-		MinVersion:   tls.VersionTLS13,
-		Certificates: []tls.Certificate{crt},
-		ClientCAs:    caPool,
-		VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
-			crl, err := parseCRL(s.CrlPath)
-			if err != nil {
-				return err
-			}
-
-			err = checkCertWithCRL(verifiedChains[0][0], crl)
-			if err != nil {
-				return err
-			}
-			return nil
-		},
+		ClientAuth:            tls.RequireAndVerifyClientCert,
+		MinVersion:            tls.VersionTLS13,
+		Certificates:          []tls.Certificate{crt},
+		ClientCAs:             caPool,
+		VerifyPeerCertificate: (&revocation.Verifier{CRLPath: s.CrlPath, OCSP: s.OCSP}).Verify,
 	}
 
 	return tlsConf, err
 }
 
-// Check provided certificate cert against CRL
-func checkCertWithCRL(cert *x509.Certificate, crl *pkix.CertificateList) error {
-	for _, revokedCertificate := range crl.TBSCertList.RevokedCertificates {
-		if revokedCertificate.SerialNumber.Cmp(cert.SerialNumber) == 0 {
-			err := errors.New("certificate was revoked", errors.CRLCertRevokErr, nil)
-			return err
-		}
-	}
-	return nil
-}
-
-// Parse CRL file which is accessible by crlPath
-func parseCRL(crlPath string) (*pkix.CertificateList, error) {
-	crlData, err := os.ReadFile(crlPath)
-	if err != nil {
-		err := errors.New("unabel to read CRL file", errors.CRLLoadErr, err)
-		return nil, err
-	}
-
-	crlList, err := x509.ParseCRL(crlData)
+// Check freshness of the CRL file, it's used by the readiness probe
+// Returns time of the next CRL update
+func (s *Server) CheckCRL(ctx context.Context) (string, error) {
+	crl, err := revocation.ParseCRL(s.CrlPath)
 	if err != nil {
-		err := errors.New("unabel to parse CRL data", errors.CRLParseErr, err)
-		return nil, err
-	}
-
-	if crlList.TBSCertList.NextUpdate.Before(time.Now()) {
-		err := errors.New("CRL is outdated", errors.CRLExpiredErr, nil)
-		return nil, err
+		return "", err
 	}
 
-	return crlList, nil
+	return "next update at " + crl.TBSCertList.NextUpdate.Format(time.RFC3339), nil
 }
 
 // retrieve IP address from the give NIC
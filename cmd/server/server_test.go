@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"net"
 	"os"
@@ -282,6 +283,108 @@ func TestSSLConnection(t *testing.T) {
 	}
 }
 
+func TestSSLClientVerified(t *testing.T) {
+	err := prepareCRL(CRL_FILE, []byte(CRL_DATA))
+	if err != nil {
+		t.Errorf("unable to create CRL file, %s\n", err)
+		return
+	}
+
+	defer cleanUpCRL(CRL_FILE)
+
+	srv := Server{
+		CrlPath:        CRL_FILE,
+		ServerCrtData:  []byte(SERVER_CERT),
+		ServerKeyData:  []byte(SERVER_KEY),
+		RootCACertData: []byte(ROOTCA_CERT),
+		Port:           9999,
+	}
+
+	lsnr, err := srv.Start()
+	if err != nil {
+		t.Errorf("unable starting server, %s", err)
+		return
+	}
+
+	done := make(chan struct{})
+	go func(l *net.Listener) {
+		defer close(done)
+
+		conn, err := (*l).Accept()
+		if err != nil {
+			t.Errorf("error establishing connection: %s\n", err)
+			return
+		}
+
+		tlsConn := tls.Server(conn, srv.GetTlsConf())
+
+		err = tlsConn.Handshake()
+		if err != nil {
+			t.Errorf("error establishing secure connection: %s\n", err)
+			return
+		}
+
+		if len(tlsConn.ConnectionState().PeerCertificates) == 0 {
+			t.Error("error verifying client certificate: no peer certificates\n")
+			return
+		}
+	}(&lsnr)
+	defer lsnr.Close()
+
+	clientPEM, err := tls.X509KeyPair([]byte(CLIENT_CERT), []byte(CLIENT_KEY))
+	if err != nil {
+		t.Errorf("unable to parse clients certificate or key: %s\n", err)
+		return
+	}
+
+	clientConn, err := net.Dial("tcp", "localhost:9999")
+	if err != nil {
+		t.Errorf("unable to establish secure connection with the server: %s\n", err)
+		return
+	}
+
+	// create secure connection for client
+	tlsClientConn := tls.Client(clientConn, &tls.Config{
+		ClientAuth:         tls.RequireAndVerifyClientCert,
+		MinVersion:         tls.VersionTLS13,
+		Certificates:       []tls.Certificate{clientPEM},
+		InsecureSkipVerify: true,
+	})
+
+	err = tlsClientConn.Handshake()
+	if err != nil {
+		t.Errorf("unable to establish secure connection on the client side: %s\n", err)
+		return
+	}
+
+	// wait for the server side to verify the client certificate
+	<-done
+}
+
+func TestCheckCRL(t *testing.T) {
+	err := prepareCRL(CRL_FILE, []byte(CRL_DATA))
+	if err != nil {
+		t.Errorf("unable to create CRL file, %s\n", err)
+		return
+	}
+
+	defer cleanUpCRL(CRL_FILE)
+
+	srv := Server{CrlPath: CRL_FILE}
+
+	if _, err := srv.CheckCRL(context.Background()); err != nil {
+		t.Errorf("error checking CRL freshness: %s\n", err)
+		return
+	}
+
+	srv.CrlPath = "missing.crl"
+
+	if _, err := srv.CheckCRL(context.Background()); err == nil {
+		t.Errorf("error checking CRL freshness: missing CRL file is reported as fresh\n")
+		return
+	}
+}
+
 func cleanUpCRL(file string) error {
 	err := os.Remove(file)
 	if err != nil {
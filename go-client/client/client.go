@@ -2,22 +2,40 @@ package client
 
 import (
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
 	"net"
+	"strings"
 	"sync"
+	"time"
 
 	cmd "github.com/arsenalzp/keyvalstore/go-client/client/command"
 	"github.com/arsenalzp/keyvalstore/go-client/internal/errors"
 	"github.com/arsenalzp/keyvalstore/go-client/internal/util"
+	"github.com/arsenalzp/keyvalstore/go-client/ring"
 )
 
 type Client struct {
-	conn *tls.Conn
+	conn net.Conn
 	mux  sync.Mutex
+
+	// address and TLS config of the server, watches use dedicated connections
+	addr      string
+	tlsConfig *tls.Config
+
+	// keys are routed to shards by the ring, it's nil if a single server is connected
+	ring   *ring.Ring
+	shards map[string]*Client // clients of shards by their addresses
+
+	// requests are sent to endpoints, it's nil if Endpoints aren't configured
+	failover *failover
 }
 
 type ClientConfig struct {
@@ -26,9 +44,41 @@ type ClientConfig struct {
 	PrivateKeyPath  string
 	Port            uint16
 	Address         string
+
+	// Name the server certificate is verified against, Address by default
+	ServerName string
+	// Trust system root CAs in addition to RootCAPath
+	UseSystemRoots bool
+	// Base64-encoded SHA-256 hashes of SubjectPublicKeyInfo, the server
+	// certificate chain must contain a certificate with one of them
+	PinnedSPKI []string
+	// DANGEROUS: skip verification of the server certificate against root CAs,
+	// it makes the connection vulnerable to man-in-the-middle attacks
+	InsecureSkipVerify bool
+
+	// Independent servers keys are sharded across, in "host:port" format;
+	// Address and Port are ignored if it's set. All clients of the servers
+	// must use the same list, a key is stored by one of them only. Servers are
+	// placed on the ring by their addresses, while the sharding proxy places
+	// shards by their names, so keys are placed the same way as by the proxy
+	// only if its shards are named by the same addresses
+	Servers []string
+	// Number of virtual nodes of every server on the hash ring, DefaultVirtualNodes by default
+	VirtualNodes int
+
+	// Endpoints of the same data, e.g. the primary and its replicas; Address and Port
+	// are ignored if it's set. Requests are sent to the healthy endpoint with the lowest
+	// Priority and retried on the next one if the connection fails. Writes are retried
+	// only if they aren't sent, as they may have been applied. Watches and subscriptions
+	// are pinned to the endpoint preferred when they start and fail with its connection
+	Endpoints []Endpoint
+	// Interval of health checks of endpoints, DefaultHealthInterval by default
+	HealthInterval time.Duration
+	// Send reads (GET, EXP) to the healthy endpoint with the lowest latency
+	PreferLowLatencyReads bool
 }
 
-// Connect to a server. Connect returns *Client structure
+// Connect to a server, to every server of Servers or to Endpoints. Connect returns *Client structure
 func (c *ClientConfig) Connect() (*Client, error) {
 	tlsConfig, err := c.initTLS()
 	if err != nil {
@@ -36,8 +86,96 @@ func (c *ClientConfig) Connect() (*Client, error) {
 		return nil, err
 	}
 
+	if len(c.Servers) > 0 && len(c.Endpoints) > 0 {
+		return nil, errors.New("servers and endpoints can't be combined", errors.EndpointsErr, nil)
+	}
+
+	if len(c.Servers) > 0 {
+		return c.connectShards(tlsConfig)
+	}
+
+	if len(c.Endpoints) > 0 {
+		return c.connectEndpoints(tlsConfig)
+	}
+
+	return dial(c.Address+":"+fmt.Sprint(c.Port), tlsConfig)
+}
+
+// Connect to every server of Servers, the server certificate is verified
+// against the host of its address unless ServerName is set
+func (c *ClientConfig) connectShards(tlsConfig *tls.Config) (*Client, error) {
+	client := &Client{ring: ring.New(c.VirtualNodes), shards: make(map[string]*Client, len(c.Servers))}
+
+	for _, addr := range c.Servers {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			client.Close()
+			return nil, errors.New("invalid server address "+addr, errors.ShardsErr, err)
+		}
+
+		if _, ok := client.shards[addr]; ok {
+			client.Close()
+			return nil, errors.New("duplicate server address "+addr, errors.ShardsErr, nil)
+		}
+
+		conf := tlsConfig.Clone()
+		if c.ServerName == "" {
+			conf.ServerName = host
+		}
+
+		shard, err := dial(addr, conf)
+		if err != nil {
+			client.Close()
+			return nil, err
+		}
+
+		client.ring.Add(addr)
+		client.shards[addr] = shard
+	}
+
+	return client, nil
+}
+
+// Connect to healthy endpoints and check them in background, the server
+// certificate is verified against the host of its address unless ServerName is set
+func (c *ClientConfig) connectEndpoints(tlsConfig *tls.Config) (*Client, error) {
+	configs := make(map[string]*tls.Config, len(c.Endpoints))
+
+	for _, e := range c.Endpoints {
+		host, _, err := net.SplitHostPort(e.Address)
+		if err != nil {
+			return nil, errors.New("invalid endpoint address "+e.Address, errors.EndpointsErr, err)
+		}
+
+		if _, ok := configs[e.Address]; ok {
+			return nil, errors.New("duplicate endpoint address "+e.Address, errors.EndpointsErr, nil)
+		}
+
+		conf := tlsConfig.Clone()
+		if c.ServerName == "" {
+			conf.ServerName = host
+		}
+		configs[e.Address] = conf
+	}
+
+	f := newFailover(c.Endpoints, func(addr string) (*Client, error) {
+		return dial(addr, configs[addr])
+	}, c.HealthInterval, c.PreferLowLatencyReads)
+
+	if !f.check() {
+		f.close()
+		return nil, errors.New("connection error: no endpoint is available", errors.EndpointsErr, nil)
+	}
+
+	go f.run()
+
+	return &Client{failover: f}, nil
+}
+
+// Connect to the server by TLS
+func dial(addr string, tlsConfig *tls.Config) (*Client, error) {
 	// Call to a server
-	conn, err := net.Dial("tcp", c.Address+":"+fmt.Sprint(c.Port))
+	conn, err := net.Dial("tcp", addr)
 	if err != nil {
 		err = errors.New("connection error", errors.NetworkErr, err)
 		return nil, err
@@ -54,13 +192,30 @@ func (c *ClientConfig) Connect() (*Client, error) {
 	}
 
 	clientConnection := &Client{
-		conn: tlsConn,
+		conn:      tlsConn,
+		addr:      addr,
+		tlsConfig: tlsConfig,
 	}
 	return clientConnection, nil
 }
 
-// Close connection with a server
+// Close connection with a server or connections with all shards or endpoints
 func (c *Client) Close() error {
+	if c.failover != nil {
+		return c.failover.close()
+	}
+
+	if c.ring != nil {
+		var firstErr error
+		for _, shard := range c.shards {
+			if err := shard.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+
+		return firstErr
+	}
+
 	if err := c.conn.Close(); err != nil {
 		return err
 	}
@@ -76,6 +231,19 @@ func (c *Client) Get(ctx context.Context, key string) ([]byte, error) {
 		return nil, err
 	}
 
+	if c.ring != nil {
+		return c.shard(key).Get(ctx, key)
+	}
+
+	if c.failover != nil {
+		var value []byte
+		err := c.failover.do(ctx, read, func(cl *Client) (err error) {
+			value, err = cl.Get(ctx, key)
+			return err
+		})
+		return value, err
+	}
+
 	dataChan := make(chan []byte, 1)
 	errChan := make(chan error, 1)
 
@@ -91,7 +259,6 @@ func (c *Client) Get(ctx context.Context, key string) ([]byte, error) {
 	case val := <-dataChan:
 		return val, nil
 	case err := <-errChan:
-		fmt.Printf("error to retrieve key %s: %s\n", key, err)
 		return nil, err
 	}
 }
@@ -104,6 +271,14 @@ func (c *Client) Set(ctx context.Context, key, value string) error {
 		return err
 	}
 
+	if c.ring != nil {
+		return c.shard(key).Set(ctx, key, value)
+	}
+
+	if c.failover != nil {
+		return c.failover.do(ctx, write, func(cl *Client) error { return cl.Set(ctx, key, value) })
+	}
+
 	dataChan := make(chan struct{}, 1)
 	errChan := make(chan error, 1)
 
@@ -123,6 +298,42 @@ func (c *Client) Set(ctx context.Context, key, value string) error {
 	}
 }
 
+// Save key=value pair on a server as secret, it can be read by Get
+// but it's omitted from export without export-secrets permission
+func (c *Client) SetSecret(ctx context.Context, key, value string) error {
+	// validate the key and the value data parameters
+	err := util.ValidateInput(key, value)
+	if err != nil {
+		return err
+	}
+
+	if c.ring != nil {
+		return c.shard(key).SetSecret(ctx, key, value)
+	}
+
+	if c.failover != nil {
+		return c.failover.do(ctx, write, func(cl *Client) error { return cl.SetSecret(ctx, key, value) })
+	}
+
+	dataChan := make(chan struct{}, 1)
+	errChan := make(chan error, 1)
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	go cmd.SetSecret(c.conn, dataChan, errChan, key, value)
+
+	select {
+	case <-ctx.Done():
+		err := errors.New("set command interrupted", errors.SetCancelErr, ctx.Err())
+		return err
+	case <-dataChan:
+		return nil
+	case err := <-errChan:
+		return err
+	}
+}
+
 // Delete key=value pair on a server. Del returns error in case of failure
 func (c *Client) Del(ctx context.Context, key string) error {
 	// validate the key and the value data parameters
@@ -131,6 +342,14 @@ func (c *Client) Del(ctx context.Context, key string) error {
 		return err
 	}
 
+	if c.ring != nil {
+		return c.shard(key).Del(ctx, key)
+	}
+
+	if c.failover != nil {
+		return c.failover.do(ctx, write, func(cl *Client) error { return cl.Del(ctx, key) })
+	}
+
 	dataChan := make(chan struct{}, 1)
 	errChan := make(chan error, 1)
 
@@ -150,7 +369,8 @@ func (c *Client) Del(ctx context.Context, key string) error {
 	}
 }
 
-// Import key=value pairs into a server. Import returns error in case of failure
+// Import key=value pairs into a server, pairs are split by shards of keys
+// and the import isn't atomic across shards. Import returns error in case of failure
 func (c *Client) Import(ctx context.Context, data []byte) error {
 	dataChan := make(chan struct{}, 1)
 	errChan := make(chan error, 1)
@@ -161,6 +381,14 @@ func (c *Client) Import(ctx context.Context, data []byte) error {
 		return err
 	}
 
+	if c.ring != nil {
+		return c.importShards(ctx, data)
+	}
+
+	if c.failover != nil {
+		return c.failover.do(ctx, write, func(cl *Client) error { return cl.Import(ctx, data) })
+	}
+
 	c.mux.Lock()
 	defer c.mux.Unlock()
 
@@ -177,8 +405,22 @@ func (c *Client) Import(ctx context.Context, data []byte) error {
 	}
 }
 
-// Export key=value pairs from a server. Export returns []byte or error in case of failure
+// Export key=value pairs from a server, pairs of all shards are merged into
+// a single array. Export returns []byte or error in case of failure
 func (c *Client) Export(ctx context.Context) ([]byte, error) {
+	if c.ring != nil {
+		return c.exportShards(ctx)
+	}
+
+	if c.failover != nil {
+		var data []byte
+		err := c.failover.do(ctx, read, func(cl *Client) (err error) {
+			data, err = cl.Export(ctx)
+			return err
+		})
+		return data, err
+	}
+
 	dataChan := make(chan []byte, 1)
 	errChan := make(chan error, 1)
 
@@ -198,6 +440,148 @@ func (c *Client) Export(ctx context.Context) ([]byte, error) {
 	}
 }
 
+// Check whether a server or every shard is alive. Ping returns error in case of failure
+func (c *Client) Ping(ctx context.Context) error {
+	if c.ring != nil {
+		return c.each(func(shard *Client) error { return shard.Ping(ctx) })
+	}
+
+	if c.failover != nil {
+		return c.failover.do(ctx, idempotent, func(cl *Client) error { return cl.Ping(ctx) })
+	}
+
+	dataChan := make(chan []byte, 1)
+	errChan := make(chan error, 1)
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	go cmd.Ping(c.conn, dataChan, errChan)
+
+	select {
+	case <-ctx.Done():
+		err := errors.New("ping operation interrupted", errors.PingCancelErr, ctx.Err())
+		return err
+	case <-dataChan:
+		return nil
+	case err := <-errChan:
+		return err
+	}
+}
+
+// Set timeout of server-side operations of the connection, zero timeout
+// resets it to the server default one. SetTimeout returns error in case of failure
+func (c *Client) SetTimeout(ctx context.Context, timeout time.Duration) error {
+	ms := timeout.Milliseconds()
+	if ms < 0 || ms > math.MaxUint32 {
+		return errors.New("timeout operation failed: invalid timeout", errors.InvalidTimeoutErr, nil)
+	}
+
+	if c.ring != nil {
+		return c.each(func(shard *Client) error { return shard.SetTimeout(ctx, timeout) })
+	}
+
+	if c.failover != nil {
+		return c.failover.setTimeout(ctx, timeout)
+	}
+
+	dataChan := make(chan struct{}, 1)
+	errChan := make(chan error, 1)
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	go cmd.Timeout(c.conn, dataChan, errChan, uint32(ms))
+
+	select {
+	case <-ctx.Done():
+		err := errors.New("timeout operation interrupted", errors.TimeoutCancelErr, ctx.Err())
+		return err
+	case <-dataChan:
+		return nil
+	case err := <-errChan:
+		return err
+	}
+}
+
+// Change of the watched key
+type WatchEvent struct {
+	Op      string    `json:"op"` // "set" or "del"
+	Key     string    `json:"key"`
+	Value   string    `json:"value,omitempty"`
+	Version uint64    `json:"version"` // sequence number of the change on the server
+	Time    time.Time `json:"time"`
+}
+
+// Watch changes of the key or keys with the prefix made after the call, every
+// change is passed to the handler. The watch runs over a dedicated connection until
+// the context is done or the handler returns error. Keys with the prefix are
+// watched on every shard, the handler isn't called concurrently. With endpoints,
+// the preferred endpoint is watched and the watch fails with its connection.
+// Watch returns error in case of failure
+func (c *Client) Watch(ctx context.Context, key string, prefix bool, handle func(WatchEvent) error) error {
+	if !prefix {
+		// validate the key data parameter
+		if err := util.ValidateInput(key, ""); err != nil {
+			return err
+		}
+	}
+
+	if c.ring != nil {
+		if !prefix {
+			return c.shard(key).Watch(ctx, key, prefix, handle)
+		}
+
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		var mu sync.Mutex
+		return c.each(func(shard *Client) error {
+			err := shard.Watch(ctx, key, prefix, func(ev WatchEvent) error {
+				mu.Lock()
+				defer mu.Unlock()
+				return handle(ev)
+			})
+			cancel()
+			return err
+		})
+	}
+
+	// the watch isn't moved to another endpoint, as changes in between would be missed
+	if c.failover != nil {
+		cl, err := c.failover.client()
+		if err != nil {
+			return err
+		}
+		return cl.Watch(ctx, key, prefix, handle)
+	}
+
+	watcher, err := dial(c.addr, c.tlsConfig)
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	// the connection is closed to interrupt waiting for events
+	stop := context.AfterFunc(ctx, func() { watcher.Close() })
+	defer stop()
+
+	err = cmd.Watch(watcher.conn, key, prefix, func(data []byte) error {
+		var ev WatchEvent
+		if err := json.Unmarshal(data, &ev); err != nil {
+			return errors.New("watch operation error: invalid event", errors.WatchRespErr, err)
+		}
+
+		return handle(ev)
+	})
+
+	if ctx.Err() != nil {
+		return errors.New("watch operation interrupted", errors.WatchCancelErr, ctx.Err())
+	}
+
+	return err
+}
+
 // Initialize TLS Config. initTLS returns *tls.Config or error in case of failure
 func (c *ClientConfig) initTLS() (*tls.Config, error) {
 	crt, err := tls.LoadX509KeyPair(c.CertificatePath, c.PrivateKeyPath)
@@ -205,24 +589,71 @@ func (c *ClientConfig) initTLS() (*tls.Config, error) {
 		return nil, errors.New("unabel to load certificate or key", errors.NetworkErr, err)
 	}
 
-	rootCA, err := ioutil.ReadFile(c.RootCAPath)
-	if err != nil {
-		return nil, errors.New("unabel to load root CA file", errors.NetworkErr, err)
+	caPool := x509.NewCertPool()
+	if c.UseSystemRoots {
+		if caPool, err = x509.SystemCertPool(); err != nil {
+			return nil, errors.New("unable to load system root CAs", errors.TLSConfigErr, err)
+		}
 	}
 
-	caPool := x509.NewCertPool()
+	if c.RootCAPath != "" {
+		rootCA, err := ioutil.ReadFile(c.RootCAPath)
+		if err != nil {
+			return nil, errors.New("unabel to load root CA file", errors.NetworkErr, err)
+		}
+
+		if ok := caPool.AppendCertsFromPEM(rootCA); !ok {
+			return nil, errors.New("unabel to add root CA into the certificate pool", errors.NetworkErr, nil)
+		}
+	} else if !c.UseSystemRoots && !c.InsecureSkipVerify {
+		return nil, errors.New("root CA is required to verify the server", errors.TLSConfigErr, nil)
+	}
 
-	if ok := caPool.AppendCertsFromPEM(rootCA); !ok {
-		log.Println()
-		return nil, errors.New("unabel to add root CA into the certificate pool", errors.NetworkErr, nil)
+	serverName := c.ServerName
+	if serverName == "" {
+		serverName = c.Address
 	}
 
 	tlsConf := &tls.Config{
-		MinVersion:         tls.VersionTLS13,
-		Certificates:       []tls.Certificate{crt},
-		ClientCAs:          caPool,
-		InsecureSkipVerify: true, // FOR TEST PURPOSES ONLY, CONSIDER NEW CERTIFICATE CRETION WITH THE !!SAN!!
+		MinVersion:   tls.VersionTLS13,
+		Certificates: []tls.Certificate{crt},
+		RootCAs:      caPool,
+		ServerName:   serverName,
+	}
+
+	if len(c.PinnedSPKI) > 0 {
+		pins := make(map[string]bool, len(c.PinnedSPKI))
+		for _, pin := range c.PinnedSPKI {
+			pins[strings.TrimPrefix(pin, "sha256//")] = true
+		}
+
+		tlsConf.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyPins(cs, pins)
+		}
+	}
+
+	if c.InsecureSkipVerify {
+		log.Printf("WARNING: verification of the server certificate is disabled, " +
+			"the connection is vulnerable to man-in-the-middle attacks\n")
+		tlsConf.InsecureSkipVerify = true
 	}
 
 	return tlsConf, nil
 }
+
+// Check whether the server certificate chain contains a pinned public key
+func verifyPins(cs tls.ConnectionState, pins map[string]bool) error {
+	certs := cs.PeerCertificates
+	if len(cs.VerifiedChains) > 0 {
+		certs = cs.VerifiedChains[0]
+	}
+
+	for _, cert := range certs {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		if pins[base64.StdEncoding.EncodeToString(sum[:])] {
+			return nil
+		}
+	}
+
+	return errors.New("server certificate doesn't match pinned public keys", errors.PinMismatchErr, nil)
+}
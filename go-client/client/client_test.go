@@ -1,6 +1,32 @@
 package client
 
-import "testing"
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	cmd "github.com/arsenalzp/keyvalstore/go-client/client/command"
+	"github.com/arsenalzp/keyvalstore/go-client/internal/errors"
+	"github.com/arsenalzp/keyvalstore/go-client/ring"
+)
 
 const (
 	SERVERNAME = "localhost"
@@ -11,5 +37,375 @@ func TestClientServer(t *testing.T) {
 }
 
 func TestMain(t *testing.M) {
+	os.Exit(t.Run())
+}
+
+func TestVerifyPins(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: SERVERNAME},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Errorf("error creating certificate: %s\n", err)
+		return
+	}
+
+	cert, _ := x509.ParseCertificate(der)
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(sum[:])
+
+	cs := tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+
+	if err := verifyPins(cs, map[string]bool{pin: true}); err != nil {
+		t.Errorf("error verifying pinned certificate: %s\n", err)
+		return
+	}
+
+	if err := verifyPins(cs, map[string]bool{"AAAA": true}); err == nil {
+		t.Errorf("error verifying certificate: certificate matches unknown pin\n")
+		return
+	}
+}
+
+type pair struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Serve requests of the client by the in-memory storage
+func serve(con net.Conn, storage map[string]string) {
+	reader := bufio.NewReader(con)
+
+	for {
+		req, err := reader.ReadBytes(cmd.EOT)
+		if err != nil {
+			return
+		}
+
+		resp := []byte{'O'}
+		key := string(bytes.Trim(req[3:min(len(req), 259)], "\x00"))
+
+		switch string(req[0:3]) {
+		case cmd.GET:
+			resp = append(resp, storage[key]...)
+		case cmd.SET, cmd.SECRET:
+			storage[key] = string(bytes.Trim(req[259:771], "\x00"))
+		case cmd.DELETE:
+			delete(storage, key)
+		case cmd.IMPORT:
+			var pairs []pair
+			json.Unmarshal(req[3:len(req)-1], &pairs)
+			for _, p := range pairs {
+				storage[p.Key] = p.Value
+			}
+		case cmd.EXPORT:
+			pairs := make([]pair, 0)
+			for k, v := range storage {
+				pairs = append(pairs, pair{k, v})
+			}
+			data, _ := json.Marshal(pairs)
+			resp = append(resp, data...)
+		case cmd.PING:
+			resp = append(resp, "PONG"...)
+		case cmd.INCR:
+			n, _ := strconv.ParseInt(storage[key], 10, 64)
+			delta, _ := strconv.ParseInt(string(bytes.Trim(req[259:771], "\x00")), 10, 64)
+			storage[key] = strconv.FormatInt(n+delta, 10)
+			resp = append(resp, storage[key]...)
+		}
+
+		if _, err := con.Write(append(resp, cmd.EOT)); err != nil {
+			return
+		}
+	}
+}
+
+// Server connection closed after the request is applied instead of
+// sending the response, e.g. the server crashed in between
+type dropping struct {
+	net.Conn
+}
+
+func (d dropping) Write([]byte) (int, error) {
+	d.Conn.Close()
+	return 0, io.ErrClosedPipe
+}
+
+func TestShards(t *testing.T) {
+	ctx := context.Background()
+
+	servers := []string{"s1:6841", "s2:6842", "s3:6843"}
+	storages := make(map[string]map[string]string)
+
+	c := &Client{ring: ring.New(0), shards: make(map[string]*Client)}
+	for _, addr := range servers {
+		clientCon, serverCon := net.Pipe()
+		storages[addr] = make(map[string]string)
+		go serve(serverCon, storages[addr])
+
+		c.ring.Add(addr)
+		c.shards[addr] = &Client{conn: clientCon}
+	}
+	defer c.Close()
+
+	for i := 0; i < 100; i++ {
+		if err := c.Set(ctx, "key"+fmt.Sprint(i), "val"+fmt.Sprint(i)); err != nil {
+			t.Errorf("error setting key: %s\n", err)
+			return
+		}
+	}
+
+	// every key is stored by its owner only
+	for i := 0; i < 100; i++ {
+		key := "key" + fmt.Sprint(i)
+
+		value, err := c.Get(ctx, key)
+		if err != nil || string(value) != "val"+fmt.Sprint(i) {
+			t.Errorf("error getting key %s: %q, %v\n", key, value, err)
+			return
+		}
+
+		for addr, storage := range storages {
+			if _, ok := storage[key]; ok != (addr == c.ring.Get(key)) {
+				t.Errorf("error routing key %s, found on %s: %t, owner is %s\n", key, addr, ok, c.ring.Get(key))
+				return
+			}
+		}
+	}
+
+	for addr, storage := range storages {
+		if len(storage) == 0 {
+			t.Errorf("error routing keys, server %s has no keys\n", addr)
+			return
+		}
+	}
+
+	if err := c.Del(ctx, "key0"); err != nil {
+		t.Errorf("error deleting key: %s\n", err)
+		return
+	}
+
+	// import is split by owners of keys
+	var pairs []pair
+	for i := 100; i < 150; i++ {
+		pairs = append(pairs, pair{"key" + fmt.Sprint(i), "val" + fmt.Sprint(i)})
+	}
+	data, _ := json.Marshal(pairs)
+
+	if err := c.Import(ctx, data); err != nil {
+		t.Errorf("error importing keys: %s\n", err)
+		return
+	}
+
+	for _, p := range pairs {
+		if storages[c.ring.Get(p.Key)][p.Key] != p.Value {
+			t.Errorf("error importing key %s to its owner\n", p.Key)
+			return
+		}
+	}
+
+	// export is merged from all servers
+	data, err := c.Export(ctx)
+	if err != nil {
+		t.Errorf("error exporting keys: %s\n", err)
+		return
+	}
+
+	var exported []pair
+	if err := json.Unmarshal(data, &exported); err != nil || len(exported) != 149 {
+		t.Errorf("error exporting keys, got %d keys, expected 149: %v\n", len(exported), err)
+		return
+	}
+
+	if err := c.Ping(ctx); err != nil {
+		t.Errorf("error pinging servers: %s\n", err)
+		return
+	}
+
+	// counters are changed by their owners
+	if value, err := c.IncrBy(ctx, "counter", 10); err != nil || value != 10 {
+		t.Errorf("error incrementing counter: %d, %v\n", value, err)
+		return
+	}
+
+	if value, err := c.Decr(ctx, "counter"); err != nil || value != 9 || storages[c.ring.Get("counter")]["counter"] != "9" {
+		t.Errorf("error decrementing counter: %d, %v\n", value, err)
+		return
+	}
+}
+
+func TestFailover(t *testing.T) {
+	ctx := context.Background()
+
+	storages := map[string]map[string]string{"primary:6841": {}, "replica:6842": {}, "far:6843": {}}
+	down := map[string]bool{}
+	servers := map[string]net.Conn{}
+	var mu sync.Mutex
+
+	dial := func(addr string) (*Client, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if down[addr] {
+			return nil, errors.New("connection error", errors.NetworkErr, fmt.Errorf("%s is down", addr))
+		}
+
+		clientCon, serverCon := net.Pipe()
+		servers[addr] = serverCon
+		go serve(serverCon, storages[addr])
+
+		return &Client{conn: clientCon}, nil
+	}
+
+	// stop the server of the address and refuse new connections
+	stop := func(addr string) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		down[addr] = true
+		servers[addr].Close()
+	}
+
+	endpoints := []Endpoint{{"far:6843", 2}, {"replica:6842", 1}, {"primary:6841", 0}}
+	f := newFailover(endpoints, dial, time.Hour, true)
+	c := &Client{failover: f}
+	defer c.Close()
+
+	if !f.check() {
+		t.Errorf("error checking endpoints: no endpoint is healthy\n")
+		return
+	}
+
+	// writes are sent to the endpoint with the lowest priority
+	if err := c.Set(ctx, "key", "primary"); err != nil || storages["primary:6841"]["key"] != "primary" {
+		t.Errorf("error routing write to the primary: %v\n", err)
+		return
+	}
+
+	// reads prefer the endpoint with the lowest latency
+	storages["far:6843"]["key"] = "far"
+	for _, ep := range f.endpoints {
+		ep.latency.Store(int64(time.Second))
+	}
+	f.endpoints[2].latency.Store(int64(time.Millisecond))
+
+	if value, err := c.Get(ctx, "key"); err != nil || string(value) != "far" {
+		t.Errorf("error routing read to the closest endpoint: %q, %v\n", value, err)
+		return
+	}
+
+	// requests are retried on the next endpoint if the connection fails
+	stop("primary:6841")
+	if err := c.Set(ctx, "key", "replica"); err != nil || storages["replica:6842"]["key"] != "replica" {
+		t.Errorf("error failing over to the replica: %v\n", err)
+		return
+	}
+
+	// the primary is preferred again once health checks find it up
+	mu.Lock()
+	down["primary:6841"] = false
+	mu.Unlock()
+	f.check()
+
+	if err := c.Del(ctx, "key"); err != nil {
+		t.Errorf("error deleting key: %s\n", err)
+		return
+	}
+	if _, ok := storages["primary:6841"]["key"]; ok {
+		t.Errorf("error failing back to the primary\n")
+		return
+	}
+
+	for addr := range storages {
+		stop(addr)
+	}
+
+	if err := c.Ping(ctx); errors.Code(err) != errors.EndpointsErr {
+		t.Errorf("error pinging endpoints, expected code %s, got %v\n", errors.EndpointsErr, err)
+		return
+	}
+}
+
+func TestFailoverAfterSend(t *testing.T) {
+	ctx := context.Background()
+
+	primary, replica := map[string]string{}, map[string]string{"key": "replica"}
+	dial := func(addr string) (*Client, error) {
+		clientCon, serverCon := net.Pipe()
+		if addr == "primary:6841" {
+			go serve(dropping{serverCon}, primary)
+		} else {
+			go serve(serverCon, replica)
+		}
+
+		return &Client{conn: clientCon}, nil
+	}
+
+	f := newFailover([]Endpoint{{"primary:6841", 0}, {"replica:6842", 1}}, dial, time.Hour, false)
+	c := &Client{failover: f}
+	defer c.Close()
+
+	// the write may have been applied, so it isn't sent to the replica
+	if err := c.Set(ctx, "key", "primary"); err == nil {
+		t.Errorf("error failing over write: the lost response isn't reported\n")
+		return
+	}
+	if primary["key"] != "primary" || replica["key"] != "replica" {
+		t.Errorf("error failing over write: the write is retried on the replica\n")
+		return
+	}
+
+	// reads are retried on the next endpoint
+	f.endpoints[0].healthy.Store(true)
+	if value, err := c.Get(ctx, "key"); err != nil || string(value) != "replica" {
+		t.Errorf("error failing over read: %q, %v\n", value, err)
+		return
+	}
+}
+
+func TestIncrByFailover(t *testing.T) {
+	ctx := context.Background()
+
+	primary, replica := map[string]string{"counter": "1"}, map[string]string{"counter": "1"}
+	down := false
+	dial := func(addr string) (*Client, error) {
+		if addr == "primary:6841" && down {
+			return nil, errors.New("connection error", errors.NetworkErr, fmt.Errorf("%s is down", addr))
+		}
+
+		clientCon, serverCon := net.Pipe()
+		if addr == "primary:6841" {
+			go serve(dropping{serverCon}, primary)
+		} else {
+			go serve(serverCon, replica)
+		}
+
+		return &Client{conn: clientCon}, nil
+	}
+
+	f := newFailover([]Endpoint{{"primary:6841", 0}, {"replica:6842", 1}}, dial, time.Hour, false)
+	c := &Client{failover: f}
+	defer c.Close()
+
+	// the increment is applied once, the lost response is reported
+	if _, err := c.Incr(ctx, "counter"); err == nil {
+		t.Errorf("error failing over increment: the lost response isn't reported\n")
+		return
+	}
+	if primary["counter"] != "2" || replica["counter"] != "1" {
+		t.Errorf("error failing over increment: applied twice, got %s and %s\n", primary["counter"], replica["counter"])
+		return
+	}
 
+	// the increment which can't be sent is moved to the next endpoint
+	down = true
+	if value, err := c.Incr(ctx, "counter"); err != nil || value != 2 {
+		t.Errorf("error failing over increment: %d, %v\n", value, err)
+		return
+	}
 }
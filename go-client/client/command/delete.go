@@ -37,7 +37,7 @@ func Del(con net.Conn, dataChan chan<- struct{}, errChan chan<- error, key strin
 	reader := bufio.NewReader(con)
 	respBuf, err := reader.ReadBytes(EOT) // waiting for server response
 	if err != nil {
-		err = errors.New("del operation failed", errors.WriteServerErr, err)
+		err = errors.New("del operation failed", errors.ReadServerErr, err)
 		errChan <- err
 		return
 	}
@@ -38,7 +38,7 @@ func Get(con net.Conn, dataChan chan<- []byte, errChan chan<- error, key string)
 	reader := bufio.NewReader(con)
 	respBuf, err := reader.ReadBytes(EOT) // waiting for server response
 	if err != nil {
-		err = errors.New("get operation failed", errors.WriteServerErr, err)
+		err = errors.New("get operation failed", errors.ReadServerErr, err)
 		errChan <- err
 		return
 	}
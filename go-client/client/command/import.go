@@ -38,7 +38,7 @@ func Import(con net.Conn, dataChan chan<- struct{}, errChan chan<- error, dataBu
 	reader := bufio.NewReader(con)
 	respBuf, err := reader.ReadBytes(EOT)
 	if err != nil {
-		err = errors.New("import operation error", errors.WriteServerErr, err)
+		err = errors.New("import operation error", errors.ReadServerErr, err)
 		errChan <- err
 		return
 	}
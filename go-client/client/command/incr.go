@@ -0,0 +1,56 @@
+// Package implements CLI commands.
+
+package command
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/arsenalzp/keyvalstore/go-client/internal/errors"
+)
+
+// Add the delta to the counter, the new value of the counter is returned
+func Incr(con net.Conn, dataChan chan<- []byte, errChan chan<- error, key string, delta int64) {
+	var buf [MESSAGE_SIZE]byte
+
+	writer := bufio.NewWriter(con) // connection writer to send the data to the server
+
+	copy(buf[0:3], []byte(INCR))
+	copy(buf[3:259], []byte(key))
+	copy(buf[259:771], []byte(strconv.FormatInt(delta, 10)))
+	buf[771] = EOT
+
+	_, err := writer.Write(buf[:])
+	if err != nil {
+		err = errors.New("incr operation error", errors.WriteServerErr, err)
+		errChan <- err
+		return
+	}
+
+	err = writer.Flush()
+	if err != nil {
+		err = errors.New("incr operation error", errors.WriteServerErr, err)
+		errChan <- err
+		return
+	}
+
+	reader := bufio.NewReader(con)
+	respBuf, err := reader.ReadBytes(EOT)
+	if err != nil {
+		err = errors.New("incr operation error", errors.ReadServerErr, err)
+		errChan <- err
+		return
+	}
+
+	if respBuf[0] == errors.ServerResponseError {
+		err = fmt.Errorf("%s", respBuf[1:]) // retrieve error value from the server response
+		err = errors.New("incr operation error", errors.IncrRespErr, err)
+		errChan <- err
+		return
+	}
+
+	dataChan <- bytes.TrimRight(respBuf[1:], string(EOT))
+}
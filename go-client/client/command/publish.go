@@ -0,0 +1,94 @@
+// Package implements CLI commands.
+
+package command
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+
+	"github.com/arsenalzp/keyvalstore/go-client/internal/errors"
+)
+
+// Publish a message to a channel, number of receiving subscribers is returned
+func Publish(con net.Conn, dataChan chan<- []byte, errChan chan<- error, channel, message string) {
+	var buf [MESSAGE_SIZE]byte
+
+	writer := bufio.NewWriter(con) // connection writer to send the data to the server
+
+	copy(buf[0:3], []byte(PUBLISH))
+	copy(buf[3:259], []byte(channel))
+	copy(buf[259:771], []byte(message))
+	buf[771] = EOT
+
+	_, err := writer.Write(buf[:])
+	if err != nil {
+		err = errors.New("publish operation error", errors.WriteServerErr, err)
+		errChan <- err
+		return
+	}
+
+	err = writer.Flush()
+	if err != nil {
+		err = errors.New("publish operation error", errors.WriteServerErr, err)
+		errChan <- err
+		return
+	}
+
+	reader := bufio.NewReader(con)
+	respBuf, err := reader.ReadBytes(EOT)
+	if err != nil {
+		err = errors.New("publish operation error", errors.ReadServerErr, err)
+		errChan <- err
+		return
+	}
+
+	if respBuf[0] == errors.ServerResponseError {
+		err = fmt.Errorf("%s", respBuf[1:]) // retrieve error value from the server response
+		err = errors.New("publish operation error", errors.PubSubRespErr, err)
+		errChan <- err
+		return
+	}
+
+	dataChan <- bytes.TrimRight(respBuf[1:], string(EOT))
+}
+
+// Subscribe the connection to the patterns or unsubscribe it by UNSUBSCRIBE command,
+// acknowledgements are received among messages
+func Subscribe(con net.Conn, command string, patterns []string) error {
+	writer := bufio.NewWriter(con) // connection writer to send the data to the server
+
+	for _, pattern := range patterns {
+		var buf [MESSAGE_SIZE]byte
+
+		copy(buf[0:3], []byte(command))
+		copy(buf[3:259], []byte(pattern))
+		buf[771] = EOT
+
+		if _, err := writer.Write(buf[:]); err != nil {
+			return errors.New("subscribe operation error", errors.WriteServerErr, err)
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		return errors.New("subscribe operation error", errors.WriteServerErr, err)
+	}
+
+	return nil
+}
+
+// Read the next frame of the subscribed connection in JSON
+func ReadFrame(reader *bufio.Reader) ([]byte, error) {
+	respBuf, err := reader.ReadBytes(EOT)
+	if err != nil {
+		return nil, errors.New("subscribe operation error", errors.ReadServerErr, err)
+	}
+
+	if respBuf[0] == errors.ServerResponseError {
+		err = fmt.Errorf("%s", respBuf[1:]) // retrieve error value from the server response
+		return nil, errors.New("subscribe operation error", errors.PubSubRespErr, err)
+	}
+
+	return respBuf[1 : len(respBuf)-1], nil
+}
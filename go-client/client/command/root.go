@@ -8,6 +8,14 @@ const (
 	DELETE       = "del"
 	GET          = "get"
 	SET          = "set"
+	SECRET       = "sec"
 	EXPORT       = "exp"
 	IMPORT       = "imp"
+	PING         = "png"
+	TIMEOUT      = "tmo"
+	WATCH        = "wch"
+	PUBLISH      = "pub"
+	SUBSCRIBE    = "sub"
+	UNSUBSCRIBE  = "uns"
+	INCR         = "inc"
 )
@@ -12,6 +12,15 @@ import (
 
 // Set key and value pair
 func Set(con net.Conn, dataChan chan<- struct{}, errChan chan<- error, key string, value string) {
+	set(SET, con, dataChan, errChan, key, value)
+}
+
+// Set key and value pair, the key is secret and omitted from export
+func SetSecret(con net.Conn, dataChan chan<- struct{}, errChan chan<- error, key string, value string) {
+	set(SECRET, con, dataChan, errChan, key, value)
+}
+
+func set(command string, con net.Conn, dataChan chan<- struct{}, errChan chan<- error, key string, value string) {
 	var buf [MESSAGE_SIZE]byte // command 3B, key 256B, value 512B
 
 	// Check input, neither key nor value should be empty
@@ -26,7 +35,7 @@ func Set(con net.Conn, dataChan chan<- struct{}, errChan chan<- error, key strin
 
 	writer := bufio.NewWriter(con) // connection writer to send the data to the server
 
-	copy(buf[0:3], []byte(SET))
+	copy(buf[0:3], []byte(command))
 	copy(buf[3:259], []byte(key))
 	copy(buf[259:], []byte(value))
 	buf[771] = EOT
@@ -35,6 +44,7 @@ func Set(con net.Conn, dataChan chan<- struct{}, errChan chan<- error, key strin
 	if err != nil {
 		err = errors.New("set operation error", errors.WriteServerErr, err)
 		errChan <- err
+		return
 	}
 
 	err = writer.Flush()
@@ -0,0 +1,53 @@
+// Package implements CLI commands.
+
+package command
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+
+	"github.com/arsenalzp/keyvalstore/go-client/internal/errors"
+)
+
+// Set timeout of server-side operations in milliseconds
+func Timeout(con net.Conn, dataChan chan<- struct{}, errChan chan<- error, ms uint32) {
+	var buf [MESSAGE_SIZE]byte
+
+	writer := bufio.NewWriter(con) // connection writer to send the data to the server
+
+	copy(buf[0:3], []byte(TIMEOUT))
+	copy(buf[3:259], []byte(fmt.Sprint(ms)))
+	buf[771] = EOT
+
+	_, err := writer.Write(buf[:])
+	if err != nil {
+		err = errors.New("timeout operation error", errors.WriteServerErr, err)
+		errChan <- err
+		return
+	}
+
+	err = writer.Flush()
+	if err != nil {
+		err = errors.New("timeout operation error", errors.WriteServerErr, err)
+		errChan <- err
+		return
+	}
+
+	reader := bufio.NewReader(con)
+	respBuf, err := reader.ReadBytes(EOT) // waiting for server response
+	if err != nil {
+		err = errors.New("timeout operation failed", errors.ReadServerErr, err)
+		errChan <- err
+		return
+	}
+
+	if respBuf[0] == errors.ServerResponseError {
+		err = fmt.Errorf("%s", respBuf[1:]) // retrieve error value from the server response
+		err = errors.New("timeout operation error", errors.TimeoutRespErr, err)
+		errChan <- err
+		return
+	}
+
+	dataChan <- struct{}{}
+}
@@ -0,0 +1,59 @@
+// Package implements CLI commands.
+
+package command
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+
+	"github.com/arsenalzp/keyvalstore/go-client/internal/errors"
+)
+
+// Watch changes of the key or keys with the prefix, every event is passed
+// to the handler in JSON until the connection fails or the handler returns error
+func Watch(con net.Conn, key string, prefix bool, handle func(event []byte) error) error {
+	var buf [MESSAGE_SIZE]byte
+
+	writer := bufio.NewWriter(con) // connection writer to send the data to the server
+
+	copy(buf[0:3], []byte(WATCH))
+	copy(buf[3:259], []byte(key))
+	if prefix {
+		copy(buf[259:771], []byte("prefix"))
+	}
+	buf[771] = EOT
+
+	_, err := writer.Write(buf[:])
+	if err != nil {
+		return errors.New("watch operation error", errors.WriteServerErr, err)
+	}
+
+	err = writer.Flush()
+	if err != nil {
+		return errors.New("watch operation error", errors.WriteServerErr, err)
+	}
+
+	reader := bufio.NewReader(con)
+	for {
+		respBuf, err := reader.ReadBytes(EOT)
+		if err != nil {
+			return errors.New("watch operation error", errors.ReadServerErr, err)
+		}
+
+		if respBuf[0] == errors.ServerResponseError {
+			err = fmt.Errorf("%s", respBuf[1:]) // retrieve error value from the server response
+			return errors.New("watch operation error", errors.WatchRespErr, err)
+		}
+
+		// the empty response acknowledges the watch
+		event := respBuf[1 : len(respBuf)-1]
+		if len(event) == 0 {
+			continue
+		}
+
+		if err := handle(event); err != nil {
+			return err
+		}
+	}
+}
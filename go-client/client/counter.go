@@ -0,0 +1,69 @@
+package client
+
+import (
+	"context"
+	"strconv"
+
+	cmd "github.com/arsenalzp/keyvalstore/go-client/client/command"
+	"github.com/arsenalzp/keyvalstore/go-client/internal/errors"
+	"github.com/arsenalzp/keyvalstore/go-client/internal/util"
+)
+
+// Increment the integer value of the key by one, the missing key counts as zero.
+// Incr returns the new value or error if the value isn't an integer or overflows
+func (c *Client) Incr(ctx context.Context, key string) (int64, error) {
+	return c.IncrBy(ctx, key, 1)
+}
+
+// Decrement the integer value of the key by one, the missing key counts as zero.
+// Decr returns the new value or error if the value isn't an integer or overflows
+func (c *Client) Decr(ctx context.Context, key string) (int64, error) {
+	return c.IncrBy(ctx, key, -1)
+}
+
+// Add the delta to the integer value of the key atomically on the server,
+// the missing key counts as zero. IncrBy returns the new value or error
+// if the value isn't an integer or the result overflows 64-bit integer.
+// With endpoints, the increment isn't retried on another endpoint once it's
+// sent, as it would be applied twice if the response is lost
+func (c *Client) IncrBy(ctx context.Context, key string, delta int64) (int64, error) {
+	err := util.ValidateInput(key, "")
+	if err != nil {
+		return 0, err
+	}
+
+	if c.ring != nil {
+		return c.shard(key).IncrBy(ctx, key, delta)
+	}
+
+	if c.failover != nil {
+		var value int64
+		err := c.failover.do(ctx, write, func(cl *Client) (err error) {
+			value, err = cl.IncrBy(ctx, key, delta)
+			return err
+		})
+		return value, err
+	}
+
+	dataChan := make(chan []byte, 1)
+	errChan := make(chan error, 1)
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	go cmd.Incr(c.conn, dataChan, errChan, key, delta)
+
+	select {
+	case <-ctx.Done():
+		err := errors.New("incr operation interrupted", errors.IncrCancelErr, ctx.Err())
+		return 0, err
+	case data := <-dataChan:
+		value, err := strconv.ParseInt(string(data), 10, 64)
+		if err != nil {
+			return 0, errors.New("incr operation error: invalid response", errors.IncrRespErr, err)
+		}
+		return value, nil
+	case err := <-errChan:
+		return 0, err
+	}
+}
@@ -0,0 +1,292 @@
+package client
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/arsenalzp/keyvalstore/go-client/internal/errors"
+)
+
+// Default interval of health checks of endpoints
+const DefaultHealthInterval = 5 * time.Second
+
+// Endpoint of the server, e.g. the primary or a replica
+type Endpoint struct {
+	Address  string // "host:port"
+	Priority int    // endpoints with lower value are preferred
+}
+
+type endpoint struct {
+	Endpoint
+
+	mu      sync.Mutex // serializes connecting
+	client  *Client    // nil while disconnected
+	healthy atomic.Bool
+	latency atomic.Int64 // moving average of ping round trips in nanoseconds
+}
+
+// Kind of the request, it defines whether the request is retried on the next endpoint
+type request int
+
+const (
+	write      request = iota // retried only if it isn't sent, as it may have been applied
+	idempotent                // retried if its response isn't received too, e.g. PING
+	read                      // idempotent, preferring the endpoint with the lowest latency
+)
+
+// Endpoints of the client, requests are sent to the preferred healthy endpoint
+// and retried on the next one if the connection fails
+type failover struct {
+	endpoints    []*endpoint // ordered by priority
+	dial         func(addr string) (*Client, error)
+	interval     time.Duration
+	readsLatency bool // reads prefer the endpoint with the lowest latency
+
+	mu      sync.Mutex
+	timeout *time.Duration // timeout of server-side operations applied to new connections
+
+	stop chan struct{}
+	once sync.Once
+}
+
+func newFailover(endpoints []Endpoint, dial func(string) (*Client, error), interval time.Duration, readsLatency bool) *failover {
+	if interval <= 0 {
+		interval = DefaultHealthInterval
+	}
+
+	f := &failover{dial: dial, interval: interval, readsLatency: readsLatency, stop: make(chan struct{})}
+	for _, e := range endpoints {
+		f.endpoints = append(f.endpoints, &endpoint{Endpoint: e})
+	}
+	sort.SliceStable(f.endpoints, func(i, j int) bool { return f.endpoints[i].Priority < f.endpoints[j].Priority })
+
+	return f
+}
+
+// Check endpoints in background until the failover is closed
+func (f *failover) run() {
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-ticker.C:
+			f.check()
+		}
+	}
+}
+
+// Connect endpoints and measure their latency by PING concurrently,
+// returns true if any endpoint is healthy
+func (f *failover) check() bool {
+	var wg sync.WaitGroup
+	for _, ep := range f.endpoints {
+		wg.Add(1)
+		go func(ep *endpoint) {
+			defer wg.Done()
+
+			cl, err := f.connect(ep)
+			if err != nil {
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), f.interval)
+			defer cancel()
+
+			start := time.Now()
+			if err := cl.Ping(ctx); err != nil {
+				f.reset(ep, cl)
+				return
+			}
+
+			rtt := int64(time.Since(start))
+			if prev := ep.latency.Load(); prev > 0 {
+				rtt = (prev*7 + rtt*3) / 10
+			}
+			ep.latency.Store(rtt)
+			ep.healthy.Store(true)
+		}(ep)
+	}
+	wg.Wait()
+
+	for _, ep := range f.endpoints {
+		if ep.healthy.Load() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Run the request on the preferred endpoint, it's retried on the next endpoint
+// if the endpoint can't be connected or the request can't be sent. Reads and
+// idempotent requests are retried if the response isn't received too, writes
+// fail then, as they may have been applied
+func (f *failover) do(ctx context.Context, req request, fn func(*Client) error) error {
+	var lastErr error
+
+	for _, ep := range f.candidates(req == read) {
+		cl, err := f.connect(ep)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		err = fn(cl)
+		if err == nil {
+			return nil
+		}
+
+		// the connection may receive the response of the interrupted request
+		if ctx.Err() != nil {
+			f.reset(ep, cl)
+			return err
+		}
+
+		switch errors.Code(err) {
+		case errors.NetworkErr, errors.WriteServerErr:
+			f.reset(ep, cl)
+			lastErr = err
+			continue
+		case errors.ReadServerErr:
+			f.reset(ep, cl)
+			if req != write {
+				lastErr = err
+				continue
+			}
+		}
+
+		return err
+	}
+
+	return errors.New("no endpoint is available", errors.EndpointsErr, lastErr)
+}
+
+// Client of the preferred endpoint which can be connected
+func (f *failover) client() (*Client, error) {
+	var cl *Client
+
+	err := f.do(context.Background(), write, func(c *Client) error {
+		cl = c
+		return nil
+	})
+
+	return cl, err
+}
+
+// Set timeout of server-side operations of connected endpoints, it's applied
+// to endpoints connected later too; failed connections are closed
+func (f *failover) setTimeout(ctx context.Context, timeout time.Duration) error {
+	f.mu.Lock()
+	f.timeout = &timeout
+	f.mu.Unlock()
+
+	for _, ep := range f.endpoints {
+		ep.mu.Lock()
+		cl := ep.client
+		ep.mu.Unlock()
+
+		if cl == nil {
+			continue
+		}
+
+		if err := cl.SetTimeout(ctx, timeout); err != nil {
+			f.reset(ep, cl)
+			if ctx.Err() != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Endpoints in order of preference: healthy ones by priority or, for reads
+// preferring latency, by latency, then the rest by priority
+func (f *failover) candidates(read bool) []*endpoint {
+	var healthy, rest []*endpoint
+	for _, ep := range f.endpoints {
+		if ep.healthy.Load() {
+			healthy = append(healthy, ep)
+		} else {
+			rest = append(rest, ep)
+		}
+	}
+
+	if read && f.readsLatency {
+		sort.SliceStable(healthy, func(i, j int) bool { return healthy[i].latency.Load() < healthy[j].latency.Load() })
+	}
+
+	return append(healthy, rest...)
+}
+
+// Get client of the endpoint, it's connected if it isn't yet
+func (f *failover) connect(ep *endpoint) (*Client, error) {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+
+	if ep.client != nil {
+		return ep.client, nil
+	}
+
+	cl, err := f.dial(ep.Address)
+	if err != nil {
+		ep.healthy.Store(false)
+		return nil, err
+	}
+
+	f.mu.Lock()
+	timeout := f.timeout
+	f.mu.Unlock()
+
+	if timeout != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), f.interval)
+		defer cancel()
+
+		if err := cl.SetTimeout(ctx, *timeout); err != nil {
+			cl.Close()
+			ep.healthy.Store(false)
+			return nil, err
+		}
+	}
+
+	ep.client = cl
+	return cl, nil
+}
+
+// Close the failed connection of the endpoint, it's reconnected
+// by the next request or health check
+func (f *failover) reset(ep *endpoint, cl *Client) {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+
+	ep.healthy.Store(false)
+	if ep.client == cl {
+		cl.Close()
+		ep.client = nil
+	}
+}
+
+// Stop health checks and close connections of endpoints
+func (f *failover) close() error {
+	f.once.Do(func() { close(f.stop) })
+
+	var firstErr error
+	for _, ep := range f.endpoints {
+		ep.mu.Lock()
+		if ep.client != nil {
+			if err := ep.client.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+			ep.client = nil
+		}
+		ep.mu.Unlock()
+	}
+
+	return firstErr
+}
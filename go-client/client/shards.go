@@ -0,0 +1,114 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/arsenalzp/keyvalstore/go-client/internal/errors"
+	"github.com/arsenalzp/keyvalstore/go-client/ring"
+)
+
+// default number of virtual nodes of a server on the ring
+const DefaultVirtualNodes = ring.DefaultVNodes
+
+// Get client of the shard owning the key
+func (c *Client) shard(key string) *Client {
+	return c.shards[c.ring.Get(key)]
+}
+
+// Run the function for every shard concurrently, the first error is returned
+func (c *Client) each(fn func(shard *Client) error) error {
+	errs := make(chan error, len(c.shards))
+
+	var wg sync.WaitGroup
+	for _, shard := range c.shards {
+		wg.Add(1)
+		go func(shard *Client) {
+			defer wg.Done()
+			errs <- fn(shard)
+		}(shard)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Split the import by shards of keys, items are sent as is
+func (c *Client) importShards(ctx context.Context, data []byte) error {
+	var items []json.RawMessage
+	if err := json.Unmarshal(data, &items); err != nil {
+		return errors.New("import operation failed: validation of input failed", errors.ReadStdinErr, err)
+	}
+
+	groups := make(map[*Client][]json.RawMessage)
+	for _, item := range items {
+		var pair struct {
+			Key string `json:"key"`
+		}
+
+		if err := json.Unmarshal(item, &pair); err != nil {
+			return errors.New("import operation failed: validation of input failed", errors.ReadStdinErr, err)
+		}
+
+		shard := c.shard(pair.Key)
+		groups[shard] = append(groups[shard], item)
+	}
+
+	return c.each(func(shard *Client) error {
+		group, ok := groups[shard]
+		if !ok {
+			return nil
+		}
+
+		data, err := json.Marshal(group)
+		if err != nil {
+			return errors.New("import operation failed", errors.ReadStdinErr, err)
+		}
+
+		return shard.Import(ctx, data)
+	})
+}
+
+// Merge exports of all shards into a single array
+func (c *Client) exportShards(ctx context.Context) ([]byte, error) {
+	var mu sync.Mutex
+	items := make([]json.RawMessage, 0)
+
+	err := c.each(func(shard *Client) error {
+		data, err := shard.Export(ctx)
+		if err != nil {
+			return err
+		}
+
+		var shardItems []json.RawMessage
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &shardItems); err != nil {
+				return errors.New("export operation failed", errors.InvalidExport, err)
+			}
+		}
+
+		mu.Lock()
+		items = append(items, shardItems...)
+		mu.Unlock()
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(items)
+	if err != nil {
+		return nil, errors.New("export operation failed", errors.InvalidExport, err)
+	}
+
+	return data, nil
+}
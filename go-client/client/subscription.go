@@ -0,0 +1,227 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"strconv"
+	"sync"
+
+	cmd "github.com/arsenalzp/keyvalstore/go-client/client/command"
+	"github.com/arsenalzp/keyvalstore/go-client/internal/errors"
+	"github.com/arsenalzp/keyvalstore/go-client/internal/util"
+)
+
+// Message published to the channel
+type Message struct {
+	Channel string `json:"channel"`
+	Pattern string `json:"pattern"` // pattern of the subscription matching the channel
+	Message string `json:"message"`
+}
+
+// Subscription to channels over dedicated connections, one per shard
+type Subscription struct {
+	conns    []net.Conn
+	mux      sync.Mutex // serializes SUBSCRIBE and UNSUBSCRIBE commands
+	messages chan Message
+	errs     chan error
+	done     chan struct{}
+	once     sync.Once
+}
+
+// Publish the message to the channel, messages aren't stored by the server
+// and are received by currently subscribed clients only. Publish returns
+// number of subscribers receiving the message or error in case of failure
+func (c *Client) Publish(ctx context.Context, channel, message string) (int, error) {
+	// channels and messages are limited as keys and values
+	err := util.ValidateInput(channel, message)
+	if err != nil {
+		return 0, err
+	}
+
+	if c.ring != nil {
+		return c.shard(channel).Publish(ctx, channel, message)
+	}
+
+	if c.failover != nil {
+		var n int
+		err := c.failover.do(ctx, write, func(cl *Client) (err error) {
+			n, err = cl.Publish(ctx, channel, message)
+			return err
+		})
+		return n, err
+	}
+
+	dataChan := make(chan []byte, 1)
+	errChan := make(chan error, 1)
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	go cmd.Publish(c.conn, dataChan, errChan, channel, message)
+
+	select {
+	case <-ctx.Done():
+		err := errors.New("publish operation interrupted", errors.PubSubCancelErr, ctx.Err())
+		return 0, err
+	case data := <-dataChan:
+		n, err := strconv.Atoi(string(data))
+		if err != nil {
+			return 0, errors.New("publish operation error: invalid response", errors.PubSubRespErr, err)
+		}
+		return n, nil
+	case err := <-errChan:
+		return 0, err
+	}
+}
+
+// Subscribe to channels matching the patterns, e.g. "news.*", over dedicated
+// connections. Every shard is subscribed, as channels are routed by the ring.
+// With endpoints, the preferred endpoint is subscribed and the subscription
+// isn't moved to another one, it fails with its connection.
+// Subscribe returns *Subscription or error in case of failure
+func (c *Client) Subscribe(ctx context.Context, patterns ...string) (*Subscription, error) {
+	for _, pattern := range patterns {
+		if err := util.ValidateInput(pattern, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	// subscribers of the preferred endpoint receive messages published through it
+	if c.failover != nil {
+		cl, err := c.failover.client()
+		if err != nil {
+			return nil, err
+		}
+		return cl.Subscribe(ctx, patterns...)
+	}
+
+	servers := []*Client{c}
+	if c.ring != nil {
+		servers = servers[:0]
+		for _, shard := range c.shards {
+			servers = append(servers, shard)
+		}
+	}
+
+	s := &Subscription{messages: make(chan Message), errs: make(chan error, len(servers)), done: make(chan struct{})}
+
+	for _, server := range servers {
+		conn, err := dial(server.addr, server.tlsConfig)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.conns = append(s.conns, conn.conn)
+	}
+
+	if err := s.send(ctx, cmd.SUBSCRIBE, patterns); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	for _, conn := range s.conns {
+		go s.receive(conn)
+	}
+
+	return s, nil
+}
+
+// Receive the next message. Receive returns Message or error if the context is done
+// or any connection fails, the subscription has to be closed after that
+func (s *Subscription) Receive(ctx context.Context) (Message, error) {
+	select {
+	case <-ctx.Done():
+		return Message{}, errors.New("subscribe operation interrupted", errors.PubSubCancelErr, ctx.Err())
+	case msg := <-s.messages:
+		return msg, nil
+	case err := <-s.errs:
+		return Message{}, err
+	}
+}
+
+// Subscribe to more patterns. Subscribe returns error in case of failure
+func (s *Subscription) Subscribe(ctx context.Context, patterns ...string) error {
+	for _, pattern := range patterns {
+		if err := util.ValidateInput(pattern, ""); err != nil {
+			return err
+		}
+	}
+
+	return s.send(ctx, cmd.SUBSCRIBE, patterns)
+}
+
+// Unsubscribe from the patterns, from all of them if none is given.
+// Unsubscribe returns error in case of failure
+func (s *Subscription) Unsubscribe(ctx context.Context, patterns ...string) error {
+	if len(patterns) == 0 {
+		patterns = []string{""}
+	}
+
+	return s.send(ctx, cmd.UNSUBSCRIBE, patterns)
+}
+
+// Close connections of the subscription
+func (s *Subscription) Close() error {
+	var firstErr error
+
+	s.once.Do(func() {
+		close(s.done)
+		for _, conn := range s.conns {
+			if err := conn.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	})
+
+	return firstErr
+}
+
+// Send the command to every connection of the subscription
+func (s *Subscription) send(ctx context.Context, command string, patterns []string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for _, conn := range s.conns {
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetWriteDeadline(deadline)
+		}
+
+		if err := cmd.Subscribe(conn, command, patterns); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Read frames of the connection until it fails, acknowledgements are skipped
+func (s *Subscription) receive(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+
+	for {
+		frame, err := cmd.ReadFrame(reader)
+		if err != nil {
+			select {
+			case s.errs <- err:
+			case <-s.done:
+			}
+			return
+		}
+
+		var msg struct {
+			Type string `json:"type"`
+			Message
+		}
+		if err := json.Unmarshal(frame, &msg); err != nil || msg.Type != "message" {
+			continue
+		}
+
+		select {
+		case s.messages <- msg.Message:
+		case <-s.done:
+			return
+		}
+	}
+}
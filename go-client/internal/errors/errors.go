@@ -30,6 +30,21 @@ const (
 	ImpCancelErr        = "ECLI-4018"
 	ServerResponseError = 'N'
 	InputValidationErr  = "ECLI-0019"
+	PingServerRespErr   = "ECLI-5020"
+	PingCancelErr       = "ECLI-5021"
+	TimeoutRespErr      = "ECLI-6022"
+	TimeoutCancelErr    = "ECLI-6023"
+	InvalidTimeoutErr   = "ECLI-0024"
+	TLSConfigErr        = "ECLI-0025"
+	PinMismatchErr      = "ECLI-1026"
+	ShardsErr           = "ECLI-0027"
+	WatchRespErr        = "ECLI-7028"
+	WatchCancelErr      = "ECLI-7029"
+	PubSubRespErr       = "ECLI-8030"
+	PubSubCancelErr     = "ECLI-8031"
+	EndpointsErr        = "ECLI-0032"
+	IncrRespErr         = "ECLI-9033"
+	IncrCancelErr       = "ECLI-9034"
 )
 
 type errorCmd struct {
@@ -58,3 +73,14 @@ func New(msg string, code string, err error) error {
 		Msg: msg, Code: code, Err: err,
 	})
 }
+
+// Get code of the error, empty string is returned
+// if the error wasn't created by New
+func Code(err error) string {
+	var e *errorCmd
+	if errors.As(err, &e) {
+		return e.Code
+	}
+
+	return ""
+}
@@ -0,0 +1,88 @@
+// Consistent-hash ring placing keys on nodes.
+// It's shared by the Go client sharding keys across servers and the sharding
+// proxy, so both place keys the same way given the same node names.
+
+package ring
+
+import (
+	"hash/fnv"
+	"slices"
+	"sort"
+	"strconv"
+)
+
+// default number of virtual nodes of a node on the ring
+const DefaultVNodes = 128
+
+// Consistent-hash ring of nodes, every node is placed on the ring by its
+// virtual nodes and owns keys hashed between its virtual node and the previous one
+// Adding a node moves only keys taken over by its virtual nodes
+type Ring struct {
+	vnodes int
+	points []uint64          // sorted hashes of virtual nodes
+	owners map[uint64]string // node of the virtual node
+}
+
+func New(vnodes int) *Ring {
+	if vnodes < 1 {
+		vnodes = DefaultVNodes
+	}
+
+	return &Ring{vnodes: vnodes, owners: make(map[uint64]string)}
+}
+
+// Add virtual nodes of the node
+func (r *Ring) Add(node string) {
+	for i := 0; i < r.vnodes; i++ {
+		point := hash(node + "#" + strconv.Itoa(i))
+		if _, ok := r.owners[point]; ok {
+			continue
+		}
+
+		r.owners[point] = node
+		r.points = append(r.points, point)
+	}
+
+	slices.Sort(r.points)
+}
+
+// Get node owning the key, it's empty if the ring has no nodes
+func (r *Ring) Get(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+
+	h := hash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+
+	return r.owners[r.points[i]]
+}
+
+// Copy the ring, the copy is changed independently
+func (r *Ring) Clone() *Ring {
+	owners := make(map[uint64]string, len(r.owners))
+	for point, node := range r.owners {
+		owners[point] = node
+	}
+
+	return &Ring{vnodes: r.vnodes, points: slices.Clone(r.points), owners: owners}
+}
+
+func hash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+
+	// FNV of similar strings differs in the low bits only,
+	// the finalizer spreads them over the ring
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+
+	return x
+}
@@ -0,0 +1,64 @@
+package ring
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRing(t *testing.T) {
+	const KEYS = 10000
+
+	ring := New(DefaultVNodes)
+	if shard := ring.Get("key"); shard != "" {
+		t.Errorf("error getting shard of empty ring, got %s\n", shard)
+		return
+	}
+
+	for _, shard := range []string{"a", "b", "c"} {
+		ring.Add(shard)
+	}
+
+	owners := make(map[string]string, KEYS)
+	counts := make(map[string]int)
+	for i := 0; i < KEYS; i++ {
+		key := "key" + fmt.Sprint(i)
+		owners[key] = ring.Get(key)
+		counts[owners[key]]++
+	}
+
+	// every shard owns about a third of keys
+	for shard, n := range counts {
+		if n < KEYS/5 || n > KEYS/2 {
+			t.Errorf("error distributing keys, shard %s owns %d of %d keys\n", shard, n, KEYS)
+			return
+		}
+	}
+
+	target := ring.Clone()
+	target.Add("d")
+
+	// only keys taken over by the new shard are moved
+	moved := 0
+	for key, owner := range owners {
+		if ring.Get(key) != owner {
+			t.Errorf("error cloning ring, owner of %s is changed\n", key)
+			return
+		}
+
+		shard := target.Get(key)
+		if shard == owner {
+			continue
+		}
+
+		if shard != "d" {
+			t.Errorf("error adding shard, key %s is moved from %s to %s\n", key, owner, shard)
+			return
+		}
+		moved++
+	}
+
+	if moved < KEYS/8 || moved > KEYS/2 {
+		t.Errorf("error adding shard, %d of %d keys are moved\n", moved, KEYS)
+		return
+	}
+}
@@ -3,12 +3,17 @@ module github.com/arsenalzp/keyvalstore
 go 1.22
 
 require (
+	github.com/arsenalzp/keyvalstore/go-client v0.0.0
 	github.com/mattn/go-sqlite3 v1.14.24
 	github.com/pkg/errors v0.9.1
 	github.com/spf13/cobra v1.8.1
+	golang.org/x/crypto v0.31.0
 )
 
 require (
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
 )
+
+// the sharding proxy places keys by the ring of the Go client
+replace github.com/arsenalzp/keyvalstore/go-client => ./go-client
@@ -0,0 +1,48 @@
+// Package implements CLI commands.
+
+package command
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/arsenalzp/keyvalstore/internal/cli/errors"
+	"github.com/arsenalzp/keyvalstore/internal/server/audit"
+
+	"github.com/spf13/cobra"
+)
+
+var auditKeyFile string
+
+func init() {
+	rootCmd.AddCommand(auditCmd)
+	auditCmd.AddCommand(auditVerifyCmd)
+
+	auditVerifyCmd.Flags().StringVar(&auditKeyFile, "key-file", "", "file of base64-encoded HMAC key of the audit log")
+	auditVerifyCmd.MarkFlagRequired("key-file")
+}
+
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Manage server audit log",
+}
+
+var auditVerifyCmd = &cobra.Command{
+	Use:   "verify path",
+	Short: "Verify audit log is neither modified nor truncated",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		key, err := audit.LoadKey(auditKeyFile)
+		if err != nil {
+			return errors.New("audit log key is invalid", errors.AuditVerifyErr, err)
+		}
+
+		head, err := audit.Verify(args[0], key)
+		if err != nil {
+			return errors.New("audit log is invalid", errors.AuditVerifyErr, err)
+		}
+
+		fmt.Fprintf(os.Stdout, "audit log is valid: %d entries, head %s\n", head.Seq, head.Hash)
+		return nil
+	},
+}
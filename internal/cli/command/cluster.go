@@ -0,0 +1,124 @@
+// Package implements CLI commands.
+
+package command
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/arsenalzp/keyvalstore/internal/cli/errors"
+
+	"github.com/spf13/cobra"
+)
+
+var adminURL, adminTokenFile string
+var memberID, memberAddr, memberClientAddr string
+
+func init() {
+	rootCmd.AddCommand(clusterCmd)
+	clusterCmd.AddCommand(clusterStatusCmd, clusterAddCmd, clusterRemoveCmd)
+
+	clusterCmd.PersistentFlags().StringVar(&adminURL, "admin", "http://127.0.0.1:9100", "URL of the admin listener of the cluster member")
+	clusterCmd.PersistentFlags().StringVar(&adminTokenFile, "admin-token-file", "", "path to a file of the admin token")
+
+	clusterAddCmd.Flags().StringVar(&memberID, "id", "", "ID of the new member")
+	clusterAddCmd.Flags().StringVar(&memberAddr, "addr", "", "address of the Raft listener of the new member")
+	clusterAddCmd.Flags().StringVar(&memberClientAddr, "client-addr", "", "address clients are redirected to")
+}
+
+var clusterCmd = &cobra.Command{
+	Use:   "cluster",
+	Short: "Manage members of the server cluster",
+}
+
+var clusterStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show status and members of the cluster",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return adminRequest(http.MethodGet, "/cluster", nil, errors.ClusterErr)
+	},
+}
+
+var clusterAddCmd = &cobra.Command{
+	Use:   "add --id id --addr host:port --client-addr host:port",
+	Short: "Add the member to the cluster, the request is sent to the leader",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		member := map[string]string{"id": memberID, "addr": memberAddr, "client_addr": memberClientAddr}
+
+		body, err := json.Marshal(member)
+		if err != nil {
+			return errors.New("invalid member", errors.ClusterErr, err)
+		}
+
+		return adminRequest(http.MethodPost, "/cluster/members", body, errors.ClusterErr)
+	},
+}
+
+var clusterRemoveCmd = &cobra.Command{
+	Use:   "remove id",
+	Short: "Remove the member from the cluster, the request is sent to the leader",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return adminRequest(http.MethodDelete, "/cluster/members?id="+url.QueryEscape(args[0]), nil, errors.ClusterErr)
+	},
+}
+
+// Send the request to the admin listener and print the JSON response,
+// failures are reported with the given error code
+func adminRequest(method, path string, body []byte, code string) error {
+	data, err := adminCall(method, path, body, code)
+	if err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	if err := json.Indent(&out, data, "", "  "); err != nil {
+		return errors.New("invalid admin response", code, err)
+	}
+
+	fmt.Fprintln(os.Stdout, out.String())
+	return nil
+}
+
+// Send the request to the admin listener, the response body is returned
+func adminCall(method, path string, body []byte, code string) ([]byte, error) {
+	req, err := http.NewRequest(method, strings.TrimRight(adminURL, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.New("invalid admin URL", code, err)
+	}
+
+	if adminTokenFile != "" {
+		token, err := os.ReadFile(adminTokenFile)
+		if err != nil {
+			return nil, errors.New("unable to read admin token", code, err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.New("connection error", errors.NetworkErr, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.New("connection error", errors.NetworkErr, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("admin request failed", code, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(data)))
+	}
+
+	return data, nil
+}
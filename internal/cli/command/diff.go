@@ -0,0 +1,180 @@
+// Package implements CLI commands.
+
+package command
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/arsenalzp/keyvalstore/internal/cli/errors"
+	entity "github.com/arsenalzp/keyvalstore/internal/server/storage/entity"
+	"github.com/arsenalzp/keyvalstore/internal/server/storage/merkle"
+
+	"github.com/spf13/cobra"
+)
+
+// ranges with up to the number of keys are compared by hashes of their pairs
+const diffLeafKeys = 64
+
+var diffServer, diffFile string
+var diffJSON bool
+
+func init() {
+	rootCmd.AddCommand(diffCmd)
+	diffCmd.Flags().StringVarP(&serverAddress, "server", "s", "", "use server and port for connection")
+	diffCmd.Flags().StringVarP(&client_cert, "cert", "c", "", "path to certificate file")
+	diffCmd.Flags().StringVarP(&privkey_cert, "key", "k", "", "path to private key file")
+	diffCmd.Flags().StringVarP(&rootca_cert, "CAcert", "r", "", "path to CA certificate file")
+	diffCmd.Flags().StringVar(&diffServer, "to", "", "server and port to compare with, the same certificates are used")
+	diffCmd.Flags().StringVar(&diffFile, "file", "", "export file to compare with")
+	diffCmd.Flags().BoolVar(&diffJSON, "json", false, "print the difference as JSON")
+	diffCmd.MarkFlagsMutuallyExclusive("to", "file")
+	diffCmd.MarkFlagsOneRequired("to", "file")
+}
+
+var diffCmd = &cobra.Command{
+	Use:   "diff [--server] --to host:port | --file export.json",
+	Short: "Compare keys of the server with another server or an export file, keys added (+), removed (-) and changed (~) in the latter are printed",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conn, err := CreateConnection()
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		var other merkle.Source
+		if diffFile != "" {
+			if other, err = fileSummary(diffFile); err != nil {
+				return err
+			}
+		} else {
+			serverAddress = diffServer
+			otherConn, err := CreateConnection()
+			if err != nil {
+				return err
+			}
+			defer otherConn.Close()
+
+			other = NewServerSummary(otherConn)
+		}
+
+		diff, err := Diff(NewServerSummary(conn), other)
+		if err != nil {
+			return err
+		}
+
+		if diffJSON {
+			data, err := json.Marshal(diff)
+			if err != nil {
+				return errors.New("diff command error", errors.DiffErr, err)
+			}
+			fmt.Fprintf(os.Stdout, "%s\n", data)
+		} else {
+			for _, line := range []struct {
+				sign string
+				keys []string
+			}{{"+", diff.Added}, {"-", diff.Removed}, {"~", diff.Changed}} {
+				for _, key := range line.keys {
+					fmt.Fprintf(os.Stdout, "%s %s\n", line.sign, key)
+				}
+			}
+		}
+
+		// scripts verifying migrations check the exit status
+		if n := len(diff.Added) + len(diff.Removed) + len(diff.Changed); n > 0 {
+			err := fmt.Errorf("%d added, %d removed, %d changed", len(diff.Added), len(diff.Removed), len(diff.Changed))
+			return errors.New("keys differ", errors.DiffErr, err)
+		}
+
+		return nil
+	},
+}
+
+// Compare keys of the sources, keys of the second one are reported
+// as added, removed or changed
+func Diff(a, b merkle.Source) (merkle.Diff, error) {
+	diff, err := merkle.Compare(a, b, diffLeafKeys)
+	if err != nil {
+		return merkle.Diff{}, errors.New("diff command error", errors.DiffErr, err)
+	}
+
+	return diff, nil
+}
+
+// Summaries of the keyspace computed by the server, only differing
+// ranges are requested, so the keyspace isn't exported
+type ServerSummary struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func NewServerSummary(conn net.Conn) *ServerSummary {
+	return &ServerSummary{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func (s *ServerSummary) Nodes(path string, levels int) ([]merkle.Node, error) {
+	var nodes []merkle.Node
+	err := s.request(path, strconv.Itoa(levels), &nodes)
+
+	return nodes, err
+}
+
+func (s *ServerSummary) Entries(path string) ([]merkle.Entry, error) {
+	var entries []merkle.Entry
+	err := s.request(path, "entries", &entries)
+
+	return entries, err
+}
+
+func (s *ServerSummary) request(path, mode string, v any) error {
+	var buf [MESSAGE_SIZE]byte
+
+	copy(buf[0:3], []byte(SUMMARY))
+	copy(buf[3:259], []byte(path))
+	copy(buf[259:771], []byte(mode))
+	buf[771] = EOT
+
+	// every request of the comparison has its own deadline
+	s.conn.SetDeadline(time.Now().Add(20 * time.Second))
+
+	if _, err := s.conn.Write(buf[:]); err != nil {
+		return errors.New("summary command error", errors.WriteServerErr, err)
+	}
+
+	respBuf, err := s.reader.ReadBytes(EOT)
+	if err != nil {
+		return errors.New("summary command error", errors.ReadServerErr, err)
+	}
+
+	if respBuf[0] == errors.ServerResponseError {
+		err = fmt.Errorf("%s", respBuf[1:])
+		return errors.New("summary command failed", errors.SummaryResponseError, err)
+	}
+
+	if err := json.Unmarshal(respBuf[1:len(respBuf)-1], v); err != nil {
+		return errors.New("summary command error", errors.SummaryResponseError, err)
+	}
+
+	return nil
+}
+
+// Summaries of the export file
+func fileSummary(path string) (*merkle.Tree, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.New("unable to read export file", errors.DiffErr, err)
+	}
+
+	var pairs []entity.ExportData
+	if err := json.Unmarshal(data, &pairs); err != nil {
+		return nil, errors.New("invalid export file", errors.InvalidExport, err)
+	}
+
+	return merkle.New(pairs), nil
+}
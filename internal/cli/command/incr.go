@@ -0,0 +1,115 @@
+// Package implements CLI commands.
+
+package command
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/arsenalzp/keyvalstore/internal/cli/errors"
+	"github.com/arsenalzp/keyvalstore/internal/cli/util"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	for _, c := range []*cobra.Command{incrCmd, decrCmd, incrByCmd} {
+		rootCmd.AddCommand(c)
+		c.Flags().StringVarP(&serverAddress, "server", "s", "", "use server and port for connection")
+		c.Flags().StringVarP(&client_cert, "cert", "c", "", "path to certificate file")
+		c.Flags().StringVarP(&privkey_cert, "key", "k", "", "path to private key file")
+		c.Flags().StringVarP(&rootca_cert, "CAcert", "r", "", "path to CA certificate file")
+	}
+}
+
+var incrCmd = &cobra.Command{
+	Use:   "incr [--server] key",
+	Short: "Increment the integer value of a key by one, the new value is printed",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runIncr(cmd, []string{args[0], "1"})
+	},
+}
+
+var decrCmd = &cobra.Command{
+	Use:   "decr [--server] key",
+	Short: "Decrement the integer value of a key by one, the new value is printed",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runIncr(cmd, []string{args[0], "-1"})
+	},
+}
+
+var incrByCmd = &cobra.Command{
+	Use:   "incrby [--server] key delta",
+	Short: "Add a signed delta to the integer value of a key, the new value is printed",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runIncr(cmd, args)
+	},
+}
+
+func runIncr(cmd *cobra.Command, args []string) error {
+	conn, err := CreateConnection()
+	if err != nil {
+		return err
+	}
+
+	data, err := Incr(conn, cmd, args)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stdout, "%s\n", data)
+	return nil
+}
+
+// Add the delta (the second argument) to the counter (the first argument),
+// the new value of the counter is returned
+func Incr(conn net.Conn, cmd *cobra.Command, args []string) ([]byte, error) {
+	var buf [MESSAGE_SIZE]byte
+
+	defer conn.Close()
+
+	key := sanitizeData([]byte(args[0]))
+
+	delta, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid delta", errors.InvalidDeltaErr, err)
+	}
+
+	if err := util.ValidateInput(key, []byte{}); err != nil {
+		return nil, err
+	}
+
+	copy(buf[0:3], []byte(INCR))
+	copy(buf[3:259], key)
+	copy(buf[259:771], strconv.FormatInt(delta, 10))
+	buf[771] = EOT
+
+	writer := bufio.NewWriter(conn)
+	if _, err := writer.Write(buf[:]); err != nil {
+		return nil, errors.New("incr command error", errors.WriteServerErr, err)
+	}
+
+	if err := writer.Flush(); err != nil {
+		return nil, errors.New("incr command error", errors.WriteServerErr, err)
+	}
+
+	reader := bufio.NewReader(conn)
+	respBuf, err := reader.ReadBytes(EOT)
+	if err != nil {
+		return nil, errors.New("incr command failed", errors.ReadServerErr, err)
+	}
+
+	if respBuf[0] == errors.ServerResponseError {
+		err = fmt.Errorf("%s", respBuf[1:])
+		return nil, errors.New("incr command failed", errors.IncrResponseError, err)
+	}
+
+	return bytes.TrimRight(respBuf[1:], string(EOT)), nil
+}
@@ -0,0 +1,84 @@
+// Package implements CLI commands.
+
+package command
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/arsenalzp/keyvalstore/internal/cli/errors"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(pingCmd)
+	pingCmd.Flags().StringVarP(&serverAddress, "server", "s", "", "use server and port for connection")
+	pingCmd.Flags().StringVarP(&client_cert, "cert", "c", "", "path to certificate file")
+	pingCmd.Flags().StringVarP(&privkey_cert, "key", "k", "", "path to private key file")
+	pingCmd.Flags().StringVarP(&rootca_cert, "CAcert", "r", "", "path to CA certificate file")
+}
+
+var pingCmd = &cobra.Command{
+	Use:   "ping [--server]",
+	Short: "Check whether the server is alive",
+	Args:  cobra.MaximumNArgs(0),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conn, err := CreateConnection()
+		if err != nil {
+			return err
+		}
+
+		data, err := Ping(conn, cmd)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(os.Stdout, "%s\n", data)
+		return nil
+	},
+}
+
+func Ping(conn net.Conn, cmd *cobra.Command) ([]byte, error) {
+	var buf []byte = make([]byte, 4)
+
+	defer conn.Close()
+
+	writer := bufio.NewWriter(conn)
+
+	copy(buf[0:3], []byte(PING)) // copy the command data
+	buf[3] = EOT                 // add EOT to signal the end of transmission
+
+	_, err := writer.Write(buf)
+	if err != nil {
+		err = errors.New("ping command error", errors.WriteServerErr, err)
+		return nil, err
+	}
+
+	err = writer.Flush()
+	if err != nil {
+		err = errors.New("ping command error", errors.WriteServerErr, err)
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	respBuf, err := reader.ReadBytes(EOT)
+	if err != nil {
+		err = errors.New("ping command error", errors.ReadServerErr, err)
+		return nil, err
+	}
+
+	if respBuf[0] == errors.ServerResponseError {
+		err = fmt.Errorf("%s", respBuf[1:])
+		err = errors.New("ping command error", errors.PingResponseError, err)
+		return nil, err
+	}
+
+	// Trim response buffer: delete EOT byte
+	respBuf = bytes.TrimRight(respBuf[1:], string(EOT))
+
+	return respBuf, nil
+}
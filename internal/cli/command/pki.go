@@ -0,0 +1,263 @@
+// Package implements CLI commands.
+
+package command
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/arsenalzp/keyvalstore/internal/cli/errors"
+	"github.com/arsenalzp/keyvalstore/internal/pki"
+
+	"github.com/spf13/cobra"
+)
+
+const day = 24 * time.Hour
+
+var pkiDir string
+
+// options of the CA
+var caCN string
+var caDays int
+
+// options of server certificates
+var serverCrtName string
+var serverDNSNames, serverIPs []string
+var serverDays int
+
+// options of client certificates
+var clientCN, clientCrtName string
+var clientOrgs, clientOUs []string
+var clientDays int
+
+// replace existing certificate and key files
+var forceIssue bool
+
+// validity of the CRL
+var crlDays int
+
+// OCSP responder put into issued certificates
+var ocspURL string
+
+// options of the OCSP responder
+var ocspAddr string
+var ocspValidity time.Duration
+
+func init() {
+	rootCmd.AddCommand(pkiCmd)
+	pkiCmd.PersistentFlags().StringVarP(&pkiDir, "dir", "d", "./pki", "directory of the CA, issued certificates and index")
+
+	pkiCmd.AddCommand(pkiInitCmd)
+	pkiInitCmd.Flags().StringVar(&caCN, "cn", "keyval root CA", "common name of the CA")
+	pkiInitCmd.Flags().IntVar(&caDays, "days", 3650, "validity of the CA in days")
+	pkiInitCmd.Flags().IntVar(&crlDays, "crl-days", 30, "validity of the initial CRL in days")
+
+	pkiCmd.AddCommand(pkiIssueServerCmd)
+	pkiIssueServerCmd.Flags().StringVar(&serverCrtName, "name", "server", "base name of the certificate and key files")
+	pkiIssueServerCmd.Flags().StringSliceVar(&serverDNSNames, "dns", []string{"localhost"}, "DNS name of the server, can be repeated")
+	pkiIssueServerCmd.Flags().StringSliceVar(&serverIPs, "ip", []string{"127.0.0.1"}, "IP address of the server, can be repeated")
+	pkiIssueServerCmd.Flags().IntVar(&serverDays, "days", 365, "validity of the certificate in days")
+	pkiIssueServerCmd.Flags().StringVar(&ocspURL, "ocsp-url", "", "URL of the OCSP responder put into the certificate")
+	pkiIssueServerCmd.Flags().BoolVar(&forceIssue, "force", false, "replace existing certificate and key files of the name")
+
+	pkiCmd.AddCommand(pkiIssueClientCmd)
+	pkiIssueClientCmd.Flags().StringVar(&clientCN, "cn", "", "common name of the client")
+	pkiIssueClientCmd.Flags().StringSliceVar(&clientOUs, "ou", nil, "organizational unit of the client, can be repeated")
+	pkiIssueClientCmd.Flags().StringSliceVar(&clientOrgs, "o", nil, "organization of the client, can be repeated")
+	pkiIssueClientCmd.Flags().StringVar(&clientCrtName, "name", "", "base name of the certificate and key files, CN by default")
+	pkiIssueClientCmd.Flags().IntVar(&clientDays, "days", 365, "validity of the certificate in days")
+	pkiIssueClientCmd.Flags().StringVar(&ocspURL, "ocsp-url", "", "URL of the OCSP responder put into the certificate")
+	pkiIssueClientCmd.Flags().BoolVar(&forceIssue, "force", false, "replace existing certificate and key files of the name")
+	pkiIssueClientCmd.MarkFlagRequired("cn")
+
+	pkiCmd.AddCommand(pkiRevokeCmd)
+
+	pkiCmd.AddCommand(pkiCRLCmd)
+	pkiCRLCmd.Flags().IntVar(&crlDays, "days", 30, "validity of the CRL in days")
+
+	pkiCmd.AddCommand(pkiListCmd)
+
+	pkiCmd.AddCommand(pkiOCSPServeCmd)
+	pkiOCSPServeCmd.Flags().StringVar(&ocspAddr, "addr", "127.0.0.1:8889", "address to listen on")
+	pkiOCSPServeCmd.Flags().DurationVar(&ocspValidity, "validity", time.Hour, "validity of OCSP responses")
+}
+
+var pkiCmd = &cobra.Command{
+	Use:   "pki",
+	Short: "Manage CA, server and client certificates",
+}
+
+var pkiInitCmd = &cobra.Command{
+	Use:   "init [--dir] [--cn] [--days] [--crl-days]",
+	Short: "Create root CA and empty CRL",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		p, err := pki.Init(pkiDir, caCN, time.Duration(caDays)*day)
+		if err != nil {
+			return errors.New("pki init error", errors.PKIErr, err)
+		}
+
+		if _, err := p.CRL(time.Duration(crlDays) * day); err != nil {
+			return errors.New("pki init error", errors.PKIErr, err)
+		}
+
+		fmt.Fprintf(os.Stdout, "CA %s is created in %s\n", p.CACert().Subject, pkiDir)
+		return nil
+	},
+}
+
+var pkiIssueServerCmd = &cobra.Command{
+	Use:   "issue-server [--dir] [--name] [--dns] [--ip] [--days] [--ocsp-url] [--force]",
+	Short: "Issue server certificate",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var ips []net.IP
+		for _, s := range serverIPs {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return errors.New("pki issue-server error", errors.PKIErr, fmt.Errorf("invalid IP address %q", s))
+			}
+			ips = append(ips, ip)
+		}
+
+		return issue(func(p *pki.PKI) (pki.Record, error) {
+			return p.IssueServer(pki.ServerRequest{
+				Name:     serverCrtName,
+				DNSNames: serverDNSNames,
+				IPs:      ips,
+				OCSPURL:  ocspURL,
+				Validity: time.Duration(serverDays) * day,
+				Force:    forceIssue,
+			})
+		})
+	},
+}
+
+var pkiIssueClientCmd = &cobra.Command{
+	Use:   "issue-client --cn [--ou] [--o] [--name] [--dir] [--days] [--ocsp-url] [--force]",
+	Short: "Issue client certificate",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return issue(func(p *pki.PKI) (pki.Record, error) {
+			return p.IssueClient(pki.ClientRequest{
+				Name:               clientCrtName,
+				CommonName:         clientCN,
+				Organization:       clientOrgs,
+				OrganizationalUnit: clientOUs,
+				OCSPURL:            ocspURL,
+				Validity:           time.Duration(clientDays) * day,
+				Force:              forceIssue,
+			})
+		})
+	},
+}
+
+var pkiRevokeCmd = &cobra.Command{
+	Use:   "revoke [--dir] SERIAL",
+	Short: "Revoke certificate by its hex serial number",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		p, err := pki.Load(pkiDir)
+		if err != nil {
+			return errors.New("pki revoke error", errors.PKIErr, err)
+		}
+
+		r, err := p.Revoke(strings.ToLower(args[0]))
+		if err != nil {
+			return errors.New("pki revoke error", errors.PKIErr, err)
+		}
+
+		fmt.Fprintf(os.Stdout, "certificate %s (%s) is revoked, run \"pki crl\" to publish the CRL\n", r.Serial, r.Subject)
+		return nil
+	},
+}
+
+var pkiCRLCmd = &cobra.Command{
+	Use:   "crl [--dir] [--days]",
+	Short: "Generate CRL of revoked certificates",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		p, err := pki.Load(pkiDir)
+		if err != nil {
+			return errors.New("pki crl error", errors.PKIErr, err)
+		}
+
+		if _, err := p.CRL(time.Duration(crlDays) * day); err != nil {
+			return errors.New("pki crl error", errors.PKIErr, err)
+		}
+
+		fmt.Fprintf(os.Stdout, "CRL %d is written to %s/%s\n", p.Index.CRLNumber, pkiDir, pki.CRLFile)
+		return nil
+	},
+}
+
+var pkiListCmd = &cobra.Command{
+	Use:   "list [--dir]",
+	Short: "List issued certificates",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		p, err := pki.Load(pkiDir)
+		if err != nil {
+			return errors.New("pki list error", errors.PKIErr, err)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "SERIAL\tKIND\tNAME\tSUBJECT\tNOT AFTER\tSTATUS")
+		for _, r := range p.Index.Certs {
+			status := "valid"
+			if r.RevokedAt != nil {
+				status = "revoked " + r.RevokedAt.Format(time.RFC3339)
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", r.Serial, r.Kind, r.Name, r.Subject, r.NotAfter.Format(time.RFC3339), status)
+		}
+
+		return w.Flush()
+	},
+}
+
+var pkiOCSPServeCmd = &cobra.Command{
+	Use:   "ocsp-serve [--dir] [--addr] [--validity]",
+	Short: "Serve OCSP responses of issued certificates for local testing",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		p, err := pki.Load(pkiDir)
+		if err != nil {
+			return errors.New("pki ocsp-serve error", errors.PKIErr, err)
+		}
+
+		srv := &http.Server{
+			Addr:              ocspAddr,
+			Handler:           p.OCSPHandler(ocspValidity),
+			ReadHeaderTimeout: 5 * time.Second,
+		}
+
+		fmt.Fprintf(os.Stdout, "serving OCSP responses on %s\n", ocspAddr)
+		if err := srv.ListenAndServe(); err != nil {
+			return errors.New("pki ocsp-serve error", errors.PKIErr, err)
+		}
+
+		return nil
+	},
+}
+
+// Issue certificate by the PKI loaded from the directory
+func issue(fn func(*pki.PKI) (pki.Record, error)) error {
+	p, err := pki.Load(pkiDir)
+	if err != nil {
+		return errors.New("pki issue error", errors.PKIErr, err)
+	}
+
+	r, err := fn(p)
+	if err != nil {
+		return errors.New("pki issue error", errors.PKIErr, err)
+	}
+
+	fmt.Fprintf(os.Stdout, "%s certificate %s (%s) is written to %s/%s.crt\n", r.Kind, r.Serial, r.Subject, pkiDir, r.Name)
+	return nil
+}
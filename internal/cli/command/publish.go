@@ -0,0 +1,84 @@
+// Package implements CLI commands.
+
+package command
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/arsenalzp/keyvalstore/internal/cli/errors"
+	"github.com/arsenalzp/keyvalstore/internal/cli/util"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(publishCmd)
+	publishCmd.Flags().StringVarP(&serverAddress, "server", "s", "", "use server and port for connection")
+	publishCmd.Flags().StringVarP(&client_cert, "cert", "c", "", "path to certificate file")
+	publishCmd.Flags().StringVarP(&privkey_cert, "key", "k", "", "path to private key file")
+	publishCmd.Flags().StringVarP(&rootca_cert, "CAcert", "r", "", "path to CA certificate file")
+}
+
+var publishCmd = &cobra.Command{
+	Use:   "publish [--server] channel message",
+	Short: "Publish a message to a channel, number of subscribers receiving it is printed",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conn, err := CreateConnection()
+		if err != nil {
+			return err
+		}
+
+		data, err := Publish(conn, cmd, args)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(os.Stdout, "%s\n", data)
+		return nil
+	},
+}
+
+func Publish(conn net.Conn, cmd *cobra.Command, args []string) ([]byte, error) {
+	var buf [MESSAGE_SIZE]byte
+
+	defer conn.Close()
+
+	channel, message := sanitizeData([]byte(args[0])), sanitizeData([]byte(args[1]))
+
+	// channels and messages are limited as keys and values
+	if err := util.ValidateInput(channel, message); err != nil {
+		return nil, err
+	}
+
+	copy(buf[0:3], []byte(PUBLISH))
+	copy(buf[3:259], channel)
+	copy(buf[259:771], message)
+	buf[771] = EOT
+
+	writer := bufio.NewWriter(conn)
+	if _, err := writer.Write(buf[:]); err != nil {
+		return nil, errors.New("publish command error", errors.WriteServerErr, err)
+	}
+
+	if err := writer.Flush(); err != nil {
+		return nil, errors.New("publish command error", errors.WriteServerErr, err)
+	}
+
+	reader := bufio.NewReader(conn)
+	respBuf, err := reader.ReadBytes(EOT)
+	if err != nil {
+		return nil, errors.New("publish command failed", errors.ReadServerErr, err)
+	}
+
+	if respBuf[0] == errors.ServerResponseError {
+		err = fmt.Errorf("%s", respBuf[1:])
+		return nil, errors.New("publish command failed", errors.PubSubResponseError, err)
+	}
+
+	return bytes.TrimRight(respBuf[1:], string(EOT)), nil
+}
@@ -0,0 +1,26 @@
+// Package implements CLI commands.
+
+package command
+
+import (
+	"net/http"
+
+	"github.com/arsenalzp/keyvalstore/internal/cli/errors"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(quotaCmd)
+
+	quotaCmd.Flags().StringVar(&adminURL, "admin", "http://127.0.0.1:9100", "URL of the admin listener of the server")
+}
+
+var quotaCmd = &cobra.Command{
+	Use:   "quota [--admin]",
+	Short: "Show storage usage and quotas of namespaces and identities",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return adminRequest(http.MethodGet, "/quotas", nil, errors.QuotaErr)
+	},
+}
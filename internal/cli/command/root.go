@@ -4,8 +4,10 @@ package command
 
 import (
 	"bufio"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -25,21 +27,53 @@ const (
 	DELETE       = "del"
 	GET          = "get"
 	SET          = "set"
+	SECRET       = "sec"
 	EXPORT       = "exp"
 	IMPORT       = "imp"
+	PING         = "png"
+	WATCH        = "wch"
+	PUBLISH      = "pub"
+	SUBSCRIBE    = "sub"
+	SUMMARY      = "sum"
+	INCR         = "inc"
 )
 
 var serverAddress string
 var client_cert, privkey_cert, rootca_cert string
 var tlsConf tls.Config
 
+// options of the server certificate verification
+var serverName string
+var spkiPins []string
+var systemRoots, insecure bool
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&serverName, "server-name", "", "name to verify the server certificate against, host of --server by default")
+	rootCmd.PersistentFlags().StringSliceVar(&spkiPins, "pin", nil, "base64 SHA-256 hash of the server public key (SPKI) to pin, can be repeated")
+	rootCmd.PersistentFlags().BoolVar(&systemRoots, "system-roots", false, "trust system root CAs in addition to --CAcert")
+	rootCmd.PersistentFlags().BoolVar(&insecure, "insecure", false, "DANGEROUS: skip verification of the server certificate")
+}
+
 var rootCmd = &cobra.Command{
 	Use: `
 	keyval get [--server] [--key] [--cert] [--CAcert] key | 
-	set [--server] [--key] [--cert] [--CAcert] key=val | 
+	set [--server] [--key] [--cert] [--CAcert] [--secret] key=val | 
 	del [--server] [--key] [--cert] [--CAcert] key | 
+	incr | decr [--server] [--key] [--cert] [--CAcert] key |
+	incrby [--server] [--key] [--cert] [--CAcert] key delta |
 	export [--server] [--key] [--cert] [--CAcert] |
-	import [--server] [--key] [--cert] [--CAcert] JSON
+	import [--server] [--key] [--cert] [--CAcert] JSON |
+	ping [--server] [--key] [--cert] [--CAcert] |
+	watch [--server] [--key] [--cert] [--CAcert] [--prefix] key |
+	publish [--server] [--key] [--cert] [--CAcert] channel message |
+	subscribe [--server] [--key] [--cert] [--CAcert] pattern... |
+	diff [--server] [--key] [--cert] [--CAcert] --to host:port | --file path |
+	audit verify --key-file file path |
+	cluster status | add | remove [--admin] [--admin-token-file] |
+	webhook list | add | remove [--admin] |
+	storage status | migrate [--admin] |
+	quota [--admin] |
+	pki init | issue-server | issue-client | revoke | crl | list | ocsp-serve [--dir]
 	`,
 	Short: "Keyval is fast Unix-style key=val storage",
 	Run: func(cmd *cobra.Command, args []string) {
@@ -71,7 +105,7 @@ func CreateConnection() (*tls.Conn, error) {
 		port = "6842"
 	}
 
-	err = initTLS() // initialize TLS configuration
+	err = initTLS(addr) // initialize TLS configuration
 	if err != nil {
 		return nil, err
 	}
@@ -105,34 +139,82 @@ func Execute() {
 	}
 }
 
-func initTLS() error {
+// Initialize TLS configuration, the server certificate is verified
+// against host unless --server-name is given
+func initTLS(host string) error {
 	crt, err := tls.LoadX509KeyPair(client_cert, privkey_cert)
 	if err != nil {
 		return errors.New("unabel to load certificate or key", errors.NetworkErr, err)
 	}
 
-	rootCA, err := ioutil.ReadFile(rootca_cert)
-	if err != nil {
-		return errors.New("unabel to load root CA file", errors.NetworkErr, err)
+	caPool := x509.NewCertPool()
+	if systemRoots {
+		if caPool, err = x509.SystemCertPool(); err != nil {
+			return errors.New("unable to load system root CAs", errors.TLSConfigErr, err)
+		}
 	}
 
-	caPool := x509.NewCertPool()
+	if rootca_cert != "" {
+		rootCA, err := ioutil.ReadFile(rootca_cert)
+		if err != nil {
+			return errors.New("unabel to load root CA file", errors.NetworkErr, err)
+		}
+
+		if ok := caPool.AppendCertsFromPEM(rootCA); !ok {
+			return errors.New("unabel to add root CA into the certificate pool", errors.NetworkErr, nil)
+		}
+	} else if !systemRoots && !insecure {
+		return errors.New("root CA is required to verify the server, use --CAcert or --system-roots", errors.TLSConfigErr, nil)
+	}
 
-	if ok := caPool.AppendCertsFromPEM(rootCA); !ok {
-		log.Println()
-		return errors.New("unabel to add root CA into the certificate pool", errors.NetworkErr, nil)
+	if serverName != "" {
+		host = serverName
 	}
 
 	tlsConf = tls.Config{
-		MinVersion:         tls.VersionTLS13,
-		Certificates:       []tls.Certificate{crt},
-		ClientCAs:          caPool,
-		InsecureSkipVerify: true, // FOR TEST PURPOSES ONLY, CONSIDER NEW CERTIFICATE CRETION WITH THE !!SAN!!
+		MinVersion:   tls.VersionTLS13,
+		Certificates: []tls.Certificate{crt},
+		RootCAs:      caPool,
+		ServerName:   host,
+	}
+
+	if len(spkiPins) > 0 {
+		pins := make(map[string]bool, len(spkiPins))
+		for _, pin := range spkiPins {
+			pins[strings.TrimPrefix(pin, "sha256//")] = true
+		}
+
+		tlsConf.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyPins(cs, pins)
+		}
+	}
+
+	if insecure {
+		fmt.Fprintln(os.Stderr, "WARNING: --insecure is set, the server certificate is NOT verified; "+
+			"the connection is vulnerable to man-in-the-middle attacks")
+		tlsConf.InsecureSkipVerify = true
 	}
 
 	return nil
 }
 
+// Check whether the server certificate chain contains a pinned public key
+func verifyPins(cs tls.ConnectionState, pins map[string]bool) error {
+	certs := cs.PeerCertificates
+	if len(cs.VerifiedChains) > 0 {
+		certs = cs.VerifiedChains[0]
+	}
+
+	for _, cert := range certs {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		if pins[base64.StdEncoding.EncodeToString(sum[:])] {
+			return nil
+		}
+	}
+
+	return errors.New("server certificate doesn't match pinned public keys", errors.PinMismatchErr, nil)
+}
+
 // get key and value from STDIN
 func readStdin(r *bufio.Reader) ([]byte, []byte, error) {
 	input, err := r.ReadString(byte('\n')) // read data from stdin
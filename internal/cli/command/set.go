@@ -20,10 +20,14 @@ func init() {
 	setCmd.Flags().StringVarP(&client_cert, "cert", "c", "", "path to certificate file")
 	setCmd.Flags().StringVarP(&privkey_cert, "key", "k", "", "path to private key file")
 	setCmd.Flags().StringVarP(&rootca_cert, "CAcert", "r", "", "path to CA certificate file")
+	setCmd.Flags().BoolVar(&secret, "secret", false, "store the key as secret, it's omitted from export")
 }
 
+// store the key as secret
+var secret bool
+
 var setCmd = &cobra.Command{
-	Use:   "set [--server] key=val",
+	Use:   "set [--server] [--secret] key=val",
 	Short: "Set key=value",
 	Args:  cobra.MinimumNArgs(0),
 	RunE: func(cmd *cobra.Command, args []string) error {
@@ -75,9 +79,14 @@ func Set(conn net.Conn, cmd *cobra.Command, args []string) error {
 
 	writer := bufio.NewWriter(conn)
 
-	copy(buf[0:3], []byte("set")) // copy the command data
-	copy(buf[3:259], key)         // copy the key data
-	copy(buf[259:], value)        // copy the value data
+	command := SET
+	if secret {
+		command = SECRET
+	}
+
+	copy(buf[0:3], []byte(command)) // copy the command data
+	copy(buf[3:259], key)           // copy the key data
+	copy(buf[259:], value)          // copy the value data
 	buf[771] = EOT
 
 	_, err = writer.Write(buf[:]) // write command, key and val
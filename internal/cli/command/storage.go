@@ -0,0 +1,96 @@
+// Package implements CLI commands.
+
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/arsenalzp/keyvalstore/internal/cli/errors"
+
+	"github.com/spf13/cobra"
+)
+
+// interval of polling status of the migration
+const migratePoll = time.Second
+
+var migrateTarget string
+var migrateWait bool
+
+func init() {
+	rootCmd.AddCommand(storageCmd)
+	storageCmd.AddCommand(storageStatusCmd, storageMigrateCmd)
+
+	storageCmd.PersistentFlags().StringVar(&adminURL, "admin", "http://127.0.0.1:9100", "URL of the admin listener of the server")
+	storageCmd.PersistentFlags().StringVar(&adminTokenFile, "admin-token-file", "", "path to a file of the admin token")
+
+	storageMigrateCmd.Flags().StringVar(&migrateTarget, "to", "", "kind of the target storage: hash or sqlite")
+	storageMigrateCmd.Flags().BoolVar(&migrateWait, "wait", false, "wait until the migration is finished, progress is printed to stderr")
+	storageMigrateCmd.MarkFlagRequired("to")
+}
+
+var storageCmd = &cobra.Command{
+	Use:   "storage",
+	Short: "Manage the underlying storage of the server",
+}
+
+var storageStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the underlying storage and status of its migration",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return adminRequest(http.MethodGet, "/storage", nil, errors.StorageMigrateErr)
+	},
+}
+
+var storageMigrateCmd = &cobra.Command{
+	Use:   "migrate --to kind [--wait]",
+	Short: "Migrate the running server to another underlying storage without downtime",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		body, err := json.Marshal(map[string]string{"storage": migrateTarget})
+		if err != nil {
+			return errors.New("invalid migration", errors.StorageMigrateErr, err)
+		}
+
+		if !migrateWait {
+			return adminRequest(http.MethodPost, "/storage", body, errors.StorageMigrateErr)
+		}
+
+		if _, err := adminCall(http.MethodPost, "/storage", body, errors.StorageMigrateErr); err != nil {
+			return err
+		}
+
+		for {
+			time.Sleep(migratePoll)
+
+			data, err := adminCall(http.MethodGet, "/storage", nil, errors.StorageMigrateErr)
+			if err != nil {
+				return err
+			}
+
+			var status struct {
+				State  string `json:"state"`
+				Copied int    `json:"copied"`
+				Total  int    `json:"total"`
+				Error  string `json:"error"`
+			}
+			if err := json.Unmarshal(data, &status); err != nil {
+				return errors.New("invalid admin response", errors.StorageMigrateErr, err)
+			}
+
+			fmt.Fprintf(os.Stderr, "%s: %d/%d keys copied\n", status.State, status.Copied, status.Total)
+
+			switch status.State {
+			case "done":
+				fmt.Fprintf(os.Stdout, "%s\n", data)
+				return nil
+			case "failed":
+				return errors.New("storage migration failed", errors.StorageMigrateErr, fmt.Errorf("%s", status.Error))
+			}
+		}
+	},
+}
@@ -0,0 +1,101 @@
+// Package implements CLI commands.
+
+package command
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/arsenalzp/keyvalstore/internal/cli/errors"
+	"github.com/arsenalzp/keyvalstore/internal/cli/util"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(subscribeCmd)
+	subscribeCmd.Flags().StringVarP(&serverAddress, "server", "s", "", "use server and port for connection")
+	subscribeCmd.Flags().StringVarP(&client_cert, "cert", "c", "", "path to certificate file")
+	subscribeCmd.Flags().StringVarP(&privkey_cert, "key", "k", "", "path to private key file")
+	subscribeCmd.Flags().StringVarP(&rootca_cert, "CAcert", "r", "", "path to CA certificate file")
+}
+
+var subscribeCmd = &cobra.Command{
+	Use:   "subscribe [--server] pattern...",
+	Short: "Print messages of channels matching the patterns, e.g. news.*, as JSON lines",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conn, err := CreateConnection()
+		if err != nil {
+			return err
+		}
+
+		return Subscribe(conn, cmd, args, func(message []byte) error {
+			_, err := fmt.Fprintf(os.Stdout, "%s\n", message)
+			return err
+		})
+	},
+}
+
+// Subscribe to channels matching the patterns, every message is passed to the
+// handler in JSON until the connection is closed or the handler returns error
+func Subscribe(conn net.Conn, cmd *cobra.Command, args []string, handle func(message []byte) error) error {
+	defer conn.Close()
+
+	writer := bufio.NewWriter(conn)
+
+	for _, pattern := range args {
+		var buf [MESSAGE_SIZE]byte
+
+		pattern := sanitizeData([]byte(pattern))
+		if err := util.ValidateInput(pattern, []byte{}); err != nil {
+			return err
+		}
+
+		copy(buf[0:3], []byte(SUBSCRIBE))
+		copy(buf[3:259], pattern)
+		buf[771] = EOT
+
+		if _, err := writer.Write(buf[:]); err != nil {
+			return errors.New("subscribe command error", errors.WriteServerErr, err)
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		return errors.New("subscribe command error", errors.WriteServerErr, err)
+	}
+
+	// messages are awaited without a deadline
+	conn.SetReadDeadline(time.Time{})
+
+	reader := bufio.NewReader(conn)
+	for {
+		respBuf, err := reader.ReadBytes(EOT)
+		if err != nil {
+			return errors.New("subscribe command failed", errors.ReadServerErr, err)
+		}
+
+		if respBuf[0] == errors.ServerResponseError {
+			err = fmt.Errorf("%s", respBuf[1:])
+			return errors.New("subscribe command failed", errors.PubSubResponseError, err)
+		}
+
+		// acknowledgements of subscriptions are skipped
+		frame := respBuf[1 : len(respBuf)-1]
+
+		var head struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(frame, &head); err != nil || head.Type != "message" {
+			continue
+		}
+
+		if err := handle(frame); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// Package implements CLI commands.
+
+package command
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/arsenalzp/keyvalstore/internal/cli/errors"
+	"github.com/arsenalzp/keyvalstore/internal/cli/util"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(watchCmd)
+	watchCmd.Flags().StringVarP(&serverAddress, "server", "s", "", "use server and port for connection")
+	watchCmd.Flags().StringVarP(&client_cert, "cert", "c", "", "path to certificate file")
+	watchCmd.Flags().StringVarP(&privkey_cert, "key", "k", "", "path to private key file")
+	watchCmd.Flags().StringVarP(&rootca_cert, "CAcert", "r", "", "path to CA certificate file")
+	watchCmd.Flags().BoolVar(&watchPrefix, "prefix", false, "watch all keys starting with the key")
+}
+
+// watch keys starting with the key
+var watchPrefix bool
+
+var watchCmd = &cobra.Command{
+	Use:   "watch [--server] [--prefix] key",
+	Short: "Print changes of a key or keys with a prefix as JSON lines",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conn, err := CreateConnection()
+		if err != nil {
+			return err
+		}
+
+		return Watch(conn, cmd, args, func(event []byte) error {
+			_, err := fmt.Fprintf(os.Stdout, "%s\n", event)
+			return err
+		})
+	},
+}
+
+// Watch changes of the key, every event is passed to the handler in JSON
+// until the connection is closed or the handler returns error
+func Watch(conn net.Conn, cmd *cobra.Command, args []string, handle func(event []byte) error) error {
+	var buf [MESSAGE_SIZE]byte
+
+	defer conn.Close()
+
+	key := sanitizeData([]byte(args[0]))
+
+	if !watchPrefix {
+		if err := util.ValidateInput(key, []byte{}); err != nil {
+			return err
+		}
+	}
+
+	copy(buf[0:3], []byte(WATCH))
+	copy(buf[3:259], key)
+	if watchPrefix {
+		copy(buf[259:771], []byte("prefix"))
+	}
+	buf[771] = EOT
+
+	writer := bufio.NewWriter(conn)
+	if _, err := writer.Write(buf[:]); err != nil {
+		return errors.New("watch command error", errors.WriteServerErr, err)
+	}
+
+	if err := writer.Flush(); err != nil {
+		return errors.New("watch command error", errors.WriteServerErr, err)
+	}
+
+	// events are awaited without a deadline
+	conn.SetReadDeadline(time.Time{})
+
+	reader := bufio.NewReader(conn)
+	for {
+		respBuf, err := reader.ReadBytes(EOT)
+		if err != nil {
+			return errors.New("watch command failed", errors.ReadServerErr, err)
+		}
+
+		if respBuf[0] == errors.ServerResponseError {
+			err = fmt.Errorf("%s", respBuf[1:])
+			return errors.New("watch command failed", errors.WatchResponseError, err)
+		}
+
+		// the empty response acknowledges the watch
+		event := respBuf[1 : len(respBuf)-1]
+		if len(event) == 0 {
+			continue
+		}
+
+		if err := handle(event); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,77 @@
+// Package implements CLI commands.
+
+package command
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+
+	"github.com/arsenalzp/keyvalstore/internal/cli/errors"
+
+	"github.com/spf13/cobra"
+)
+
+var hookID, hookURL, hookTenant, hookPrefix, hookSecret string
+var hookEvents []string
+
+func init() {
+	rootCmd.AddCommand(webhookCmd)
+	webhookCmd.AddCommand(webhookListCmd, webhookAddCmd, webhookRemoveCmd)
+
+	webhookCmd.PersistentFlags().StringVar(&adminURL, "admin", "http://127.0.0.1:9100", "URL of the admin listener of the server")
+	webhookCmd.PersistentFlags().StringVar(&adminTokenFile, "admin-token-file", "", "path to a file of the admin token")
+
+	webhookAddCmd.Flags().StringVar(&hookID, "id", "", "ID of the webhook, the webhook with the same ID is replaced, it's generated by default")
+	webhookAddCmd.Flags().StringVar(&hookURL, "url", "", "URL the JSON payload is posted to")
+	webhookAddCmd.Flags().StringVar(&hookTenant, "tenant", "", "notify of keys of the tenant only")
+	webhookAddCmd.Flags().StringVar(&hookPrefix, "prefix", "", "notify of keys with the prefix only")
+	webhookAddCmd.Flags().StringSliceVar(&hookEvents, "events", nil, "notify of the events only: set, del")
+	webhookAddCmd.Flags().StringVar(&hookSecret, "secret", "", "key of the HMAC-SHA256 signature of payloads")
+}
+
+var webhookCmd = &cobra.Command{
+	Use:   "webhook",
+	Short: "Manage webhooks notified of mutations of the server",
+}
+
+var webhookListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List registered webhooks",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return adminRequest(http.MethodGet, "/webhooks", nil, errors.WebhookErr)
+	},
+}
+
+var webhookAddCmd = &cobra.Command{
+	Use:   "add --url url [--prefix prefix] [--events set,del] [--secret secret]",
+	Short: "Register the webhook",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		hook := map[string]any{
+			"id":     hookID,
+			"url":    hookURL,
+			"tenant": hookTenant,
+			"prefix": hookPrefix,
+			"events": hookEvents,
+			"secret": hookSecret,
+		}
+
+		body, err := json.Marshal(hook)
+		if err != nil {
+			return errors.New("invalid webhook", errors.WebhookErr, err)
+		}
+
+		return adminRequest(http.MethodPost, "/webhooks", body, errors.WebhookErr)
+	},
+}
+
+var webhookRemoveCmd = &cobra.Command{
+	Use:   "remove id",
+	Short: "Remove the webhook and its pending deliveries",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return adminRequest(http.MethodDelete, "/webhooks?id="+url.QueryEscape(args[0]), nil, errors.WebhookErr)
+	},
+}
@@ -10,21 +10,36 @@ import (
 )
 
 const (
-	InvalidAddrErr      = "ECLI-0001"
-	NetworkErr          = "ECLI-0002"
-	ReadStdinErr        = "ECLI-0003"
-	ReadServerErr       = "ECLI-0004"
-	WriteServerErr      = "ECLI-0005"
-	InvalidExport       = "ECLI-0006"
-	GetResponseError    = "ECLI-0007"
-	SetResponseError    = "ECLI-0008"
-	DelResponseError    = "ECLI-0009"
-	ExpResponseError    = "ECLI-0010"
-	ImpResponseError    = "ECLI-0011"
-	ServerResponseError = 'N'
-	KeyLenExceededErr   = "ECLI-0012"
-	ValueLenExceededErr = "ECLI-1013"
-	KeyEmptyErr         = "ECLI-2014"
+	InvalidAddrErr       = "ECLI-0001"
+	NetworkErr           = "ECLI-0002"
+	ReadStdinErr         = "ECLI-0003"
+	ReadServerErr        = "ECLI-0004"
+	WriteServerErr       = "ECLI-0005"
+	InvalidExport        = "ECLI-0006"
+	GetResponseError     = "ECLI-0007"
+	SetResponseError     = "ECLI-0008"
+	DelResponseError     = "ECLI-0009"
+	ExpResponseError     = "ECLI-0010"
+	ImpResponseError     = "ECLI-0011"
+	ServerResponseError  = 'N'
+	KeyLenExceededErr    = "ECLI-0012"
+	ValueLenExceededErr  = "ECLI-1013"
+	KeyEmptyErr          = "ECLI-2014"
+	PingResponseError    = "ECLI-0015"
+	AuditVerifyErr       = "ECLI-0016"
+	TLSConfigErr         = "ECLI-0017"
+	PinMismatchErr       = "ECLI-1018"
+	PKIErr               = "ECLI-0019"
+	ClusterErr           = "ECLI-0020"
+	WatchResponseError   = "ECLI-0021"
+	PubSubResponseError  = "ECLI-0022"
+	WebhookErr           = "ECLI-0023"
+	SummaryResponseError = "ECLI-0024"
+	DiffErr              = "ECLI-0025"
+	StorageMigrateErr    = "ECLI-0026"
+	IncrResponseError    = "ECLI-0027"
+	InvalidDeltaErr      = "ECLI-1028"
+	QuotaErr             = "ECLI-0029"
 )
 
 type errorCmd struct {
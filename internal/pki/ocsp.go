@@ -0,0 +1,106 @@
+// Management of the private PKI of the key-value storage.
+// Minimal OCSP responder backed by the index of issued certificates.
+
+package pki
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	xocsp "golang.org/x/crypto/ocsp"
+)
+
+const maxOCSPRequest = 4096
+
+// OCSP responder signing responses by the CA, responses are valid for the given period
+// The index is re-read on every request, so revocations are effective immediately
+func (p *PKI) OCSPHandler(validity time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqData []byte
+		var err error
+
+		switch r.Method {
+		case http.MethodPost:
+			reqData, err = io.ReadAll(io.LimitReader(r.Body, maxOCSPRequest))
+		case http.MethodGet:
+			reqData, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(r.URL.Path, "/"))
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		req, err := xocsp.ParseRequest(reqData)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/ocsp-response")
+			w.Write(xocsp.MalformedRequestErrorResponse)
+			return
+		}
+
+		resp, err := p.ocspResponse(req, validity)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/ocsp-response")
+			w.Write(xocsp.InternalErrorErrorResponse)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(resp)
+	})
+}
+
+// Signed response of the certificate status in the index
+func (p *PKI) ocspResponse(req *xocsp.Request, validity time.Duration) ([]byte, error) {
+	index, err := readIndex(p.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	tmpl := xocsp.Response{
+		Status:       xocsp.Unknown,
+		SerialNumber: req.SerialNumber,
+		ThisUpdate:   now,
+		NextUpdate:   now.Add(validity),
+	}
+
+	for _, r := range index.Certs {
+		serial, ok := new(big.Int).SetString(r.Serial, 16)
+		if !ok || serial.Cmp(req.SerialNumber) != 0 {
+			continue
+		}
+
+		tmpl.Status = xocsp.Good
+		if r.RevokedAt != nil {
+			tmpl.Status = xocsp.Revoked
+			tmpl.RevokedAt = *r.RevokedAt
+			tmpl.RevocationReason = xocsp.Unspecified
+		}
+		break
+	}
+
+	return xocsp.CreateResponse(p.cert, p.cert, tmpl, p.key)
+}
+
+func readIndex(dir string) (Index, error) {
+	var index Index
+
+	data, err := os.ReadFile(filepath.Join(dir, IndexFile))
+	if err != nil {
+		return index, err
+	}
+
+	err = json.Unmarshal(data, &index)
+
+	return index, err
+}
@@ -0,0 +1,400 @@
+// Management of the private PKI of the key-value storage.
+// It creates the root CA, issues server and client certificates,
+// revokes them and generates the CRL. Issued certificates are kept
+// in the index file of the PKI directory.
+
+package pki
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Files of the PKI directory, names are compatible with the server defaults
+const (
+	CACertFile = "rootCA.crt"
+	CAKeyFile  = "rootCA.key"
+	CRLFile    = "list.crl"
+	IndexFile  = "index.json"
+)
+
+// Kind of the issued certificate
+const (
+	KindServer = "server"
+	KindClient = "client"
+)
+
+// Record of the issued certificate
+type Record struct {
+	Serial    string     `json:"serial"` // hex serial number
+	Kind      string     `json:"kind"`
+	Subject   string     `json:"subject"`
+	Name      string     `json:"name"` // base name of the certificate and key files
+	NotAfter  time.Time  `json:"not_after"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Index of issued certificates
+type Index struct {
+	CRLNumber int64    `json:"crl_number"`
+	Certs     []Record `json:"certs"`
+}
+
+// PKI keeps the root CA and the index in the directory
+type PKI struct {
+	Dir   string
+	Index Index
+
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+// Server certificate request
+type ServerRequest struct {
+	Name     string   // base name of the files
+	DNSNames []string // the first DNS name is also used as CN
+	IPs      []net.IP
+	OCSPURL  string // OCSP responder put into AIA of the certificate
+	Validity time.Duration
+	Force    bool // replace existing certificate and key files of the name
+}
+
+// Client certificate request
+type ClientRequest struct {
+	Name               string // base name of the files, CN by default
+	CommonName         string
+	Organization       []string
+	OrganizationalUnit []string
+	OCSPURL            string // OCSP responder put into AIA of the certificate
+	Validity           time.Duration
+	Force              bool // replace existing certificate and key files of the name
+}
+
+// Create the root CA and an empty index in the directory
+func Init(dir, cn string, validity time.Duration) (*PKI, error) {
+	if _, err := os.Stat(filepath.Join(dir, CAKeyFile)); err == nil {
+		return nil, fmt.Errorf("CA already exists in %s", dir)
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeKeyPair(dir, "rootCA", der, key); err != nil {
+		return nil, err
+	}
+
+	p := &PKI{Dir: dir, cert: cert, key: key}
+	if err := p.save(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Load the root CA and the index from the directory
+func Load(dir string) (*PKI, error) {
+	certPEM, err := os.ReadFile(filepath.Join(dir, CACertFile))
+	if err != nil {
+		return nil, err
+	}
+
+	keyPEM, err := os.ReadFile(filepath.Join(dir, CAKeyFile))
+	if err != nil {
+		return nil, err
+	}
+
+	certBlock, _ := pem.Decode(certPEM)
+	keyBlock, _ := pem.Decode(keyPEM)
+	if certBlock == nil || keyBlock == nil {
+		return nil, fmt.Errorf("invalid PEM data of the CA")
+	}
+
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported CA key type %T", key)
+	}
+
+	p := &PKI{Dir: dir, cert: cert, key: signer}
+
+	if p.Index, err = readIndex(dir); err != nil {
+		return nil, fmt.Errorf("invalid index: %w", err)
+	}
+
+	return p, nil
+}
+
+// Certificate of the root CA
+func (p *PKI) CACert() *x509.Certificate {
+	return p.cert
+}
+
+// Issue server certificate, its certificate and key are written into the directory
+func (p *PKI) IssueServer(req ServerRequest) (Record, error) {
+	if len(req.DNSNames) == 0 && len(req.IPs) == 0 {
+		return Record{}, fmt.Errorf("server certificate requires at least one DNS name or IP address")
+	}
+
+	cn := ""
+	if len(req.DNSNames) > 0 {
+		cn = req.DNSNames[0]
+	} else {
+		cn = req.IPs[0].String()
+	}
+
+	tmpl := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: cn},
+		DNSNames:    req.DNSNames,
+		IPAddresses: req.IPs,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	return p.issue(KindServer, req.Name, tmpl, req.OCSPURL, req.Validity, req.Force)
+}
+
+// Issue client certificate, its certificate and key are written into the directory
+func (p *PKI) IssueClient(req ClientRequest) (Record, error) {
+	if req.CommonName == "" {
+		return Record{}, fmt.Errorf("client certificate requires CN")
+	}
+
+	name := req.Name
+	if name == "" {
+		name = req.CommonName
+	}
+
+	tmpl := &x509.Certificate{
+		Subject: pkix.Name{
+			CommonName:         req.CommonName,
+			Organization:       req.Organization,
+			OrganizationalUnit: req.OrganizationalUnit,
+		},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	return p.issue(KindClient, name, tmpl, req.OCSPURL, req.Validity, req.Force)
+}
+
+// Mark the certificate with the hex serial number as revoked
+// The CRL has to be regenerated to publish the revocation
+func (p *PKI) Revoke(serial string) (Record, error) {
+	for i, r := range p.Index.Certs {
+		if r.Serial != serial {
+			continue
+		}
+
+		if r.RevokedAt != nil {
+			return r, fmt.Errorf("certificate %s is already revoked", serial)
+		}
+
+		now := time.Now().UTC()
+		p.Index.Certs[i].RevokedAt = &now
+
+		return p.Index.Certs[i], p.save()
+	}
+
+	return Record{}, fmt.Errorf("certificate %s isn't found in the index", serial)
+}
+
+// Generate the CRL of revoked certificates valid for the given period
+func (p *PKI) CRL(validity time.Duration) ([]byte, error) {
+	var revoked []x509.RevocationListEntry
+
+	for _, r := range p.Index.Certs {
+		if r.RevokedAt == nil {
+			continue
+		}
+
+		serial, ok := new(big.Int).SetString(r.Serial, 16)
+		if !ok {
+			return nil, fmt.Errorf("invalid serial %s in the index", r.Serial)
+		}
+
+		revoked = append(revoked, x509.RevocationListEntry{SerialNumber: serial, RevocationTime: *r.RevokedAt})
+	}
+
+	number := p.Index.CRLNumber + 1
+
+	now := time.Now()
+	tmpl := &x509.RevocationList{
+		Number:                    big.NewInt(number),
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(validity),
+		RevokedCertificateEntries: revoked,
+	}
+
+	der, err := x509.CreateRevocationList(rand.Reader, tmpl, p.cert, p.key)
+	if err != nil {
+		return nil, err
+	}
+
+	// the number is saved before the CRL is published, so it's never reused
+	p.Index.CRLNumber = number
+	if err := p.save(); err != nil {
+		p.Index.CRLNumber--
+		return nil, err
+	}
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+	if err := writeFile(filepath.Join(p.Dir, CRLFile), data, 0644); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (p *PKI) issue(kind, name string, tmpl *x509.Certificate, ocspURL string, validity time.Duration, force bool) (Record, error) {
+	if name == "" || filepath.Base(name) != name {
+		return Record{}, fmt.Errorf("invalid certificate name %q", name)
+	}
+
+	if name == "rootCA" {
+		return Record{}, fmt.Errorf("certificate name %q is reserved", name)
+	}
+
+	if !force {
+		for _, ext := range []string{".crt", ".key"} {
+			if _, err := os.Stat(filepath.Join(p.Dir, name+ext)); err == nil {
+				return Record{}, fmt.Errorf("certificate files of %q already exist, they are replaced only if forced", name)
+			}
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return Record{}, err
+	}
+
+	if tmpl.SerialNumber, err = newSerial(); err != nil {
+		return Record{}, err
+	}
+
+	if ocspURL != "" {
+		tmpl.OCSPServer = []string{ocspURL}
+	}
+
+	now := time.Now()
+	tmpl.NotBefore = now.Add(-time.Minute)
+	tmpl.NotAfter = now.Add(validity)
+	if tmpl.NotAfter.After(p.cert.NotAfter) {
+		tmpl.NotAfter = p.cert.NotAfter
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, p.cert, key.Public(), p.key)
+	if err != nil {
+		return Record{}, err
+	}
+
+	if err := writeKeyPair(p.Dir, name, der, key); err != nil {
+		return Record{}, err
+	}
+
+	r := Record{
+		Serial:   tmpl.SerialNumber.Text(16),
+		Kind:     kind,
+		Subject:  tmpl.Subject.String(),
+		Name:     name,
+		NotAfter: tmpl.NotAfter.UTC(),
+	}
+	p.Index.Certs = append(p.Index.Certs, r)
+
+	return r, p.save()
+}
+
+// Write the index atomically
+func (p *PKI) save() error {
+	data, err := json.MarshalIndent(p.Index, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFile(filepath.Join(p.Dir, IndexFile), data, 0600)
+}
+
+// Replace the file atomically
+func writeFile(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// Write PEM-encoded certificate and PKCS#8 private key as name.crt and name.key
+func writeKeyPair(dir, name string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+
+	if err := os.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0600); err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(dir, name+".crt"), certPEM, 0644)
+}
+
+// Random 128-bit serial number
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
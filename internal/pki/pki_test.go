@@ -0,0 +1,194 @@
+package pki
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func readCert(t *testing.T, path string) *x509.Certificate {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("error reading certificate: %s\n", err)
+	}
+
+	block, _ := pem.Decode(data)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("error parsing certificate: %s\n", err)
+	}
+
+	return cert
+}
+
+func TestIssue(t *testing.T) {
+	dir := t.TempDir()
+
+	if _, err := Init(dir, "test CA", 24*time.Hour); err != nil {
+		t.Errorf("error creating CA: %s\n", err)
+		return
+	}
+
+	if _, err := Init(dir, "test CA", 24*time.Hour); err == nil {
+		t.Errorf("error creating CA: existing CA is overwritten\n")
+		return
+	}
+
+	p, err := Load(dir)
+	if err != nil {
+		t.Errorf("error loading CA: %s\n", err)
+		return
+	}
+
+	if _, err := p.IssueServer(ServerRequest{
+		Name:     "server",
+		DNSNames: []string{"localhost"},
+		IPs:      []net.IP{net.ParseIP("127.0.0.1")},
+		Validity: time.Hour,
+	}); err != nil {
+		t.Errorf("error issuing server certificate: %s\n", err)
+		return
+	}
+
+	if _, err := p.IssueClient(ClientRequest{
+		CommonName:         "alice",
+		OrganizationalUnit: []string{"payments"},
+		Validity:           time.Hour,
+	}); err != nil {
+		t.Errorf("error issuing client certificate: %s\n", err)
+		return
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(p.CACert())
+
+	server := readCert(t, filepath.Join(dir, "server.crt"))
+	if _, err := server.Verify(x509.VerifyOptions{Roots: roots, DNSName: "localhost"}); err != nil {
+		t.Errorf("error verifying server certificate: %s\n", err)
+		return
+	}
+
+	if err := server.VerifyHostname("127.0.0.1"); err != nil {
+		t.Errorf("error verifying server certificate IP: %s\n", err)
+		return
+	}
+
+	client := readCert(t, filepath.Join(dir, "alice.crt"))
+	_, err = client.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	if err != nil {
+		t.Errorf("error verifying client certificate: %s\n", err)
+		return
+	}
+
+	if client.Subject.OrganizationalUnit[0] != "payments" {
+		t.Errorf("error issuing client certificate, expected OU payments, got %v\n", client.Subject.OrganizationalUnit)
+		return
+	}
+
+	// existing files are replaced only if it's forced
+	if _, err := p.IssueClient(ClientRequest{CommonName: "alice", Validity: time.Hour}); err == nil {
+		t.Errorf("error issuing client certificate: existing files are replaced\n")
+		return
+	}
+
+	if _, err := p.IssueClient(ClientRequest{CommonName: "alice", Validity: time.Hour, Force: true}); err != nil {
+		t.Errorf("error replacing client certificate: %s\n", err)
+		return
+	}
+
+	// the index survives reloading
+	if p, err = Load(dir); err != nil || len(p.Index.Certs) != 3 {
+		t.Errorf("error loading index, expected 3 certificates, got %d, %v\n", len(p.Index.Certs), err)
+		return
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	dir := t.TempDir()
+
+	p, err := Init(dir, "test CA", 24*time.Hour)
+	if err != nil {
+		t.Errorf("error creating CA: %s\n", err)
+		return
+	}
+
+	r, err := p.IssueClient(ClientRequest{CommonName: "bob", Validity: time.Hour})
+	if err != nil {
+		t.Errorf("error issuing client certificate: %s\n", err)
+		return
+	}
+
+	if _, err := p.Revoke(r.Serial); err != nil {
+		t.Errorf("error revoking certificate: %s\n", err)
+		return
+	}
+
+	if _, err := p.Revoke(r.Serial); err == nil {
+		t.Errorf("error revoking certificate: certificate is revoked twice\n")
+		return
+	}
+
+	if _, err := p.Revoke("abc"); err == nil {
+		t.Errorf("error revoking certificate: unknown certificate is revoked\n")
+		return
+	}
+
+	if _, err := p.CRL(time.Hour); err != nil {
+		t.Errorf("error generating CRL: %s\n", err)
+		return
+	}
+
+	data, _ := os.ReadFile(filepath.Join(dir, CRLFile))
+	block, _ := pem.Decode(data)
+
+	crl, err := x509.ParseRevocationList(block.Bytes)
+	if err != nil {
+		t.Errorf("error parsing CRL: %s\n", err)
+		return
+	}
+
+	if err := crl.CheckSignatureFrom(p.CACert()); err != nil {
+		t.Errorf("error verifying CRL signature: %s\n", err)
+		return
+	}
+
+	if len(crl.RevokedCertificateEntries) != 1 || crl.RevokedCertificateEntries[0].SerialNumber.Text(16) != r.Serial {
+		t.Errorf("error generating CRL, expected revoked %s, got %v\n", r.Serial, crl.RevokedCertificateEntries)
+		return
+	}
+}
+
+func TestCRLSaveFailure(t *testing.T) {
+	dir := t.TempDir()
+
+	p, err := Init(dir, "test CA", 24*time.Hour)
+	if err != nil {
+		t.Errorf("error creating CA: %s\n", err)
+		return
+	}
+
+	// the index can't be replaced
+	if err := os.Mkdir(filepath.Join(dir, IndexFile+".tmp"), 0700); err != nil {
+		t.Errorf("error creating directory: %s\n", err)
+		return
+	}
+
+	if _, err := p.CRL(time.Hour); err == nil {
+		t.Errorf("error generating CRL: index isn't saved, but there is no error\n")
+		return
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, CRLFile)); !os.IsNotExist(err) {
+		t.Errorf("error generating CRL: CRL is written without saving its number, %v\n", err)
+		return
+	}
+
+	if p.Index.CRLNumber != 0 {
+		t.Errorf("error generating CRL: expected CRL number 0, got %d\n", p.Index.CRLNumber)
+		return
+	}
+}
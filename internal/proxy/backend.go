@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/arsenalzp/keyvalstore/internal/server/replication"
+	entity "github.com/arsenalzp/keyvalstore/internal/server/storage/entity"
+)
+
+const maxIdleConns = 16 // idle connections kept per backend
+
+// Connects to the backend server
+type Dialer func(ctx context.Context, addr string) (net.Conn, error)
+
+// Connection to the backend server
+type conn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// Backend server of the shard, connections are reused by sequential requests
+type Backend struct {
+	Name string
+	Addr string
+
+	dial Dialer
+	idle chan *conn
+}
+
+func newBackend(name, addr string, dial Dialer) *Backend {
+	return &Backend{Name: name, Addr: addr, dial: dial, idle: make(chan *conn, maxIdleConns)}
+}
+
+// Send the request and read the response of the backend, the request is
+// retried by a new connection if the idle one is closed by the server
+func (b *Backend) Do(ctx context.Context, req []byte) ([]byte, error) {
+	for {
+		c, reused, err := b.get(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := b.roundTrip(ctx, c, req)
+		if err == nil {
+			b.put(c)
+			return resp, nil
+		}
+
+		c.Close()
+		if !reused || ctx.Err() != nil {
+			return nil, err
+		}
+	}
+}
+
+// Get snapshot of the whole backend storage by the replication stream,
+// secret keys are included and flagged
+func (b *Backend) Snapshot(ctx context.Context) ([]entity.ExportData, error) {
+	c, err := b.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	req := make([]byte, messageSize)
+	copy(req[0:3], "rep")
+	req[messageSize-1] = EOT
+
+	resp, err := b.roundTrip(ctx, c, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp[0] == NOK {
+		return nil, fmt.Errorf("backend error: %s", strings.TrimRight(string(resp[1:]), "\x00\u0004"))
+	}
+
+	var frame replication.Frame
+	if err := json.Unmarshal(resp[1:len(resp)-1], &frame); err != nil {
+		return nil, err
+	}
+
+	return frame.Data, nil
+}
+
+func (b *Backend) roundTrip(ctx context.Context, c *conn, req []byte) ([]byte, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	} else {
+		c.SetDeadline(time.Time{})
+	}
+
+	if _, err := c.Write(req); err != nil {
+		return nil, err
+	}
+
+	return c.reader.ReadBytes(EOT)
+}
+
+// Get the idle connection or dial the new one
+func (b *Backend) get(ctx context.Context) (*conn, bool, error) {
+	select {
+	case c := <-b.idle:
+		return c, true, nil
+	default:
+	}
+
+	c, err := b.connect(ctx)
+	return c, false, err
+}
+
+func (b *Backend) connect(ctx context.Context) (*conn, error) {
+	c, err := b.dial(ctx, b.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &conn{Conn: c, reader: bufio.NewReader(c)}, nil
+}
+
+func (b *Backend) put(c *conn) {
+	select {
+	case b.idle <- c:
+	default:
+		c.Close()
+	}
+}
+
+// Close idle connections
+func (b *Backend) Close() {
+	for {
+		select {
+		case c := <-b.idle:
+			c.Close()
+		default:
+			return
+		}
+	}
+}
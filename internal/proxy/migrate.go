@@ -0,0 +1,251 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/arsenalzp/keyvalstore/go-client/ring"
+	"github.com/arsenalzp/keyvalstore/internal/server/errors"
+	"github.com/arsenalzp/keyvalstore/internal/server/metrics"
+	entity "github.com/arsenalzp/keyvalstore/internal/server/storage/entity"
+)
+
+const (
+	defaultRetry   = 5 * time.Second // delay of retrying failed migration
+	migrationBatch = 100             // number of keys moved by a single import
+)
+
+// Status of moving keys to the new shard
+type MigrationStatus struct {
+	Shard    string     `json:"shard"`
+	Running  bool       `json:"running"`
+	Moved    int        `json:"moved"` // number of keys moved to the shard
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Error    string     `json:"error,omitempty"` // the last error, the migration is retried after it
+}
+
+// Migration of keys taken over by the new shard
+type migration struct {
+	shard  *Backend
+	target *ring.Ring // ring including the new shard
+
+	// keys written by clients while moving, they aren't copied
+	// by the migration; it's guarded by the moving lock
+	touched map[string]bool
+}
+
+// Add the shard and move keys it takes over from other shards in background
+// Clients are served while moving: keys are read from the new owner, then
+// from the previous one; writes go to the new owner. Only one shard is added at once
+func (p *Proxy) AddShard(shard Shard) error {
+	if shard.Name == "" || shard.Addr == "" {
+		return errors.New("shard name and address are required", errors.ProxyShardErr, nil)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.mig != nil {
+		return errors.New("migration to shard "+p.mig.shard.Name+" is in progress", errors.MigrationErr, nil)
+	}
+
+	if _, ok := p.backends[shard.Name]; ok {
+		return errors.New("shard "+shard.Name+" already exists", errors.ProxyShardErr, nil)
+	}
+
+	mig := &migration{
+		shard:   newBackend(shard.Name, shard.Addr, p.dial),
+		target:  p.ring.Clone(),
+		touched: make(map[string]bool),
+	}
+	mig.target.Add(shard.Name)
+
+	p.backends[shard.Name] = mig.shard
+	p.mig = mig
+	p.status = MigrationStatus{Shard: shard.Name, Running: true, Started: time.Now()}
+
+	sources := make([]*Backend, 0, len(p.shards))
+	for _, s := range p.shards {
+		sources = append(sources, p.backends[s.Name])
+	}
+
+	go p.migrate(context.Background(), mig, sources, shard)
+
+	slog.Info("adding shard", "shard", shard.Name, "addr", shard.Addr)
+
+	return nil
+}
+
+// Get shards and status of the last migration
+func (p *Proxy) Shards() ([]Shard, MigrationStatus) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return append([]Shard(nil), p.shards...), p.status
+}
+
+// Move keys until all of them are moved, the ring is replaced after that
+func (p *Proxy) migrate(ctx context.Context, mig *migration, sources []*Backend, shard Shard) {
+	// requests routed by the previous ring are finished before reading the shards
+	p.inflight.Lock()
+	p.inflight.Unlock()
+
+	retry := p.Retry
+	if retry <= 0 {
+		retry = defaultRetry
+	}
+
+	for _, src := range sources {
+		for {
+			err := p.moveKeys(ctx, mig, src)
+			if err == nil {
+				break
+			}
+
+			err = errors.New("migration error", errors.MigrationErr, err)
+			slog.Error("unable to move keys", "shard", shard.Name, "source", src.Name, "error", err, "code", errors.Code(err))
+
+			p.mu.Lock()
+			p.status.Error = err.Error()
+			p.mu.Unlock()
+
+			time.Sleep(retry)
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	finished := time.Now()
+	p.ring = mig.target
+	p.shards = append(p.shards, shard)
+	p.mig = nil
+	p.status.Running = false
+	p.status.Finished = &finished
+	p.status.Error = ""
+
+	slog.Info("shard added", "shard", shard.Name, "moved", p.status.Moved)
+}
+
+// Move keys taken over by the new shard from the source shard, keys written
+// by clients in the meantime are only deleted from the source
+func (p *Proxy) moveKeys(ctx context.Context, mig *migration, src *Backend) error {
+	snapCtx, cancel := context.WithTimeout(ctx, 10*p.timeout())
+	data, err := src.Snapshot(snapCtx)
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	var keys []entity.ImportData
+	for _, item := range data {
+		if mig.target.Get(item.Key) == mig.shard.Name {
+			keys = append(keys, entity.ImportData(item))
+		}
+	}
+
+	for start := 0; start < len(keys); start += migrationBatch {
+		if err := p.moveBatch(ctx, mig, src, keys[start:min(start+migrationBatch, len(keys))]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *Proxy) moveBatch(ctx context.Context, mig *migration, src *Backend, batch []entity.ImportData) error {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout())
+	defer cancel()
+
+	p.moving.Lock()
+	defer p.moving.Unlock()
+
+	var items []entity.ImportData
+	for _, item := range batch {
+		if !mig.touched[item.Key] {
+			items = append(items, item)
+		}
+	}
+
+	// secret keys are imported as secret by their flag
+	if len(items) > 0 {
+		if err := checkResponse(p.call(ctx, mig.shard, importRequest(items))); err != nil {
+			return err
+		}
+	}
+
+	for _, item := range batch {
+		if err := checkResponse(p.call(ctx, src, deleteRequest(item.Key))); err != nil {
+			return err
+		}
+	}
+
+	metrics.MigratedKeys.Add(float64(len(items)))
+
+	p.mu.Lock()
+	p.status.Moved += len(items)
+	p.mu.Unlock()
+
+	return nil
+}
+
+// Admin handler of shards:
+// GET /shards reports shards and status of the last migration,
+// POST /shards adds the shard sent in JSON
+func (p *Proxy) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		code := http.StatusOK
+
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var shard Shard
+			if err := json.NewDecoder(r.Body).Decode(&shard); err != nil {
+				http.Error(w, "invalid shard: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			if err := p.AddShard(shard); err != nil {
+				status := http.StatusBadRequest
+				if errors.Code(err) == errors.MigrationErr {
+					status = http.StatusConflict
+				}
+
+				http.Error(w, err.Error(), status)
+				return
+			}
+
+			code = http.StatusAccepted
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		shards, status := p.Shards()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(struct {
+			Shards    []Shard         `json:"shards"`
+			Migration MigrationStatus `json:"migration"`
+		}{shards, status})
+	})
+}
+
+// Error of the failed request or the error response of the backend
+func checkResponse(resp []byte, err error) error {
+	if err != nil {
+		return err
+	}
+
+	if resp[0] == NOK {
+		return errors.New(string(bytes.TrimRight(resp[1:], "\x00\u0004")), errors.ProxyBackendErr, nil)
+	}
+
+	return nil
+}
@@ -0,0 +1,588 @@
+// Sharding proxy of keyvalstore servers.
+// Keys are distributed over shards by the consistent-hash ring: GET, SET,
+// SEC and DEL are routed to the shard owning the key, EXP is fanned out to
+// all shards and IMP is split by owners of the imported keys. Shards see
+// the proxy certificate only, so permissions of clients are checked by the proxy.
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arsenalzp/keyvalstore/go-client/ring"
+	"github.com/arsenalzp/keyvalstore/internal/server/acl"
+	"github.com/arsenalzp/keyvalstore/internal/server/errors"
+	"github.com/arsenalzp/keyvalstore/internal/server/identity"
+	"github.com/arsenalzp/keyvalstore/internal/server/metrics"
+	"github.com/arsenalzp/keyvalstore/internal/server/storage/counter"
+	entity "github.com/arsenalzp/keyvalstore/internal/server/storage/entity"
+)
+
+const (
+	EOT = '\u0004' // End-Of-Transmission character
+	OK  = 'O'
+	NOK = 'N'
+
+	DefaultTimeout = 10 * time.Second // default timeout of a request
+
+	messageSize = 772
+	statusOK    = "ok"
+	statusErr   = "error"
+)
+
+// default number of virtual nodes of a shard on the ring
+const DefaultVNodes = ring.DefaultVNodes
+
+// Permissions of commands, keys of export and import are checked by the commands
+var permissions = map[string]acl.Permission{
+	"get": acl.Read,
+	"set": acl.Write,
+	"sec": acl.Write,
+	"del": acl.Delete,
+	"inc": acl.Write,
+	"exp": acl.Export,
+	"imp": acl.Import,
+}
+
+// Shard served by the backend server
+type Shard struct {
+	Name string `json:"name"`
+	Addr string `json:"addr"`
+}
+
+// Parse comma-separated shards in "name=host:port" format
+func ParseShards(spec string) ([]Shard, error) {
+	var shards []Shard
+
+	for _, item := range strings.Split(spec, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+
+		name, addr, ok := strings.Cut(item, "=")
+		if !ok || name == "" || addr == "" {
+			return nil, errors.New("invalid shard "+item, errors.ProxyShardErr, nil)
+		}
+
+		shards = append(shards, Shard{Name: name, Addr: addr})
+	}
+
+	return shards, nil
+}
+
+// Proxy routing requests of clients to shards
+type Proxy struct {
+	Timeout     time.Duration // default timeout of a request, DefaultTimeout if zero
+	IdleTimeout time.Duration // close connection if no request is received within the timeout
+	Retry       time.Duration // delay of retrying failed migration, 5s if zero
+	ACL         *acl.Policy   // permissions of client certificates, all commands are allowed if nil
+
+	dial Dialer
+
+	mu       sync.RWMutex
+	ring     *ring.Ring
+	shards   []Shard // shards in order of adding
+	backends map[string]*Backend
+	mig      *migration      // migration to the new shard, nil if keys aren't moving
+	status   MigrationStatus // status of the last migration
+
+	// serializes requests on keys moving to the new shard with the migration
+	moving sync.Mutex
+
+	// held by every request, the migration waits for requests routed
+	// before it's started
+	inflight sync.RWMutex
+}
+
+// Create the proxy of shards, backends are connected by the dialer
+func New(shards []Shard, vnodes int, dial Dialer) (*Proxy, error) {
+	if len(shards) == 0 {
+		return nil, errors.New("shards are undefined", errors.ProxyShardErr, nil)
+	}
+
+	p := &Proxy{dial: dial, ring: ring.New(vnodes), backends: make(map[string]*Backend)}
+	for _, shard := range shards {
+		if _, ok := p.backends[shard.Name]; ok {
+			return nil, errors.New("duplicate shard "+shard.Name, errors.ProxyShardErr, nil)
+		}
+
+		p.ring.Add(shard.Name)
+		p.shards = append(p.shards, shard)
+		p.backends[shard.Name] = newBackend(shard.Name, shard.Addr, dial)
+	}
+
+	return p, nil
+}
+
+// Handle requests of the client connection until it's closed
+func (p *Proxy) HandleCon(ctx context.Context, con net.Conn) {
+	defer con.Close()
+
+	log := slog.Default().With("remote_addr", con.RemoteAddr().String())
+	reader := bufio.NewReader(con)
+	timeout := p.timeout()
+	id, _ := identity.FromConn(con)
+
+	for {
+		if p.IdleTimeout > 0 {
+			con.SetReadDeadline(time.Now().Add(p.IdleTimeout))
+		}
+
+		req, err := reader.ReadBytes(EOT)
+		if err != nil {
+			if err != io.EOF {
+				log.Debug("closing client connection", "error", err)
+			}
+			return
+		}
+
+		start := time.Now()
+
+		var cmd string
+		var resp []byte
+		switch {
+		case len(req) < 4:
+			err = errors.New("invalid request", errors.ProxyCmdErr, nil)
+		case string(req[0:3]) == "tmo":
+			cmd = "tmo"
+			timeout, err = p.readTimeout(req)
+			resp = []byte{OK, EOT}
+		default:
+			cmd = string(req[0:3])
+			if err = p.authorize(id, cmd, req); err != nil {
+				break
+			}
+
+			opCtx, cancel := context.WithTimeout(ctx, timeout)
+			p.inflight.RLock()
+			resp, err = p.exec(opCtx, id, cmd, req)
+			p.inflight.RUnlock()
+			cancel()
+		}
+
+		if err != nil {
+			resp = writeError(err)
+		}
+
+		if _, werr := con.Write(resp); werr != nil {
+			log.Warn("unable to send response", "command", cmd, "error", werr)
+			return
+		}
+
+		logRequest(log, cmd, start, resp, err)
+	}
+}
+
+// Check permission of the client to run the command
+func (p *Proxy) authorize(id identity.Identity, cmd string, req []byte) error {
+	perm, ok := permissions[cmd]
+	if p.ACL == nil || !ok {
+		return nil
+	}
+
+	if cmd == "exp" || cmd == "imp" {
+		if !p.ACL.Granted(id, perm) {
+			return acl.Denied(perm)
+		}
+		return nil
+	}
+
+	return p.ACL.Check(id, perm, readKey(req))
+}
+
+// Check permission of the client on the key
+func (p *Proxy) allowed(id identity.Identity, perm acl.Permission, key string) bool {
+	return p.ACL == nil || p.ACL.Allowed(id, perm, key)
+}
+
+// Execute the command, responses of backends are returned as is
+func (p *Proxy) exec(ctx context.Context, id identity.Identity, cmd string, req []byte) ([]byte, error) {
+	switch cmd {
+	case "get":
+		return p.get(ctx, req)
+	case "set", "sec":
+		return p.set(ctx, req)
+	case "del":
+		return p.del(ctx, req)
+	case "inc":
+		return p.inc(ctx, req)
+	case "exp":
+		return p.exp(ctx, id)
+	case "imp":
+		return p.imp(ctx, id, req)
+	case "png":
+		return p.ping(ctx)
+	}
+
+	return nil, errors.New("command isn't supported by proxy", errors.ProxyCmdErr, nil)
+}
+
+// Keys moving to the new shard are read from the previous owner until they are moved
+func (p *Proxy) get(ctx context.Context, req []byte) ([]byte, error) {
+	owner, prev, _ := p.route(readKey(req))
+	if prev == nil {
+		return p.call(ctx, owner, req)
+	}
+
+	p.moving.Lock()
+	defer p.moving.Unlock()
+
+	resp, err := p.call(ctx, owner, req)
+	if err != nil || resp[0] == NOK || len(bytes.Trim(resp[1:], "\x00\u0004")) > 0 {
+		return resp, err
+	}
+
+	return p.call(ctx, prev, req)
+}
+
+// Keys moving to the new shard are written to the new owner and removed from the previous one
+func (p *Proxy) set(ctx context.Context, req []byte) ([]byte, error) {
+	key := readKey(req)
+
+	owner, prev, mig := p.route(key)
+	if prev == nil {
+		return p.call(ctx, owner, req)
+	}
+
+	p.moving.Lock()
+	defer p.moving.Unlock()
+
+	resp, err := p.call(ctx, owner, req)
+	if err != nil || resp[0] == NOK {
+		return resp, err
+	}
+
+	p.forget(ctx, mig, prev, key)
+
+	return resp, nil
+}
+
+// Keys moving to the new shard are deleted from both owners
+func (p *Proxy) del(ctx context.Context, req []byte) ([]byte, error) {
+	key := readKey(req)
+
+	owner, prev, mig := p.route(key)
+	if prev == nil {
+		return p.call(ctx, owner, req)
+	}
+
+	p.moving.Lock()
+	defer p.moving.Unlock()
+
+	resp, err := p.call(ctx, owner, req)
+	if err != nil || resp[0] == NOK {
+		return resp, err
+	}
+
+	p.forget(ctx, mig, prev, key)
+
+	return resp, nil
+}
+
+// Counters moving to the new shard are copied to the new owner before they are changed
+// and removed from the previous one
+func (p *Proxy) inc(ctx context.Context, req []byte) ([]byte, error) {
+	key := readKey(req)
+
+	owner, prev, mig := p.route(key)
+	if prev == nil {
+		return p.call(ctx, owner, req)
+	}
+
+	p.moving.Lock()
+	defer p.moving.Unlock()
+
+	resp, err := p.call(ctx, prev, getRequest(key))
+	if err != nil || resp[0] == NOK {
+		return resp, err
+	}
+
+	// secret values are unmarked by GET, so only counters are copied
+	if value := string(bytes.Trim(resp[1:], "\x00\u0004")); value != "" {
+		if _, err := counter.Parse(value); err != nil {
+			return nil, err
+		}
+
+		if err := checkResponse(p.call(ctx, owner, importRequest([]entity.ImportData{{Key: key, Value: value}}))); err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err = p.call(ctx, owner, req)
+	if err != nil || resp[0] == NOK {
+		return resp, err
+	}
+
+	p.forget(ctx, mig, prev, key)
+
+	return resp, nil
+}
+
+// Export of all shards, the key found on several shards while migrating
+// is taken from its owner; keys aren't exported unless they are permitted
+// to the client
+func (p *Proxy) exp(ctx context.Context, id identity.Identity) ([]byte, error) {
+	backends := p.all()
+
+	resps := make([][]byte, len(backends))
+	errs := make([]error, len(backends))
+
+	var wg sync.WaitGroup
+	for i, b := range backends {
+		wg.Add(1)
+		go func(i int, b *Backend) {
+			defer wg.Done()
+			resps[i], errs[i] = p.call(ctx, b, []byte{'e', 'x', 'p', EOT})
+		}(i, b)
+	}
+	wg.Wait()
+
+	items := make([]entity.ExportData, 0)
+	index := make(map[string]int)
+
+	for i, b := range backends {
+		if errs[i] != nil || resps[i][0] == NOK {
+			return resps[i], errs[i]
+		}
+
+		var data []entity.ExportData
+		if err := json.Unmarshal(bytes.TrimRight(resps[i][1:], "\x00\u0004"), &data); err != nil {
+			return nil, errors.New("invalid export of shard "+b.Name, errors.ProxyBackendErr, err)
+		}
+
+		for _, item := range data {
+			if !p.allowed(id, acl.Export, item.Key) || (item.Secret && !p.allowed(id, acl.ExportSecrets, item.Key)) {
+				continue
+			}
+
+			j, ok := index[item.Key]
+			if !ok {
+				index[item.Key] = len(items)
+				items = append(items, item)
+				continue
+			}
+
+			if owner, _, _ := p.route(item.Key); owner == b {
+				items[j] = item
+			}
+		}
+	}
+
+	data, err := json.Marshal(items)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(append([]byte{OK}, data...), EOT), nil
+}
+
+// Import split by owners of keys, the import isn't atomic across shards;
+// it's rejected if any key isn't permitted to the client
+func (p *Proxy) imp(ctx context.Context, id identity.Identity, req []byte) ([]byte, error) {
+	var items []entity.ImportData
+	if err := json.Unmarshal(bytes.TrimRight(req[3:], "\u0004"), &items); err != nil {
+		return nil, errors.New("invalid import", errors.ImportErr, err)
+	}
+
+	for _, item := range items {
+		if !p.allowed(id, acl.Import, item.Key) {
+			return nil, acl.Denied(acl.Import)
+		}
+	}
+
+	groups := make(map[*Backend][]entity.ImportData)
+	moved := make(map[*Backend][]string) // previous owners of moving keys
+
+	var mig *migration
+	for _, item := range items {
+		owner, prev, m := p.route(item.Key)
+
+		groups[owner] = append(groups[owner], item)
+		if prev != nil {
+			moved[prev] = append(moved[prev], item.Key)
+			mig = m
+		}
+	}
+
+	if len(moved) > 0 {
+		p.moving.Lock()
+		defer p.moving.Unlock()
+	}
+
+	for b, group := range groups {
+		resp, err := p.call(ctx, b, importRequest(group))
+		if err != nil || resp[0] == NOK {
+			return resp, err
+		}
+	}
+
+	for prev, keys := range moved {
+		for _, key := range keys {
+			p.forget(ctx, mig, prev, key)
+		}
+	}
+
+	return []byte{OK, EOT}, nil
+}
+
+// Ping all shards
+func (p *Proxy) ping(ctx context.Context) ([]byte, error) {
+	req := make([]byte, messageSize)
+	copy(req, "png")
+	req[messageSize-1] = EOT
+
+	for _, b := range p.all() {
+		resp, err := p.call(ctx, b, req)
+		if err != nil || resp[0] == NOK {
+			return resp, err
+		}
+	}
+
+	return append(append([]byte{OK}, "PONG"...), EOT), nil
+}
+
+// Get owner of the key and its previous owner if the key is moving
+// to the new shard, the previous owner is nil otherwise
+func (p *Proxy) route(key string) (*Backend, *Backend, *migration) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	owner := p.ring.Get(key)
+	if p.mig != nil {
+		if target := p.mig.target.Get(key); target != owner {
+			return p.backends[target], p.backends[owner], p.mig
+		}
+	}
+
+	return p.backends[owner], nil, nil
+}
+
+// Delete the moved key from its previous owner and exclude it from the migration
+// It's called with the moving lock held
+func (p *Proxy) forget(ctx context.Context, mig *migration, prev *Backend, key string) {
+	mig.touched[key] = true
+
+	if resp, err := p.call(ctx, prev, deleteRequest(key)); err != nil || resp[0] == NOK {
+		slog.Warn("unable to delete moved key from previous shard", "shard", prev.Name, "error", err)
+	}
+}
+
+// Backends of all shards including the shard being added
+func (p *Proxy) all() []*Backend {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	backends := make([]*Backend, 0, len(p.backends))
+	for _, b := range p.backends {
+		backends = append(backends, b)
+	}
+
+	return backends
+}
+
+func (p *Proxy) call(ctx context.Context, b *Backend, req []byte) ([]byte, error) {
+	resp, err := b.Do(ctx, req)
+	if err != nil {
+		metrics.ProxyRequests.Inc(b.Name, statusErr)
+		return nil, errors.New("shard "+b.Name+" is unavailable", errors.ProxyBackendErr, err)
+	}
+
+	metrics.ProxyRequests.Inc(b.Name, statusOK)
+
+	return resp, nil
+}
+
+func (p *Proxy) timeout() time.Duration {
+	if p.Timeout > 0 {
+		return p.Timeout
+	}
+
+	return DefaultTimeout
+}
+
+// Read client-supplied timeout of requests in milliseconds,
+// zero timeout resets it to the default one
+func (p *Proxy) readTimeout(req []byte) (time.Duration, error) {
+	ms, err := strconv.ParseUint(readKey(req), 10, 32)
+	if err != nil {
+		return p.timeout(), errors.New("invalid timeout", errors.InvalidTimeoutErr, err)
+	}
+
+	if ms == 0 {
+		return p.timeout(), nil
+	}
+
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+func readKey(req []byte) string {
+	if len(req) < messageSize {
+		return ""
+	}
+
+	return string(bytes.Trim(req[3:259], "\x00"))
+}
+
+func getRequest(key string) []byte {
+	req := make([]byte, messageSize)
+	copy(req[0:3], "get")
+	copy(req[3:259], key)
+	req[messageSize-1] = EOT
+
+	return req
+}
+
+func deleteRequest(key string) []byte {
+	req := make([]byte, messageSize)
+	copy(req[0:3], "del")
+	copy(req[3:259], key)
+	req[messageSize-1] = EOT
+
+	return req
+}
+
+func importRequest(items []entity.ImportData) []byte {
+	data, _ := json.Marshal(items)
+	return append(append([]byte("imp"), data...), EOT)
+}
+
+func writeError(err error) []byte {
+	resp := make([]byte, 64)
+	resp[0] = NOK
+	copy(resp[1:63], err.Error())
+	resp[63] = EOT
+
+	return resp
+}
+
+// Write request log record, keys and values aren't logged
+func logRequest(log *slog.Logger, cmd string, start time.Time, resp []byte, err error) {
+	status := statusOK
+	if err != nil || resp[0] == NOK {
+		status = statusErr
+	}
+
+	attrs := []slog.Attr{
+		slog.String("command", cmd),
+		slog.Duration("duration", time.Since(start)),
+		slog.String("status", status),
+	}
+
+	if err != nil {
+		attrs = append(attrs, slog.String("code", errors.Code(err)), slog.String("error", err.Error()))
+		log.LogAttrs(context.Background(), slog.LevelWarn, "request failed", attrs...)
+		return
+	}
+
+	log.LogAttrs(context.Background(), slog.LevelInfo, "request", attrs...)
+}
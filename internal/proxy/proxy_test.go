@@ -0,0 +1,411 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arsenalzp/keyvalstore/go-client/ring"
+	"github.com/arsenalzp/keyvalstore/internal/server/acl"
+	"github.com/arsenalzp/keyvalstore/internal/server/errors"
+	"github.com/arsenalzp/keyvalstore/internal/server/handler"
+	"github.com/arsenalzp/keyvalstore/internal/server/storage/changelog"
+	entity "github.com/arsenalzp/keyvalstore/internal/server/storage/entity"
+	ht "github.com/arsenalzp/keyvalstore/internal/server/storage/hash-table"
+)
+
+// Create storages of the shards, they are served over in-memory connections
+// by the dialer, the shard address is its name
+func newShards(names ...string) (map[string]*changelog.Storage, Dialer) {
+	storages := make(map[string]*changelog.Storage)
+	for _, name := range names {
+		s, _ := ht.NewHT()
+		storages[name] = changelog.New(s, 0)
+	}
+
+	// the proxy is granted all permissions, net.Pipe has no client
+	// certificate, so the identity is empty
+	policy := acl.New(acl.Config{Rules: []acl.Rule{
+		{Identities: []string{"*"}, Prefixes: []string{""}, Permissions: []acl.Permission{acl.Admin}},
+	}})
+
+	dial := func(ctx context.Context, addr string) (net.Conn, error) {
+		s, ok := storages[addr]
+		if !ok {
+			return nil, fmt.Errorf("unknown shard %s", addr)
+		}
+
+		client, server := net.Pipe()
+		go (&handler.ConnHandler{Changes: s, Replication: true, ACL: policy}).HandleCon(context.Background(), server, s)
+
+		return client, nil
+	}
+
+	return storages, dial
+}
+
+// Client connection to the proxy
+type client struct {
+	con    net.Conn
+	reader *bufio.Reader
+}
+
+func connect(p *Proxy) *client {
+	con, server := net.Pipe()
+	go p.HandleCon(context.Background(), server)
+
+	return &client{con: con, reader: bufio.NewReader(con)}
+}
+
+func (c *client) do(t *testing.T, req []byte) []byte {
+	if _, err := c.con.Write(req); err != nil {
+		t.Fatalf("error sending request: %s\n", err)
+	}
+
+	resp, err := c.reader.ReadBytes(EOT)
+	if err != nil {
+		t.Fatalf("error reading response: %s\n", err)
+	}
+
+	return resp
+}
+
+func (c *client) get(t *testing.T, key string) string {
+	resp := c.do(t, request("get", key, ""))
+	if resp[0] != OK {
+		t.Fatalf("error getting key %s: %s\n", key, resp)
+	}
+
+	return string(bytes.Trim(resp[1:], "\x00\u0004"))
+}
+
+func (c *client) set(t *testing.T, cmd, key, value string) {
+	if resp := c.do(t, request(cmd, key, value)); resp[0] != OK {
+		t.Fatalf("error setting key %s: %s\n", key, resp)
+	}
+}
+
+func (c *client) export(t *testing.T) []entity.ExportData {
+	resp := c.do(t, []byte{'e', 'x', 'p', EOT})
+	if resp[0] != OK {
+		t.Fatalf("error exporting keys: %s\n", resp)
+	}
+
+	var data []entity.ExportData
+	if err := json.Unmarshal(bytes.TrimRight(resp[1:], "\x00\u0004"), &data); err != nil {
+		t.Fatalf("error decoding export: %s\n", err)
+	}
+
+	return data
+}
+
+func request(cmd, key, value string) []byte {
+	req := make([]byte, messageSize)
+	copy(req[0:3], cmd)
+	copy(req[3:259], key)
+	copy(req[259:771], value)
+	req[messageSize-1] = EOT
+
+	return req
+}
+
+// Check the key is stored by its owner only
+func checkPlacement(t *testing.T, storages map[string]*changelog.Storage, r *ring.Ring, key, value string) bool {
+	ctx := context.Background()
+	owner := r.Get(key)
+
+	for name, s := range storages {
+		v, _ := s.Search(ctx, key)
+		if name == owner && v != value {
+			t.Errorf("error storing key %s, shard %s has %q, expected %q\n", key, name, v, value)
+			return false
+		}
+
+		if name != owner && v != "" {
+			t.Errorf("error storing key %s, it's found on shard %s, owner is %s\n", key, name, owner)
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestProxy(t *testing.T) {
+	storages, dial := newShards("a", "b")
+
+	p, err := New([]Shard{{Name: "a", Addr: "a"}, {Name: "b", Addr: "b"}}, DefaultVNodes, dial)
+	if err != nil {
+		t.Errorf("error creating proxy: %s\n", err)
+		return
+	}
+
+	c := connect(p)
+
+	for i := 0; i < 100; i++ {
+		c.set(t, "set", "key"+fmt.Sprint(i), "val"+fmt.Sprint(i))
+	}
+
+	for i := 0; i < 100; i++ {
+		key, value := "key"+fmt.Sprint(i), "val"+fmt.Sprint(i)
+		if v := c.get(t, key); v != value {
+			t.Errorf("error getting key %s, got %q, expected %q\n", key, v, value)
+			return
+		}
+
+		if !checkPlacement(t, storages, p.ring, key, value) {
+			return
+		}
+	}
+
+	// both shards own some keys
+	for name, s := range storages {
+		if data, _ := s.Export(context.Background()); len(data) == 0 {
+			t.Errorf("error routing keys, shard %s has no keys\n", name)
+			return
+		}
+	}
+
+	if resp := c.do(t, request("del", "key0", "")); resp[0] != OK {
+		t.Errorf("error deleting key: %s\n", resp)
+		return
+	}
+
+	if v := c.get(t, "key0"); v != "" {
+		t.Errorf("error deleting key, got %q\n", v)
+		return
+	}
+
+	// import is split by owners of keys
+	var items []entity.ImportData
+	for i := 100; i < 150; i++ {
+		items = append(items, entity.ImportData{Key: "key" + fmt.Sprint(i), Value: "val" + fmt.Sprint(i)})
+	}
+
+	if resp := c.do(t, importRequest(items)); resp[0] != OK {
+		t.Errorf("error importing keys: %s\n", resp)
+		return
+	}
+
+	for _, item := range items {
+		if !checkPlacement(t, storages, p.ring, item.Key, item.Value) {
+			return
+		}
+	}
+
+	// export is merged from all shards
+	if data := c.export(t); len(data) != 149 {
+		t.Errorf("error exporting keys, got %d keys, expected 149\n", len(data))
+		return
+	}
+
+	// counters are changed by their owners
+	for _, want := range []string{"5", "10"} {
+		if resp := c.do(t, request("inc", "counter", "5")); string(resp) != "O"+want+"\u0004" {
+			t.Errorf("error incrementing counter, got %q, expected %s\n", resp, want)
+			return
+		}
+	}
+
+	if !checkPlacement(t, storages, p.ring, "counter", "10") {
+		return
+	}
+
+	if resp := c.do(t, request("png", "", "")); string(resp) != "OPONG\u0004" {
+		t.Errorf("error pinging shards, got %q\n", resp)
+		return
+	}
+
+	if resp := c.do(t, request("rep", "", "")); resp[0] != NOK || !bytes.Contains(resp, []byte(errors.ProxyCmdErr)) {
+		t.Errorf("error rejecting unsupported command, got %q\n", resp)
+		return
+	}
+}
+
+func TestProxyACL(t *testing.T) {
+	_, dial := newShards("s1", "s2")
+
+	p, err := New([]Shard{{Name: "s1", Addr: "s1"}, {Name: "s2", Addr: "s2"}}, DefaultVNodes, dial)
+	if err != nil {
+		t.Fatalf("error creating proxy: %s\n", err)
+	}
+
+	c := connect(p)
+	defer c.con.Close()
+
+	c.set(t, "set", "public/1", "v1")
+	c.set(t, "set", "private/1", "v2")
+
+	// net.Pipe has no client certificate, so the identity is empty
+	p.ACL = acl.New(acl.Config{Rules: []acl.Rule{
+		{Identities: []string{"*"}, Prefixes: []string{"public/"}, Permissions: []acl.Permission{acl.Read, acl.Write, acl.Export}},
+	}})
+
+	for _, tc := range []struct {
+		req    []byte
+		status byte
+	}{
+		{request("get", "public/1", ""), OK},
+		{request("get", "private/1", ""), NOK},
+		{request("set", "private/1", "v3"), NOK},
+		{request("del", "public/1", ""), NOK},
+		{append([]byte(`imp[{"key":"public/2","value":"v4"}]`), EOT), NOK},
+		{[]byte{'g', EOT}, NOK},
+	} {
+		if resp := c.do(t, tc.req); resp[0] != tc.status {
+			t.Errorf("error checking %q, expected status %c, got %s\n", tc.req[:3], tc.status, resp)
+		}
+	}
+
+	// only permitted keys are exported
+	if data := c.export(t); len(data) != 1 || data[0].Key != "public/1" {
+		t.Errorf("error exporting permitted keys, got %+v\n", data)
+	}
+}
+
+func TestAddShard(t *testing.T) {
+	storages, dial := newShards("a", "b", "c")
+
+	p, err := New([]Shard{{Name: "a", Addr: "a"}, {Name: "b", Addr: "b"}}, DefaultVNodes, dial)
+	if err != nil {
+		t.Errorf("error creating proxy: %s\n", err)
+		return
+	}
+	p.Retry = 10 * time.Millisecond
+
+	c := connect(p)
+
+	expected := make(map[string]string)
+
+	var items []entity.ImportData
+	for i := 0; i < 300; i++ {
+		key, value := "key"+fmt.Sprint(i), "val"+fmt.Sprint(i)
+		items = append(items, entity.ImportData{Key: key, Value: value})
+		expected[key] = value
+	}
+
+	if resp := c.do(t, importRequest(items)); resp[0] != OK {
+		t.Errorf("error importing keys: %s\n", resp)
+		return
+	}
+
+	c.set(t, "sec", "secret", "s3cr3t")
+	expected["secret"] = "s3cr3t"
+
+	for i := 0; i < 30; i++ {
+		c.set(t, "set", "counter"+fmt.Sprint(i), "5")
+	}
+
+	// the migration is blocked until the moving lock is released
+	p.moving.Lock()
+
+	if err := p.AddShard(Shard{Name: "c", Addr: "c"}); err != nil {
+		p.moving.Unlock()
+		t.Errorf("error adding shard: %s\n", err)
+		return
+	}
+
+	err = p.AddShard(Shard{Name: "d", Addr: "d"})
+	p.moving.Unlock()
+
+	if errors.Code(err) != errors.MigrationErr {
+		t.Errorf("error rejecting concurrent migration, got %v\n", err)
+		return
+	}
+
+	// clients write keys while moving
+	w := connect(p)
+	for i := 0; i < 100; i++ {
+		key := "key" + fmt.Sprint(i)
+		if i%10 == 0 {
+			w.do(t, request("del", key, ""))
+			continue
+		}
+		w.set(t, "set", key, "new"+fmt.Sprint(i))
+	}
+
+	// counters are changed once while moving
+	for i := 0; i < 30; i++ {
+		key := "counter" + fmt.Sprint(i)
+		if resp := w.do(t, request("inc", key, "1")); string(resp) != "O6\u0004" {
+			t.Errorf("error incrementing counter %s while moving, got %q\n", key, resp)
+			return
+		}
+		expected[key] = "6"
+	}
+
+	for i := 0; i < 100; i++ {
+		key := "key" + fmt.Sprint(i)
+		if i%10 == 0 {
+			delete(expected, key)
+			continue
+		}
+		expected[key] = "new" + fmt.Sprint(i)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, status := p.Shards(); !status.Running {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Errorf("error waiting for migration\n")
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	shards, status := p.Shards()
+	if len(shards) != 3 || status.Shard != "c" || status.Moved == 0 || status.Finished == nil || status.Error != "" {
+		t.Errorf("error reporting migration: %v %+v\n", shards, status)
+		return
+	}
+
+	for key, value := range expected {
+		if v := c.get(t, key); v != value {
+			t.Errorf("error getting key %s after migration, got %q, expected %q\n", key, v, value)
+			return
+		}
+	}
+
+	// the secret key isn't exported without export-secrets permission
+	data := c.export(t)
+	if len(data) != len(expected)-1 {
+		t.Errorf("error exporting keys, got %d keys, expected %d\n", len(data), len(expected)-1)
+		return
+	}
+
+	for _, item := range data {
+		if item.Key == "secret" {
+			t.Errorf("error exporting keys, secret key is exported\n")
+			return
+		}
+
+		if !checkPlacement(t, storages, p.ring, item.Key, item.Value) {
+			return
+		}
+	}
+
+	// values are moved raw, the secret key keeps its marker
+	raw, _ := storages[p.ring.Get("secret")].Search(context.Background(), "secret")
+	if raw == "s3cr3t" || !strings.Contains(raw, "s3cr3t") {
+		t.Errorf("error moving secret key, got raw value %q\n", raw)
+		return
+	}
+
+	if data, _ := storages["c"].Export(context.Background()); len(data) == 0 {
+		t.Errorf("error moving keys, shard c has no keys\n")
+		return
+	}
+
+	if err := p.AddShard(Shard{Name: "a", Addr: "a"}); errors.Code(err) != errors.ProxyShardErr {
+		t.Errorf("error rejecting duplicate shard, got %v\n", err)
+		return
+	}
+}
@@ -0,0 +1,173 @@
+// Access control lists of key prefixes.
+// Rules bind client certificate identities to permissions
+// on keys with the given prefixes, everything else is denied.
+
+package acl
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/arsenalzp/keyvalstore/internal/server/errors"
+	"github.com/arsenalzp/keyvalstore/internal/server/identity"
+)
+
+// Permission of a command
+type Permission string
+
+const (
+	Read   Permission = "read"
+	Write  Permission = "write"
+	Delete Permission = "delete"
+	Export Permission = "export"
+	Import Permission = "import"
+	Admin  Permission = "admin" // administrative commands, implies all other permissions except ExportSecrets
+
+	// export of secret keys, it has to be granted explicitly
+	ExportSecrets Permission = "export-secrets"
+
+	// replication of the whole storage by REP command
+	Replicate Permission = "replicate"
+
+	// Raft RPCs of cluster members
+	Cluster Permission = "cluster"
+
+	// publishing to and subscribing to channels, prefixes of rules match channel names
+	Publish   Permission = "publish"
+	Subscribe Permission = "subscribe"
+)
+
+var permissions = map[Permission]bool{
+	Read: true, Write: true, Delete: true, Export: true, Import: true, Replicate: true, Cluster: true, Publish: true, Subscribe: true, Admin: true, ExportSecrets: true,
+}
+
+// Rule grants permissions on keys with the prefixes
+// to identities matching any of the selectors
+type Rule struct {
+	Identities  []string     `json:"identities"`  // identity selectors, e.g. "ou:payments"
+	Prefixes    []string     `json:"prefixes"`    // key prefixes, empty prefix matches all keys
+	Permissions []Permission `json:"permissions"` // granted permissions
+}
+
+// Configuration of the access control lists
+type Config struct {
+	Rules []Rule `json:"rules"`
+}
+
+// Policy checks permissions of identities
+type Policy struct {
+	mu  sync.RWMutex
+	cfg Config
+}
+
+func New(cfg Config) *Policy {
+	return &Policy{cfg: cfg}
+}
+
+// Load configuration of the access control lists from the JSON file
+func LoadConfig(path string) (Config, error) {
+	var cfg Config
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, errors.New("unable to read ACL config", errors.ACLConfigErr, err)
+	}
+
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, errors.New("unable to parse ACL config", errors.ACLConfigErr, err)
+	}
+
+	for i, rule := range cfg.Rules {
+		for _, perm := range rule.Permissions {
+			if !permissions[perm] {
+				err := fmt.Errorf("rule %d: unknown permission %q", i, perm)
+				return cfg, errors.New("invalid ACL config", errors.ACLConfigErr, err)
+			}
+		}
+	}
+
+	return cfg, nil
+}
+
+// Replace configuration of the policy, e.g. on reload
+func (p *Policy) SetConfig(cfg Config) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.cfg = cfg
+}
+
+// Check whether the identity has the permission on the key
+func (p *Policy) Allowed(id identity.Identity, perm Permission, key string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for _, rule := range p.cfg.Rules {
+		if rule.grants(perm) && rule.matches(id) && rule.covers(key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Check whether the identity has the permission on any key
+func (p *Policy) Granted(id identity.Identity, perm Permission) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for _, rule := range p.cfg.Rules {
+		if rule.grants(perm) && rule.matches(id) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Same as Allowed, but returns access denied error
+func (p *Policy) Check(id identity.Identity, perm Permission, key string) error {
+	if p.Allowed(id, perm, key) {
+		return nil
+	}
+
+	return Denied(perm)
+}
+
+// Access denied error of the permission
+func Denied(perm Permission) error {
+	return errors.New(fmt.Sprintf("access denied: %s", perm), errors.AccessDeniedErr, nil)
+}
+
+func (r Rule) grants(perm Permission) bool {
+	for _, p := range r.Permissions {
+		if p == perm || (p == Admin && perm != ExportSecrets) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r Rule) matches(id identity.Identity) bool {
+	for _, selector := range r.Identities {
+		if id.Matches(selector) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r Rule) covers(key string) bool {
+	for _, prefix := range r.Prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,81 @@
+package acl
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/arsenalzp/keyvalstore/internal/server/errors"
+	"github.com/arsenalzp/keyvalstore/internal/server/identity"
+)
+
+func TestAllowed(t *testing.T) {
+	p := New(Config{Rules: []Rule{
+		{Identities: []string{"ou:payments"}, Prefixes: []string{"payments/"}, Permissions: []Permission{Read, Write}},
+		{Identities: []string{"cn:reporter"}, Prefixes: []string{""}, Permissions: []Permission{Read, Export}},
+		{Identities: []string{"cn:reporter"}, Prefixes: []string{"vault/"}, Permissions: []Permission{ExportSecrets}},
+		{Identities: []string{"cn:ops"}, Prefixes: []string{""}, Permissions: []Permission{Admin}},
+	}})
+
+	payments := identity.Identity{CommonName: "svc", OrganizationalUnit: []string{"payments"}}
+	reporter := identity.Identity{CommonName: "reporter"}
+	ops := identity.Identity{CommonName: "ops"}
+
+	for _, tc := range []struct {
+		id      identity.Identity
+		perm    Permission
+		key     string
+		allowed bool
+	}{
+		{payments, Write, "payments/1", true},
+		{payments, Read, "payments/1", true},
+		{payments, Delete, "payments/1", false},
+		{payments, Read, "users/1", false},
+		{reporter, Read, "users/1", true},
+		{reporter, Export, "payments/1", true},
+		{reporter, Write, "users/1", false},
+		{reporter, ExportSecrets, "vault/1", true},
+		{reporter, ExportSecrets, "users/1", false},
+		{ops, Delete, "users/1", true},
+		{ops, ExportSecrets, "vault/1", false},
+		{identity.Identity{CommonName: "other"}, Read, "users/1", false},
+	} {
+		if allowed := p.Allowed(tc.id, tc.perm, tc.key); allowed != tc.allowed {
+			t.Errorf("error checking %s of %s on %s, expected %t, got %t\n", tc.perm, tc.id.Name(), tc.key, tc.allowed, allowed)
+		}
+	}
+
+	if p.Granted(payments, Export) {
+		t.Errorf("error checking export of %s: export is granted\n", payments.Name())
+	}
+
+	if err := p.Check(payments, Delete, "payments/1"); errors.Code(err) != errors.AccessDeniedErr {
+		t.Errorf("error checking delete, expected code %s, got %v\n", errors.AccessDeniedErr, err)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+
+	valid := filepath.Join(dir, "acl.json")
+	os.WriteFile(valid, []byte(`{"rules": [{"identities": ["*"], "prefixes": ["public/"], "permissions": ["read"]}]}`), 0600)
+
+	cfg, err := LoadConfig(valid)
+	if err != nil {
+		t.Errorf("error loading config: %s\n", err)
+		return
+	}
+
+	if len(cfg.Rules) != 1 || cfg.Rules[0].Permissions[0] != Read {
+		t.Errorf("error loading config, unexpected config: %+v\n", cfg)
+		return
+	}
+
+	invalid := filepath.Join(dir, "invalid.json")
+	os.WriteFile(invalid, []byte(`{"rules": [{"identities": ["*"], "prefixes": [""], "permissions": ["root"]}]}`), 0600)
+
+	if _, err := LoadConfig(invalid); errors.Code(err) != errors.ACLConfigErr {
+		t.Errorf("error loading invalid config, expected code %s, got %v\n", errors.ACLConfigErr, err)
+		return
+	}
+}
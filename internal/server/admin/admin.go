@@ -0,0 +1,204 @@
+// Plain-HTTP admin listener.
+// It exposes server metrics in the Prometheus text format,
+// liveness and readiness probes. Requests changing the state of
+// the server are authenticated by a bearer token.
+
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arsenalzp/keyvalstore/internal/server/errors"
+	"github.com/arsenalzp/keyvalstore/internal/server/metrics"
+)
+
+const (
+	readHeaderTimeout = 5 * time.Second
+	checkTimeout      = 5 * time.Second // timeout for all readiness checks
+	minTokenLen       = 16              // minimum length of the admin token
+	bearerPrefix      = "Bearer "
+)
+
+// Readiness check, returns a short detail of the checked component status
+type Check func(context.Context) (string, error)
+
+// Result of a single readiness check
+type checkResult struct {
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Response of the readiness probe
+type readyResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks"`
+}
+
+type Server struct {
+	Addr     string            // address to listen on, e.g. 127.0.0.1:9100
+	Registry *metrics.Registry // registry of exposed metrics
+	Token    string            // bearer token of protected requests, they are refused if it's empty
+
+	mu     sync.Mutex
+	checks map[string]Check // readiness checks by name
+
+	mux  *http.ServeMux
+	srv  *http.Server
+	lsnr net.Listener
+}
+
+// Create admin server listening on addr
+func New(addr string, registry *metrics.Registry) *Server {
+	s := &Server{
+		Addr:     addr,
+		Registry: registry,
+		checks:   make(map[string]Check),
+		mux:      http.NewServeMux(),
+	}
+
+	s.mux.HandleFunc("/metrics", s.handleMetrics)
+	s.mux.HandleFunc("/healthz", s.handleHealth)
+	s.mux.HandleFunc("/readyz", s.handleReady)
+
+	return s
+}
+
+// Register readiness check with the given name
+func (s *Server) AddCheck(name string, check Check) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.checks[name] = check
+}
+
+// Register additional handler for the given pattern
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// Register handler for the given pattern, its requests other than GET
+// and HEAD change the state of the server and require the admin token
+func (s *Server) HandleProtected(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && !s.authorized(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "access denied", http.StatusUnauthorized)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	}))
+}
+
+// Check the bearer token of the request
+func (s *Server) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), bearerPrefix)
+	if !ok || s.Token == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) == 1
+}
+
+// Load the admin token from the file, surrounding whitespaces are trimmed
+func LoadToken(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", errors.New("unable to read admin token", errors.AdminTokenErr, err)
+	}
+
+	token := strings.TrimSpace(string(data))
+	if len(token) < minTokenLen {
+		return "", errors.New("admin token is too short", errors.AdminTokenErr, nil)
+	}
+
+	return token, nil
+}
+
+func (s *Server) Handler() http.Handler {
+	return s.mux
+}
+
+// Start listening and serving admin requests in background
+func (s *Server) Start() (net.Listener, error) {
+	lsnr, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return nil, errors.New("unable to create admin listener", errors.AdminSrvErr, err)
+	}
+	s.lsnr = lsnr
+
+	s.srv = &http.Server{
+		Handler:           s.mux,
+		ReadHeaderTimeout: readHeaderTimeout,
+	}
+
+	go s.srv.Serve(lsnr)
+
+	return lsnr, nil
+}
+
+func (s *Server) Stop() error {
+	if s.srv == nil {
+		return nil
+	}
+
+	if err := s.srv.Close(); err != nil {
+		return errors.New("unable to stop admin server", errors.AdminSrvErr, err)
+	}
+
+	return nil
+}
+
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	if err := s.Registry.WriteText(w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Liveness probe, the server is alive while it's able to respond
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+// Readiness probe, the server is ready when all the checks pass
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+	defer cancel()
+
+	s.mu.Lock()
+	checks := make(map[string]Check, len(s.checks))
+	for name, check := range s.checks {
+		checks[name] = check
+	}
+	s.mu.Unlock()
+
+	resp := readyResponse{Status: "ready", Checks: make(map[string]checkResult)}
+	code := http.StatusOK
+
+	for name, check := range checks {
+		detail, err := check(ctx)
+		if err != nil {
+			resp.Checks[name] = checkResult{Status: "fail", Detail: err.Error()}
+			resp.Status = "not ready"
+			code = http.StatusServiceUnavailable
+			continue
+		}
+
+		resp.Checks[name] = checkResult{Status: "ok", Detail: detail}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,105 @@
+package admin
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/arsenalzp/keyvalstore/internal/server/metrics"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	reg := &metrics.Registry{}
+	c := metrics.NewCounterVec("test_total", "Test counter.")
+	reg.Register(c)
+	c.Inc()
+
+	srv := New("", reg)
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	rec := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("error requesting metrics, expected status %d, got %d\n", http.StatusOK, rec.Code)
+		return
+	}
+
+	body, _ := io.ReadAll(rec.Body)
+	if !strings.Contains(string(body), "test_total 1\n") {
+		t.Errorf("error requesting metrics, counter is missing:\n%s\n", body)
+		return
+	}
+}
+
+func TestReadinessEndpoint(t *testing.T) {
+	srv := New("", &metrics.Registry{})
+	srv.AddCheck("storage", func(ctx context.Context) (string, error) {
+		return "", nil
+	})
+
+	rec := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("error requesting readiness, expected status %d, got %d\n", http.StatusOK, rec.Code)
+		return
+	}
+
+	srv.AddCheck("crl", func(ctx context.Context) (string, error) {
+		return "", fmt.Errorf("CRL is outdated")
+	})
+
+	rec = httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("error requesting readiness, expected status %d, got %d\n", http.StatusServiceUnavailable, rec.Code)
+		return
+	}
+
+	body, _ := io.ReadAll(rec.Body)
+	if !strings.Contains(string(body), "CRL is outdated") {
+		t.Errorf("error requesting readiness, failed check is missing:\n%s\n", body)
+		return
+	}
+}
+
+func TestProtectedHandler(t *testing.T) {
+	srv := New("", &metrics.Registry{})
+	srv.HandleProtected("/state", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	}))
+
+	for _, tc := range []struct {
+		name   string
+		token  string
+		method string
+		auth   string
+		code   int
+	}{
+		{"read", "", http.MethodGet, "", http.StatusOK},
+		{"without token", "", http.MethodPost, "Bearer ", http.StatusUnauthorized},
+		{"missing", "0123456789abcdef", http.MethodPost, "", http.StatusUnauthorized},
+		{"wrong", "0123456789abcdef", http.MethodPost, "Bearer 0123456789abcdeX", http.StatusUnauthorized},
+		{"valid", "0123456789abcdef", http.MethodDelete, "Bearer 0123456789abcdef", http.StatusOK},
+	} {
+		srv.Token = tc.token
+
+		req := httptest.NewRequest(tc.method, "/state", nil)
+		if tc.auth != "" {
+			req.Header.Set("Authorization", tc.auth)
+		}
+
+		rec := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(rec, req)
+
+		if rec.Code != tc.code {
+			t.Errorf("%s: error requesting protected handler, expected status %d, got %d\n", tc.name, tc.code, rec.Code)
+		}
+	}
+}
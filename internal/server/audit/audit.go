@@ -0,0 +1,322 @@
+// Tamper-evident audit log of mutating operations.
+// Entries are appended to a JSON lines file, every entry includes
+// the HMAC of the previous one, so edits of the file break the chain
+// and entries can't be forged without the key.
+// The last sequence number and hash are kept in the head file
+// next to the log to detect truncation. The log is the source of truth:
+// it may be ahead of the head after a crash, the head is recomputed on open.
+
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/arsenalzp/keyvalstore/internal/server/errors"
+)
+
+const headSuffix = ".head"
+
+// minimal length of the HMAC key
+const minKeyLen = 32
+
+// Audit log entry
+type Entry struct {
+	Seq         uint64    `json:"seq"`
+	Time        time.Time `json:"time"`
+	Command     string    `json:"command"`
+	Fingerprint string    `json:"fingerprint,omitempty"` // SHA-256 fingerprint of the client certificate
+	Subject     string    `json:"subject,omitempty"`     // subject of the client certificate
+	RemoteAddr  string    `json:"remote_addr"`
+	Tenant      string    `json:"tenant,omitempty"`
+	Keys        []string  `json:"keys,omitempty"`
+	Result      string    `json:"result"`         // ok, error or requested by the mutation recorded before it's applied
+	Code        string    `json:"code,omitempty"` // error code of the failed operation
+	Prev        string    `json:"prev"`           // HMAC of the previous entry
+	Hash        string    `json:"hash"`           // HMAC of the entry
+}
+
+// Head of the audit log, it's the last entry reference
+type Head struct {
+	Seq  uint64 `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+// Append-only audit log
+type Log struct {
+	mu   sync.Mutex
+	f    *os.File
+	path string
+	key  []byte
+	head Head
+}
+
+// Load the HMAC key of the audit log from the file of base64-encoded key
+func LoadKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.New("unable to read audit log key", errors.AuditKeyErr, err)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil {
+		return nil, errors.New("invalid audit log key", errors.AuditKeyErr, err)
+	}
+
+	if len(key) < minKeyLen {
+		err := fmt.Errorf("key is %d bytes, at least %d bytes are required", len(key), minKeyLen)
+		return nil, errors.New("invalid audit log key", errors.AuditKeyErr, err)
+	}
+
+	return key, nil
+}
+
+// Open the audit log file for appending, the file is created if it doesn't exist
+// Returns error if the existing log doesn't pass verification
+func Open(path string, key []byte) (*Log, error) {
+	var head Head
+
+	if len(key) < minKeyLen {
+		return nil, errors.New("invalid audit log key", errors.AuditKeyErr, nil)
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		if err := trimPartial(path); err != nil {
+			return nil, errors.New("unable to open audit log", errors.AuditErr, err)
+		}
+
+		if head, err = Verify(path, key); err != nil {
+			return nil, err
+		}
+	} else if saved, err := readHead(path); err == nil && saved.Seq != 0 {
+		err := fmt.Errorf("log of head entry %d is missing", saved.Seq)
+		return nil, errors.New("audit log verification failed", errors.AuditVerifyErr, err)
+	}
+
+	// the head is recomputed from the log, it's behind the log
+	// if the server crashed while appending
+	if err := writeHead(path, head); err != nil {
+		return nil, errors.New("unable to write audit log head", errors.AuditErr, err)
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, errors.New("unable to open audit log", errors.AuditErr, err)
+	}
+
+	return &Log{f: f, path: path, key: key, head: head}, nil
+}
+
+// Append the entry to the log, its sequence number and hashes are filled in
+func (l *Log) Append(e Entry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e.Seq = l.head.Seq + 1
+	e.Time = e.Time.UTC()
+	e.Prev = l.head.Hash
+
+	hash, err := e.hash(l.key)
+	if err != nil {
+		return errors.New("unable to write audit log", errors.AuditErr, err)
+	}
+	e.Hash = hash
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return errors.New("unable to write audit log", errors.AuditErr, err)
+	}
+
+	if _, err := l.f.Write(append(line, '\n')); err != nil {
+		return errors.New("unable to write audit log", errors.AuditErr, err)
+	}
+
+	if err := l.f.Sync(); err != nil {
+		return errors.New("unable to write audit log", errors.AuditErr, err)
+	}
+
+	l.head = Head{Seq: e.Seq, Hash: e.Hash}
+
+	if err := writeHead(l.path, l.head); err != nil {
+		return errors.New("unable to write audit log head", errors.AuditErr, err)
+	}
+
+	return nil
+}
+
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.f.Close()
+}
+
+// Verify the HMAC chain of the audit log and check the entry of the head file is in the log,
+// the log may be ahead of the head if the server crashed while appending
+// Returns head of the valid log
+func Verify(path string, key []byte) (Head, error) {
+	var head Head
+
+	f, err := os.Open(path)
+	if err != nil {
+		return head, errors.New("unable to open audit log", errors.AuditErr, err)
+	}
+	defer f.Close()
+
+	saved, err := readHead(path)
+	missing := os.IsNotExist(err)
+	if err != nil && !missing {
+		return head, errors.New("unable to read audit log head", errors.AuditVerifyErr, err)
+	}
+
+	if head, err = verifyChain(f, key, saved); err != nil {
+		return head, err
+	}
+
+	// the head is created along with the log
+	if missing && head.Seq != 0 {
+		err := fmt.Errorf("head file %s is missing", path+headSuffix)
+		return head, errors.New("audit log verification failed", errors.AuditVerifyErr, err)
+	}
+
+	if head.Seq < saved.Seq {
+		err := fmt.Errorf("last entry %d is behind head entry %d, log is truncated", head.Seq, saved.Seq)
+		return head, errors.New("audit log verification failed", errors.AuditVerifyErr, err)
+	}
+
+	return head, nil
+}
+
+// Verify sequence numbers and HMACs of the entries, the entry of the saved head must match it
+func verifyChain(r io.Reader, key []byte, saved Head) (Head, error) {
+	var head Head
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024) // import entries contain many keys
+
+	for line := 1; scanner.Scan(); line++ {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			err = fmt.Errorf("line %d: %w", line, err)
+			return head, errors.New("audit log verification failed", errors.AuditVerifyErr, err)
+		}
+
+		hash, err := e.hash(key)
+		if err != nil {
+			return head, errors.New("audit log verification failed", errors.AuditVerifyErr, err)
+		}
+
+		switch {
+		case e.Seq != head.Seq+1:
+			err = fmt.Errorf("line %d: expected entry %d, got %d", line, head.Seq+1, e.Seq)
+		case e.Prev != head.Hash:
+			err = fmt.Errorf("line %d: entry %d is not chained to the previous entry", line, e.Seq)
+		case !hmac.Equal([]byte(e.Hash), []byte(hash)):
+			err = fmt.Errorf("line %d: entry %d is modified", line, e.Seq)
+		case e.Seq == saved.Seq && e.Hash != saved.Hash:
+			err = fmt.Errorf("line %d: entry %d does not match the head", line, e.Seq)
+		}
+		if err != nil {
+			return head, errors.New("audit log verification failed", errors.AuditVerifyErr, err)
+		}
+
+		head = Head{Seq: e.Seq, Hash: e.Hash}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return head, errors.New("unable to read audit log", errors.AuditErr, err)
+	}
+
+	return head, nil
+}
+
+// HMAC of the entry without its own hash
+func (e Entry) hash(key []byte) (string, error) {
+	e.Hash = ""
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// Cut off the last line of the log if it isn't complete,
+// the server crashed while writing it
+func trimPartial(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	// look for the last line end backwards
+	buf := make([]byte, 4096)
+	for end := info.Size(); end > 0; {
+		start := max(end-int64(len(buf)), 0)
+
+		n, err := f.ReadAt(buf[:end-start], start)
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		i := bytes.LastIndexByte(buf[:n], '\n')
+		switch {
+		case i == n-1 && end == info.Size():
+			return nil // the last line is complete
+		case i >= 0:
+			return f.Truncate(start + int64(i) + 1)
+		}
+
+		end = start
+	}
+
+	return f.Truncate(0)
+}
+
+func readHead(path string) (Head, error) {
+	var head Head
+
+	data, err := os.ReadFile(path + headSuffix)
+	if err != nil {
+		return head, err
+	}
+
+	err = json.Unmarshal(data, &head)
+
+	return head, err
+}
+
+// Replace the head file atomically
+func writeHead(path string, head Head) error {
+	data, err := json.Marshal(head)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + headSuffix + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path+headSuffix)
+}
@@ -0,0 +1,151 @@
+package audit
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/arsenalzp/keyvalstore/internal/server/errors"
+)
+
+var testKey = bytes.Repeat([]byte("k"), minKeyLen)
+
+func writeLog(t *testing.T, n int) string {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	l, err := Open(path, testKey)
+	if err != nil {
+		t.Fatalf("error opening audit log: %s\n", err)
+	}
+	defer l.Close()
+
+	for i := 0; i < n; i++ {
+		err := l.Append(Entry{
+			Time:        time.Now(),
+			Command:     "set",
+			Fingerprint: "ab12",
+			RemoteAddr:  "127.0.0.1:5000",
+			Keys:        []string{"key"},
+			Result:      "ok",
+		})
+		if err != nil {
+			t.Fatalf("error appending audit entry: %s\n", err)
+		}
+	}
+
+	return path
+}
+
+func TestVerify(t *testing.T) {
+	path := writeLog(t, 3)
+
+	head, err := Verify(path, testKey)
+	if err != nil {
+		t.Errorf("error verifying audit log: %s\n", err)
+		return
+	}
+
+	if head.Seq != 3 {
+		t.Errorf("error verifying audit log, expected 3 entries, got %d\n", head.Seq)
+		return
+	}
+
+	// the chain is continued after reopening
+	l, err := Open(path, testKey)
+	if err != nil {
+		t.Errorf("error reopening audit log: %s\n", err)
+		return
+	}
+
+	if err := l.Append(Entry{Time: time.Now(), Command: "del", Result: "ok"}); err != nil {
+		t.Errorf("error appending audit entry: %s\n", err)
+		return
+	}
+	l.Close()
+
+	if head, err := Verify(path, testKey); err != nil || head.Seq != 4 {
+		t.Errorf("error verifying reopened audit log, expected 4 entries, got %d, %v\n", head.Seq, err)
+		return
+	}
+}
+
+func TestVerifyTampering(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		tamper func(lines [][]byte) [][]byte
+	}{
+		{"edit", func(lines [][]byte) [][]byte {
+			lines[1] = bytes.Replace(lines[1], []byte(`"key"`), []byte(`"other"`), 1)
+			return lines
+		}},
+		{"delete", func(lines [][]byte) [][]byte {
+			return append(lines[:1], lines[2:]...)
+		}},
+		{"truncate", func(lines [][]byte) [][]byte {
+			return lines[:2]
+		}},
+	} {
+		path := writeLog(t, 3)
+
+		data, _ := os.ReadFile(path)
+		lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+		lines = tc.tamper(lines)
+		os.WriteFile(path, append(bytes.Join(lines, []byte("\n")), '\n'), 0600)
+
+		if _, err := Verify(path, testKey); errors.Code(err) != errors.AuditVerifyErr {
+			t.Errorf("error detecting %s, expected code %s, got %v\n", tc.name, errors.AuditVerifyErr, err)
+		}
+
+		if _, err := Open(path, testKey); err == nil {
+			t.Errorf("error opening tampered audit log: %s is not detected\n", tc.name)
+		}
+	}
+}
+
+func TestVerifyKey(t *testing.T) {
+	path := writeLog(t, 2)
+
+	if _, err := Verify(path, bytes.Repeat([]byte("x"), minKeyLen)); errors.Code(err) != errors.AuditVerifyErr {
+		t.Errorf("error verifying audit log by another key, expected code %s, got %v\n", errors.AuditVerifyErr, err)
+		return
+	}
+
+	if _, err := Open(path, []byte("short")); errors.Code(err) != errors.AuditKeyErr {
+		t.Errorf("error opening audit log by short key, expected code %s, got %v\n", errors.AuditKeyErr, err)
+		return
+	}
+}
+
+func TestOpenAfterCrash(t *testing.T) {
+	path := writeLog(t, 2)
+
+	// the entry is written, but the head isn't updated
+	head, _ := readHead(path)
+	l, err := Open(path, testKey)
+	if err != nil {
+		t.Errorf("error opening audit log: %s\n", err)
+		return
+	}
+	l.Append(Entry{Time: time.Now(), Command: "set", Result: "ok"})
+	l.Close()
+	writeHead(path, head)
+
+	// the next entry is written partially
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	f.WriteString(`{"seq":4,"time":`)
+	f.Close()
+
+	l, err = Open(path, testKey)
+	if err != nil {
+		t.Errorf("error opening audit log after crash: %s\n", err)
+		return
+	}
+	l.Close()
+
+	if head, err := Verify(path, testKey); err != nil || head.Seq != 3 {
+		t.Errorf("error verifying recovered audit log, expected 3 entries, got %d, %v\n", head.Seq, err)
+		return
+	}
+}
@@ -0,0 +1,286 @@
+// Envelope encryption of stored data.
+// Every value is encrypted by its own data key (DEK) with AES-256-GCM,
+// the data key is wrapped by a master key identified by its ID.
+// Master keys are rotated by rewrapping data keys with the primary master key,
+// values themselves don't need to be re-encrypted.
+
+package crypt
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/arsenalzp/keyvalstore/internal/server/errors"
+)
+
+const keySize = 32 // AES-256
+
+// Value encrypted by the data key
+type Sealed struct {
+	KeyID string // ID of the master key which wraps the data key
+	DEK   []byte // wrapped data key
+	Data  []byte // encrypted value
+}
+
+// Master keys by their IDs, the primary one wraps new data keys
+type Keyring struct {
+	primary string
+	keys    map[string]cipher.AEAD
+}
+
+// Load master keys from SERVICE_MASTER_KEY_FILE file or SERVICE_MASTER_KEYS env
+// Returns nil keyring if none of them is set, so encryption is disabled
+func LoadKeyring() (*Keyring, error) {
+	if path, ok := os.LookupEnv("SERVICE_MASTER_KEY_FILE"); ok {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, errors.New("unable to read master keys", errors.CryptKeyErr, err)
+		}
+		defer f.Close()
+
+		return ReadKeyring(f)
+	}
+
+	if keys, ok := os.LookupEnv("SERVICE_MASTER_KEYS"); ok {
+		return ReadKeyring(strings.NewReader(strings.ReplaceAll(keys, ",", "\n")))
+	}
+
+	return nil, nil
+}
+
+// Read master keys in "id:base64-key" format, one per line,
+// the first key is the primary one
+func ReadKeyring(r io.Reader) (*Keyring, error) {
+	kr := &Keyring{keys: make(map[string]cipher.AEAD)}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		id, encoded, ok := strings.Cut(line, ":")
+		if !ok || id == "" {
+			return nil, errors.New("invalid master key", errors.CryptKeyErr, fmt.Errorf("expected id:base64-key"))
+		}
+
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != keySize {
+			return nil, errors.New("invalid master key", errors.CryptKeyErr, fmt.Errorf("key %s must be %d base64-encoded bytes", id, keySize))
+		}
+
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, errors.New("invalid master key", errors.CryptKeyErr, err)
+		}
+
+		if _, ok := kr.keys[id]; ok {
+			return nil, errors.New("invalid master key", errors.CryptKeyErr, fmt.Errorf("duplicate key %s", id))
+		}
+
+		kr.keys[id] = aead
+		if kr.primary == "" {
+			kr.primary = id
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errors.New("unable to read master keys", errors.CryptKeyErr, err)
+	}
+
+	if kr.primary == "" {
+		return nil, errors.New("invalid master key", errors.CryptKeyErr, fmt.Errorf("no master keys"))
+	}
+
+	return kr, nil
+}
+
+// ID of the primary master key
+func (kr *Keyring) Primary() string {
+	return kr.primary
+}
+
+// Encrypt the value by a new data key wrapped by the primary master key
+// The value is bound to aad, e.g. its key, so it can't be moved to another row
+func (kr *Keyring) Seal(value, aad []byte) (Sealed, error) {
+	dek := make([]byte, keySize)
+	if _, err := rand.Read(dek); err != nil {
+		return Sealed{}, errors.New("unable to generate data key", errors.CryptErr, err)
+	}
+
+	aead, err := newAEAD(dek)
+	if err != nil {
+		return Sealed{}, errors.New("unable to encrypt value", errors.CryptErr, err)
+	}
+
+	data, err := seal(aead, value, aad)
+	if err != nil {
+		return Sealed{}, errors.New("unable to encrypt value", errors.CryptErr, err)
+	}
+
+	wrapped, err := seal(kr.keys[kr.primary], dek, []byte(kr.primary))
+	if err != nil {
+		return Sealed{}, errors.New("unable to wrap data key", errors.CryptErr, err)
+	}
+
+	return Sealed{KeyID: kr.primary, DEK: wrapped, Data: data}, nil
+}
+
+// Decrypt the value, integrity error is returned if the value,
+// its data key or aad was modified
+func (kr *Keyring) Open(s Sealed, aad []byte) ([]byte, error) {
+	dek, err := kr.unwrap(s)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(dek)
+	if err != nil {
+		return nil, errors.New("unable to decrypt value", errors.CryptErr, err)
+	}
+
+	value, err := open(aead, s.Data, aad)
+	if err != nil {
+		return nil, errors.New("value integrity check failed", errors.CryptIntegrityErr, err)
+	}
+
+	return value, nil
+}
+
+// Wrap the data key by the primary master key
+// Returns false if it's already wrapped by the primary master key
+func (kr *Keyring) Rewrap(s Sealed) (Sealed, bool, error) {
+	if s.KeyID == kr.primary {
+		return s, false, nil
+	}
+
+	dek, err := kr.unwrap(s)
+	if err != nil {
+		return s, false, err
+	}
+
+	wrapped, err := seal(kr.keys[kr.primary], dek, []byte(kr.primary))
+	if err != nil {
+		return s, false, errors.New("unable to wrap data key", errors.CryptErr, err)
+	}
+
+	return Sealed{KeyID: kr.primary, DEK: wrapped, Data: s.Data}, true, nil
+}
+
+// Encrypt a self-contained blob, e.g. a snapshot or an export file
+func (kr *Keyring) SealBlob(data []byte) ([]byte, error) {
+	s, err := kr.Seal(data, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	blob := binary.AppendUvarint(nil, uint64(len(s.KeyID)))
+	blob = append(blob, s.KeyID...)
+	blob = binary.AppendUvarint(blob, uint64(len(s.DEK)))
+	blob = append(blob, s.DEK...)
+
+	return append(blob, s.Data...), nil
+}
+
+// Decrypt a blob encrypted by SealBlob
+func (kr *Keyring) OpenBlob(blob []byte) ([]byte, error) {
+	keyID, blob, err := readField(blob)
+	if err != nil {
+		return nil, err
+	}
+
+	dek, data, err := readField(blob)
+	if err != nil {
+		return nil, err
+	}
+
+	return kr.Open(Sealed{KeyID: string(keyID), DEK: dek, Data: data}, nil)
+}
+
+// Encrypt a blob into base64 text, e.g. a line of a JSON lines file,
+// the text never starts with "{", so it's told apart from plain JSON
+func (kr *Keyring) SealText(data []byte) ([]byte, error) {
+	blob, err := kr.SealBlob(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return base64.StdEncoding.AppendEncode(nil, blob), nil
+}
+
+// Decrypt a text encrypted by SealText
+func (kr *Keyring) OpenText(text []byte) ([]byte, error) {
+	blob, err := base64.StdEncoding.AppendDecode(nil, text)
+	if err != nil {
+		return nil, errors.New("value integrity check failed", errors.CryptIntegrityErr, err)
+	}
+
+	return kr.OpenBlob(blob)
+}
+
+// Whether the data is plain JSON rather than a text sealed by SealText
+func IsPlain(data []byte) bool {
+	return len(data) > 0 && data[0] == '{'
+}
+
+// read length-prefixed field of the blob, returns the field and the rest of the blob
+func readField(blob []byte) ([]byte, []byte, error) {
+	n, l := binary.Uvarint(blob)
+	if l <= 0 || uint64(len(blob)-l) < n {
+		return nil, nil, errors.New("value integrity check failed", errors.CryptIntegrityErr, fmt.Errorf("malformed blob"))
+	}
+
+	return blob[l : l+int(n)], blob[l+int(n):], nil
+}
+
+func (kr *Keyring) unwrap(s Sealed) ([]byte, error) {
+	master, ok := kr.keys[s.KeyID]
+	if !ok {
+		return nil, errors.New("unknown master key", errors.CryptKeyErr, fmt.Errorf("key %s isn't loaded", s.KeyID))
+	}
+
+	dek, err := open(master, s.DEK, []byte(s.KeyID))
+	if err != nil {
+		return nil, errors.New("data key integrity check failed", errors.CryptIntegrityErr, err)
+	}
+
+	return dek, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// encrypt plaintext, the random nonce is prepended to the ciphertext
+func seal(aead cipher.AEAD, plaintext, aad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+func open(aead cipher.AEAD, ciphertext, aad []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext is too short")
+	}
+
+	nonce, data := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+
+	return aead.Open(nil, nonce, data, aad)
+}
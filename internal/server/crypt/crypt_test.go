@@ -0,0 +1,146 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/arsenalzp/keyvalstore/internal/server/errors"
+)
+
+func newKey() string {
+	key := make([]byte, keySize)
+	rand.Read(key)
+
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func newKeyring(t *testing.T, keys string) *Keyring {
+	kr, err := ReadKeyring(strings.NewReader(keys))
+	if err != nil {
+		t.Fatalf("error reading keyring: %s\n", err)
+	}
+
+	return kr
+}
+
+func TestSealOpen(t *testing.T) {
+	kr := newKeyring(t, "k1:"+newKey())
+
+	s, err := kr.Seal([]byte("secret"), []byte("key"))
+	if err != nil {
+		t.Errorf("error sealing value: %s\n", err)
+		return
+	}
+
+	if s.KeyID != "k1" || bytes.Contains(s.Data, []byte("secret")) {
+		t.Errorf("error sealing value, unexpected sealed value: %+v\n", s)
+		return
+	}
+
+	value, err := kr.Open(s, []byte("key"))
+	if err != nil || string(value) != "secret" {
+		t.Errorf("error opening value, expected: secret, got: %s, %v\n", value, err)
+		return
+	}
+
+	// value is bound to its key
+	if _, err := kr.Open(s, []byte("other")); errors.Code(err) != errors.CryptIntegrityErr {
+		t.Errorf("error opening value of another key, expected code %s, got %v\n", errors.CryptIntegrityErr, err)
+		return
+	}
+
+	s.Data[len(s.Data)-1] ^= 1
+	if _, err := kr.Open(s, []byte("key")); errors.Code(err) != errors.CryptIntegrityErr {
+		t.Errorf("error opening modified value, expected code %s, got %v\n", errors.CryptIntegrityErr, err)
+		return
+	}
+}
+
+func TestRewrap(t *testing.T) {
+	k1, k2 := newKey(), newKey()
+
+	old := newKeyring(t, "k1:"+k1)
+	s, _ := old.Seal([]byte("secret"), nil)
+
+	kr := newKeyring(t, fmt.Sprintf("k2:%s\nk1:%s\n", k2, k1))
+
+	rewrapped, ok, err := kr.Rewrap(s)
+	if err != nil || !ok || rewrapped.KeyID != "k2" {
+		t.Errorf("error rewrapping data key, got: %s, %t, %v\n", rewrapped.KeyID, ok, err)
+		return
+	}
+
+	if _, ok, _ := kr.Rewrap(rewrapped); ok {
+		t.Errorf("error rewrapping data key: key wrapped by the primary key is rewrapped\n")
+		return
+	}
+
+	// the old master key can be removed after rewrapping
+	rotated := newKeyring(t, "k2:"+k2)
+	if value, err := rotated.Open(rewrapped, nil); err != nil || string(value) != "secret" {
+		t.Errorf("error opening rewrapped value, expected: secret, got: %s, %v\n", value, err)
+		return
+	}
+
+	if _, err := rotated.Open(s, nil); errors.Code(err) != errors.CryptKeyErr {
+		t.Errorf("error opening value of removed key, expected code %s, got %v\n", errors.CryptKeyErr, err)
+		return
+	}
+}
+
+func TestBlob(t *testing.T) {
+	kr := newKeyring(t, "k1:"+newKey())
+
+	blob, err := kr.SealBlob([]byte("snapshot"))
+	if err != nil {
+		t.Errorf("error sealing blob: %s\n", err)
+		return
+	}
+
+	if data, err := kr.OpenBlob(blob); err != nil || string(data) != "snapshot" {
+		t.Errorf("error opening blob, expected: snapshot, got: %s, %v\n", data, err)
+		return
+	}
+
+	if _, err := kr.OpenBlob(blob[:3]); errors.Code(err) != errors.CryptIntegrityErr {
+		t.Errorf("error opening truncated blob, expected code %s, got %v\n", errors.CryptIntegrityErr, err)
+		return
+	}
+}
+
+func TestText(t *testing.T) {
+	kr := newKeyring(t, "k1:"+newKey())
+
+	text, err := kr.SealText([]byte(`{"index":1}`))
+	if err != nil || IsPlain(text) {
+		t.Errorf("error sealing text: %s, %v\n", text, err)
+		return
+	}
+
+	if data, err := kr.OpenText(text); err != nil || string(data) != `{"index":1}` {
+		t.Errorf("error opening text, expected: {\"index\":1}, got: %s, %v\n", data, err)
+		return
+	}
+
+	if _, err := kr.OpenText([]byte("{}")); errors.Code(err) != errors.CryptIntegrityErr {
+		t.Errorf("error opening plain text, expected code %s, got %v\n", errors.CryptIntegrityErr, err)
+		return
+	}
+}
+
+func TestReadKeyring(t *testing.T) {
+	for _, keys := range []string{
+		"",
+		"k1",
+		"k1:c2hvcnQ=",
+		fmt.Sprintf("k1:%s\nk1:%s", newKey(), newKey()),
+	} {
+		if _, err := ReadKeyring(strings.NewReader(keys)); errors.Code(err) != errors.CryptKeyErr {
+			t.Errorf("error reading invalid keyring %q, expected code %s, got %v\n", keys, errors.CryptKeyErr, err)
+		}
+	}
+}
@@ -56,6 +56,55 @@ const (
 	NetworkInitTLSErr = "ESRV-4045"
 	SrvStartErr       = "ESRV-5046"
 	SrvStopErr        = "ESRV-6047"
+	StorageStatsErr   = "ESTRG-4048"
+	AdminSrvErr       = "ESRV-7049"
+	StoragePingErr    = "ESTRG-5050"
+	ConnLimitErr      = "WSRV-8051"
+	ConnPerClientErr  = "WSRV-9052"
+	IdleTimeoutErr    = "WSRV-0053"
+	InvalidTimeoutErr = "ESRV-1054"
+	HandshakeErr      = "ETLS-5055"
+	RateLimitErr      = "WSRV-2056"
+	RateLimitCfgErr   = "ESRV-3057"
+	AccessDeniedErr   = "WSRV-4058"
+	ACLConfigErr      = "ESRV-5059"
+	TenantErr         = "WSRV-6060"
+	TenantCfgErr      = "ESRV-7061"
+	AuditErr          = "ESRV-8062"
+	AuditVerifyErr    = "ESRV-9063"
+	CryptErr          = "ECRPT-0064"
+	CryptKeyErr       = "ECRPT-1065"
+	CryptIntegrityErr = "ECRPT-2066"
+	OCSPRevokedErr    = "ETLS-6067"
+	OCSPCheckErr      = "ETLS-7068"
+	QuotaErr          = "WSRV-0069"
+	QuotaCfgErr       = "ESRV-1070"
+	ReadOnlyErr       = "WSRV-2071"
+	ReplicationErr    = "ESRV-3072"
+	ChangelogGapErr   = "ESTRG-6073"
+	NotLeaderErr      = "WSRV-4074"
+	ClusterErr        = "ESRV-5075"
+	ClusterCfgErr     = "ESRV-6076"
+	ProxyBackendErr   = "EPRX-0077"
+	ProxyShardErr     = "EPRX-1078"
+	MigrationErr      = "EPRX-2079"
+	ProxyCmdErr       = "WPRX-3080"
+	WatchErr          = "ESRV-7081"
+	PubSubErr         = "ESRV-8082"
+	SlowSubscriberErr = "WSRV-9083"
+	PubSubCfgErr      = "ESRV-0084"
+	WebhookErr        = "ESRV-1085"
+	WebhookCfgErr     = "ESRV-2086"
+	SummaryErr        = "ESRV-3087"
+	StorageMigrateErr = "ESTRG-7088"
+	CounterValueErr   = "WSRV-0089"
+	CounterRangeErr   = "WSRV-1090"
+	IncrOpErr         = "ESRV-4091"
+	HashTabIncrErr    = "EHTAB-5092"
+	AuditKeyErr       = "ESRV-6093"
+	SecretMarkerErr   = "ESRV-6094"
+	AdminTokenErr     = "ESRV-6095"
+	StorageStateErr   = "ESTRG-7096"
 )
 
 type errCommon struct {
@@ -84,3 +133,14 @@ func New(msg string, code string, err error) error {
 		Msg: msg, Code: code, Err: err,
 	})
 }
+
+// Get code of the error, empty string is returned
+// if the error wasn't created by New
+func Code(err error) string {
+	var e *errCommon
+	if errors.As(err, &e) {
+		return e.Code
+	}
+
+	return ""
+}
@@ -7,16 +7,31 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
+	"strconv"
+	"sync/atomic"
 	"time"
 
+	"github.com/arsenalzp/keyvalstore/internal/server/acl"
+	"github.com/arsenalzp/keyvalstore/internal/server/audit"
 	"github.com/arsenalzp/keyvalstore/internal/server/errors"
+	"github.com/arsenalzp/keyvalstore/internal/server/identity"
+	"github.com/arsenalzp/keyvalstore/internal/server/limits"
+	"github.com/arsenalzp/keyvalstore/internal/server/logger"
+	"github.com/arsenalzp/keyvalstore/internal/server/metrics"
+	"github.com/arsenalzp/keyvalstore/internal/server/pubsub"
+	"github.com/arsenalzp/keyvalstore/internal/server/ratelimit"
+	"github.com/arsenalzp/keyvalstore/internal/server/replication"
 	strg "github.com/arsenalzp/keyvalstore/internal/server/storage"
-
-	"sync"
+	"github.com/arsenalzp/keyvalstore/internal/server/storage/changelog"
+	entity "github.com/arsenalzp/keyvalstore/internal/server/storage/entity"
+	"github.com/arsenalzp/keyvalstore/internal/server/storage/merkle"
+	"github.com/arsenalzp/keyvalstore/internal/server/storage/quota"
+	"github.com/arsenalzp/keyvalstore/internal/server/storage/tenant"
 )
 
 const (
@@ -24,6 +39,11 @@ const (
 	OK        = 'O'
 	NOK       = 'N'
 	EOT       = '\u0004'
+	PONG      = "PONG" // response to the ping command
+	statusOK  = "ok"
+	statusErr = "error"
+
+	statusRequested = "requested" // audit result of the mutation recorded before it's applied
 )
 
 type Cmd = string
@@ -34,33 +54,157 @@ type Handler interface {
 
 type dataStruct struct {
 	strg.Storage
+	id      identity.Identity           // identity of the client certificate
+	policy  *acl.Policy                 // access control lists, nil allows everything
+	summary atomic.Pointer[merkle.Tree] // summaries of the comparison in progress
+}
+
+// Description of the command: message and codes of its errors
+type operation struct {
+	msg         string         // error message
+	errCode     string         // code of the operation error
+	timeoutCode string         // code of the operation timeout
+	perm        acl.Permission // permission required by the command
+}
+
+// Rate limiting class of commands, commands without a class aren't limited
+var classes = map[Cmd]ratelimit.Class{
+	"get": ratelimit.Read,
+	"exp": ratelimit.Read,
+	"sum": ratelimit.Read,
+	"set": ratelimit.Write,
+	"sec": ratelimit.Write,
+	"del": ratelimit.Write,
+	"inc": ratelimit.Write,
+	"imp": ratelimit.Write,
+	"pub": ratelimit.Write,
+}
+
+var operations = map[Cmd]operation{
+	"set": {"set operation error", errors.SettOpErr, errors.SetOpTimeout, acl.Write},
+	"sec": {"secret set operation error", errors.SettOpErr, errors.SetOpTimeout, acl.Write},
+	"get": {"get operation error", errors.GetOpErr, errors.GetOpTimeout, acl.Read},
+	"del": {"del operation error", errors.DelOpErr, errors.DelOpTimeout, acl.Delete},
+	"inc": {"incr operation error", errors.IncrOpErr, errors.OperationTimeout, acl.Write},
+	"exp": {"export operation error", errors.ExpOpErr, errors.ExpOpTimeout, acl.Export},
+	"imp": {"import operation error", errors.ImpOpErr, errors.ImpOpTimeout, acl.Import},
+	"sum": {"summary operation error", errors.SummaryErr, errors.ExpOpTimeout, acl.Export},
+	"png": {"ping operation error", errors.ServerIntErr, errors.OperationTimeout, ""},
+	"tmo": {"timeout operation error", errors.InvalidTimeoutErr, errors.OperationTimeout, ""},
+	"rep": {"replication error", errors.ReplicationErr, errors.OperationTimeout, acl.Replicate},
+	"wch": {"watch error", errors.WatchErr, errors.OperationTimeout, acl.Read},
+	"pub": {"publish error", errors.PubSubErr, errors.OperationTimeout, acl.Publish},
+	"sub": {"subscribe error", errors.PubSubErr, errors.OperationTimeout, acl.Subscribe},
+	"uns": {"unsubscribe error", errors.PubSubErr, errors.OperationTimeout, acl.Subscribe},
+}
+
+// sequence of connection IDs
+var conID atomic.Uint64
+
+// Connection handler with configurable timeouts and limits
+// Zero value handles connections without timeouts and limits
+type ConnHandler struct {
+	IdleTimeout   time.Duration       // close connection if no request is received within the timeout
+	WriteTimeout  time.Duration       // timeout of sending a response
+	OpTimeout     time.Duration       // default timeout of a storage operation, timeoutOp if zero
+	MaxOpTimeout  time.Duration       // upper bound of a client-supplied operation timeout
+	Limiter       *limits.ConnLimiter // limits of connections per client certificate
+	RateLimiter   *ratelimit.Limiter  // rate limits of requests per client certificate
+	ACL           *acl.Policy         // permissions of client certificates on keys
+	TenantField   tenant.Field        // certificate field of the client tenant, keyspace isn't isolated if empty
+	Quota         *quota.Tracker      // storage quotas of namespaces
+	Audit         *audit.Log          // audit log of mutating operations
+	AuditFailOpen bool                // acknowledge operations which aren't recorded into the audit log
+	Changes       *changelog.Storage  // change log of the storage, it's required by replication and watches
+	Replication   bool                // stream changes to replicas granted replicate permission
+	Watch         bool                // stream changes of watched keys to clients
+	PubSub        *pubsub.Broker      // channels of publish/subscribe commands, they are disabled if nil
+	ReadOnly      bool                // reject writes of clients, e.g. on a replica
 }
 
+// State of a single client connection
+type session struct {
+	*dataStruct
+	h         *ConnHandler
+	log       *slog.Logger
+	opTimeout time.Duration // timeout of storage operations
+	tenant    string        // tenant of the client
+}
+
+// default handler used by HandleCon
+var defaultHandler = &ConnHandler{}
+
 // Handle connection from a cli
 func HandleCon(pCtx context.Context, con net.Conn, storage strg.Storage) {
-	var mu sync.Mutex
-	var ds = &dataStruct{storage}              // init new data structure
-	var errCh chan error = make(chan error)    // channel to send errors
-	var dataCh chan []byte = make(chan []byte) // channel to send a date
-	var reader *bufio.Reader
-	var writer *bufio.Writer
+	defaultHandler.HandleCon(pCtx, con, storage)
+}
 
+// Handle connection from a cli
+func (h *ConnHandler) HandleCon(pCtx context.Context, con net.Conn, storage strg.Storage) {
 	ctx, cancel := context.WithCancel(pCtx) // create context from the parent context
 
+	log := conLogger(con)
+
 	defer func() {
 		if err := recover(); err != nil {
-			log.Printf("%+v", err)
+			log.Error("handler panic", "panic", err)
 		}
 	}()
 	defer cancel()
 	defer con.Close()
 
+	metrics.ActiveConns.Inc()
+	defer metrics.ActiveConns.Dec()
+
+	reader := bufio.NewReader(con)
+	writer := bufio.NewWriter(con)
+
+	id, hasID := identity.FromConn(con)
+
+	// limit number of connections of the client certificate
+	if hasID && h.Limiter != nil {
+		if err := h.Limiter.AcquireClient(id.Fingerprint); err != nil {
+			h.reject(con, writer, log, "per_client", err)
+			return
+		}
+		defer h.Limiter.ReleaseClient(id.Fingerprint)
+	}
+
+	// scope the storage to the tenant of the client certificate
+	var tenantName string
+	if h.TenantField != "" {
+		name, err := h.TenantField.Tenant(id)
+		if err != nil {
+			h.reject(con, writer, log, "tenant", err)
+			return
+		}
+
+		storage = tenant.New(storage, name)
+		log = log.With("tenant", name)
+		tenantName = name
+	}
+
+	// limit usage of the storage by the namespace of the client
+	if h.Quota != nil {
+		storage = h.Quota.Storage(storage, tenantName, id)
+	}
+
+	var ds = &dataStruct{Storage: storage, id: id, policy: h.ACL} // init new data structure
+
+	sess := &session{
+		dataStruct: ds,
+		h:          h,
+		log:        log,
+		opTimeout:  h.opTimeout(),
+		tenant:     tenantName,
+	}
+
 	// Handle different requests withing a single connection
-Loop:
 	// continiously reading a data from the connection
 	for {
-		reader = bufio.NewReader(con)
-		writer = bufio.NewWriter(con)
+		if h.IdleTimeout > 0 {
+			con.SetReadDeadline(time.Now().Add(h.IdleTimeout))
+		}
 
 		// read a data from the connection, until EOT reached
 		buf, err := reader.ReadBytes(EOT)
@@ -68,286 +212,405 @@ Loop:
 			return
 		}
 
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			metrics.IdleTimeouts.Inc()
+			err = errors.New("connection is idle", errors.IdleTimeoutErr, err)
+			log.Info("closing idle connection", "code", errors.Code(err))
+			return
+		}
+
 		if err != nil && err != io.ErrUnexpectedEOF {
 			err = errors.New("handler error", errors.ReadClientErr, err)
-			log.Printf("%+v", err)
+			metrics.Errors.Inc(errors.Code(err))
+			log.Error("unable to read request", "error", err, "code", errors.Code(err))
 			return
 		}
 
 		// get command from the buffer
 		cmd := getCmd(buf)
 		if cmd == "" {
-			continue Loop
+			continue
 		}
 
-		// select the command
-		switch cmd {
-		case "set":
-			respBuf := make([]byte, 63) // create outcomming buffer
-			key := readKey(buf)         // get key value from the buffer
-			val := readValue(buf)       // get value from the buffer
-
-			go ds.set(ctx, key, val, dataCh, errCh)
+		start := time.Now()
 
-			select {
-			case <-ctx.Done():
-				respBuf = writeStatus(respBuf, NOK)
-
-				err := errors.New("set operation error", errors.SetOpTimeout, ctx.Err())
-				respBuf = writeError(respBuf, err)
+		// the connection is taken over by the replication stream
+		if cmd == "rep" {
+			sess.replicate(ctx, con, writer, buf, start)
+			return
+		}
 
-				err = sendData(respBuf, *writer)
-				if err != nil {
-					err = errors.New("set operation error", errors.WriteClientErr, err)
-					log.Printf("%+v", err)
-					return
-				}
+		// the connection serves subscriptions until it's unsubscribed
+		if cmd == "sub" {
+			if !sess.subscribe(ctx, con, reader, writer, buf, start) {
+				return
+			}
+			continue
+		}
 
-				log.Printf("%+v", err)
+		// the connection is taken over by the stream of watched changes
+		if cmd == "wch" {
+			sess.watch(ctx, con, reader, writer, buf, start)
+			return
+		}
 
-			case err := <-errCh:
-				respBuf = writeStatus(respBuf, NOK)
+		respBuf, err := sess.exec(ctx, con, cmd, buf, start)
+		if err != nil {
+			respBuf = writeStatus(make([]byte, 64), NOK)
+			respBuf = writeError(respBuf, err)
+		}
 
-				err = errors.New("set operation error", errors.SettOpErr, err)
+		// the operation is recorded before the client is acknowledged, it isn't
+		// acknowledged if it can't be recorded; mutations are recorded by exec
+		// before they are applied, failed ones are recorded again by their error
+		if recordResult(cmd, err) {
+			if aerr := sess.audit(con, cmd, buf, start, err); aerr != nil && !h.AuditFailOpen {
+				err = aerr
+				respBuf = writeStatus(make([]byte, 64), NOK)
 				respBuf = writeError(respBuf, err)
+			}
+		}
 
-				err = sendData(respBuf, *writer)
-				if err != nil {
-					err = errors.New("set operation error", errors.WriteClientErr, err)
-					log.Printf("%+v", err)
-					return
-				}
+		h.setWriteDeadline(con)
+		if werr := sendData(respBuf, *writer); werr != nil {
+			werr = errors.New(operations[cmd].msg, errors.WriteClientErr, werr)
+			metrics.Errors.Inc(errors.Code(werr))
+			log.Error("unable to send response", "command", cmd, "error", werr, "code", errors.Code(werr))
+			return
+		}
 
-				log.Printf("%+v", err)
+		logRequest(log, cmd, buf, start, err)
+	}
+}
 
-			case <-dataCh:
-				respBuf = writeStatus(respBuf, OK)
-				respBuf = writeEOT(respBuf)
+// Stream changes of the storage to the replica until the connection fails
+func (s *session) replicate(ctx context.Context, con net.Conn, writer *bufio.Writer, buf []byte, start time.Time) {
+	// replicas read every key, so the stream is served only to
+	// clients explicitly granted replicate permission
+	var err error
+	switch {
+	case !s.h.Replication || s.h.Changes == nil:
+		err = errors.New("replication is disabled", errors.ReplicationErr, nil)
+	case s.policy == nil:
+		err = denied(acl.Replicate)
+	default:
+		err = s.authorize("rep", buf)
+	}
 
-				err := sendData(respBuf, *writer)
-				if err != nil {
-					err = errors.New("set operation error", errors.WriteClientErr, err)
-					log.Printf("%+v", err)
-					return
-				}
+	if err != nil {
+		s.h.setWriteDeadline(con)
+		sendData(writeError(writeStatus(make([]byte, 64), NOK), err), *writer)
+		logRequest(s.log, "rep", buf, start, err)
+		return
+	}
 
-				continue Loop // exit
-			}
+	s.log.Info("replica connected")
 
-		case "get":
-			respBuf := make([]byte, 512)
+	err = replication.Stream(ctx, s.h.Changes, string(clearKey(readKey(buf))), func(frame replication.Frame) error {
+		data, err := json.Marshal(frame)
+		if err != nil {
+			return err
+		}
 
-			// get key value from the buffer
-			key := readKey(buf)
+		s.h.setWriteDeadline(con)
+		return sendData(writeEOT(append(writeStatus(make([]byte, 1), OK), data...)), *writer)
+	})
 
-			go ds.get(ctx, key, dataCh, errCh)
+	err = errors.New("replication error", errors.ReplicationErr, err)
+	s.log.Info("replica disconnected", "error", err, "code", errors.Code(err))
+}
 
-			select {
-			case <-ctx.Done():
-				respBuf = writeStatus(respBuf, NOK)
+// Send error response to the client rejected before serving any request
+func (h *ConnHandler) reject(con net.Conn, writer *bufio.Writer, log *slog.Logger, reason string, err error) {
+	metrics.RejectedConns.Inc(reason)
+	metrics.Errors.Inc(errors.Code(err))
+	log.Warn("connection rejected", "reason", reason, "error", err, "code", errors.Code(err))
+	h.setWriteDeadline(con)
+	sendData(writeError(writeStatus(make([]byte, 64), NOK), err), *writer)
+}
 
-				err := errors.New("get operation error", errors.GetOpTimeout, ctx.Err())
-				respBuf = writeError(respBuf, err)
+// default timeout of a storage operation
+func (h *ConnHandler) opTimeout() time.Duration {
+	if h.OpTimeout > 0 {
+		return h.OpTimeout
+	}
 
-				err = sendData(respBuf, *writer)
-				if err != nil {
-					err = errors.New("get operation error", errors.WriteClientErr, err)
-					log.Printf("%+v", err)
-					return
-				}
+	return timeoutOp
+}
 
-				log.Printf("%+v", err)
+func (h *ConnHandler) setWriteDeadline(con net.Conn) {
+	if h.WriteTimeout > 0 {
+		con.SetWriteDeadline(time.Now().Add(h.WriteTimeout))
+	}
+}
 
-			case err := <-errCh:
-				respBuf = writeStatus(respBuf, NOK)
+// Execute the command read from buf within the operation timeout
+// Returns the response buffer or error of the operation
+func (s *session) exec(pCtx context.Context, con net.Conn, cmd Cmd, buf []byte, start time.Time) ([]byte, error) {
+	op := operations[cmd]
 
-				err = errors.New("get operation error", errors.GetOpErr, err)
-				respBuf = writeError(respBuf, err)
+	if cmd == "tmo" {
+		timeout, err := s.h.readTimeout(readKey(buf))
+		if err != nil {
+			return nil, err
+		}
 
-				err = sendData(respBuf, *writer)
-				if err != nil {
-					err = errors.New("get operation error", errors.WriteClientErr, err)
-					log.Printf("%+v", err)
-					return
-				}
-
-				log.Printf("%+v", err)
-
-			case data := <-dataCh:
-				respBuf = writeStatus(respBuf, OK)
-				respBuf = writeValue(respBuf, data)
-				respBuf = writeEOT(respBuf)
-
-				mu.Lock()
-				err := sendData(respBuf, *writer)
-				if err != nil {
-					err = errors.New("get operation error", errors.WriteClientErr, err)
-					log.Printf("%+v", err)
-					return
-				}
-				mu.Unlock()
-
-				continue Loop
-			}
+		s.opTimeout = timeout
+		return writeEOT(writeStatus(make([]byte, 1), OK)), nil
+	}
 
-		case "del":
-			respBuf := make([]byte, 63) // create outcomming buffer
-			// get key value from the buffer
-			key := readKey(buf)
+	if cmd == "uns" {
+		return nil, errors.New("connection isn't subscribed", errors.PubSubErr, nil)
+	}
 
-			go ds.del(ctx, key, dataCh, errCh)
+	if err := s.authorize(cmd, buf); err != nil {
+		return nil, err
+	}
 
-			select {
-			case <-ctx.Done():
-				respBuf = writeStatus(respBuf, NOK)
+	// messages aren't stored, so replicas publish them
+	if s.h.ReadOnly && classes[cmd] == ratelimit.Write && cmd != "pub" {
+		return nil, errors.New("writes are rejected by read-only replica", errors.ReadOnlyErr, nil)
+	}
 
-				err := errors.New("del operation error", errors.DelOpTimeout, ctx.Err())
-				respBuf = writeError(respBuf, err)
+	if class, ok := classes[cmd]; ok && s.h.RateLimiter != nil {
+		if err := s.h.RateLimiter.Allow(s.id, class); err != nil {
+			metrics.RateLimited.Inc(string(class))
+			return nil, err
+		}
+	}
 
-				err = sendData(respBuf, *writer)
-				if err != nil {
-					err = errors.New("del operation error", errors.WriteClientErr, err)
-					log.Printf("%+v", err)
-					return
-				}
+	// the mutation isn't applied if it can't be recorded, so the client
+	// isn't failed for a mutation which is already applied
+	if mutations[cmd] {
+		if err := s.audit(con, cmd, buf, start, nil); err != nil && !s.h.AuditFailOpen {
+			return nil, err
+		}
+	}
 
-				log.Printf("%+v", err)
+	ctx, cancel := context.WithTimeout(pCtx, s.opTimeout)
+	defer cancel()
 
-			case err := <-errCh:
-				respBuf = writeStatus(respBuf, NOK)
+	dataCh := make(chan []byte, 1) // channel to send a data
+	errCh := make(chan error, 1)   // channel to send errors
 
-				err = errors.New("del operation error", errors.DelOpErr, err)
-				respBuf = writeError(respBuf, err)
+	ds := s.dataStruct
 
-				err = sendData(respBuf, *writer)
-				if err != nil {
-					err = errors.New("del operation error", errors.WriteClientErr, err)
-					log.Printf("%+v", err)
-					return
-				}
+	switch cmd {
+	case "set":
+		go ds.set(ctx, readKey(buf), readValue(buf), dataCh, errCh)
+	case "sec":
+		go ds.sec(ctx, readKey(buf), readValue(buf), dataCh, errCh)
+	case "get":
+		go ds.get(ctx, readKey(buf), dataCh, errCh)
+	case "del":
+		go ds.del(ctx, readKey(buf), dataCh, errCh)
+	case "inc":
+		go ds.inc(ctx, readKey(buf), readValue(buf), dataCh, errCh)
+	case "exp":
+		go ds.exp(ctx, dataCh, errCh)
+	case "sum":
+		go ds.sum(ctx, readKey(buf), readValue(buf), dataCh, errCh)
+	case "imp":
+		go ds.imp(ctx, readImport(buf[3:]), dataCh, errCh)
+	case "png":
+		dataCh <- []byte(PONG)
+	case "pub":
+		go s.pub(readKey(buf), readValue(buf), dataCh, errCh)
+	}
 
-				log.Printf("%+v", err)
+	select {
+	case <-ctx.Done():
+		return nil, errors.New(op.msg, op.timeoutCode, ctx.Err())
 
-			case <-dataCh:
-				respBuf = writeStatus(respBuf, OK)
-				respBuf = writeEOT(respBuf)
+	case err := <-errCh:
+		switch errors.Code(err) {
+		case errors.AccessDeniedErr, errors.QuotaErr, errors.NotLeaderErr, errors.CounterValueErr, errors.CounterRangeErr:
+			return nil, err
+		}
 
-				err := sendData(respBuf, *writer)
-				if err != nil {
-					err = errors.New("del operation error", errors.WriteClientErr, err)
-					log.Printf("%+v", err)
-					return
-				}
+		return nil, errors.New(op.msg, op.errCode, err)
 
-				continue Loop
-			}
-		case "exp":
-			respBuf := make([]byte, 1)
+	case data := <-dataCh:
+		respBuf := writeStatus(make([]byte, 1), OK)
 
-			go ds.exp(ctx, dataCh, errCh)
+		switch cmd {
+		case "get":
+			respBuf = writeValue(append(respBuf, make([]byte, 511)...), data)
+		case "exp", "sum":
+			respBuf = writeExport(respBuf, data)
+		case "png", "pub", "inc":
+			respBuf = append(respBuf, data...)
+		}
 
-			select {
-			case <-ctx.Done():
-				respBuf = writeStatus(respBuf, NOK)
+		return writeEOT(respBuf), nil
+	}
+}
 
-				err := errors.New("export operation error", errors.ExpOpTimeout, ctx.Err())
-				respBuf = writeError(respBuf, err)
+// Check permission of the client to run the command
+// Keys of export and import are checked by the commands
+func (s *session) authorize(cmd Cmd, buf []byte) error {
+	perm := operations[cmd].perm
+	if s.policy == nil || perm == "" {
+		return nil
+	}
 
-				err = sendData(respBuf, *writer)
-				if err != nil {
-					err = errors.New("export operation error", errors.WriteClientErr, err)
-					log.Printf("%+v", err)
-					return
-				}
+	switch cmd {
+	case "set", "sec", "get", "del", "inc", "pub":
+		if !s.allowed(perm, string(clearKey(readKey(buf)))) {
+			return denied(perm)
+		}
+	default:
+		if !s.policy.Granted(s.id, perm) {
+			return denied(perm)
+		}
+	}
 
-				log.Printf("%+v", err)
+	return nil
+}
 
-			case err := <-errCh:
-				respBuf = writeStatus(respBuf, NOK)
+// Check permission of the client on the key
+func (ds *dataStruct) allowed(perm acl.Permission, key string) bool {
+	return ds.policy == nil || ds.policy.Allowed(ds.id, perm, key)
+}
 
-				err = errors.New("export operation error", errors.ExpOpErr, err)
-				respBuf = writeError(respBuf, err)
+// Access denied error of the permission
+func denied(perm acl.Permission) error {
+	metrics.AccessDenied.Inc(string(perm))
+	return acl.Denied(perm)
+}
 
-				err = sendData(respBuf, *writer)
-				if err != nil {
-					err = errors.New("export operation error", errors.WriteClientErr, err)
-					log.Printf("%+v", err)
-					return
-				}
+// Read client-supplied timeout of storage operations in milliseconds
+// Zero timeout resets it to the default one
+func (h *ConnHandler) readTimeout(buf []byte) (time.Duration, error) {
+	ms, err := strconv.ParseUint(string(clearKey(buf)), 10, 32)
+	if err != nil {
+		return 0, errors.New("invalid timeout", errors.InvalidTimeoutErr, err)
+	}
 
-				log.Printf("%+v", err)
+	if ms == 0 {
+		return h.opTimeout(), nil
+	}
 
-			case data := <-dataCh:
-				respBuf = writeStatus(respBuf, OK)
+	timeout := time.Duration(ms) * time.Millisecond
+	if h.MaxOpTimeout > 0 && timeout > h.MaxOpTimeout {
+		timeout = h.MaxOpTimeout
+	}
 
-				respBuf = writeExport(respBuf, data)
-				respBuf = writeEOT(respBuf)
+	return timeout, nil
+}
 
-				mu.Lock()
-				err := sendData(respBuf, *writer)
-				if err != nil {
-					err = errors.New("export operation error", errors.WriteClientErr, err)
-					log.Printf("%+v", err)
-					return
-				}
-				mu.Unlock()
+// Get logger of the connection
+// Log records are populated by connection ID and client's certificate details
+func conLogger(con net.Conn) *slog.Logger {
+	log := slog.Default().With(
+		"conn_id", conID.Add(1),
+		"remote_addr", con.RemoteAddr().String(),
+	)
+
+	if id, ok := identity.FromConn(con); ok {
+		log = log.With(
+			"client_subject", id.Subject,
+			"client_serial", id.Serial,
+		)
+	}
 
-				continue Loop
-			}
+	return log
+}
 
-		case "imp":
-			respBuf := make([]byte, 64)
+// Record mutating and exporting commands into the audit log
+func (s *session) audit(con net.Conn, cmd Cmd, buf []byte, start time.Time, err error) error {
+	if s.h.Audit == nil {
+		return nil
+	}
 
-			importData := readImport(buf[3:])
+	e := audit.Entry{
+		Time:        start,
+		Command:     cmd,
+		Fingerprint: s.id.Fingerprint,
+		Subject:     s.id.Subject,
+		RemoteAddr:  con.RemoteAddr().String(),
+		Tenant:      s.tenant,
+		Result:      statusOK,
+	}
 
-			go ds.imp(ctx, importData, dataCh, errCh)
+	switch cmd {
+	case "set", "sec", "del", "inc":
+		e.Keys = []string{string(clearKey(readKey(buf)))}
+	case "imp":
+		var items []entity.ImportData
+		json.Unmarshal(readImport(buf[3:]), &items)
+		for _, item := range items {
+			e.Keys = append(e.Keys, item.Key)
+		}
+	case "exp":
+		// exported keys aren't listed, the whole export is recorded
+	default:
+		return nil
+	}
 
-			select {
-			case <-ctx.Done():
-				respBuf = writeStatus(respBuf, NOK)
+	switch {
+	case err != nil:
+		e.Result = statusErr
+		e.Code = errors.Code(err)
+	case mutations[cmd]:
+		e.Result = statusRequested
+	}
 
-				err = errors.New("import operation error", errors.ImpOpTimeout, ctx.Err())
-				respBuf = writeError(respBuf, err)
+	if err := s.h.Audit.Append(e); err != nil {
+		metrics.AuditFailures.Inc()
+		s.log.Error("unable to write audit log", "command", cmd, "error", err, "code", errors.Code(err))
+		return errors.New("operation isn't recorded into audit log", errors.AuditErr, err)
+	}
 
-				err = sendData(respBuf, *writer)
-				if err != nil {
-					err = errors.New("export operation error", errors.WriteClientErr, err)
-					log.Printf("%+v", err)
-					return
-				}
+	return nil
+}
 
-				log.Printf("%+v", err)
+// Mutations recorded into the audit log before they are applied
+var mutations = map[Cmd]bool{"set": true, "sec": true, "del": true, "inc": true, "imp": true}
 
-			case err := <-errCh:
-				respBuf = writeStatus(respBuf, NOK)
+// Check whether the result of the command is recorded into the audit log
+// after it's executed: mutations are recorded before, so only their errors
+// are recorded, unless the error is the failure of the audit log itself
+func recordResult(cmd Cmd, err error) bool {
+	if !mutations[cmd] {
+		return true
+	}
 
-				err = errors.New("import operation error", errors.ImpOpErr, err)
-				respBuf = writeError(respBuf, err)
+	return err != nil && errors.Code(err) != errors.AuditErr
+}
+
+// Write request log record and update request metrics of the command
+func logRequest(log *slog.Logger, cmd Cmd, buf []byte, start time.Time, err error) {
+	duration := time.Since(start)
 
-				err = sendData(respBuf, *writer)
-				if err != nil {
-					err = errors.New("import operation error", errors.WriteClientErr, err)
-					log.Printf("%+v", err)
-					return
-				}
+	status := statusOK
+	if err != nil {
+		status = statusErr
+	}
 
-				log.Printf("%+v", err)
+	metrics.Requests.Inc(cmd, status)
+	metrics.RequestDuration.Observe(duration.Seconds(), cmd)
 
-			case <-dataCh:
-				respBuf = writeStatus(respBuf, OK)
-				respBuf = writeEOT(respBuf)
+	attrs := []slog.Attr{
+		slog.String("command", cmd),
+		slog.Duration("duration", duration),
+		slog.String("status", status),
+	}
 
-				err := sendData(respBuf, *writer)
-				if err != nil {
-					err = errors.New("import operation error", errors.WriteClientErr, err)
-					log.Printf("%+v", err)
-					return
-				}
+	// values are never logged
+	switch cmd {
+	case "set", "sec", "get", "del", "inc", "wch", "pub", "sub", "uns":
+		attrs = append(attrs, logger.Key(string(clearKey(readKey(buf)))))
+	}
 
-				continue Loop
-			}
-		}
+	if err != nil {
+		metrics.Errors.Inc(errors.Code(err))
+		attrs = append(attrs, slog.String("code", errors.Code(err)), slog.String("error", err.Error()))
+		log.LogAttrs(context.Background(), slog.LevelWarn, "request failed", attrs...)
+		return
 	}
+
+	log.LogAttrs(context.Background(), slog.LevelInfo, "request", attrs...)
 }
 
 func getCmd(buf []byte) Cmd {
@@ -356,14 +619,34 @@ func getCmd(buf []byte) Cmd {
 	switch cmd {
 	case "set":
 		return cmd
+	case "sec":
+		return cmd
 	case "get":
 		return cmd
 	case "del":
 		return cmd
+	case "inc":
+		return cmd
 	case "imp":
 		return cmd
 	case "exp":
 		return cmd
+	case "sum":
+		return cmd
+	case "png":
+		return cmd
+	case "tmo":
+		return cmd
+	case "rep":
+		return cmd
+	case "wch":
+		return cmd
+	case "pub":
+		return cmd
+	case "sub":
+		return cmd
+	case "uns":
+		return cmd
 	default:
 		return ""
 	}
@@ -377,6 +660,11 @@ func readValue(buf []byte) []byte {
 	return buf[259:512]
 }
 
+// remove EOT and NULL bytes from the key
+func clearKey(key []byte) []byte {
+	return bytes.Trim(bytes.Trim(key, string(EOT)), "\x00")
+}
+
 func readImport(buf []byte) []byte {
 	return trimEOT(buf)
 }
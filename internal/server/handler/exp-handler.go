@@ -6,11 +6,14 @@ package handler
 import (
 	"context"
 	"encoding/json"
+
+	"github.com/arsenalzp/keyvalstore/internal/server/acl"
+	entity "github.com/arsenalzp/keyvalstore/internal/server/storage/entity"
 )
 
 // export EXPORT command
 func (ds *dataStruct) exp(ctx context.Context, dataCh chan<- []byte, errCh chan<- error) {
-	exports, err := ds.Export(ctx)
+	exports, err := ds.exported(ctx)
 	if err != nil {
 		errCh <- err
 		return
@@ -24,3 +27,27 @@ func (ds *dataStruct) exp(ctx context.Context, dataCh chan<- []byte, errCh chan<
 
 	dataCh <- data
 }
+
+// Export keys permitted to the client, secret keys are omitted
+// unless export of secrets is explicitly permitted
+func (ds *dataStruct) exported(ctx context.Context) ([]entity.ExportData, error) {
+	exports, err := ds.Export(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	permitted := make([]entity.ExportData, 0, len(exports))
+	for _, item := range exports {
+		if !ds.allowed(acl.Export, item.Key) {
+			continue
+		}
+
+		if item.Secret && (ds.policy == nil || !ds.policy.Allowed(ds.id, acl.ExportSecrets, item.Key)) {
+			continue
+		}
+
+		permitted = append(permitted, item)
+	}
+
+	return permitted, nil
+}
@@ -19,6 +19,9 @@ func (ds *dataStruct) get(ctx context.Context, key []byte, dataCh chan<- []byte,
 		return
 	}
 
+	// secret values are readable by clients permitted to read the key
+	val, _ = unmarkSecret(val)
+
 	data := []byte(val)
 	dataCh <- data
 }
@@ -1,15 +1,33 @@
 package handler
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"net"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	cli "github.com/arsenalzp/keyvalstore/internal/cli/command"
+	"github.com/arsenalzp/keyvalstore/internal/server/acl"
+	"github.com/arsenalzp/keyvalstore/internal/server/audit"
+	"github.com/arsenalzp/keyvalstore/internal/server/errors"
+	"github.com/arsenalzp/keyvalstore/internal/server/pubsub"
+	"github.com/arsenalzp/keyvalstore/internal/server/ratelimit"
+	"github.com/arsenalzp/keyvalstore/internal/server/replication"
+	"github.com/arsenalzp/keyvalstore/internal/server/storage/changelog"
+	"github.com/arsenalzp/keyvalstore/internal/server/storage/counter"
 	entity "github.com/arsenalzp/keyvalstore/internal/server/storage/entity"
+	"github.com/arsenalzp/keyvalstore/internal/server/storage/merkle"
+	"github.com/arsenalzp/keyvalstore/internal/server/storage/quota"
+	"github.com/arsenalzp/keyvalstore/internal/server/storage/tenant"
 )
 
 const KEY = "key100000"
@@ -18,6 +36,7 @@ const IMPORT_DATA = `[{"key":"key694","value":"val694"},{"key":"key132","value":
 
 type Storage struct {
 	storage map[string]string
+	exports int // number of exports
 }
 
 func initStorage() *Storage {
@@ -121,6 +140,57 @@ func TestSetHandler(t *testing.T) {
 	}
 }
 
+func TestIncrHandler(t *testing.T) {
+	ctx := context.Background()
+	stg := initStorage()
+
+	stg.storage = map[string]string{KEY: VALUE}
+
+	for _, tc := range []struct {
+		args  []string
+		value string
+		code  string
+	}{
+		{[]string{"counter", "1"}, "1", ""},
+		{[]string{"counter", "41"}, "42", ""},
+		{[]string{"counter", "-50"}, "-8", ""},
+		{[]string{KEY, "1"}, "", errors.CounterValueErr},
+		{[]string{"counter", "9223372036854775807"}, "9223372036854775799", ""},
+		{[]string{"counter", "8"}, "9223372036854775807", ""},
+	} {
+		clientConn, serverConn := net.Pipe()
+		go HandleCon(ctx, serverConn, stg)
+
+		data, err := cli.Incr(clientConn, nil, tc.args)
+		if tc.code != "" {
+			if err == nil || !bytes.Contains([]byte(err.Error()), []byte(tc.code)) {
+				t.Errorf("error in Incr command %v, expected code %s, got %v\n", tc.args, tc.code, err)
+				return
+			}
+			continue
+		}
+
+		if err != nil || string(data) != tc.value {
+			t.Errorf("error in Incr command %v, expected %s, got %s, %v\n", tc.args, tc.value, data, err)
+			return
+		}
+	}
+
+	// the overflowing delta is rejected and the counter is kept
+	clientConn, serverConn := net.Pipe()
+	go HandleCon(ctx, serverConn, stg)
+
+	if _, err := cli.Incr(clientConn, nil, []string{"counter", "1"}); err == nil || !bytes.Contains([]byte(err.Error()), []byte(errors.CounterRangeErr)) {
+		t.Errorf("error in Incr command, expected code %s, got %v\n", errors.CounterRangeErr, err)
+		return
+	}
+
+	if value := stg.storage["counter"]; value != "9223372036854775807" {
+		t.Errorf("error in Incr command, expected counter 9223372036854775807, got %s\n", value)
+		return
+	}
+}
+
 func FuzzSetHandler(f *testing.F) {
 	f.Add("data", "data")
 	f.Fuzz(func(t *testing.T, k, v string) {
@@ -169,6 +239,529 @@ func TestGetHandler(t *testing.T) {
 	}
 }
 
+func TestPingHandler(t *testing.T) {
+	ctx := context.Background()
+	stg := initStorage()
+
+	clientConn, serverConn := net.Pipe()
+	go HandleCon(ctx, serverConn, stg)
+
+	data, err := cli.Ping(clientConn, nil)
+	if err != nil {
+		t.Errorf("error in Ping command: %s", err)
+		return
+	}
+
+	if string(data) != PONG {
+		t.Errorf("error in Ping handler: expected: %s got: %s\n", PONG, data)
+		return
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	ctx := context.Background()
+	stg := initStorage()
+
+	h := &ConnHandler{IdleTimeout: 50 * time.Millisecond}
+
+	clientConn, serverConn := net.Pipe()
+
+	done := make(chan struct{})
+	go func() {
+		h.HandleCon(ctx, serverConn, stg)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("error closing idle connection: connection is still open\n")
+		return
+	}
+
+	if _, err := cli.Ping(clientConn, nil); err == nil {
+		t.Errorf("error closing idle connection: ping succeeded\n")
+		return
+	}
+}
+
+func TestTimeoutCommand(t *testing.T) {
+	ctx := context.Background()
+	stg := initStorage()
+
+	h := &ConnHandler{MaxOpTimeout: time.Second}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go h.HandleCon(ctx, serverConn, stg)
+
+	reader := bufio.NewReader(clientConn)
+
+	for _, tc := range []struct {
+		timeout string
+		status  byte
+	}{
+		{"1500", OK},
+		{"0", OK},
+		{"soon", NOK},
+	} {
+		var buf [772]byte
+		copy(buf[0:3], "tmo")
+		copy(buf[3:259], tc.timeout)
+		buf[771] = EOT
+
+		if _, err := clientConn.Write(buf[:]); err != nil {
+			t.Errorf("error sending timeout command: %s\n", err)
+			return
+		}
+
+		respBuf, err := reader.ReadBytes(EOT)
+		if err != nil {
+			t.Errorf("error reading timeout command response: %s\n", err)
+			return
+		}
+
+		if respBuf[0] != tc.status {
+			t.Errorf("error setting timeout %s, expected status %c, got %c\n", tc.timeout, tc.status, respBuf[0])
+			return
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	ctx := context.Background()
+	stg := initStorage()
+
+	h := &ConnHandler{RateLimiter: ratelimit.New(ratelimit.Config{
+		Default: ratelimit.Budget{Write: ratelimit.Limit{Rate: 0.001, Burst: 1}},
+	})}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go h.HandleCon(ctx, serverConn, stg)
+
+	reader := bufio.NewReader(clientConn)
+
+	for _, tc := range []struct {
+		cmd    string
+		status byte
+	}{
+		{"set", OK},
+		{"set", NOK},
+		{"del", NOK},
+		{"get", OK},
+		{"png", OK},
+	} {
+		var buf [772]byte
+		copy(buf[0:3], tc.cmd)
+		copy(buf[3:259], KEY)
+		copy(buf[259:], VALUE)
+		buf[771] = EOT
+
+		if _, err := clientConn.Write(buf[:]); err != nil {
+			t.Errorf("error sending %s command: %s\n", tc.cmd, err)
+			return
+		}
+
+		respBuf, err := reader.ReadBytes(EOT)
+		if err != nil {
+			t.Errorf("error reading %s command response: %s\n", tc.cmd, err)
+			return
+		}
+
+		if respBuf[0] != tc.status {
+			t.Errorf("error limiting %s command, expected status %c, got %c\n", tc.cmd, tc.status, respBuf[0])
+			return
+		}
+
+		if respBuf[0] == NOK && !bytes.Contains(respBuf, []byte("rate limited, retry after")) {
+			t.Errorf("error limiting %s command, unexpected response: %s\n", tc.cmd, respBuf[1:])
+			return
+		}
+	}
+}
+
+func TestQuota(t *testing.T) {
+	ctx := context.Background()
+	stg := initStorage()
+
+	h := &ConnHandler{Quota: quota.New(quota.Config{Default: quota.Limit{Keys: 1}})}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go h.HandleCon(ctx, serverConn, h.Quota.Count(stg, tenant.Split))
+
+	reader := bufio.NewReader(clientConn)
+
+	for _, tc := range []struct {
+		cmd    string
+		key    string
+		status byte
+	}{
+		{"set", KEY, OK},
+		{"set", KEY, OK},
+		{"set", "other", NOK},
+		{"del", KEY, OK},
+		{"set", "other", OK},
+	} {
+		var buf [772]byte
+		copy(buf[0:3], tc.cmd)
+		copy(buf[3:259], tc.key)
+		copy(buf[259:], VALUE)
+		buf[771] = EOT
+
+		if _, err := clientConn.Write(buf[:]); err != nil {
+			t.Errorf("error sending %s command: %s\n", tc.cmd, err)
+			return
+		}
+
+		respBuf, err := reader.ReadBytes(EOT)
+		if err != nil {
+			t.Errorf("error reading %s command response: %s\n", tc.cmd, err)
+			return
+		}
+
+		if respBuf[0] != tc.status {
+			t.Errorf("error checking quota of %s %s, expected status %c, got %c\n", tc.cmd, tc.key, tc.status, respBuf[0])
+			return
+		}
+
+		if respBuf[0] == NOK && !bytes.Contains(respBuf, []byte(errors.QuotaErr)) {
+			t.Errorf("error checking quota of %s %s, unexpected response: %s\n", tc.cmd, tc.key, respBuf[1:])
+			return
+		}
+	}
+}
+
+func TestACL(t *testing.T) {
+	ctx := context.Background()
+	stg := initStorage()
+	stg.storage[KEY] = VALUE
+
+	// net.Pipe has no client certificate, so the identity is empty
+	h := &ConnHandler{ACL: acl.New(acl.Config{Rules: []acl.Rule{
+		{Identities: []string{"*"}, Prefixes: []string{"public/"}, Permissions: []acl.Permission{acl.Read, acl.Write, acl.Export}},
+	}})}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go h.HandleCon(ctx, serverConn, stg)
+
+	reader := bufio.NewReader(clientConn)
+
+	for _, tc := range []struct {
+		cmd    string
+		key    string
+		status byte
+	}{
+		{"set", "public/1", OK},
+		{"get", "public/1", OK},
+		{"del", "public/1", NOK},
+		{"set", KEY, NOK},
+		{"imp", `[{"key":"public/2","value":"val"}]`, NOK},
+		{"exp", "", OK},
+	} {
+		var buf [772]byte
+		copy(buf[0:3], tc.cmd)
+		copy(buf[3:259], tc.key)
+		copy(buf[259:], VALUE)
+		buf[771] = EOT
+
+		if tc.cmd == "imp" {
+			buf = [772]byte{}
+			copy(buf[0:3], tc.cmd)
+			copy(buf[3:], tc.key)
+			buf[771] = EOT
+		}
+
+		if _, err := clientConn.Write(buf[:]); err != nil {
+			t.Errorf("error sending %s command: %s\n", tc.cmd, err)
+			return
+		}
+
+		respBuf, err := reader.ReadBytes(EOT)
+		if err != nil {
+			t.Errorf("error reading %s command response: %s\n", tc.cmd, err)
+			return
+		}
+
+		if respBuf[0] != tc.status {
+			t.Errorf("error checking %s %s, expected status %c, got %c: %s\n", tc.cmd, tc.key, tc.status, respBuf[0], respBuf[1:])
+			return
+		}
+
+		if respBuf[0] == NOK && !bytes.Contains(respBuf, []byte(errors.AccessDeniedErr)) {
+			t.Errorf("error checking %s %s, unexpected response: %s\n", tc.cmd, tc.key, respBuf[1:])
+			return
+		}
+
+		// only permitted keys are exported
+		if tc.cmd == "exp" && (!bytes.Contains(respBuf, []byte("public/1")) || bytes.Contains(respBuf, []byte(KEY))) {
+			t.Errorf("error checking export, unexpected keys: %s\n", respBuf[1:])
+			return
+		}
+	}
+}
+
+func TestSecret(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		name     string
+		policy   *acl.Policy
+		exported bool
+	}{
+		{"without ACL", nil, false},
+		{"admin", acl.New(acl.Config{Rules: []acl.Rule{
+			{Identities: []string{"*"}, Prefixes: []string{""}, Permissions: []acl.Permission{acl.Admin}},
+		}}), false},
+		{"export-secrets", acl.New(acl.Config{Rules: []acl.Rule{
+			{Identities: []string{"*"}, Prefixes: []string{""}, Permissions: []acl.Permission{acl.Admin}},
+			{Identities: []string{"*"}, Prefixes: []string{"vault/"}, Permissions: []acl.Permission{acl.ExportSecrets}},
+		}}), true},
+	} {
+		stg := initStorage()
+		h := &ConnHandler{ACL: tc.policy}
+
+		clientConn, serverConn := net.Pipe()
+		go h.HandleCon(ctx, serverConn, stg)
+
+		reader := bufio.NewReader(clientConn)
+
+		var respBuf []byte
+		for _, cmd := range []string{"sec", "set", "get", "exp"} {
+			var buf [772]byte
+			copy(buf[0:3], cmd)
+			if cmd == "sec" || cmd == "get" {
+				copy(buf[3:259], "vault/password")
+				copy(buf[259:], "s3cr3t")
+			} else {
+				copy(buf[3:259], KEY)
+				copy(buf[259:], VALUE)
+			}
+			buf[771] = EOT
+
+			if _, err := clientConn.Write(buf[:]); err != nil {
+				t.Errorf("%s: error sending %s command: %s\n", tc.name, cmd, err)
+				return
+			}
+
+			var err error
+			respBuf, err = reader.ReadBytes(EOT)
+			if err != nil {
+				t.Errorf("%s: error reading %s command response: %s\n", tc.name, cmd, err)
+				return
+			}
+
+			if respBuf[0] != OK {
+				t.Errorf("%s: error running %s command: %s\n", tc.name, cmd, respBuf[1:])
+				return
+			}
+
+			// secret is readable individually
+			if cmd == "get" && !bytes.HasPrefix(respBuf[1:], []byte("s3cr3t\x00")) {
+				t.Errorf("%s: error getting secret, unexpected value: %q\n", tc.name, respBuf[1:])
+				return
+			}
+		}
+		clientConn.Close()
+
+		var exports []entity.ExportData
+		if err := json.Unmarshal(trimEOT(respBuf[1:]), &exports); err != nil {
+			t.Errorf("%s: error parsing export: %s\n", tc.name, err)
+			return
+		}
+
+		expected := []entity.ExportData{{Key: KEY, Value: VALUE}}
+		if tc.exported {
+			expected = append(expected, entity.ExportData{Key: "vault/password", Value: "s3cr3t", Secret: true})
+		}
+
+		sort.Slice(exports, func(i, j int) bool { return exports[i].Key < exports[j].Key })
+		if !reflect.DeepEqual(exports, expected) {
+			t.Errorf("%s: error exporting secrets, got %+v, expected %+v\n", tc.name, exports, expected)
+			return
+		}
+	}
+}
+
+func TestImportSecretMarker(t *testing.T) {
+	ctx := context.Background()
+	stg := initStorage()
+
+	clientConn, serverConn := net.Pipe()
+	go HandleCon(ctx, serverConn, stg)
+
+	// the marker of the storage can't be forged by the imported value
+	data, _ := json.Marshal([]entity.ImportData{{Key: "vault/password", Value: entity.SecretMarker + "s3cr3t"}})
+	err := cli.Import(clientConn, nil, []string{string(data)})
+	if err == nil || !strings.Contains(err.Error(), errors.ImpOpErr) {
+		t.Errorf("error rejecting secret marker, expected code %s, got %v\n", errors.ImpOpErr, err)
+		return
+	}
+
+	if _, ok := stg.storage["vault/password"]; ok {
+		t.Errorf("error rejecting secret marker, the key is imported\n")
+	}
+}
+
+func TestReplication(t *testing.T) {
+	ctx := context.Background()
+	stg := initStorage()
+	stg.storage[KEY] = VALUE
+
+	changes := changelog.New(stg, 0)
+
+	// net.Pipe has no client certificate, so the identity is empty
+	replicator := acl.New(acl.Config{Rules: []acl.Rule{
+		{Identities: []string{"*"}, Prefixes: []string{""}, Permissions: []acl.Permission{acl.Replicate}},
+	}})
+	reader := acl.New(acl.Config{Rules: []acl.Rule{
+		{Identities: []string{"*"}, Prefixes: []string{""}, Permissions: []acl.Permission{acl.Read}},
+	}})
+
+	for _, tc := range []struct {
+		name string
+		h    *ConnHandler
+		cmd  string
+		code string
+	}{
+		{"replica", &ConnHandler{Changes: changes, ReadOnly: true}, "set", errors.ReadOnlyErr},
+		{"disabled", &ConnHandler{Changes: changes, ACL: replicator}, "rep", errors.ReplicationErr},
+		{"without ACL", &ConnHandler{Changes: changes, Replication: true}, "rep", errors.AccessDeniedErr},
+		{"not granted", &ConnHandler{Changes: changes, Replication: true, ACL: reader}, "rep", errors.AccessDeniedErr},
+		{"primary", &ConnHandler{Changes: changes, Replication: true, ACL: replicator}, "rep", ""},
+	} {
+		clientConn, serverConn := net.Pipe()
+		go tc.h.HandleCon(ctx, serverConn, changes)
+
+		var buf [772]byte
+		copy(buf[0:3], tc.cmd)
+		copy(buf[3:259], KEY)
+		copy(buf[259:], VALUE)
+		buf[771] = EOT
+
+		if tc.cmd == "rep" {
+			buf = [772]byte{}
+			copy(buf[0:3], tc.cmd)
+			buf[771] = EOT
+		}
+
+		if _, err := clientConn.Write(buf[:]); err != nil {
+			t.Errorf("%s: error sending %s command: %s\n", tc.name, tc.cmd, err)
+			return
+		}
+
+		respBuf, err := bufio.NewReader(clientConn).ReadBytes(EOT)
+		clientConn.Close()
+		if err != nil {
+			t.Errorf("%s: error reading %s command response: %s\n", tc.name, tc.cmd, err)
+			return
+		}
+
+		if tc.code != "" {
+			if respBuf[0] != NOK || !bytes.Contains(respBuf, []byte(tc.code)) {
+				t.Errorf("%s: error running %s command, expected code %s, got %s\n", tc.name, tc.cmd, tc.code, respBuf)
+			}
+			continue
+		}
+
+		// the replica without position receives a snapshot first
+		var frame replication.Frame
+		if err := json.Unmarshal(trimEOT(respBuf[1:]), &frame); err != nil {
+			t.Errorf("%s: error parsing frame: %s\n", tc.name, err)
+			return
+		}
+
+		if frame.Type != "snapshot" || frame.Log != changes.ID() || len(frame.Data) != 1 || frame.Data[0].Key != KEY {
+			t.Errorf("%s: error streaming snapshot, unexpected frame: %+v\n", tc.name, frame)
+			return
+		}
+	}
+}
+
+func TestTenantWithoutCertificate(t *testing.T) {
+	ctx := context.Background()
+	stg := initStorage()
+
+	h := &ConnHandler{TenantField: tenant.FieldOU}
+
+	clientConn, serverConn := net.Pipe()
+	go h.HandleCon(ctx, serverConn, stg)
+
+	respBuf, err := bufio.NewReader(clientConn).ReadBytes(EOT)
+	if err != nil {
+		t.Errorf("error reading rejection: %s\n", err)
+		return
+	}
+
+	if respBuf[0] != NOK || !bytes.Contains(respBuf, []byte(errors.TenantErr)) {
+		t.Errorf("error rejecting client without tenant, unexpected response: %s\n", respBuf)
+		return
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	ctx := context.Background()
+	stg := initStorage()
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	key := bytes.Repeat([]byte("k"), 32)
+	log, err := audit.Open(path, key)
+	if err != nil {
+		t.Errorf("error opening audit log: %s\n", err)
+		return
+	}
+	defer log.Close()
+
+	h := &ConnHandler{Audit: log}
+
+	for _, cmd := range []func(net.Conn) error{
+		func(conn net.Conn) error { return cli.Set(conn, nil, []string{KEY, VALUE}) },
+		func(conn net.Conn) error { _, err := cli.Get(conn, nil, []string{KEY}); return err },
+		func(conn net.Conn) error { return cli.Del(conn, nil, []string{KEY}) },
+	} {
+		clientConn, serverConn := net.Pipe()
+		go h.HandleCon(ctx, serverConn, stg)
+
+		if err := cmd(clientConn); err != nil {
+			t.Errorf("error running command: %s\n", err)
+			return
+		}
+	}
+
+	// only SET and DEL are recorded
+	head, err := audit.Verify(path, key)
+	if err != nil || head.Seq != 2 {
+		t.Errorf("error verifying audit log, expected 2 entries, got %d, %v\n", head.Seq, err)
+		return
+	}
+
+	// mutations are recorded before they are applied
+	entries, err := os.ReadFile(path)
+	if err != nil || strings.Count(string(entries), `"result":"requested"`) != 2 {
+		t.Errorf("error recording mutations before they are applied: %s, %v\n", entries, err)
+		return
+	}
+
+	// mutations which can't be recorded aren't applied
+	log.Close()
+
+	clientConn, serverConn := net.Pipe()
+	go h.HandleCon(ctx, serverConn, stg)
+
+	err = cli.Set(clientConn, nil, []string{KEY, VALUE})
+	if err == nil || !strings.Contains(err.Error(), errors.AuditErr) {
+		t.Errorf("error failing unrecorded operation, expected code %s, got %v\n", errors.AuditErr, err)
+		return
+	}
+
+	if _, ok := stg.storage[KEY]; ok {
+		t.Errorf("error failing unrecorded operation: the mutation is applied\n")
+		return
+	}
+}
+
 func (s *Storage) Search(ctx context.Context, key string) (string, error) {
 	return s.storage[key], nil
 }
@@ -188,18 +781,31 @@ func (s *Storage) Delete(ctx context.Context, key string) (bool, error) {
 	return true, nil
 }
 
+func (s *Storage) Increment(ctx context.Context, key string, delta int64) (int64, error) {
+	value, err := counter.Add(s.storage[key], delta)
+	if err != nil {
+		return 0, err
+	}
+
+	s.storage[key] = counter.Format(value)
+
+	return value, nil
+}
+
 func (s *Storage) Import(ctx context.Context, data []entity.ImportData) (bool, error) {
 	for _, i := range data {
-		s.Insert(ctx, i.Key, i.Value)
+		s.Insert(ctx, i.Key, entity.StoredValue(i.Value, i.Secret))
 	}
 
 	return true, nil
 }
 func (s *Storage) Export(context.Context) ([]entity.ExportData, error) {
 	var exportData []entity.ExportData
+	s.exports++
 
 	for k, v := range s.storage {
-		exportData = append(exportData, entity.ExportData{k, v})
+		value, secret := entity.UnmarkSecret(v)
+		exportData = append(exportData, entity.ExportData{Key: k, Value: value, Secret: secret})
 	}
 
 	return exportData, nil
@@ -219,3 +825,237 @@ func keyValSkip(k, v string) bool {
 
 	return false
 }
+
+func TestWatch(t *testing.T) {
+	ctx := context.Background()
+	changes := changelog.New(initStorage(), 0)
+
+	// net.Pipe has no client certificate, so the identity is empty
+	h := &ConnHandler{Changes: changes, Watch: true, ACL: acl.New(acl.Config{Rules: []acl.Rule{
+		{Identities: []string{"*"}, Prefixes: []string{"public/"}, Permissions: []acl.Permission{acl.Read}},
+	}})}
+
+	watch := func(h *ConnHandler, key, mode string) (net.Conn, *bufio.Reader, []byte) {
+		clientConn, serverConn := net.Pipe()
+		go h.HandleCon(ctx, serverConn, changes)
+
+		var buf [772]byte
+		copy(buf[0:3], "wch")
+		copy(buf[3:259], key)
+		copy(buf[259:], mode)
+		buf[771] = EOT
+
+		if _, err := clientConn.Write(buf[:]); err != nil {
+			t.Fatalf("error sending wch command: %s\n", err)
+		}
+
+		reader := bufio.NewReader(clientConn)
+		respBuf, err := reader.ReadBytes(EOT)
+		if err != nil {
+			t.Fatalf("error reading wch command response: %s\n", err)
+		}
+
+		return clientConn, reader, respBuf
+	}
+
+	for _, tc := range []struct {
+		name string
+		h    *ConnHandler
+		key  string
+		code string
+	}{
+		{"disabled", &ConnHandler{Changes: changes}, KEY, errors.WatchErr},
+		{"denied", h, KEY, errors.AccessDeniedErr},
+		{"empty", h, "", errors.WatchErr},
+	} {
+		clientConn, _, respBuf := watch(tc.h, tc.key, "")
+		clientConn.Close()
+
+		if respBuf[0] != NOK || !bytes.Contains(respBuf, []byte(tc.code)) {
+			t.Errorf("%s: error running wch command, expected code %s, got %s\n", tc.name, tc.code, respBuf)
+			return
+		}
+	}
+
+	clientConn, reader, respBuf := watch(h, "", watchPrefix)
+	defer clientConn.Close()
+
+	if string(respBuf) != "O\u0004" {
+		t.Errorf("error acknowledging watch, got %q\n", respBuf)
+		return
+	}
+
+	// keys the client can't read aren't pushed, secret values are unmarked
+	changes.Insert(ctx, "public/1", "val1")
+	changes.Insert(ctx, KEY, VALUE)
+	changes.Insert(ctx, "public/2", markSecret("val2"))
+	changes.Delete(ctx, "public/1")
+
+	expected := []watchEvent{
+		{Op: changelog.Set, Key: "public/1", Value: "val1", Version: 1},
+		{Op: changelog.Set, Key: "public/2", Value: "val2", Version: 3},
+		{Op: changelog.Delete, Key: "public/1", Version: 4},
+	}
+
+	for _, exp := range expected {
+		respBuf, err := reader.ReadBytes(EOT)
+		if err != nil {
+			t.Errorf("error reading watch event: %s\n", err)
+			return
+		}
+
+		var ev watchEvent
+		if err := json.Unmarshal(trimEOT(respBuf[1:]), &ev); err != nil {
+			t.Errorf("error parsing watch event: %s\n", err)
+			return
+		}
+
+		ev.Time = time.Time{}
+		if respBuf[0] != OK || ev != exp {
+			t.Errorf("error watching keys, expected %+v, got %+v\n", exp, ev)
+			return
+		}
+	}
+}
+
+func TestPubSub(t *testing.T) {
+	ctx := context.Background()
+	stg := initStorage()
+
+	h := &ConnHandler{PubSub: pubsub.New(0, pubsub.Drop)}
+
+	request := func(conn net.Conn, reader *bufio.Reader, cmd, key, value string) []byte {
+		var buf [772]byte
+		copy(buf[0:3], cmd)
+		copy(buf[3:259], key)
+		copy(buf[259:], value)
+		buf[771] = EOT
+
+		if _, err := conn.Write(buf[:]); err != nil {
+			t.Fatalf("error sending %s command: %s\n", cmd, err)
+		}
+
+		respBuf, err := reader.ReadBytes(EOT)
+		if err != nil {
+			t.Fatalf("error reading %s command response: %s\n", cmd, err)
+		}
+
+		return respBuf
+	}
+
+	subConn, serverConn := net.Pipe()
+	defer subConn.Close()
+	go h.HandleCon(ctx, serverConn, stg)
+	subReader := bufio.NewReader(subConn)
+
+	pubConn, serverConn := net.Pipe()
+	defer pubConn.Close()
+	go h.HandleCon(ctx, serverConn, stg)
+	pubReader := bufio.NewReader(pubConn)
+
+	if resp := request(subConn, subReader, "sub", "news.*", ""); string(resp) != `O{"type":"subscribe","pattern":"news.*","count":1}`+"\u0004" {
+		t.Errorf("error subscribing, got %q\n", resp)
+		return
+	}
+
+	// only SUB and UNS are served while subscribed
+	if resp := request(subConn, subReader, "get", KEY, ""); resp[0] != NOK || !bytes.Contains(resp, []byte(errors.PubSubErr)) {
+		t.Errorf("error rejecting command of subscribed connection, got %q\n", resp)
+		return
+	}
+
+	if resp := request(pubConn, pubReader, "pub", "news.sport", "goal"); string(resp) != "O1\u0004" {
+		t.Errorf("error publishing message, got %q\n", resp)
+		return
+	}
+
+	respBuf, err := subReader.ReadBytes(EOT)
+	if err != nil {
+		t.Errorf("error reading message: %s\n", err)
+		return
+	}
+
+	if string(respBuf) != `O{"type":"message","channel":"news.sport","pattern":"news.*","message":"goal"}`+"\u0004" {
+		t.Errorf("error receiving message, got %q\n", respBuf)
+		return
+	}
+
+	// the connection serves other commands once it's unsubscribed from all patterns
+	if resp := request(subConn, subReader, "uns", "", ""); string(resp) != `O{"type":"unsubscribe","pattern":"","count":0}`+"\u0004" {
+		t.Errorf("error unsubscribing, got %q\n", resp)
+		return
+	}
+
+	if resp := request(subConn, subReader, "png", "", ""); string(resp) != "OPONG\u0004" {
+		t.Errorf("error running command after unsubscribing, got %q\n", resp)
+		return
+	}
+
+	if resp := request(pubConn, pubReader, "pub", "news.sport", "goal"); string(resp) != "O0\u0004" {
+		t.Errorf("error publishing message without subscribers, got %q\n", resp)
+		return
+	}
+}
+
+func TestSummary(t *testing.T) {
+	ctx := context.Background()
+
+	primary, replica := initStorage(), initStorage()
+	var file []entity.ExportData
+	for i := 0; i < 1000; i++ {
+		key, value := fmt.Sprintf("key%d", i), fmt.Sprintf("val%d", i)
+		primary.storage[key] = value
+		replica.storage[key] = value
+		file = append(file, entity.ExportData{Key: key, Value: value})
+	}
+
+	replica.storage["key1"] = "changed"
+	delete(replica.storage, "key2")
+	replica.storage["added"] = "value"
+
+	primaryConn, serverConn := net.Pipe()
+	defer primaryConn.Close()
+	go HandleCon(ctx, serverConn, primary)
+
+	replicaConn, serverConn := net.Pipe()
+	defer replicaConn.Close()
+	go HandleCon(ctx, serverConn, replica)
+
+	diff, err := cli.Diff(cli.NewServerSummary(primaryConn), cli.NewServerSummary(replicaConn))
+	if err != nil {
+		t.Errorf("error comparing servers: %s\n", err)
+		return
+	}
+
+	if !reflect.DeepEqual(diff.Added, []string{"added"}) || !reflect.DeepEqual(diff.Removed, []string{"key2"}) ||
+		!reflect.DeepEqual(diff.Changed, []string{"key1"}) {
+		t.Errorf("error comparing servers, got %+v\n", diff)
+		return
+	}
+
+	// the tree is built once per comparison
+	if primary.exports != 1 || replica.exports != 1 {
+		t.Errorf("error comparing servers: got %d and %d exports, expected 1\n", primary.exports, replica.exports)
+		return
+	}
+
+	// summaries of the server match summaries of its export
+	diff, err = cli.Diff(cli.NewServerSummary(primaryConn), merkle.New(file))
+	if err != nil || len(diff.Added)+len(diff.Removed)+len(diff.Changed) != 0 {
+		t.Errorf("error comparing server with export, got %+v, %v\n", diff, err)
+		return
+	}
+
+	// the next comparison sees changes made after the previous one
+	primary.storage["key3"] = "changed"
+	diff, err = cli.Diff(cli.NewServerSummary(primaryConn), merkle.New(file))
+	if err != nil || !reflect.DeepEqual(diff.Changed, []string{"key3"}) {
+		t.Errorf("error comparing changed server with export, got %+v, %v\n", diff, err)
+		return
+	}
+
+	if _, err := cli.NewServerSummary(primaryConn).Nodes("012", 1); err == nil {
+		t.Errorf("error requesting summary: invalid path is accepted\n")
+		return
+	}
+}
@@ -7,6 +7,8 @@ import (
 	"context"
 	"encoding/json"
 
+	"github.com/arsenalzp/keyvalstore/internal/server/acl"
+	"github.com/arsenalzp/keyvalstore/internal/server/errors"
 	entity "github.com/arsenalzp/keyvalstore/internal/server/storage/entity"
 )
 
@@ -21,6 +23,23 @@ func (ds *dataStruct) imp(ctx context.Context, data []byte, dataCh chan<- []byte
 		return
 	}
 
+	// import is rejected if any key isn't permitted to the client
+	for _, item := range importItems {
+		if !ds.allowed(acl.Import, item.Key) {
+			errCh <- denied(acl.Import)
+			return
+		}
+	}
+
+	// keys exported as secret are imported as secret by the flag only,
+	// the marker of the storage can't be forged by the value
+	for _, item := range importItems {
+		if _, ok := unmarkSecret(item.Value); ok {
+			errCh <- errors.New("imported value starts with the secret marker", errors.SecretMarkerErr, nil)
+			return
+		}
+	}
+
 	_, err = ds.Import(ctx, importItems)
 	if err != nil {
 		errCh <- err
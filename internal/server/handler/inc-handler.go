@@ -0,0 +1,30 @@
+// Handle incoming connection by reading command from a connection
+// then run related handler.
+
+package handler
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/arsenalzp/keyvalstore/internal/server/errors"
+	strg "github.com/arsenalzp/keyvalstore/internal/server/storage"
+)
+
+// handle INC command, the value is the signed delta of the counter
+// and the new value of the counter is returned
+func (ds *dataStruct) inc(ctx context.Context, key, val []byte, dataCh chan<- []byte, errCh chan<- error) {
+	delta, err := strconv.ParseInt(string(clearKey(val)), 10, 64)
+	if err != nil {
+		errCh <- errors.New("invalid counter delta", errors.CounterValueErr, err)
+		return
+	}
+
+	value, err := strg.Increment(ctx, ds.Storage, string(clearKey(key)), delta)
+	if err != nil {
+		errCh <- err
+		return
+	}
+
+	dataCh <- []byte(strconv.FormatInt(value, 10))
+}
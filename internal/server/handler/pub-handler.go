@@ -0,0 +1,154 @@
+// Handle incoming connection by reading command from a connection
+// then run related handler.
+
+package handler
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/arsenalzp/keyvalstore/internal/server/acl"
+	"github.com/arsenalzp/keyvalstore/internal/server/errors"
+	"github.com/arsenalzp/keyvalstore/internal/server/pubsub"
+)
+
+// Frame of the subscribed connection: acknowledgement of SUB and UNS commands
+type subFrame struct {
+	Type    string `json:"type"` // subscribe or unsubscribe
+	Pattern string `json:"pattern"`
+	Count   int    `json:"count"` // number of patterns of the connection
+}
+
+// Frame of the subscribed connection: the published message
+type msgFrame struct {
+	Type string `json:"type"` // message
+	pubsub.Message
+}
+
+// handle PUB command, the number of subscribers receiving the message is returned
+func (s *session) pub(channel, message []byte, dataCh chan<- []byte, errCh chan<- error) {
+	if s.h.PubSub == nil {
+		errCh <- errors.New("publish/subscribe is disabled", errors.PubSubErr, nil)
+		return
+	}
+
+	n := s.h.PubSub.Publish(s.tenant, string(clearKey(channel)), string(clearKey(message)))
+	dataCh <- []byte(strconv.Itoa(n))
+}
+
+// handle SUB command, the connection is subscribed to channels matching the pattern
+// and receives messages until it's unsubscribed from all patterns by UNS command;
+// only SUB and UNS commands are served meanwhile. Every frame is sent in JSON
+// Returns false if the connection has to be closed
+func (s *session) subscribe(ctx context.Context, con net.Conn, reader *bufio.Reader, writer *bufio.Writer, buf []byte, start time.Time) bool {
+	if s.h.PubSub == nil {
+		err := errors.New("publish/subscribe is disabled", errors.PubSubErr, nil)
+		s.h.setWriteDeadline(con)
+		sendData(writeError(writeStatus(make([]byte, 64), NOK), err), *writer)
+		logRequest(s.log, "sub", buf, start, err)
+		return true
+	}
+
+	sub := s.h.PubSub.Subscribe(s.tenant)
+
+	var mu sync.Mutex // serializes frames of messages and responses
+	send := func(resp []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		s.h.setWriteDeadline(con)
+		return sendData(resp, *writer)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for msg := range sub.C {
+			data, _ := json.Marshal(msgFrame{Type: "message", Message: msg})
+			if err := send(writeEOT(append(writeStatus(make([]byte, 1), OK), data...))); err != nil {
+				con.Close()
+				return
+			}
+		}
+
+		if sub.Dropped() {
+			err := errors.New("subscriber is too slow", errors.SlowSubscriberErr, nil)
+			s.log.Warn("disconnecting slow subscriber", "code", errors.Code(err))
+			send(writeError(writeStatus(make([]byte, 64), NOK), err))
+			con.Close()
+		}
+	}()
+
+	// messages are sent until the subscriber is closed
+	defer wg.Wait()
+	defer sub.Close()
+
+	// subscribers wait for messages without the idle timeout
+	con.SetReadDeadline(time.Time{})
+
+	for {
+		cmd := getCmd(buf)
+
+		var frame subFrame
+		var err error
+
+		switch cmd {
+		case "sub":
+			frame.Type, frame.Pattern = "subscribe", string(clearKey(readKey(buf)))
+			if !s.allowed(acl.Subscribe, frame.Pattern) {
+				err = denied(acl.Subscribe)
+			} else {
+				err = sub.Add(frame.Pattern)
+			}
+		case "uns":
+			frame.Type, frame.Pattern = "unsubscribe", string(clearKey(readKey(buf)))
+			sub.Remove(frame.Pattern)
+		default:
+			err = errors.New("only SUB and UNS are served", errors.PubSubErr, nil)
+		}
+		frame.Count = sub.Count()
+
+		// the last message is sent before the connection leaves the subscribed mode
+		if frame.Count == 0 {
+			sub.Close()
+			wg.Wait()
+		}
+
+		var resp []byte
+		if err != nil {
+			resp = writeError(writeStatus(make([]byte, 64), NOK), err)
+		} else {
+			data, _ := json.Marshal(frame)
+			resp = writeEOT(append(writeStatus(make([]byte, 1), OK), data...))
+		}
+
+		werr := send(resp)
+		if cmd != "" {
+			if werr != nil {
+				err = errors.New("subscribe error", errors.WriteClientErr, werr)
+			}
+			logRequest(s.log, cmd, buf, start, err)
+		}
+
+		if werr != nil {
+			return false
+		}
+
+		if frame.Count == 0 {
+			return true
+		}
+
+		buf, err = reader.ReadBytes(EOT)
+		if err != nil {
+			return false
+		}
+		start = time.Now()
+	}
+}
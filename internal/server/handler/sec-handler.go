@@ -0,0 +1,31 @@
+// Handle incoming connection by reading command from a connection
+// then run related handler.
+
+package handler
+
+import (
+	"context"
+
+	entity "github.com/arsenalzp/keyvalstore/internal/server/storage/entity"
+)
+
+// handle SEC command, the value is stored as secret
+func (ds *dataStruct) sec(ctx context.Context, key, val []byte, dataCh chan<- []byte, errCh chan<- error) {
+	_, err := ds.Insert(ctx, string(clearKey(key)), markSecret(string(clearKey(val))))
+	if err != nil {
+		errCh <- err
+		return
+	}
+
+	dataCh <- []byte{}
+}
+
+func markSecret(value string) string {
+	return entity.StoredValue(value, true)
+}
+
+// Get the value without the secret marker
+// Returns true if the value is secret
+func unmarkSecret(value string) (string, bool) {
+	return entity.UnmarkSecret(value)
+}
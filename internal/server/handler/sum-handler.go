@@ -0,0 +1,69 @@
+// Handle incoming connection by reading command from a connection
+// then run related handler.
+
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+
+	"github.com/arsenalzp/keyvalstore/internal/server/errors"
+	"github.com/arsenalzp/keyvalstore/internal/server/storage/merkle"
+)
+
+// value of SUMMARY command requesting hashes of pairs of the range
+const summaryEntries = "entries"
+
+// value of SUMMARY command requesting the hash of the range itself
+const summaryRoot = "0"
+
+// handle SUMMARY command, the key is the path of the range and the value is
+// number of levels of ranges below it or "entries"; summaries are computed
+// over keys the client is permitted to export. A comparison starts with the
+// hash of the root range, so the tree is built by that request and reused by
+// the following requests on the connection until the next comparison.
+func (ds *dataStruct) sum(ctx context.Context, key, val []byte, dataCh chan<- []byte, errCh chan<- error) {
+	path, mode := string(clearKey(key)), string(clearKey(val))
+
+	if err := merkle.ParsePath(path); err != nil {
+		errCh <- err
+		return
+	}
+
+	tree := ds.summary.Load()
+	if (path == "" && mode == summaryRoot) || tree == nil {
+		exports, err := ds.exported(ctx)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		tree = merkle.New(exports)
+		ds.summary.Store(tree)
+	}
+
+	var summary any
+	var err error
+	if mode == summaryEntries {
+		summary, err = tree.Entries(path)
+	} else {
+		levels, convErr := strconv.Atoi(mode)
+		if convErr != nil {
+			errCh <- errors.New("invalid range levels", errors.SummaryErr, convErr)
+			return
+		}
+		summary, err = tree.Nodes(path, levels)
+	}
+	if err != nil {
+		errCh <- err
+		return
+	}
+
+	data, err := json.Marshal(summary)
+	if err != nil {
+		errCh <- err
+		return
+	}
+
+	dataCh <- data
+}
@@ -0,0 +1,134 @@
+// Handle incoming connection by reading command from a connection
+// then run related handler.
+
+package handler
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/arsenalzp/keyvalstore/internal/server/acl"
+	"github.com/arsenalzp/keyvalstore/internal/server/errors"
+	"github.com/arsenalzp/keyvalstore/internal/server/metrics"
+	"github.com/arsenalzp/keyvalstore/internal/server/storage/changelog"
+	"github.com/arsenalzp/keyvalstore/internal/server/storage/tenant"
+)
+
+// value of WCH command watching keys starting with the key
+const watchPrefix = "prefix"
+
+// Change of the watched key pushed to the client
+type watchEvent struct {
+	Op      changelog.Op `json:"op"` // set or del
+	Key     string       `json:"key"`
+	Value   string       `json:"value,omitempty"`
+	Version uint64       `json:"version"` // sequence number of the change in the server change log
+	Time    time.Time    `json:"time"`
+}
+
+// handle WCH command, changes of the key or keys with the prefix made after
+// the command are pushed to the client until the connection is closed
+// The client is acknowledged by the empty OK response, then every event is sent
+// in JSON; the stream is closed by the error response if the client falls
+// behind the change log
+func (s *session) watch(ctx context.Context, con net.Conn, reader *bufio.Reader, writer *bufio.Writer, buf []byte, start time.Time) {
+	key := string(clearKey(readKey(buf)))
+	prefix := string(clearKey(readValue(buf))) == watchPrefix
+
+	var err error
+	switch {
+	case !s.h.Watch || s.h.Changes == nil:
+		err = errors.New("watching is disabled", errors.WatchErr, nil)
+	case key == "" && !prefix:
+		err = errors.New("key is empty", errors.WatchErr, nil)
+	case s.policy != nil && prefix && !s.policy.Granted(s.id, acl.Read):
+		err = denied(acl.Read)
+	case !prefix && !s.allowed(acl.Read, key):
+		err = denied(acl.Read)
+	}
+
+	// events are published after the position, the client is
+	// acknowledged once changes are followed
+	seq := uint64(0)
+	if err == nil {
+		seq = s.h.Changes.Seq()
+	}
+
+	s.h.setWriteDeadline(con)
+	if err != nil {
+		sendData(writeError(writeStatus(make([]byte, 64), NOK), err), *writer)
+		logRequest(s.log, "wch", buf, start, err)
+		return
+	}
+
+	if err := sendData(writeEOT(writeStatus(make([]byte, 1), OK)), *writer); err != nil {
+		logRequest(s.log, "wch", buf, start, errors.New("watch error", errors.WriteClientErr, err))
+		return
+	}
+
+	logRequest(s.log, "wch", buf, start, nil)
+
+	metrics.Watchers.Inc()
+	defer metrics.Watchers.Dec()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// the watch is stopped when the client closes the connection or sends anything
+	con.SetReadDeadline(time.Time{})
+	go func() {
+		reader.ReadByte()
+		cancel()
+	}()
+
+	for {
+		ev, err := s.h.Changes.Next(ctx, seq)
+		if err != nil {
+			if ctx.Err() == nil {
+				err = errors.New("watch error", errors.WatchErr, err)
+				s.h.setWriteDeadline(con)
+				sendData(writeError(writeStatus(make([]byte, 64), NOK), err), *writer)
+				s.log.Warn("watch stopped", "error", err, "code", errors.Code(err))
+			}
+			return
+		}
+		seq = ev.Seq
+
+		k, ok := s.watched(ev.Key, key, prefix)
+		if !ok {
+			continue
+		}
+
+		data, err := json.Marshal(watchEvent{Op: ev.Op, Key: k, Value: ev.Value, Version: ev.Seq, Time: ev.Time})
+		if err != nil {
+			continue
+		}
+
+		s.h.setWriteDeadline(con)
+		if err := sendData(writeEOT(append(writeStatus(make([]byte, 1), OK), data...)), *writer); err != nil {
+			return
+		}
+	}
+}
+
+// Get the key of the client if the stored key is watched and readable by the client
+func (s *session) watched(stored, key string, prefix bool) (string, bool) {
+	k := stored
+	if s.h.TenantField != "" {
+		name, tk := tenant.Split(stored)
+		if name != s.tenant {
+			return "", false
+		}
+		k = tk
+	}
+
+	if prefix && !strings.HasPrefix(k, key) || !prefix && k != key {
+		return "", false
+	}
+
+	return k, s.allowed(acl.Read, k)
+}
@@ -0,0 +1,114 @@
+// Identity of a client derived from its verified certificate.
+
+package identity
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"net"
+	"strings"
+)
+
+type Identity struct {
+	Subject            string   // distinguished name of the certificate subject
+	CommonName         string   // subject CN
+	Organization       []string // subject O
+	OrganizationalUnit []string // subject OU
+	SANs               []string // DNS names, e-mail addresses and URIs
+	Serial             string   // serial number in hex
+	Fingerprint        string   // SHA-256 fingerprint of the certificate in hex
+}
+
+// Get identity from the given certificate
+func FromCert(crt *x509.Certificate) Identity {
+	id := Identity{
+		Subject:            crt.Subject.String(),
+		CommonName:         crt.Subject.CommonName,
+		Organization:       crt.Subject.Organization,
+		OrganizationalUnit: crt.Subject.OrganizationalUnit,
+		Serial:             crt.SerialNumber.Text(16),
+	}
+
+	id.SANs = append(id.SANs, crt.DNSNames...)
+	id.SANs = append(id.SANs, crt.EmailAddresses...)
+	for _, uri := range crt.URIs {
+		id.SANs = append(id.SANs, uri.String())
+	}
+
+	sum := sha256.Sum256(crt.Raw)
+	id.Fingerprint = hex.EncodeToString(sum[:])
+
+	return id
+}
+
+// Get identity of the client connected by con
+// The second value is false if the connection doesn't carry a client certificate
+func FromConn(con net.Conn) (Identity, bool) {
+	tlsCon, ok := con.(*tls.Conn)
+	if !ok {
+		return Identity{}, false
+	}
+
+	state := tlsCon.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return Identity{}, false
+	}
+
+	return FromCert(state.PeerCertificates[0]), true
+}
+
+// Name of the identity, subject CN or the first SAN if CN is empty
+func (id Identity) Name() string {
+	if id.CommonName != "" {
+		return id.CommonName
+	}
+
+	if len(id.SANs) > 0 {
+		return id.SANs[0]
+	}
+
+	return id.Subject
+}
+
+// Check whether the identity matches the selector
+// Selector is one of "*", "cn:NAME", "o:NAME", "ou:NAME", "san:NAME",
+// "subject:DN" or "serial:HEX"; selector without a prefix matches CN or any SAN
+func (id Identity) Matches(selector string) bool {
+	if selector == "*" {
+		return true
+	}
+
+	kind, value, ok := strings.Cut(selector, ":")
+	if !ok {
+		return id.CommonName == selector || contains(id.SANs, selector)
+	}
+
+	switch strings.ToLower(kind) {
+	case "cn":
+		return id.CommonName == value
+	case "o":
+		return contains(id.Organization, value)
+	case "ou":
+		return contains(id.OrganizationalUnit, value)
+	case "san":
+		return contains(id.SANs, value)
+	case "subject":
+		return id.Subject == value
+	case "serial":
+		return strings.EqualFold(id.Serial, value)
+	default:
+		return id.CommonName == selector || contains(id.SANs, selector)
+	}
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,110 @@
+package identity
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFromCert(t *testing.T) {
+	crt, err := createCert(pkix.Name{
+		CommonName:         "batch-job",
+		Organization:       []string{"GOKEYVAL"},
+		OrganizationalUnit: []string{"team-a"},
+	}, []string{"job.example.com"})
+	if err != nil {
+		t.Errorf("error creating certificate: %s\n", err)
+		return
+	}
+
+	id := FromCert(crt)
+
+	if id.CommonName != "batch-job" || id.Name() != "batch-job" {
+		t.Errorf("error getting identity name, expected %s, got %s\n", "batch-job", id.Name())
+		return
+	}
+
+	if len(id.OrganizationalUnit) != 1 || id.OrganizationalUnit[0] != "team-a" {
+		t.Errorf("error getting identity OU, got %v\n", id.OrganizationalUnit)
+		return
+	}
+
+	if len(id.SANs) != 1 || id.SANs[0] != "job.example.com" {
+		t.Errorf("error getting identity SANs, got %v\n", id.SANs)
+		return
+	}
+
+	if id.Serial != "2a" || len(id.Fingerprint) != 64 {
+		t.Errorf("error getting identity serial and fingerprint, got %s and %s\n", id.Serial, id.Fingerprint)
+		return
+	}
+}
+
+func TestMatches(t *testing.T) {
+	id := Identity{
+		Subject:            "CN=batch-job,OU=team-a,O=GOKEYVAL",
+		CommonName:         "batch-job",
+		Organization:       []string{"GOKEYVAL"},
+		OrganizationalUnit: []string{"team-a"},
+		SANs:               []string{"job.example.com"},
+		Serial:             "2a",
+	}
+
+	for selector, expected := range map[string]bool{
+		"*":                    true,
+		"batch-job":            true,
+		"job.example.com":      true,
+		"cn:batch-job":         true,
+		"cn:job.example.com":   false,
+		"o:GOKEYVAL":           true,
+		"ou:team-a":            true,
+		"ou:team-b":            false,
+		"san:job.example.com":  true,
+		"serial:2A":            true,
+		"subject:CN=batch-job": false,
+		"other":                false,
+	} {
+		if id.Matches(selector) != expected {
+			t.Errorf("error matching identity with selector %s, expected %t\n", selector, expected)
+		}
+	}
+}
+
+func TestFromConnWithoutTLS(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	if _, ok := FromConn(serverConn); ok {
+		t.Errorf("error getting identity: plain connection has an identity\n")
+		return
+	}
+}
+
+func createCert(subject pkix.Name, dnsNames []string) (*x509.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      subject,
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return x509.ParseCertificate(der)
+}
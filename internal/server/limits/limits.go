@@ -0,0 +1,74 @@
+// Limits of concurrent client connections.
+
+package limits
+
+import (
+	"sync"
+
+	"github.com/arsenalzp/keyvalstore/internal/server/errors"
+)
+
+// ConnLimiter limits number of concurrent connections
+// globally and per client certificate, zero value means unlimited
+type ConnLimiter struct {
+	Max          int // maximum number of connections
+	MaxPerClient int // maximum number of connections of a single client certificate
+
+	mu        sync.Mutex
+	total     int
+	perClient map[string]int
+}
+
+// Acquire a slot for a new connection
+// Returns error if the maximum number of connections is reached
+func (l *ConnLimiter) Acquire() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.Max > 0 && l.total >= l.Max {
+		return errors.New("too many connections", errors.ConnLimitErr, nil)
+	}
+	l.total++
+
+	return nil
+}
+
+// Release the slot of a closed connection
+func (l *ConnLimiter) Release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.total > 0 {
+		l.total--
+	}
+}
+
+// Acquire a slot for a new connection of the client
+// Returns error if the maximum number of client's connections is reached
+func (l *ConnLimiter) AcquireClient(client string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.perClient == nil {
+		l.perClient = make(map[string]int)
+	}
+
+	if l.MaxPerClient > 0 && l.perClient[client] >= l.MaxPerClient {
+		return errors.New("too many connections of the client", errors.ConnPerClientErr, nil)
+	}
+	l.perClient[client]++
+
+	return nil
+}
+
+// Release the slot of a closed client's connection
+func (l *ConnLimiter) ReleaseClient(client string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.perClient[client] <= 1 {
+		delete(l.perClient, client)
+		return
+	}
+	l.perClient[client]--
+}
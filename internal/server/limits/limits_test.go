@@ -0,0 +1,67 @@
+package limits
+
+import "testing"
+
+func TestConnLimiter(t *testing.T) {
+	l := &ConnLimiter{Max: 2, MaxPerClient: 1}
+
+	if err := l.Acquire(); err != nil {
+		t.Errorf("error acquiring connection slot: %s\n", err)
+		return
+	}
+
+	if err := l.Acquire(); err != nil {
+		t.Errorf("error acquiring connection slot: %s\n", err)
+		return
+	}
+
+	if err := l.Acquire(); err == nil {
+		t.Errorf("error acquiring connection slot: limit of connections isn't enforced\n")
+		return
+	}
+
+	l.Release()
+
+	if err := l.Acquire(); err != nil {
+		t.Errorf("error acquiring released connection slot: %s\n", err)
+		return
+	}
+
+	if err := l.AcquireClient("client-a"); err != nil {
+		t.Errorf("error acquiring client connection slot: %s\n", err)
+		return
+	}
+
+	if err := l.AcquireClient("client-a"); err == nil {
+		t.Errorf("error acquiring client connection slot: limit of client connections isn't enforced\n")
+		return
+	}
+
+	if err := l.AcquireClient("client-b"); err != nil {
+		t.Errorf("error acquiring connection slot of another client: %s\n", err)
+		return
+	}
+
+	l.ReleaseClient("client-a")
+
+	if err := l.AcquireClient("client-a"); err != nil {
+		t.Errorf("error acquiring released client connection slot: %s\n", err)
+		return
+	}
+}
+
+func TestUnlimited(t *testing.T) {
+	l := &ConnLimiter{}
+
+	for i := 0; i < 100; i++ {
+		if err := l.Acquire(); err != nil {
+			t.Errorf("error acquiring connection slot: %s\n", err)
+			return
+		}
+
+		if err := l.AcquireClient("client"); err != nil {
+			t.Errorf("error acquiring client connection slot: %s\n", err)
+			return
+		}
+	}
+}
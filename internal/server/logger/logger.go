@@ -0,0 +1,111 @@
+// Structured logging of the server.
+// It configures log/slog output format and runtime-adjustable log level.
+
+package logger
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Level of the server logger, it can be changed at runtime
+var Level = new(slog.LevelVar)
+
+// whether keys are logged in cleartext, they are hashed by default
+var clearKeys atomic.Bool
+
+// Initialize the default logger writing into w
+func Init(w io.Writer, format, level string, hash bool) error {
+	lvl, err := ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	Level.Set(lvl)
+
+	clearKeys.Store(!hash)
+
+	opts := &slog.HandlerOptions{Level: Level}
+
+	var h slog.Handler
+	switch strings.ToLower(format) {
+	case "", FormatText:
+		h = slog.NewTextHandler(w, opts)
+	case FormatJSON:
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+
+	slog.SetDefault(slog.New(h))
+
+	return nil
+}
+
+// Parse log level name, empty name means info level
+func ParseLevel(s string) (slog.Level, error) {
+	var lvl slog.Level
+
+	if s == "" {
+		return slog.LevelInfo, nil
+	}
+
+	if err := lvl.UnmarshalText([]byte(s)); err != nil {
+		return lvl, err
+	}
+
+	return lvl, nil
+}
+
+// Key attribute of the log record, the key is hashed unless it's configured
+// otherwise, so values of keys aren't disclosed by logs
+func Key(key string) slog.Attr {
+	if clearKeys.Load() {
+		return slog.String("key", key)
+	}
+
+	sum := sha256.Sum256([]byte(key))
+
+	return slog.String("key_hash", hex.EncodeToString(sum[:8]))
+}
+
+// HTTP handler to get the current log level by GET request
+// and to change it by PUT request with the level name in the body
+func LevelHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			body, err := io.ReadAll(io.LimitReader(r.Body, 64))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			lvl, err := ParseLevel(strings.TrimSpace(string(body)))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			Level.Set(lvl)
+			slog.Info("log level changed", "level", lvl.String())
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, Level.Level().String())
+	})
+}
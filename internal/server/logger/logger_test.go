@@ -0,0 +1,77 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestInitJSON(t *testing.T) {
+	var buf bytes.Buffer
+
+	defer slog.SetDefault(slog.Default())
+
+	err := Init(&buf, FormatJSON, "warn", false)
+	if err != nil {
+		t.Errorf("error initializing logger: %s\n", err)
+		return
+	}
+
+	slog.Info("skipped record")
+	slog.Warn("logged record", Key("key1"))
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Errorf("error parsing JSON log record: %s, record: %s\n", err, buf.String())
+		return
+	}
+
+	if record["msg"] != "logged record" || record["key"] != "key1" {
+		t.Errorf("error logging record, got: %s\n", buf.String())
+		return
+	}
+}
+
+func TestHashedKey(t *testing.T) {
+	clearKeys.Store(false)
+
+	attr := Key("secret-key")
+	if attr.Key != "key_hash" || strings.Contains(attr.Value.String(), "secret") {
+		t.Errorf("error hashing key, got: %s=%s\n", attr.Key, attr.Value)
+		return
+	}
+}
+
+func TestInvalidFormat(t *testing.T) {
+	if err := Init(&bytes.Buffer{}, "xml", "", false); err == nil {
+		t.Errorf("error initializing logger: unknown format is accepted\n")
+		return
+	}
+}
+
+func TestLevelHandler(t *testing.T) {
+	Level.Set(slog.LevelInfo)
+	defer Level.Set(slog.LevelInfo)
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPut, "/loglevel", strings.NewReader("debug"))
+	LevelHandler().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK || Level.Level() != slog.LevelDebug {
+		t.Errorf("error changing log level, status %d, level %s\n", rec.Code, Level.Level())
+		return
+	}
+
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPut, "/loglevel", strings.NewReader("verbose"))
+	LevelHandler().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("error changing log level, expected status %d, got %d\n", http.StatusBadRequest, rec.Code)
+		return
+	}
+}
@@ -0,0 +1,350 @@
+// Minimal implementation of counters, gauges and histograms
+// exposed in the Prometheus text format.
+
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Default histogram buckets (in seconds) for a request latency
+var DefBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Sample is a single value of a metric with its label values
+type Sample struct {
+	Labels []string
+	Value  float64
+}
+
+// collector is implemented by every metric kept in the Registry
+type collector interface {
+	write(w *bufio.Writer) error
+}
+
+// Registry keeps metrics and writes them out in the text format
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+// Default registry of the server metrics
+var Default = &Registry{}
+
+func (r *Registry) Register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.collectors = append(r.collectors, c)
+}
+
+// WriteText writes all registered metrics into w
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	collectors := make([]collector, len(r.collectors))
+	copy(collectors, r.collectors)
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, c := range collectors {
+		if err := c.write(bw); err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+// desc describes a metric family
+type desc struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (d *desc) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, escapeHelp(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.kind)
+}
+
+// series is a value of a metric for the certain label values
+type series struct {
+	labels []string
+	value  float64
+}
+
+// vec keeps series of a counter or a gauge
+type vec struct {
+	desc
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+func newVec(name, help, kind string, labels []string) *vec {
+	return &vec{
+		desc:   desc{name: name, help: help, kind: kind, labels: labels},
+		series: make(map[string]*series),
+	}
+}
+
+// get series for the label values, v.mu must be held
+func (v *vec) get(lvs []string) *series {
+	if len(lvs) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s: expected %d label values, got %d", v.name, len(v.labels), len(lvs)))
+	}
+
+	key := strings.Join(lvs, "\xff")
+
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{labels: append([]string(nil), lvs...)}
+		v.series[key] = s
+	}
+
+	return s
+}
+
+func (v *vec) add(delta float64, lvs []string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.get(lvs).value += delta
+}
+
+func (v *vec) set(val float64, lvs []string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.get(lvs).value = val
+}
+
+func (v *vec) write(w *bufio.Writer) error {
+	v.mu.Lock()
+	samples := make([]Sample, 0, len(v.series))
+	for _, s := range v.series {
+		samples = append(samples, Sample{Labels: s.labels, Value: s.value})
+	}
+	v.mu.Unlock()
+
+	// metrics without labels are always exposed
+	if len(samples) == 0 && len(v.labels) == 0 {
+		samples = append(samples, Sample{})
+	}
+
+	return writeSamples(w, &v.desc, samples)
+}
+
+// CounterVec is a monotonically increasing value partitioned by labels
+type CounterVec struct {
+	*vec
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{newVec(name, help, "counter", labels)}
+}
+
+func (c *CounterVec) Inc(lvs ...string) {
+	c.add(1, lvs)
+}
+
+func (c *CounterVec) Add(delta float64, lvs ...string) {
+	if delta < 0 {
+		panic(fmt.Sprintf("metric %s: counter cannot decrease", c.name))
+	}
+	c.add(delta, lvs)
+}
+
+// GaugeVec is a value which can go up and down partitioned by labels
+type GaugeVec struct {
+	*vec
+}
+
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{newVec(name, help, "gauge", labels)}
+}
+
+func (g *GaugeVec) Inc(lvs ...string) {
+	g.add(1, lvs)
+}
+
+func (g *GaugeVec) Dec(lvs ...string) {
+	g.add(-1, lvs)
+}
+
+func (g *GaugeVec) Set(val float64, lvs ...string) {
+	g.set(val, lvs)
+}
+
+// GaugeFunc is a gauge which samples are collected by the callback on every scrape
+type GaugeFunc struct {
+	desc
+	fn func() []Sample
+}
+
+func NewGaugeFunc(name, help string, fn func() []Sample, labels ...string) *GaugeFunc {
+	return &GaugeFunc{
+		desc: desc{name: name, help: help, kind: "gauge", labels: labels},
+		fn:   fn,
+	}
+}
+
+func (g *GaugeFunc) write(w *bufio.Writer) error {
+	return writeSamples(w, &g.desc, g.fn())
+}
+
+// histogram keeps observations of the certain label values
+type histogram struct {
+	labels []string
+	counts []uint64 // cumulative counters are calculated on write
+	count  uint64
+	sum    float64
+}
+
+// HistogramVec counts observations in configurable buckets partitioned by labels
+type HistogramVec struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogram
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	b := append([]float64(nil), buckets...)
+	sort.Float64s(b)
+
+	return &HistogramVec{
+		desc:    desc{name: name, help: help, kind: "histogram", labels: labels},
+		buckets: b,
+		series:  make(map[string]*histogram),
+	}
+}
+
+func (h *HistogramVec) Observe(val float64, lvs ...string) {
+	if len(lvs) != len(h.labels) {
+		panic(fmt.Sprintf("metric %s: expected %d label values, got %d", h.name, len(h.labels), len(lvs)))
+	}
+
+	key := strings.Join(lvs, "\xff")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{
+			labels: append([]string(nil), lvs...),
+			counts: make([]uint64, len(h.buckets)),
+		}
+		h.series[key] = s
+	}
+
+	for i, upper := range h.buckets {
+		if val <= upper {
+			s.counts[i]++
+			break
+		}
+	}
+	s.count++
+	s.sum += val
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) error {
+	h.writeHeader(w)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		s := h.series[k]
+
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += s.counts[i]
+			writeLine(w, h.name+"_bucket", h.labels, s.labels, "le", formatFloat(upper), float64(cumulative))
+		}
+		writeLine(w, h.name+"_bucket", h.labels, s.labels, "le", "+Inf", float64(s.count))
+		writeLine(w, h.name+"_sum", h.labels, s.labels, "", "", s.sum)
+		writeLine(w, h.name+"_count", h.labels, s.labels, "", "", float64(s.count))
+	}
+
+	return nil
+}
+
+func writeSamples(w *bufio.Writer, d *desc, samples []Sample) error {
+	sort.Slice(samples, func(i, j int) bool {
+		return strings.Join(samples[i].Labels, "\xff") < strings.Join(samples[j].Labels, "\xff")
+	})
+
+	d.writeHeader(w)
+	for _, s := range samples {
+		if len(s.Labels) != len(d.labels) {
+			return fmt.Errorf("metric %s: expected %d label values, got %d", d.name, len(d.labels), len(s.Labels))
+		}
+		writeLine(w, d.name, d.labels, s.Labels, "", "", s.Value)
+	}
+
+	return nil
+}
+
+// write a single sample line, extra label is appended if it's not empty
+func writeLine(w *bufio.Writer, name string, labels, lvs []string, extraLabel, extraValue string, val float64) {
+	w.WriteString(name)
+
+	if len(labels) > 0 || extraLabel != "" {
+		w.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", l, escapeLabel(lvs[i]))
+		}
+		if extraLabel != "" {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", extraLabel, extraValue)
+		}
+		w.WriteByte('}')
+	}
+
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(val))
+	w.WriteByte('\n')
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+}
+
+var labelReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+var helpReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelReplacer.Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return helpReplacer.Replace(s)
+}
@@ -0,0 +1,100 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCounterVec(t *testing.T) {
+	reg := &Registry{}
+	c := NewCounterVec("test_requests_total", "Number of requests.", "command", "status")
+	reg.Register(c)
+
+	c.Inc("get", "ok")
+	c.Inc("get", "ok")
+	c.Add(3, "set", "error")
+
+	var buf bytes.Buffer
+	if err := reg.WriteText(&buf); err != nil {
+		t.Errorf("error writing metrics: %s\n", err)
+		return
+	}
+
+	expected := `# HELP test_requests_total Number of requests.
+# TYPE test_requests_total counter
+test_requests_total{command="get",status="ok"} 2
+test_requests_total{command="set",status="error"} 3
+`
+	if buf.String() != expected {
+		t.Errorf("error writing metrics, expected:\n%s\ngot:\n%s\n", expected, buf.String())
+		return
+	}
+}
+
+func TestGaugeWithoutLabels(t *testing.T) {
+	reg := &Registry{}
+	g := NewGaugeVec("test_connections", "Number of connections.")
+	reg.Register(g)
+
+	var buf bytes.Buffer
+	reg.WriteText(&buf)
+
+	if !strings.Contains(buf.String(), "test_connections 0\n") {
+		t.Errorf("error writing metrics, gauge without labels isn't exposed:\n%s\n", buf.String())
+		return
+	}
+
+	g.Inc()
+	g.Inc()
+	g.Dec()
+
+	buf.Reset()
+	reg.WriteText(&buf)
+
+	if !strings.Contains(buf.String(), "test_connections 1\n") {
+		t.Errorf("error writing metrics, expected gauge value 1:\n%s\n", buf.String())
+		return
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	reg := &Registry{}
+	h := NewHistogramVec("test_duration_seconds", "Latency.", []float64{0.1, 1}, "command")
+	reg.Register(h)
+
+	h.Observe(0.05, "get")
+	h.Observe(0.5, "get")
+	h.Observe(5, "get")
+
+	var buf bytes.Buffer
+	reg.WriteText(&buf)
+
+	for _, line := range []string{
+		`test_duration_seconds_bucket{command="get",le="0.1"} 1`,
+		`test_duration_seconds_bucket{command="get",le="1"} 2`,
+		`test_duration_seconds_bucket{command="get",le="+Inf"} 3`,
+		`test_duration_seconds_sum{command="get"} 5.55`,
+		`test_duration_seconds_count{command="get"} 3`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("error writing histogram, line %q is missing:\n%s\n", line, buf.String())
+			return
+		}
+	}
+}
+
+func TestGaugeFunc(t *testing.T) {
+	reg := &Registry{}
+	reg.Register(NewGaugeFunc("test_keys", "Number of keys.", func() []Sample {
+		return []Sample{{Labels: []string{"ha\"sh"}, Value: 42}}
+	}, "backend"))
+
+	var buf bytes.Buffer
+	reg.WriteText(&buf)
+
+	if !strings.Contains(buf.String(), `test_keys{backend="ha\"sh"} 42`+"\n") {
+		t.Errorf("error writing gauge func:\n%s\n", buf.String())
+		return
+	}
+}
@@ -0,0 +1,19 @@
+// Metrics of the sharding proxy.
+// All of them are registered in the Default registry.
+
+package metrics
+
+var (
+	// number of requests sent to shards by shard name and status (ok or error)
+	ProxyRequests = NewCounterVec("keyval_proxy_backend_requests_total",
+		"Number of requests sent to shards.", "shard", "status")
+
+	// number of keys moved to added shards
+	MigratedKeys = NewCounterVec("keyval_proxy_migrated_keys_total",
+		"Number of keys moved to added shards.")
+)
+
+func init() {
+	Default.Register(ProxyRequests)
+	Default.Register(MigratedKeys)
+}
@@ -0,0 +1,134 @@
+// Metrics of the key-value server.
+// All of them are registered in the Default registry.
+
+package metrics
+
+var (
+	// number of processed commands by command name and status (ok or error)
+	Requests = NewCounterVec("keyval_requests_total",
+		"Number of processed commands.", "command", "status")
+
+	// latency of processed commands by command name
+	RequestDuration = NewHistogramVec("keyval_request_duration_seconds",
+		"Latency of processed commands in seconds.", DefBuckets, "command")
+
+	// number of errors by error code
+	Errors = NewCounterVec("keyval_errors_total",
+		"Number of errors by code.", "code")
+
+	// number of currently served client connections
+	ActiveConns = NewGaugeVec("keyval_active_connections",
+		"Number of currently served client connections.")
+
+	// number of connections rejected by connection limits by reason
+	RejectedConns = NewCounterVec("keyval_rejected_connections_total",
+		"Number of connections rejected by connection limits.", "reason")
+
+	// number of connections closed by idle timeout
+	IdleTimeouts = NewCounterVec("keyval_idle_timeouts_total",
+		"Number of connections closed by idle timeout.")
+
+	// number of failed TLS handshakes
+	HandshakeFailures = NewCounterVec("keyval_tls_handshake_failures_total",
+		"Number of failed TLS handshakes.")
+
+	// number of client certificates rejected by CRL checking
+	CRLRejections = NewCounterVec("keyval_crl_rejections_total",
+		"Number of client certificates rejected by CRL checking.")
+
+	// number of OCSP checks of client certificates by result
+	OCSPChecks = NewCounterVec("keyval_ocsp_checks_total",
+		"Number of OCSP checks of client certificates by result.", "result")
+
+	// number of requests rejected by rate limiting by request class
+	RateLimited = NewCounterVec("keyval_rate_limited_total",
+		"Number of requests rejected by rate limiting.", "class")
+
+	// number of requests denied by access control lists by permission
+	AccessDenied = NewCounterVec("keyval_access_denied_total",
+		"Number of requests denied by access control lists.", "permission")
+
+	// number of writes rejected by storage quotas by exceeded resource (keys or bytes)
+	QuotaExceeded = NewCounterVec("keyval_quota_exceeded_total",
+		"Number of writes rejected by storage quotas.", "resource")
+
+	// replication lag of the replica in seconds
+	ReplicationLag = NewGaugeVec("keyval_replication_lag_seconds",
+		"Age of the last applied event if the replica is behind the primary.")
+
+	// replication lag of the replica in events
+	ReplicationLagEvents = NewGaugeVec("keyval_replication_lag_events",
+		"Number of events of the primary not applied by the replica.")
+
+	// whether the replica is connected to the primary
+	ReplicationConnected = NewGaugeVec("keyval_replication_connected",
+		"Whether the replica is connected to the primary.")
+
+	// current term of the cluster member
+	ClusterTerm = NewGaugeVec("keyval_cluster_term",
+		"Current Raft term of the cluster member.")
+
+	// whether the cluster member is the leader
+	ClusterLeader = NewGaugeVec("keyval_cluster_leader",
+		"Whether the cluster member is the leader.")
+
+	// index of the last log entry applied to the storage
+	ClusterApplied = NewGaugeVec("keyval_cluster_applied_index",
+		"Index of the last Raft log entry applied to the storage.")
+
+	// number of connections watching changes of keys
+	Watchers = NewGaugeVec("keyval_watchers",
+		"Number of connections watching changes of keys.")
+
+	// number of connections subscribed to channels
+	Subscribers = NewGaugeVec("keyval_subscribers",
+		"Number of connections subscribed to channels.")
+
+	// number of messages published to channels
+	PublishedMessages = NewCounterVec("keyval_published_messages_total",
+		"Number of messages published to channels.")
+
+	// number of messages not delivered to slow subscribers by the policy
+	DroppedMessages = NewCounterVec("keyval_dropped_messages_total",
+		"Number of messages not delivered to slow subscribers.", "policy")
+
+	// number of webhook delivery attempts by result: ok, retry or dead
+	WebhookDeliveries = NewCounterVec("keyval_webhook_deliveries_total",
+		"Number of webhook delivery attempts.", "result")
+
+	// number of webhook deliveries waiting in the queue
+	WebhookQueue = NewGaugeVec("keyval_webhook_queue",
+		"Number of webhook deliveries waiting in the queue.")
+
+	// number of failed writes into the audit log
+	AuditFailures = NewCounterVec("keyval_audit_failures_total",
+		"Number of failed writes into the audit log.")
+)
+
+func init() {
+	Default.Register(Requests)
+	Default.Register(RequestDuration)
+	Default.Register(Errors)
+	Default.Register(ActiveConns)
+	Default.Register(RejectedConns)
+	Default.Register(IdleTimeouts)
+	Default.Register(HandshakeFailures)
+	Default.Register(CRLRejections)
+	Default.Register(OCSPChecks)
+	Default.Register(RateLimited)
+	Default.Register(AccessDenied)
+	Default.Register(QuotaExceeded)
+	Default.Register(ReplicationLag)
+	Default.Register(ReplicationLagEvents)
+	Default.Register(ReplicationConnected)
+	Default.Register(ClusterTerm)
+	Default.Register(ClusterLeader)
+	Default.Register(ClusterApplied)
+	Default.Register(Watchers)
+	Default.Register(Subscribers)
+	Default.Register(PublishedMessages)
+	Default.Register(DroppedMessages)
+	Default.Register(WebhookDeliveries)
+	Default.Register(WebhookQueue)
+	Default.Register(AuditFailures)
+}
@@ -0,0 +1,178 @@
+// OCSP revocation checking of client certificates.
+// Responses are cached until their NextUpdate, failures of the responder
+// are either tolerated (soft-fail) or reject the certificate (hard-fail).
+
+package ocsp
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arsenalzp/keyvalstore/internal/server/errors"
+	"github.com/arsenalzp/keyvalstore/internal/server/metrics"
+	xocsp "golang.org/x/crypto/ocsp"
+)
+
+const (
+	defaultTimeout = 5 * time.Second // timeout of a request to the responder
+	maxResponse    = 1 << 20         // limit of the response size
+)
+
+// Policy of handling responder failures
+type Policy string
+
+const (
+	SoftFail Policy = "soft" // certificate is accepted if its status can't be obtained
+	HardFail Policy = "hard" // certificate is rejected if its status can't be obtained
+)
+
+// Parse name of the policy
+func ParsePolicy(s string) (Policy, error) {
+	switch p := Policy(strings.ToLower(s)); p {
+	case SoftFail, HardFail:
+		return p, nil
+	default:
+		err := fmt.Errorf("unknown OCSP policy %q", s)
+		return "", errors.New("invalid OCSP policy", errors.OCSPCheckErr, err)
+	}
+}
+
+// cached status of the certificate
+type entry struct {
+	status     int
+	nextUpdate time.Time
+}
+
+// Checker of client certificates status
+type Checker struct {
+	URL    string // responder URL, AIA of the certificate is used if it's empty
+	Policy Policy
+	Client *http.Client
+
+	mu    sync.Mutex
+	cache map[string]entry // status by issuer and serial number
+	now   func() time.Time
+}
+
+func New(url string, policy Policy) *Checker {
+	return &Checker{
+		URL:    url,
+		Policy: policy,
+		Client: &http.Client{Timeout: defaultTimeout},
+		cache:  make(map[string]entry),
+		now:    time.Now,
+	}
+}
+
+// Check status of the certificate issued by the issuer
+// Returns error if the certificate is revoked or, for hard-fail policy,
+// its status can't be obtained
+func (c *Checker) Check(ctx context.Context, cert, issuer *x509.Certificate) error {
+	key := string(issuer.RawSubjectPublicKeyInfo) + cert.SerialNumber.String()
+
+	status, ok := c.cached(key)
+	if !ok {
+		var err error
+
+		status, err = c.query(ctx, key, cert, issuer)
+		if err != nil {
+			metrics.OCSPChecks.Inc("error")
+			if c.Policy == SoftFail {
+				return nil
+			}
+
+			return errors.New("unable to check certificate status", errors.OCSPCheckErr, err)
+		}
+	}
+
+	switch status {
+	case xocsp.Good:
+		metrics.OCSPChecks.Inc("good")
+		return nil
+	case xocsp.Revoked:
+		metrics.OCSPChecks.Inc("revoked")
+		return errors.New("certificate was revoked", errors.OCSPRevokedErr, nil)
+	default:
+		metrics.OCSPChecks.Inc("unknown")
+		if c.Policy == SoftFail {
+			return nil
+		}
+
+		return errors.New("certificate status is unknown", errors.OCSPCheckErr, nil)
+	}
+}
+
+func (c *Checker) cached(key string) (int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.cache[key]
+	if !ok {
+		return 0, false
+	}
+
+	if !c.now().Before(e.nextUpdate) {
+		delete(c.cache, key)
+		return 0, false
+	}
+
+	return e.status, true
+}
+
+// Query the responder, the response is cached until its NextUpdate
+func (c *Checker) query(ctx context.Context, key string, cert, issuer *x509.Certificate) (int, error) {
+	url := c.URL
+	if url == "" {
+		if len(cert.OCSPServer) == 0 {
+			return 0, fmt.Errorf("certificate has no OCSP responder")
+		}
+		url = cert.OCSPServer[0]
+	}
+
+	reqData, err := xocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(reqData))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/ocsp-request")
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("OCSP responder returned %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponse))
+	if err != nil {
+		return 0, err
+	}
+
+	// the response is signed either by the issuer or by its delegated responder
+	ocspResp, err := xocsp.ParseResponseForCert(body, cert, issuer)
+	if err != nil {
+		return 0, err
+	}
+
+	if !ocspResp.NextUpdate.IsZero() {
+		c.mu.Lock()
+		c.cache[key] = entry{status: ocspResp.Status, nextUpdate: ocspResp.NextUpdate}
+		c.mu.Unlock()
+	}
+
+	return ocspResp.Status, nil
+}
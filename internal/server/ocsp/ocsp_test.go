@@ -0,0 +1,134 @@
+package ocsp
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/arsenalzp/keyvalstore/internal/pki"
+	"github.com/arsenalzp/keyvalstore/internal/server/errors"
+)
+
+func readCert(t *testing.T, path string) *x509.Certificate {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("error reading certificate: %s\n", err)
+	}
+
+	block, _ := pem.Decode(data)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("error parsing certificate: %s\n", err)
+	}
+
+	return cert
+}
+
+// PKI with a client certificate and OCSP responder counting requests
+func newResponder(t *testing.T) (*pki.PKI, *httptest.Server, *int32) {
+	dir := t.TempDir()
+
+	if _, err := pki.Init(dir, "test CA", 24*time.Hour); err != nil {
+		t.Fatalf("error creating CA: %s\n", err)
+	}
+
+	p, err := pki.Load(dir)
+	if err != nil {
+		t.Fatalf("error loading CA: %s\n", err)
+	}
+
+	var requests int32
+	handler := p.OCSPHandler(time.Hour)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	return p, srv, &requests
+}
+
+func TestCheck(t *testing.T) {
+	p, srv, requests := newResponder(t)
+
+	rec, err := p.IssueClient(pki.ClientRequest{CommonName: "alice", OCSPURL: srv.URL, Validity: time.Hour})
+	if err != nil {
+		t.Fatalf("error issuing client certificate: %s\n", err)
+	}
+
+	cert := readCert(t, filepath.Join(p.Dir, rec.Name+".crt"))
+	issuer := readCert(t, filepath.Join(p.Dir, pki.CACertFile))
+
+	// responder is taken from AIA of the certificate
+	c := New("", HardFail)
+	if err := c.Check(context.Background(), cert, issuer); err != nil {
+		t.Errorf("error checking good certificate: %s\n", err)
+	}
+
+	if err := c.Check(context.Background(), cert, issuer); err != nil {
+		t.Errorf("error checking cached certificate: %s\n", err)
+	}
+
+	if n := atomic.LoadInt32(requests); n != 1 {
+		t.Errorf("error caching response: got %d requests, expected 1\n", n)
+	}
+
+	if _, err := p.Revoke(rec.Serial); err != nil {
+		t.Fatalf("error revoking certificate: %s\n", err)
+	}
+
+	// cached status is used until NextUpdate
+	if err := c.Check(context.Background(), cert, issuer); err != nil {
+		t.Errorf("error checking cached certificate: %s\n", err)
+	}
+
+	c.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	err = c.Check(context.Background(), cert, issuer)
+	if errors.Code(err) != errors.OCSPRevokedErr {
+		t.Errorf("error checking revoked certificate: got %v, expected %s\n", err, errors.OCSPRevokedErr)
+	}
+
+	if n := atomic.LoadInt32(requests); n != 2 {
+		t.Errorf("error refreshing response: got %d requests, expected 2\n", n)
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	p, srv, _ := newResponder(t)
+
+	rec, err := p.IssueClient(pki.ClientRequest{CommonName: "bob", Validity: time.Hour})
+	if err != nil {
+		t.Fatalf("error issuing client certificate: %s\n", err)
+	}
+
+	cert := readCert(t, filepath.Join(p.Dir, rec.Name+".crt"))
+	issuer := readCert(t, filepath.Join(p.Dir, pki.CACertFile))
+	srv.Close()
+
+	// configured URL of the stopped responder
+	if err := New(srv.URL, SoftFail).Check(context.Background(), cert, issuer); err != nil {
+		t.Errorf("error checking certificate with soft-fail policy: %s\n", err)
+	}
+
+	err = New(srv.URL, HardFail).Check(context.Background(), cert, issuer)
+	if errors.Code(err) != errors.OCSPCheckErr {
+		t.Errorf("error checking certificate with hard-fail policy: got %v, expected %s\n", err, errors.OCSPCheckErr)
+	}
+
+	// certificate without AIA
+	err = New("", HardFail).Check(context.Background(), cert, issuer)
+	if errors.Code(err) != errors.OCSPCheckErr {
+		t.Errorf("error checking certificate without responder: got %v, expected %s\n", err, errors.OCSPCheckErr)
+	}
+
+	if _, err := ParsePolicy("lenient"); err == nil {
+		t.Errorf("error parsing policy: unknown policy is accepted\n")
+	}
+}
@@ -0,0 +1,212 @@
+// Publish/subscribe channels.
+// Messages are delivered to subscribers connected at the moment of publishing
+// and aren't stored; every subscriber has a bounded buffer of messages and
+// the policy of slow consumers decides what happens when it's full.
+
+package pubsub
+
+import (
+	"path"
+	"sync"
+
+	"github.com/arsenalzp/keyvalstore/internal/server/errors"
+	"github.com/arsenalzp/keyvalstore/internal/server/metrics"
+)
+
+// default number of messages buffered per subscriber
+const DefaultBuffer = 128
+
+// Policy of subscribers which don't read messages fast enough
+type Policy string
+
+const (
+	Drop       Policy = "drop"       // messages are dropped while the buffer is full
+	Disconnect Policy = "disconnect" // the subscriber is closed once the buffer is full
+)
+
+// Parse the policy of slow subscribers, Drop is the default one
+func ParsePolicy(s string) (Policy, error) {
+	switch p := Policy(s); p {
+	case "":
+		return Drop, nil
+	case Drop, Disconnect:
+		return p, nil
+	}
+
+	return "", errors.New("invalid slow subscriber policy "+s, errors.PubSubCfgErr, nil)
+}
+
+// Message published to the channel
+type Message struct {
+	Channel string `json:"channel"`
+	Pattern string `json:"pattern"` // pattern of the subscription matching the channel
+	Message string `json:"message"`
+}
+
+// Broker delivering messages to subscribers of the channels
+// Channels are isolated by namespaces, e.g. tenants of clients
+type Broker struct {
+	buffer int
+	policy Policy
+
+	mu   sync.RWMutex
+	subs map[*Subscriber]bool
+}
+
+func New(buffer int, policy Policy) *Broker {
+	if buffer < 1 {
+		buffer = DefaultBuffer
+	}
+
+	if policy == "" {
+		policy = Drop
+	}
+
+	return &Broker{buffer: buffer, policy: policy, subs: make(map[*Subscriber]bool)}
+}
+
+// Subscriber of channels matching its patterns
+// Patterns are matched by path.Match rules, e.g. "news.*"
+type Subscriber struct {
+	C <-chan Message // delivered messages, it's closed by Close or when the slow subscriber is disconnected
+
+	broker    *Broker
+	namespace string
+	messages  chan Message
+
+	mu       sync.Mutex
+	patterns map[string]bool
+	closed   bool
+	dropped  bool // the subscriber was disconnected as the slow one
+}
+
+// Create the subscriber of channels of the namespace without patterns
+func (b *Broker) Subscribe(namespace string) *Subscriber {
+	messages := make(chan Message, b.buffer)
+	s := &Subscriber{C: messages, broker: b, namespace: namespace, messages: messages, patterns: make(map[string]bool)}
+
+	b.mu.Lock()
+	b.subs[s] = true
+	b.mu.Unlock()
+
+	metrics.Subscribers.Inc()
+
+	return s
+}
+
+// Publish the message to the channel of the namespace
+// Returns number of subscribers the message is delivered to
+func (b *Broker) Publish(namespace, channel, message string) int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	metrics.PublishedMessages.Inc()
+
+	delivered := 0
+	for s := range b.subs {
+		if s.deliver(namespace, channel, message) {
+			delivered++
+		}
+	}
+
+	return delivered
+}
+
+// Add the pattern of channels
+func (s *Subscriber) Add(pattern string) error {
+	if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+		return errors.New("invalid pattern "+pattern, errors.PubSubErr, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.patterns[pattern] = true
+	return nil
+}
+
+// Remove the pattern or all patterns if it's empty
+func (s *Subscriber) Remove(pattern string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if pattern == "" {
+		clear(s.patterns)
+	}
+	delete(s.patterns, pattern)
+}
+
+// Number of patterns of the subscriber
+func (s *Subscriber) Count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.patterns)
+}
+
+// Check whether the subscriber was disconnected as the slow one
+func (s *Subscriber) Dropped() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.dropped
+}
+
+// Stop receiving messages
+func (s *Subscriber) Close() {
+	s.broker.mu.Lock()
+	delete(s.broker.subs, s)
+	s.broker.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.close()
+}
+
+// Close the channel of messages, it's called with the lock held
+func (s *Subscriber) close() {
+	if s.closed {
+		return
+	}
+
+	s.closed = true
+	close(s.messages)
+	metrics.Subscribers.Dec()
+}
+
+// Deliver the message if the channel matches any pattern of the subscriber
+func (s *Subscriber) deliver(namespace, channel, message string) bool {
+	if namespace != s.namespace {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+
+	for pattern := range s.patterns {
+		if ok, _ := path.Match(pattern, channel); !ok {
+			continue
+		}
+
+		select {
+		case s.messages <- Message{Channel: channel, Pattern: pattern, Message: message}:
+			return true
+		default:
+		}
+
+		metrics.DroppedMessages.Inc(string(s.broker.policy))
+		if s.broker.policy == Disconnect {
+			s.dropped = true
+			s.close()
+		}
+
+		return false
+	}
+
+	return false
+}
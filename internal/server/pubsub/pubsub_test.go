@@ -0,0 +1,88 @@
+package pubsub
+
+import (
+	"testing"
+)
+
+func TestPublish(t *testing.T) {
+	b := New(0, "")
+
+	news := b.Subscribe("")
+	defer news.Close()
+	news.Add("news.*")
+
+	tenant := b.Subscribe("tenant")
+	defer tenant.Close()
+	tenant.Add("*")
+
+	if err := news.Add("[invalid"); err == nil {
+		t.Errorf("error adding pattern: invalid pattern is accepted\n")
+		return
+	}
+
+	if n := b.Publish("", "news.sport", "goal"); n != 1 {
+		t.Errorf("error publishing message, delivered to %d subscribers, expected 1\n", n)
+		return
+	}
+
+	if n := b.Publish("", "weather", "rain"); n != 0 {
+		t.Errorf("error publishing message, delivered to %d subscribers, expected 0\n", n)
+		return
+	}
+
+	msg := <-news.C
+	if msg != (Message{Channel: "news.sport", Pattern: "news.*", Message: "goal"}) {
+		t.Errorf("error receiving message, got %+v\n", msg)
+		return
+	}
+
+	// channels of namespaces are isolated
+	if n := b.Publish("tenant", "news.sport", "goal"); n != 1 || len(news.C) != 0 {
+		t.Errorf("error isolating namespaces, delivered to %d subscribers\n", n)
+		return
+	}
+
+	news.Remove("")
+	if n := news.Count(); n != 0 {
+		t.Errorf("error removing patterns, %d patterns left\n", n)
+		return
+	}
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	for _, policy := range []Policy{Drop, Disconnect} {
+		b := New(2, policy)
+
+		s := b.Subscribe("")
+		s.Add("*")
+
+		for i := 0; i < 3; i++ {
+			b.Publish("", "channel", "message")
+		}
+
+		// the buffered messages are delivered in both cases
+		received := 0
+		if policy == Disconnect {
+			for range s.C {
+				received++
+			}
+		} else {
+			for len(s.C) > 0 {
+				<-s.C
+				received++
+			}
+		}
+
+		if received != 2 || s.Dropped() != (policy == Disconnect) {
+			t.Errorf("%s: error handling slow subscriber, received %d messages, dropped %t\n", policy, received, s.Dropped())
+			return
+		}
+
+		s.Close()
+	}
+
+	if _, err := ParsePolicy("block"); err == nil {
+		t.Errorf("error parsing policy: invalid policy is accepted\n")
+		return
+	}
+}
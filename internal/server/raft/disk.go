@@ -0,0 +1,247 @@
+package raft
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/arsenalzp/keyvalstore/internal/server/crypt"
+	entity "github.com/arsenalzp/keyvalstore/internal/server/storage/entity"
+)
+
+const (
+	stateFile    = "state.json"
+	logFile      = "log.jsonl"
+	snapshotFile = "snapshot.json"
+)
+
+// Persistent state of the node
+type state struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"voted_for,omitempty"`
+}
+
+// Snapshot of the storage replacing the compacted log
+type snapshot struct {
+	Index   uint64              `json:"index"` // index of the last entry included in the snapshot
+	Term    uint64              `json:"term"`
+	Members []Member            `json:"members"` // configuration of the cluster at the index
+	Data    []entity.ExportData `json:"data,omitempty"`
+}
+
+// Directory keeping the persistent state, the log and the snapshot of the node
+// Files and lines of the log are encrypted if master keys are given,
+// plain ones written before encryption is enabled are still read.
+type disk struct {
+	dir  string
+	log  *os.File       // log entries, one JSON document per line
+	keys *crypt.Keyring // master keys, data is written in plaintext if nil
+}
+
+func openDisk(dir string, keys *crypt.Keyring) (*disk, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, logFile), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &disk{dir: dir, log: f, keys: keys}, nil
+}
+
+func (d *disk) close() error {
+	return d.log.Close()
+}
+
+func (d *disk) loadState() (state, error) {
+	var st state
+	err := d.read(stateFile, &st)
+
+	return st, err
+}
+
+func (d *disk) saveState(st state) error {
+	return d.write(stateFile, st)
+}
+
+// Load the snapshot, the zero snapshot is returned if there is none
+func (d *disk) loadSnapshot() (snapshot, error) {
+	var snap snapshot
+	err := d.read(snapshotFile, &snap)
+
+	return snap, err
+}
+
+func (d *disk) saveSnapshot(snap snapshot) error {
+	return d.write(snapshotFile, snap)
+}
+
+// Load all entries of the log, an incomplete last line is cut off
+func (d *disk) loadLog() ([]Entry, error) {
+	if _, err := d.log.Seek(0, 0); err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+	var lineErr error
+
+	scanner := bufio.NewScanner(d.log)
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		// only the last line may be broken
+		if lineErr != nil {
+			return nil, lineErr
+		}
+
+		var e Entry
+		data, err := d.decode(scanner.Bytes())
+		if err == nil {
+			err = json.Unmarshal(data, &e)
+		}
+		if err != nil {
+			lineErr = fmt.Errorf("entry %d of the log: %w", len(entries)+1, err)
+			continue
+		}
+
+		entries = append(entries, e)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// next entries are appended after the complete ones
+	if lineErr != nil {
+		if err := d.rewriteLog(entries); err != nil {
+			return nil, err
+		}
+	}
+
+	return entries, nil
+}
+
+// Append entries to the log and flush them to the disk
+func (d *disk) appendLog(entries []Entry) error {
+	var buf []byte
+	for _, e := range entries {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+
+		if data, err = d.encode(data); err != nil {
+			return err
+		}
+		buf = append(append(buf, data...), '\n')
+	}
+
+	if _, err := d.log.Write(buf); err != nil {
+		return err
+	}
+
+	return d.log.Sync()
+}
+
+// Replace the log by the entries, it's used on truncation and compaction
+func (d *disk) rewriteLog(entries []Entry) error {
+	path := filepath.Join(d.dir, logFile)
+
+	f, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_TRUNC|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	tmp := &disk{dir: d.dir, log: f, keys: d.keys}
+	if err := tmp.appendLog(entries); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := os.Rename(path+".tmp", path); err != nil {
+		f.Close()
+		return err
+	}
+
+	d.log.Close()
+	d.log = f
+
+	return nil
+}
+
+// Read the JSON file, missing file leaves the value untouched
+func (d *disk) read(name string, v any) error {
+	data, err := os.ReadFile(filepath.Join(d.dir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if data, err = d.decode(data); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+// Write the JSON file atomically
+func (d *disk) write(name string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	if data, err = d.encode(data); err != nil {
+		return err
+	}
+
+	path := filepath.Join(d.dir, name)
+
+	f, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// Encrypt JSON data if master keys are given
+func (d *disk) encode(data []byte) ([]byte, error) {
+	if d.keys == nil {
+		return data, nil
+	}
+
+	return d.keys.SealText(data)
+}
+
+// Decrypt data unless it's plain JSON
+func (d *disk) decode(data []byte) ([]byte, error) {
+	if crypt.IsPlain(data) {
+		return data, nil
+	}
+
+	if d.keys == nil {
+		return nil, fmt.Errorf("data is encrypted, but master keys aren't configured")
+	}
+
+	return d.keys.OpenText(data)
+}
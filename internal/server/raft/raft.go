@@ -0,0 +1,1009 @@
+// Replicated cluster based on the Raft consensus algorithm.
+// Mutations are appended to the log of the leader, replicated to the
+// followers and applied to the local storage of every member once they
+// are stored by the majority. The log is compacted by storage snapshots.
+
+package raft
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arsenalzp/keyvalstore/internal/server/crypt"
+	"github.com/arsenalzp/keyvalstore/internal/server/errors"
+	"github.com/arsenalzp/keyvalstore/internal/server/identity"
+	"github.com/arsenalzp/keyvalstore/internal/server/metrics"
+	"github.com/arsenalzp/keyvalstore/internal/server/storage"
+	entity "github.com/arsenalzp/keyvalstore/internal/server/storage/entity"
+)
+
+const (
+	DefaultElectionTimeout = time.Second
+	DefaultSnapshotEntries = 10000
+
+	maxBatch = 256 // maximum number of entries sent by a single append request
+)
+
+// Role of the member
+type State string
+
+const (
+	Follower  State = "follower"
+	Candidate State = "candidate"
+	Leader    State = "leader"
+)
+
+// Member of the cluster
+type Member struct {
+	ID         string `json:"id"`
+	Addr       string `json:"addr"`        // address of the Raft listener
+	ClientAddr string `json:"client_addr"` // address clients are redirected to
+}
+
+// Parse comma-separated members in "id=addr=client-addr" format
+func ParseMembers(spec string) ([]Member, error) {
+	var members []Member
+
+	for _, item := range strings.Split(spec, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+
+		fields := strings.Split(item, "=")
+		if len(fields) != 3 || fields[0] == "" || fields[1] == "" || fields[2] == "" {
+			return nil, errors.New("invalid cluster member "+item, errors.ClusterCfgErr, nil)
+		}
+
+		members = append(members, Member{ID: fields[0], Addr: fields[1], ClientAddr: fields[2]})
+	}
+
+	return members, nil
+}
+
+// Operation of the command
+type Op string
+
+const (
+	Set    Op = "set"
+	Delete Op = "del"
+	Import Op = "imp"
+	Incr   Op = "inc"
+)
+
+// Mutation of the storage
+type Command struct {
+	Op     Op                  `json:"op"`
+	Key    string              `json:"key,omitempty"`
+	Value  string              `json:"value,omitempty"`
+	Secret bool                `json:"secret,omitempty"` // the value is secret
+	Data   []entity.ImportData `json:"data,omitempty"`
+	Delta  int64               `json:"delta,omitempty"` // delta of the counter
+}
+
+// Entry of the replicated log, it carries either a command or a new
+// configuration of the cluster; the entry without both is appended by
+// a new leader to commit entries of the previous terms
+type Entry struct {
+	Index   uint64   `json:"index"`
+	Term    uint64   `json:"term"`
+	Command *Command `json:"command,omitempty"`
+	Members []Member `json:"members,omitempty"`
+}
+
+// Configuration of the member
+type Config struct {
+	ID              string
+	Dir             string         // directory of the persistent state, the log and snapshots
+	Members         []Member       // initial configuration, it's used if the directory is empty
+	ElectionTimeout time.Duration  // the leader sends heartbeats 5 times within it
+	SnapshotEntries int            // the log is compacted after the number of applied entries
+	Keys            *crypt.Keyring // master keys encrypting the log and snapshots, they are plain if nil
+
+	// authorize Raft requests of the peer, all peers are authorized if nil
+	Authorize func(identity.Identity) bool
+}
+
+// Status of the member
+type Status struct {
+	ID       string   `json:"id"`
+	State    State    `json:"state"`
+	Term     uint64   `json:"term"`
+	Leader   string   `json:"leader,omitempty"`
+	Commit   uint64   `json:"commit"`
+	Applied  uint64   `json:"applied"`
+	Snapshot uint64   `json:"snapshot"` // index of the last entry included in the snapshot
+	Members  []Member `json:"members"`
+}
+
+// Proposal waiting for its entry to be applied
+type waiter struct {
+	term  uint64
+	ch    chan error
+	value *int64 // result of the counter command, it's set before ch is notified
+}
+
+// Member of the cluster applying the replicated log to the storage
+type Node struct {
+	cfg       Config
+	storage   storage.Storage
+	transport transport
+	disk      *disk
+
+	mu        sync.Mutex
+	ctx       context.Context // context of the running member, nil if it's stopped
+	state     State
+	term      uint64
+	votedFor  string
+	leader    string          // ID of the known leader
+	contact   time.Time       // last request of the leader
+	deadline  time.Time       // election is started after the deadline
+	heartbeat time.Time       // last broadcast of the leader
+	votes     map[string]bool // votes granted to the candidate
+
+	log     []Entry  // entries following the snapshot
+	snap    snapshot // the last snapshot without data
+	commit  uint64
+	applied uint64
+
+	next     map[string]uint64 // index of the next entry sent to the peer
+	match    map[string]uint64 // index of the last entry stored by the peer
+	inflight map[string]bool   // request to the peer is in progress
+	waiters  map[uint64]waiter
+
+	wake chan struct{}
+}
+
+// Create the member, its state is loaded from the directory and the content
+// of the storage is restored from the snapshot; the cluster is bootstrapped
+// by the configured members if the directory is empty
+// Requests between members are sent over HTTPS with the TLS configuration
+func New(cfg Config, s storage.Storage, tlsConf *tls.Config) (*Node, error) {
+	return newNode(cfg, s, newHTTPTransport(tlsConf))
+}
+
+func newNode(cfg Config, s storage.Storage, t transport) (*Node, error) {
+	if cfg.ElectionTimeout <= 0 {
+		cfg.ElectionTimeout = DefaultElectionTimeout
+	}
+
+	if cfg.SnapshotEntries <= 0 {
+		cfg.SnapshotEntries = DefaultSnapshotEntries
+	}
+
+	d, err := openDisk(cfg.Dir, cfg.Keys)
+	if err != nil {
+		return nil, errors.New("unable to open cluster directory", errors.ClusterErr, err)
+	}
+
+	st, err := d.loadState()
+	if err != nil {
+		return nil, errors.New("unable to load cluster state", errors.ClusterErr, err)
+	}
+
+	snap, err := d.loadSnapshot()
+	if err != nil {
+		return nil, errors.New("unable to load cluster snapshot", errors.ClusterErr, err)
+	}
+
+	entries, err := d.loadLog()
+	if err != nil {
+		return nil, errors.New("unable to load cluster log", errors.ClusterErr, err)
+	}
+
+	if snap.Members == nil && len(entries) == 0 {
+		if len(cfg.Members) == 0 {
+			return nil, errors.New("cluster members are undefined", errors.ClusterCfgErr, nil)
+		}
+
+		snap.Members = cfg.Members
+		if err := d.saveSnapshot(snap); err != nil {
+			return nil, errors.New("unable to bootstrap cluster", errors.ClusterErr, err)
+		}
+	}
+
+	if snap.Index > 0 {
+		if err := storage.Restore(context.Background(), s, snap.Data); err != nil {
+			return nil, errors.New("unable to restore cluster snapshot", errors.ClusterErr, err)
+		}
+	}
+
+	n := &Node{
+		cfg:       cfg,
+		storage:   s,
+		transport: t,
+		disk:      d,
+		state:     Follower,
+		term:      st.Term,
+		votedFor:  st.VotedFor,
+		commit:    snap.Index,
+		applied:   snap.Index,
+		waiters:   make(map[uint64]waiter),
+		wake:      make(chan struct{}, 1),
+	}
+
+	// entries included in the snapshot are left in the log
+	// if the member is stopped while compacting
+	for _, e := range entries {
+		if e.Index > snap.Index {
+			n.log = append(n.log, e)
+		}
+	}
+
+	snap.Data = nil
+	n.snap = snap
+
+	return n, nil
+}
+
+// Run the member until the context is done
+func (n *Node) Run(ctx context.Context) {
+	ticker := time.NewTicker(n.cfg.ElectionTimeout / 10)
+	defer ticker.Stop()
+
+	n.mu.Lock()
+	n.ctx = ctx
+	n.resetDeadline()
+	n.mu.Unlock()
+
+	defer func() {
+		n.mu.Lock()
+		n.ctx = nil
+		n.stepDown(n.term)
+		n.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n.tick()
+		case <-n.wake:
+			n.mu.Lock()
+			if n.state == Leader {
+				n.broadcast()
+			}
+			n.mu.Unlock()
+		}
+	}
+}
+
+// Propose the command, it returns once the command is applied to the local
+// storage of the leader; followers return the error with the leader address
+func (n *Node) Propose(ctx context.Context, cmd Command) error {
+	return n.propose(ctx, nil, func() (Entry, error) {
+		return Entry{Command: &cmd}, nil
+	})
+}
+
+// Add the member to the cluster, only one membership change is allowed at once
+func (n *Node) AddMember(ctx context.Context, m Member) error {
+	return n.propose(ctx, nil, func() (Entry, error) {
+		if m.ID == "" || m.Addr == "" || m.ClientAddr == "" {
+			return Entry{}, errors.New("member ID and addresses are required", errors.ClusterCfgErr, nil)
+		}
+
+		members, err := n.members(true)
+		if err != nil {
+			return Entry{}, err
+		}
+
+		if slices.ContainsFunc(members, func(member Member) bool { return member.ID == m.ID }) {
+			return Entry{}, errors.New("member "+m.ID+" already exists", errors.ClusterCfgErr, nil)
+		}
+
+		return Entry{Members: append(members, m)}, nil
+	})
+}
+
+// Remove the member from the cluster, the removed leader steps down
+// once the new configuration is committed
+func (n *Node) RemoveMember(ctx context.Context, id string) error {
+	return n.propose(ctx, nil, func() (Entry, error) {
+		members, err := n.members(true)
+		if err != nil {
+			return Entry{}, err
+		}
+
+		i := slices.IndexFunc(members, func(member Member) bool { return member.ID == id })
+		switch {
+		case i < 0:
+			return Entry{}, errors.New("member "+id+" doesn't exist", errors.ClusterCfgErr, nil)
+		case len(members) == 1:
+			return Entry{}, errors.New("the last member can't be removed", errors.ClusterCfgErr, nil)
+		}
+
+		return Entry{Members: slices.Delete(members, i, i+1)}, nil
+	})
+}
+
+// Get status of the member
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return Status{
+		ID:       n.cfg.ID,
+		State:    n.state,
+		Term:     n.term,
+		Leader:   n.leader,
+		Commit:   n.commit,
+		Applied:  n.applied,
+		Snapshot: n.snap.Index,
+		Members:  slices.Clone(n.configuration(n.lastIndex())),
+	}
+}
+
+// Readiness check, the member is ready once the leader is known
+func (n *Node) Check(ctx context.Context) (string, error) {
+	status := n.Status()
+	if status.Leader == "" {
+		return "", fmt.Errorf("leader of the cluster is unknown, term %d", status.Term)
+	}
+
+	return fmt.Sprintf("%s, leader %s, term %d, applied %d", status.State, status.Leader, status.Term, status.Applied), nil
+}
+
+// Append the entry built under the lock to the log of the leader
+// and wait until it's applied
+func (n *Node) propose(ctx context.Context, value *int64, build func() (Entry, error)) error {
+	n.mu.Lock()
+
+	if n.state != Leader {
+		err := n.notLeader()
+		n.mu.Unlock()
+		return err
+	}
+
+	e, err := build()
+	if err != nil {
+		n.mu.Unlock()
+		return err
+	}
+
+	index, err := n.appendEntry(e)
+	if err != nil {
+		n.mu.Unlock()
+		return errors.New("unable to append log entry", errors.ClusterErr, err)
+	}
+
+	ch := make(chan error, 1)
+	n.waiters[index] = waiter{term: n.term, ch: ch, value: value}
+	n.mu.Unlock()
+
+	n.trigger()
+
+	select {
+	case err := <-ch:
+		return err
+	case <-ctx.Done():
+		n.mu.Lock()
+		delete(n.waiters, index)
+		n.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// Start election after the deadline, the leader sends heartbeats
+func (n *Node) tick() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	switch {
+	case n.state == Leader:
+		if time.Since(n.heartbeat) >= n.cfg.ElectionTimeout/5 {
+			n.broadcast()
+		}
+	case time.Now().After(n.deadline):
+		n.campaign()
+	}
+}
+
+// Wake up the leader to replicate new entries
+func (n *Node) trigger() {
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Become the candidate and request votes of the members,
+// the member which isn't in the configuration doesn't start elections
+func (n *Node) campaign() {
+	n.resetDeadline()
+
+	members := n.configuration(n.lastIndex())
+	if !isMember(members, n.cfg.ID) {
+		return
+	}
+
+	n.term++
+	n.state = Candidate
+	n.votedFor = n.cfg.ID
+	n.leader = ""
+	n.votes = map[string]bool{n.cfg.ID: true}
+	n.report()
+
+	if err := n.persist(); err != nil {
+		slog.Error("unable to start election", "error", err, "code", errors.Code(err))
+		return
+	}
+
+	slog.Info("starting election", "member", n.cfg.ID, "term", n.term)
+
+	if quorum(members, func(id string) bool { return n.votes[id] }) {
+		n.becomeLeader()
+		return
+	}
+
+	req := voteRequest{Term: n.term, Candidate: n.cfg.ID, LastIndex: n.lastIndex(), LastTerm: n.lastTerm()}
+	for _, m := range members {
+		if m.ID != n.cfg.ID {
+			go n.requestVote(n.ctx, m, req)
+		}
+	}
+}
+
+func (n *Node) requestVote(ctx context.Context, m Member, req voteRequest) {
+	ctx, cancel := context.WithTimeout(ctx, n.cfg.ElectionTimeout)
+	defer cancel()
+
+	var resp voteResponse
+	if err := n.transport.call(ctx, m.Addr, votePath, req, &resp); err != nil {
+		slog.Debug("vote request failed", "member", m.ID, "error", err)
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if resp.Term > n.term {
+		n.stepDown(resp.Term)
+		return
+	}
+
+	if n.state != Candidate || n.term != req.Term || !resp.Granted {
+		return
+	}
+
+	n.votes[m.ID] = true
+	if quorum(n.configuration(n.lastIndex()), func(id string) bool { return n.votes[id] }) {
+		n.becomeLeader()
+	}
+}
+
+// The leader appends the entry without command to commit entries of the previous terms
+func (n *Node) becomeLeader() {
+	n.state = Leader
+	n.leader = n.cfg.ID
+	n.next = make(map[string]uint64)
+	n.match = make(map[string]uint64)
+	n.inflight = make(map[string]bool)
+	n.report()
+
+	slog.Info("elected as leader", "member", n.cfg.ID, "term", n.term)
+
+	if _, err := n.appendEntry(Entry{}); err != nil {
+		slog.Error("unable to append log entry", "error", err, "code", errors.Code(err))
+		n.stepDown(n.term)
+		return
+	}
+
+	n.broadcast()
+}
+
+// Return to the follower state, proposals waiting for commit are failed
+func (n *Node) stepDown(term uint64) {
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+		n.leader = ""
+
+		if err := n.persist(); err != nil {
+			slog.Error("unable to save cluster state", "error", err, "code", errors.Code(err))
+		}
+	}
+
+	if n.state == Leader {
+		slog.Info("stepping down", "member", n.cfg.ID, "term", n.term)
+		n.leader = ""
+	}
+
+	n.state = Follower
+	n.resetDeadline()
+	n.report()
+
+	for index, w := range n.waiters {
+		w.ch <- n.notLeader()
+		delete(n.waiters, index)
+	}
+}
+
+// Send new entries or heartbeats to the peers
+func (n *Node) broadcast() {
+	n.heartbeat = time.Now()
+
+	for _, m := range n.configuration(n.lastIndex()) {
+		if m.ID == n.cfg.ID || n.inflight[m.ID] {
+			continue
+		}
+
+		if _, ok := n.next[m.ID]; !ok {
+			n.next[m.ID] = n.lastIndex() + 1
+		}
+
+		n.inflight[m.ID] = true
+		go n.replicate(n.ctx, m)
+	}
+
+	// the single member commits by itself
+	n.advance()
+}
+
+// Send the next entries to the peer or the snapshot if they are compacted
+func (n *Node) replicate(ctx context.Context, m Member) {
+	ctx, cancel := context.WithTimeout(ctx, n.cfg.ElectionTimeout)
+	defer cancel()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.state != Leader {
+		return
+	}
+
+	defer func() {
+		n.inflight[m.ID] = false
+		if n.state == Leader && n.next[m.ID] <= n.lastIndex() {
+			n.trigger()
+		}
+	}()
+
+	term, next := n.term, n.next[m.ID]
+
+	if next <= n.snap.Index {
+		snap, err := n.disk.loadSnapshot()
+		if err != nil {
+			slog.Error("unable to load cluster snapshot", "error", err, "code", errors.Code(err))
+			return
+		}
+
+		var resp snapshotResponse
+
+		n.mu.Unlock()
+		err = n.transport.call(ctx, m.Addr, snapshotPath, snapshotRequest{Term: term, Leader: n.cfg.ID, Snapshot: snap}, &resp)
+		n.mu.Lock()
+
+		if err != nil {
+			slog.Debug("snapshot request failed", "member", m.ID, "error", err)
+			return
+		}
+
+		if resp.Term > n.term {
+			n.stepDown(resp.Term)
+			return
+		}
+
+		if n.state == Leader && n.term == term {
+			n.match[m.ID] = max(n.match[m.ID], snap.Index)
+			n.next[m.ID] = n.match[m.ID] + 1
+		}
+
+		return
+	}
+
+	prev := next - 1
+	req := appendRequest{Term: term, Leader: n.cfg.ID, PrevIndex: prev, PrevTerm: n.termAt(prev), Commit: n.commit}
+	entries := n.log[prev-n.snap.Index:]
+	req.Entries = slices.Clone(entries[:min(len(entries), maxBatch)])
+
+	var resp appendResponse
+
+	n.mu.Unlock()
+	err := n.transport.call(ctx, m.Addr, appendPath, req, &resp)
+	n.mu.Lock()
+
+	if err != nil {
+		slog.Debug("append request failed", "member", m.ID, "error", err)
+		return
+	}
+
+	if resp.Term > n.term {
+		n.stepDown(resp.Term)
+		return
+	}
+
+	if n.state != Leader || n.term != term {
+		return
+	}
+
+	if resp.Success {
+		n.match[m.ID] = max(n.match[m.ID], prev+uint64(len(req.Entries)))
+		n.next[m.ID] = n.match[m.ID] + 1
+		n.advance()
+		return
+	}
+
+	// the peer log doesn't match, step back to its last entry
+	n.next[m.ID] = max(1, min(prev, resp.LastIndex+1))
+}
+
+// Commit the last entry of the current term stored by the majority
+func (n *Node) advance() {
+	members := n.configuration(n.lastIndex())
+
+	for index := n.lastIndex(); index > n.commit && n.termAt(index) == n.term; index-- {
+		stored := func(id string) bool { return id == n.cfg.ID || n.match[id] >= index }
+		if quorum(members, stored) {
+			n.commit = index
+			n.apply()
+			return
+		}
+	}
+}
+
+// Apply committed entries to the storage and notify proposals
+func (n *Node) apply() {
+	removed := false
+
+	for n.applied < n.commit {
+		e := n.entry(n.applied + 1)
+
+		var value int64
+		var err error
+		if e.Command != nil {
+			value, err = n.execute(*e.Command)
+			switch errors.Code(err) {
+			case "", errors.CounterValueErr, errors.CounterRangeErr:
+				// counters are rejected the same way by every member
+			default:
+				slog.Error("unable to apply log entry", "index", e.Index, "error", err, "code", errors.Code(err))
+			}
+		}
+
+		if e.Members != nil {
+			slog.Info("cluster configuration committed", "index", e.Index, "members", len(e.Members))
+			removed = !isMember(e.Members, n.cfg.ID)
+		}
+
+		n.applied = e.Index
+
+		if w, ok := n.waiters[e.Index]; ok {
+			if w.term != e.Term {
+				err = errors.New("log entry is overwritten by the leader", errors.ClusterErr, nil)
+			}
+			if w.value != nil {
+				*w.value = value
+			}
+			w.ch <- err
+			delete(n.waiters, e.Index)
+		}
+	}
+
+	metrics.ClusterApplied.Set(float64(n.applied))
+
+	if removed && n.state == Leader {
+		n.stepDown(n.term)
+	}
+
+	n.compact()
+}
+
+// Apply the command to the storage, the new value is returned for counters
+func (n *Node) execute(cmd Command) (int64, error) {
+	ctx := context.Background()
+
+	var value int64
+	var err error
+	switch cmd.Op {
+	case Set:
+		_, err = n.storage.Insert(ctx, cmd.Key, entity.StoredValue(cmd.Value, cmd.Secret))
+	case Delete:
+		_, err = n.storage.Delete(ctx, cmd.Key)
+	case Import:
+		_, err = n.storage.Import(ctx, cmd.Data)
+	case Incr:
+		value, err = storage.Increment(ctx, n.storage, cmd.Key, cmd.Delta)
+	default:
+		err = fmt.Errorf("unknown operation %q", cmd.Op)
+	}
+
+	return value, err
+}
+
+// Replace applied entries by the snapshot of the storage
+func (n *Node) compact() {
+	if n.applied-n.snap.Index < uint64(n.cfg.SnapshotEntries) {
+		return
+	}
+
+	data, err := n.storage.Export(context.Background())
+	if err != nil {
+		slog.Error("unable to take cluster snapshot", "error", err, "code", errors.Code(err))
+		return
+	}
+
+	snap := snapshot{Index: n.applied, Term: n.termAt(n.applied), Members: n.configuration(n.applied), Data: data}
+	if err := n.disk.saveSnapshot(snap); err != nil {
+		slog.Error("unable to save cluster snapshot", "error", err, "code", errors.Code(err))
+		return
+	}
+
+	n.log = slices.Clone(n.log[n.applied-n.snap.Index:])
+	snap.Data = nil
+	n.snap = snap
+
+	if err := n.disk.rewriteLog(n.log); err != nil {
+		slog.Error("unable to compact cluster log", "error", err, "code", errors.Code(err))
+		return
+	}
+
+	slog.Info("cluster log compacted", "index", snap.Index, "keys", len(data))
+}
+
+// Handle the vote request of the candidate
+func (n *Node) handleVote(req voteRequest) (voteResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// a member which is removed or partitioned doesn't disrupt
+	// the cluster while the leader is heard from
+	if n.leader != "" && (n.state == Leader || time.Since(n.contact) < n.cfg.ElectionTimeout) {
+		return voteResponse{Term: n.term}, nil
+	}
+
+	if req.Term < n.term {
+		return voteResponse{Term: n.term}, nil
+	}
+
+	if req.Term > n.term {
+		n.stepDown(req.Term)
+	}
+
+	upToDate := req.LastTerm > n.lastTerm() || (req.LastTerm == n.lastTerm() && req.LastIndex >= n.lastIndex())
+	if !upToDate || (n.votedFor != "" && n.votedFor != req.Candidate) {
+		return voteResponse{Term: n.term}, nil
+	}
+
+	n.votedFor = req.Candidate
+	if err := n.persist(); err != nil {
+		return voteResponse{}, err
+	}
+
+	n.resetDeadline()
+
+	return voteResponse{Term: n.term, Granted: true}, nil
+}
+
+// Handle entries of the leader, conflicting entries of the log are replaced
+func (n *Node) handleAppend(req appendRequest) (appendResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if req.Term < n.term {
+		return appendResponse{Term: n.term}, nil
+	}
+
+	n.follow(req.Term, req.Leader)
+
+	if req.PrevIndex > n.lastIndex() {
+		return appendResponse{Term: n.term, LastIndex: n.lastIndex()}, nil
+	}
+
+	prev, entries := req.PrevIndex, req.Entries
+
+	if prev < n.snap.Index {
+		// entries included in the snapshot are committed already
+		skip := min(n.snap.Index-prev, uint64(len(entries)))
+		prev, entries = prev+skip, entries[skip:]
+	} else if n.termAt(prev) != req.PrevTerm {
+		return appendResponse{Term: n.term, LastIndex: prev - 1}, nil
+	}
+
+	for i, e := range entries {
+		if e.Index <= n.lastIndex() {
+			if n.termAt(e.Index) == e.Term {
+				continue
+			}
+
+			n.log = n.log[:e.Index-n.snap.Index-1]
+			if err := n.disk.rewriteLog(n.log); err != nil {
+				return appendResponse{}, err
+			}
+		}
+
+		if err := n.disk.appendLog(entries[i:]); err != nil {
+			return appendResponse{}, err
+		}
+
+		n.log = append(n.log, entries[i:]...)
+		break
+	}
+
+	if commit := min(req.Commit, prev+uint64(len(entries))); commit > n.commit {
+		n.commit = commit
+		n.apply()
+	}
+
+	return appendResponse{Term: n.term, Success: true, LastIndex: n.lastIndex()}, nil
+}
+
+// Handle the snapshot of the leader, content of the storage is replaced by it
+func (n *Node) handleSnapshot(req snapshotRequest) (snapshotResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if req.Term < n.term {
+		return snapshotResponse{Term: n.term}, nil
+	}
+
+	n.follow(req.Term, req.Leader)
+
+	snap := req.Snapshot
+	if snap.Index <= n.applied {
+		return snapshotResponse{Term: n.term}, nil
+	}
+
+	if err := storage.Restore(context.Background(), n.storage, snap.Data); err != nil {
+		return snapshotResponse{}, err
+	}
+
+	if err := n.disk.saveSnapshot(snap); err != nil {
+		return snapshotResponse{}, err
+	}
+
+	// entries following the snapshot are kept if the log is consistent with it
+	var entries []Entry
+	if e := n.entry(snap.Index); e != nil && e.Term == snap.Term {
+		entries = slices.Clone(n.log[snap.Index-n.snap.Index:])
+	}
+
+	if err := n.disk.rewriteLog(entries); err != nil {
+		return snapshotResponse{}, err
+	}
+
+	slog.Info("cluster snapshot installed", "index", snap.Index, "keys", len(snap.Data))
+
+	snap.Data = nil
+	n.snap, n.log = snap, entries
+	n.commit, n.applied = max(n.commit, snap.Index), snap.Index
+	n.apply()
+
+	return snapshotResponse{Term: n.term}, nil
+}
+
+// Accept the leader of the term
+func (n *Node) follow(term uint64, leader string) {
+	if term > n.term || n.state != Follower {
+		n.stepDown(term)
+	}
+
+	n.leader = leader
+	n.contact = time.Now()
+	n.resetDeadline()
+}
+
+// Append the entry of the current term to the log of the leader
+func (n *Node) appendEntry(e Entry) (uint64, error) {
+	e.Index, e.Term = n.lastIndex()+1, n.term
+
+	if err := n.disk.appendLog([]Entry{e}); err != nil {
+		return 0, err
+	}
+
+	n.log = append(n.log, e)
+
+	return e.Index, nil
+}
+
+// Get members of the latest configuration, the pending change is rejected
+// if the change is requested
+func (n *Node) members(change bool) ([]Member, error) {
+	for i := len(n.log) - 1; i >= 0 && change; i-- {
+		if n.log[i].Index > n.commit && n.log[i].Members != nil {
+			return nil, errors.New("membership change is in progress", errors.ClusterErr, nil)
+		}
+	}
+
+	return slices.Clone(n.configuration(n.lastIndex())), nil
+}
+
+// Get the configuration in effect at the index, it's the latest
+// configuration entry of the log up to the index
+func (n *Node) configuration(index uint64) []Member {
+	for i := len(n.log) - 1; i >= 0; i-- {
+		if n.log[i].Index <= index && n.log[i].Members != nil {
+			return n.log[i].Members
+		}
+	}
+
+	return n.snap.Members
+}
+
+func (n *Node) lastIndex() uint64 {
+	if len(n.log) > 0 {
+		return n.log[len(n.log)-1].Index
+	}
+
+	return n.snap.Index
+}
+
+func (n *Node) lastTerm() uint64 {
+	return n.termAt(n.lastIndex())
+}
+
+// Get term of the entry, it's zero if the entry is unknown
+func (n *Node) termAt(index uint64) uint64 {
+	if index == n.snap.Index {
+		return n.snap.Term
+	}
+
+	if e := n.entry(index); e != nil {
+		return e.Term
+	}
+
+	return 0
+}
+
+// Get the entry of the log, it's nil if the entry is compacted or missing
+func (n *Node) entry(index uint64) *Entry {
+	if index <= n.snap.Index || index > n.lastIndex() {
+		return nil
+	}
+
+	return &n.log[index-n.snap.Index-1]
+}
+
+func (n *Node) persist() error {
+	return n.disk.saveState(state{Term: n.term, VotedFor: n.votedFor})
+}
+
+// Randomize the election deadline within the double election timeout
+func (n *Node) resetDeadline() {
+	timeout := n.cfg.ElectionTimeout
+	n.deadline = time.Now().Add(timeout + time.Duration(rand.Int63n(int64(timeout))))
+}
+
+// Error redirecting the client to the leader
+func (n *Node) notLeader() error {
+	for _, m := range n.configuration(n.lastIndex()) {
+		if m.ID == n.leader && n.leader != "" {
+			return errors.New("redirect to "+m.ClientAddr, errors.NotLeaderErr, nil)
+		}
+	}
+
+	return errors.New("leader is unknown", errors.NotLeaderErr, nil)
+}
+
+func (n *Node) report() {
+	metrics.ClusterTerm.Set(float64(n.term))
+
+	if n.state == Leader {
+		metrics.ClusterLeader.Set(1)
+	} else {
+		metrics.ClusterLeader.Set(0)
+	}
+}
+
+func isMember(members []Member, id string) bool {
+	return slices.ContainsFunc(members, func(m Member) bool { return m.ID == id })
+}
+
+// Check the majority of members
+func quorum(members []Member, ok func(string) bool) bool {
+	count := 0
+	for _, m := range members {
+		if ok(m.ID) {
+			count++
+		}
+	}
+
+	return count > len(members)/2
+}
@@ -0,0 +1,461 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/arsenalzp/keyvalstore/internal/server/crypt"
+	"github.com/arsenalzp/keyvalstore/internal/server/errors"
+	"github.com/arsenalzp/keyvalstore/internal/server/storage"
+	entity "github.com/arsenalzp/keyvalstore/internal/server/storage/entity"
+	ht "github.com/arsenalzp/keyvalstore/internal/server/storage/hash-table"
+)
+
+// In-memory transport between members of the test cluster
+type network struct {
+	mu    sync.Mutex
+	nodes map[string]*Node
+	cut   map[string]bool // partitioned members, their requests aren't delivered
+}
+
+// Transport of the member
+type link struct {
+	nw   *network
+	from string
+}
+
+func (l link) call(ctx context.Context, addr, path string, req, resp any) error {
+	l.nw.mu.Lock()
+	cut := l.nw.cut[l.from]
+	l.nw.mu.Unlock()
+
+	if cut {
+		return fmt.Errorf("member %s is partitioned", l.from)
+	}
+
+	return l.nw.call(ctx, addr, path, req, resp)
+}
+
+func (nw *network) call(ctx context.Context, addr, path string, req, resp any) error {
+	nw.mu.Lock()
+	n := nw.nodes[addr]
+	nw.mu.Unlock()
+
+	if n == nil {
+		return fmt.Errorf("member %s is unreachable", addr)
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	out, err := n.serve(path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(out)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, resp)
+}
+
+// Member of the test cluster
+type member struct {
+	node    *Node
+	storage storage.Storage
+	stop    context.CancelFunc
+}
+
+// Start the member with the storage, the member address is its ID
+func (nw *network) start(t *testing.T, id, dir string, members []Member, snapshotEntries int) *member {
+	s, _ := ht.NewHT()
+
+	cfg := Config{ID: id, Dir: dir, Members: members, ElectionTimeout: 300 * time.Millisecond, SnapshotEntries: snapshotEntries}
+	n, err := newNode(cfg, s, link{nw, id})
+	if err != nil {
+		t.Fatalf("error creating member %s: %s\n", id, err)
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	go n.Run(ctx)
+
+	nw.mu.Lock()
+	nw.nodes[id] = n
+	nw.mu.Unlock()
+
+	return &member{node: n, storage: s, stop: stop}
+}
+
+// Stop the member and make it unreachable
+func (nw *network) kill(m *member) {
+	nw.mu.Lock()
+	delete(nw.nodes, m.node.cfg.ID)
+	nw.mu.Unlock()
+
+	m.stop()
+}
+
+func newMembers(ids ...string) []Member {
+	var members []Member
+	for _, id := range ids {
+		members = append(members, Member{ID: id, Addr: id, ClientAddr: id + ":6842"})
+	}
+
+	return members
+}
+
+// Wait until the condition is met
+func waitFor(t *testing.T, what string, cond func() bool) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Errorf("error waiting for %s\n", what)
+	return false
+}
+
+// Wait for the single leader among the members
+func waitLeader(t *testing.T, members ...*member) *member {
+	var leader *member
+
+	waitFor(t, "leader", func() bool {
+		leader = nil
+		for _, m := range members {
+			if m.node.Status().State == Leader {
+				if leader != nil {
+					return false
+				}
+				leader = m
+			}
+		}
+		return leader != nil
+	})
+
+	return leader
+}
+
+// Wait until the key has the value in the storage of every member
+func waitValue(t *testing.T, key, value string, members ...*member) bool {
+	return waitFor(t, "value of "+key, func() bool {
+		for _, m := range members {
+			if v, _ := m.storage.Search(context.Background(), key); v != value {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestCluster(t *testing.T) {
+	ctx := context.Background()
+	nw := &network{nodes: make(map[string]*Node)}
+	members := newMembers("n1", "n2", "n3")
+
+	dirs := map[string]string{}
+	var cluster []*member
+	for _, m := range members {
+		dirs[m.ID] = t.TempDir()
+		cluster = append(cluster, nw.start(t, m.ID, dirs[m.ID], members, 0))
+	}
+	defer func() {
+		for _, m := range cluster {
+			m.stop()
+		}
+	}()
+
+	leader := waitLeader(t, cluster...)
+	if leader == nil {
+		return
+	}
+
+	if _, err := leader.node.Storage().Insert(ctx, "k1", "v1"); err != nil {
+		t.Errorf("error inserting key: %s\n", err)
+		return
+	}
+
+	if !waitValue(t, "k1", "v1", cluster...) {
+		return
+	}
+
+	// counters are changed by the log and the value of the leader is returned
+	for i := int64(1); i <= 3; i++ {
+		if value, err := leader.node.Storage().Increment(ctx, "c1", 1); err != nil || value != i {
+			t.Errorf("error incrementing counter, expected %d, got %d, %v\n", i, value, err)
+			return
+		}
+	}
+
+	if _, err := leader.node.Storage().Increment(ctx, "k1", 1); errors.Code(err) != errors.CounterValueErr {
+		t.Errorf("error incrementing non-numeric value, expected code %s, got %v\n", errors.CounterValueErr, err)
+		return
+	}
+
+	if !waitValue(t, "c1", "3", cluster...) {
+		return
+	}
+
+	// followers redirect writes to the leader
+	for _, m := range cluster {
+		if m == leader {
+			continue
+		}
+
+		_, err := m.node.Storage().Insert(ctx, "k2", "v2")
+		expected := "redirect to " + leader.node.cfg.ID + ":6842"
+		if errors.Code(err) != errors.NotLeaderErr || err.Error() != expected+", code: "+errors.NotLeaderErr {
+			t.Errorf("error redirecting write, expected %q, got %v\n", expected, err)
+			return
+		}
+	}
+
+	// the new leader is elected after failure of the leader
+	nw.kill(leader)
+
+	var alive []*member
+	for _, m := range cluster {
+		if m != leader {
+			alive = append(alive, m)
+		}
+	}
+
+	newLeader := waitLeader(t, alive...)
+	if newLeader == nil {
+		return
+	}
+
+	if _, err := newLeader.node.Storage().Delete(ctx, "k1"); err != nil {
+		t.Errorf("error deleting key: %s\n", err)
+		return
+	}
+
+	if _, err := newLeader.node.Storage().Insert(ctx, "k3", "v3"); err != nil {
+		t.Errorf("error inserting key: %s\n", err)
+		return
+	}
+
+	// the restarted member restores its log and catches up
+	restarted := nw.start(t, leader.node.cfg.ID, dirs[leader.node.cfg.ID], nil, 0)
+	cluster = append(alive, restarted)
+
+	if !waitValue(t, "k3", "v3", cluster...) || !waitValue(t, "k1", "", cluster...) {
+		return
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	ctx := context.Background()
+	nw := &network{nodes: make(map[string]*Node)}
+	members := newMembers("n1", "n2", "n3")
+
+	var cluster []*member
+	for _, m := range members {
+		cluster = append(cluster, nw.start(t, m.ID, t.TempDir(), members, 5))
+	}
+	defer func() {
+		for _, m := range cluster {
+			m.stop()
+		}
+	}()
+
+	leader := waitLeader(t, cluster...)
+	if leader == nil {
+		return
+	}
+
+	// the lagging member receives the snapshot instead of compacted entries
+	var lagging *member
+	for _, m := range cluster {
+		if m != leader {
+			lagging = m
+			break
+		}
+	}
+
+	// the partitioned member doesn't disrupt the leader by its elections
+	nw.mu.Lock()
+	delete(nw.nodes, lagging.node.cfg.ID)
+	nw.cut = map[string]bool{lagging.node.cfg.ID: true}
+	nw.mu.Unlock()
+
+	for i := 0; i < 20; i++ {
+		if _, err := leader.node.Storage().Insert(ctx, fmt.Sprintf("k%d", i), "v"); err != nil {
+			t.Errorf("error inserting key: %s\n", err)
+			return
+		}
+	}
+
+	if status := leader.node.Status(); status.Snapshot < 15 {
+		t.Errorf("error compacting log, snapshot index %d\n", status.Snapshot)
+		return
+	}
+
+	lagging.storage.Insert(ctx, "stale", "v")
+
+	nw.mu.Lock()
+	nw.nodes[lagging.node.cfg.ID] = lagging.node
+	nw.cut = nil
+	nw.mu.Unlock()
+
+	if !waitValue(t, "k19", "v", cluster...) || !waitValue(t, "stale", "", lagging) {
+		return
+	}
+
+	if status := lagging.node.Status(); status.Snapshot == 0 {
+		t.Errorf("error installing snapshot: %+v\n", status)
+		return
+	}
+}
+
+func TestMembership(t *testing.T) {
+	ctx := context.Background()
+	nw := &network{nodes: make(map[string]*Node)}
+	members := newMembers("n1", "n2", "n3")
+
+	// the single member bootstraps the cluster
+	first := nw.start(t, "n1", t.TempDir(), members[:1], 0)
+	defer first.stop()
+
+	if waitLeader(t, first) == nil {
+		return
+	}
+
+	if _, err := first.node.Storage().Insert(ctx, "k1", "v1"); err != nil {
+		t.Errorf("error inserting key: %s\n", err)
+		return
+	}
+
+	// new members know the existing ones and wait for the leader
+	cluster := []*member{first}
+	for _, m := range members[1:] {
+		joined := nw.start(t, m.ID, t.TempDir(), members[:1], 0)
+		defer joined.stop()
+
+		if err := first.node.AddMember(ctx, m); err != nil {
+			t.Errorf("error adding member %s: %s\n", m.ID, err)
+			return
+		}
+
+		cluster = append(cluster, joined)
+	}
+
+	if err := first.node.AddMember(ctx, members[1]); errors.Code(err) != errors.ClusterCfgErr {
+		t.Errorf("error adding existing member, expected code %s, got %v\n", errors.ClusterCfgErr, err)
+		return
+	}
+
+	if !waitValue(t, "k1", "v1", cluster...) {
+		return
+	}
+
+	if status := cluster[2].node.Status(); len(status.Members) != 3 || status.Leader != "n1" {
+		t.Errorf("error replicating configuration: %+v\n", status)
+		return
+	}
+
+	// the removed leader steps down and the rest elect the new one
+	if err := first.node.RemoveMember(ctx, "n1"); err != nil {
+		t.Errorf("error removing member: %s\n", err)
+		return
+	}
+
+	leader := waitLeader(t, cluster...)
+	if leader == nil {
+		return
+	}
+
+	if leader == first {
+		t.Errorf("error removing member, the removed member is the leader\n")
+		return
+	}
+
+	if status := leader.node.Status(); len(status.Members) != 2 {
+		t.Errorf("error removing member: %+v\n", status)
+		return
+	}
+
+	if _, err := leader.node.Storage().Insert(ctx, "k2", "v2"); err != nil {
+		t.Errorf("error inserting key: %s\n", err)
+		return
+	}
+
+	waitValue(t, "k2", "v2", cluster[1:]...)
+}
+
+func TestDiskEncryption(t *testing.T) {
+	keys, err := crypt.ReadKeyring(strings.NewReader("k1:" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("k"), 32))))
+	if err != nil {
+		t.Fatalf("error reading master keys: %s\n", err)
+	}
+
+	dir := t.TempDir()
+	d, err := openDisk(dir, keys)
+	if err != nil {
+		t.Fatalf("error opening disk: %s\n", err)
+	}
+
+	entries := []Entry{
+		{Index: 1, Term: 1, Command: &Command{Op: Set, Key: "key1", Value: "secret-value"}},
+		{Index: 2, Term: 1, Command: &Command{Op: Delete, Key: "key1"}},
+	}
+	if err := d.appendLog(entries); err != nil {
+		t.Fatalf("error appending log: %s\n", err)
+	}
+
+	snap := snapshot{Index: 2, Term: 1, Data: []entity.ExportData{{Key: "key2", Value: "secret-value"}}}
+	if err := d.saveSnapshot(snap); err != nil {
+		t.Fatalf("error saving snapshot: %s\n", err)
+	}
+
+	// the entry is written partially
+	d.log.WriteString("partial")
+	d.close()
+
+	for _, name := range []string{logFile, snapshotFile} {
+		data, _ := os.ReadFile(filepath.Join(dir, name))
+		if bytes.Contains(data, []byte("secret-value")) {
+			t.Errorf("error encrypting %s, it contains the value\n", name)
+			return
+		}
+	}
+
+	d, err = openDisk(dir, keys)
+	if err != nil {
+		t.Fatalf("error reopening disk: %s\n", err)
+	}
+	defer d.close()
+
+	loaded, err := d.loadLog()
+	if err != nil || len(loaded) != 2 || loaded[0].Command.Value != "secret-value" {
+		t.Errorf("error loading encrypted log, expected 2 entries, got %+v, %v\n", loaded, err)
+		return
+	}
+
+	if loaded, err := d.loadSnapshot(); err != nil || len(loaded.Data) != 1 || loaded.Data[0].Value != "secret-value" {
+		t.Errorf("error loading encrypted snapshot, got %+v, %v\n", loaded, err)
+		return
+	}
+
+	// encrypted data isn't read without master keys
+	plain := &disk{dir: dir, log: d.log}
+	if _, err := plain.loadSnapshot(); err == nil {
+		t.Errorf("error loading encrypted snapshot without master keys: no error\n")
+		return
+	}
+}
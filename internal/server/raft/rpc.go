@@ -0,0 +1,170 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/arsenalzp/keyvalstore/internal/server/identity"
+)
+
+const (
+	votePath     = "/raft/vote"
+	appendPath   = "/raft/append"
+	snapshotPath = "/raft/snapshot"
+)
+
+type voteRequest struct {
+	Term      uint64 `json:"term"`
+	Candidate string `json:"candidate"`
+	LastIndex uint64 `json:"last_index"`
+	LastTerm  uint64 `json:"last_term"`
+}
+
+type voteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+type appendRequest struct {
+	Term      uint64  `json:"term"`
+	Leader    string  `json:"leader"`
+	PrevIndex uint64  `json:"prev_index"`
+	PrevTerm  uint64  `json:"prev_term"`
+	Entries   []Entry `json:"entries,omitempty"`
+	Commit    uint64  `json:"commit"`
+}
+
+type appendResponse struct {
+	Term    uint64 `json:"term"`
+	Success bool   `json:"success"`
+
+	// last entry of the follower, the leader steps back to it
+	// if the log doesn't match
+	LastIndex uint64 `json:"last_index"`
+}
+
+type snapshotRequest struct {
+	Term     uint64   `json:"term"`
+	Leader   string   `json:"leader"`
+	Snapshot snapshot `json:"snapshot"`
+}
+
+type snapshotResponse struct {
+	Term uint64 `json:"term"`
+}
+
+// Transport of requests between members
+type transport interface {
+	call(ctx context.Context, addr, path string, req, resp any) error
+}
+
+// Requests are sent as JSON over HTTPS, members are authenticated by client certificates
+type httpTransport struct {
+	client *http.Client
+}
+
+func newHTTPTransport(tlsConf *tls.Config) *httpTransport {
+	return &httpTransport{client: &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConf}}}
+}
+
+func (t *httpTransport) call(ctx context.Context, addr, path string, req, resp any) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://"+addr+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+
+	res, err := t.client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("%s: %s", res.Status, bytes.TrimSpace(msg))
+	}
+
+	return json.NewDecoder(res.Body).Decode(resp)
+}
+
+// Handler of requests of other members, it's served by the Raft listener
+func (n *Node) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if n.cfg.Authorize != nil {
+			if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 || !n.cfg.Authorize(identity.FromCert(r.TLS.PeerCertificates[0])) {
+				http.Error(w, "access denied", http.StatusForbidden)
+				return
+			}
+		}
+
+		resp, err := n.serve(r.URL.Path, r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if resp == nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	})
+}
+
+// Decode the request by its path and handle it,
+// nil response is returned for unknown paths
+func (n *Node) serve(path string, body io.Reader) (any, error) {
+	if !n.running() {
+		return nil, fmt.Errorf("member %s is stopped", n.cfg.ID)
+	}
+
+	switch path {
+	case votePath:
+		var req voteRequest
+		if err := json.NewDecoder(body).Decode(&req); err != nil {
+			return nil, err
+		}
+		return n.handleVote(req)
+
+	case appendPath:
+		var req appendRequest
+		if err := json.NewDecoder(body).Decode(&req); err != nil {
+			return nil, err
+		}
+		return n.handleAppend(req)
+
+	case snapshotPath:
+		var req snapshotRequest
+		if err := json.NewDecoder(body).Decode(&req); err != nil {
+			return nil, err
+		}
+		return n.handleSnapshot(req)
+	}
+
+	return nil, nil
+}
+
+func (n *Node) running() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.ctx != nil
+}
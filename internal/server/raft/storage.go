@@ -0,0 +1,109 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/arsenalzp/keyvalstore/internal/server/errors"
+	"github.com/arsenalzp/keyvalstore/internal/server/storage"
+	entity "github.com/arsenalzp/keyvalstore/internal/server/storage/entity"
+)
+
+// Storage replicating mutations through the log of the cluster,
+// reads are served by the local storage of the member
+type Storage struct {
+	storage.Storage
+
+	node *Node
+}
+
+// Storage of the member, it has to be the storage the member applies the log to
+func (n *Node) Storage() *Storage {
+	return &Storage{Storage: n.storage, node: n}
+}
+
+func (s *Storage) Insert(ctx context.Context, key, value string) (bool, error) {
+	value, secret := entity.UnmarkSecret(value)
+	if err := s.node.Propose(ctx, Command{Op: Set, Key: key, Value: value, Secret: secret}); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (s *Storage) Delete(ctx context.Context, key string) (bool, error) {
+	if err := s.node.Propose(ctx, Command{Op: Delete, Key: key}); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (s *Storage) Import(ctx context.Context, data []entity.ImportData) (bool, error) {
+	if err := s.node.Propose(ctx, Command{Op: Import, Data: data}); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// The counter is changed by every member applying the log,
+// the new value on the leader is returned
+func (s *Storage) Increment(ctx context.Context, key string, delta int64) (int64, error) {
+	var value int64
+
+	err := s.node.propose(ctx, &value, func() (Entry, error) {
+		return Entry{Command: &Command{Op: Incr, Key: key, Delta: delta}}, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return value, nil
+}
+
+// Admin handler of the cluster membership:
+// GET /cluster reports status of the member,
+// POST /cluster/members adds the member sent in JSON,
+// DELETE /cluster/members?id= removes the member
+// Membership changes are accepted by the leader only
+func (n *Node) AdminHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		switch {
+		case r.URL.Path == "/cluster" && r.Method == http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(n.Status())
+			return
+
+		case r.URL.Path == "/cluster/members" && r.Method == http.MethodPost:
+			var m Member
+			if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+				http.Error(w, "invalid member: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			err = n.AddMember(r.Context(), m)
+
+		case r.URL.Path == "/cluster/members" && r.Method == http.MethodDelete:
+			err = n.RemoveMember(r.Context(), r.URL.Query().Get("id"))
+
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+
+		switch errors.Code(err) {
+		case "":
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(n.Status())
+		case errors.NotLeaderErr:
+			http.Error(w, err.Error(), http.StatusMisdirectedRequest)
+		case errors.ClusterCfgErr:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		}
+	})
+}
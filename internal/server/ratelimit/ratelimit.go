@@ -0,0 +1,197 @@
+// Token-bucket rate limiting of client requests.
+// Buckets are keyed by the client certificate identity or by the group
+// whose members share a bucket, read and write requests have separate
+// budgets configured per identity or group.
+
+package ratelimit
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/arsenalzp/keyvalstore/internal/server/errors"
+	"github.com/arsenalzp/keyvalstore/internal/server/identity"
+)
+
+// Class of requests with a separate budget
+type Class string
+
+const (
+	Read  Class = "read"
+	Write Class = "write"
+)
+
+// Limit of a token bucket, zero rate means unlimited
+type Limit struct {
+	Rate  float64 `json:"rate"`  // tokens per second
+	Burst int     `json:"burst"` // bucket capacity
+}
+
+// Budgets of read and write requests
+type Budget struct {
+	Read  Limit `json:"read"`
+	Write Limit `json:"write"`
+}
+
+// Group of identities sharing the same budget
+type Group struct {
+	Members []string `json:"members"` // identity selectors, e.g. "ou:batch"
+	Budget
+}
+
+// Configuration of the rate limiter
+type Config struct {
+	Default    Budget            `json:"default"`    // budget of identities without explicit configuration
+	Groups     map[string]Group  `json:"groups"`     // budgets of identity groups
+	Identities map[string]Budget `json:"identities"` // budgets of identities by name (CN or SAN)
+}
+
+// interval of evicting idle buckets
+const sweepInterval = time.Minute
+
+type bucket struct {
+	limit  Limit
+	tokens float64
+	last   time.Time
+}
+
+// Limiter keeps token buckets of identities
+type Limiter struct {
+	mu      sync.Mutex
+	cfg     Config
+	buckets map[string]*bucket
+	swept   time.Time // time of the last eviction of idle buckets
+	now     func() time.Time
+}
+
+func New(cfg Config) *Limiter {
+	return &Limiter{
+		cfg:     cfg,
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// Load configuration of the limiter from the JSON file
+func LoadConfig(path string) (Config, error) {
+	var cfg Config
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, errors.New("unable to read rate limit config", errors.RateLimitCfgErr, err)
+	}
+
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, errors.New("unable to parse rate limit config", errors.RateLimitCfgErr, err)
+	}
+
+	return cfg, nil
+}
+
+// Replace configuration of the limiter, e.g. on reload
+func (l *Limiter) SetConfig(cfg Config) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.cfg = cfg
+}
+
+// Take a token of the class from the identity's bucket
+// Returns error with retry interval if the budget is exhausted
+func (l *Limiter) Allow(id identity.Identity, class Class) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	owner, limit := l.limit(id, class)
+	if limit.Rate <= 0 {
+		return nil
+	}
+
+	key := string(class) + ":" + owner
+	now := l.now()
+
+	if now.Sub(l.swept) >= sweepInterval {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok || b.limit != limit {
+		b = &bucket{limit: limit, tokens: float64(burst(limit)), last: now}
+		l.buckets[key] = b
+	}
+
+	// refill the bucket since the last request
+	b.tokens = math.Min(float64(burst(limit)), b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return nil
+	}
+
+	retryAfter := time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+	msg := fmt.Sprintf("rate limited, retry after %s", retryAfter.Round(time.Millisecond))
+
+	return errors.New(msg, errors.RateLimitErr, nil)
+}
+
+// Drop buckets which have been refilled to their capacity,
+// they are the same as new ones
+func (l *Limiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		full := b.tokens + now.Sub(b.last).Seconds()*b.limit.Rate
+		if full >= float64(burst(b.limit)) {
+			delete(l.buckets, key)
+		}
+	}
+
+	l.swept = now
+}
+
+// Get owner of the bucket and limit of the class for the identity: identity
+// budget, then the first matching group in name order, then the default one.
+// Members of a group share the bucket of the group.
+func (l *Limiter) limit(id identity.Identity, class Class) (string, Limit) {
+	if budget, ok := l.cfg.Identities[id.Name()]; ok {
+		return "id:" + id.Name(), budget.get(class)
+	}
+
+	names := make([]string, 0, len(l.cfg.Groups))
+	for name := range l.cfg.Groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		group := l.cfg.Groups[name]
+		for _, selector := range group.Members {
+			if id.Matches(selector) {
+				return "group:" + name, group.get(class)
+			}
+		}
+	}
+
+	return "id:" + id.Name(), l.cfg.Default.get(class)
+}
+
+func (b Budget) get(class Class) Limit {
+	if class == Write {
+		return b.Write
+	}
+
+	return b.Read
+}
+
+// bucket capacity, at least a single token
+func burst(limit Limit) int {
+	if limit.Burst < 1 {
+		return 1
+	}
+
+	return limit.Burst
+}
@@ -0,0 +1,151 @@
+package ratelimit
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arsenalzp/keyvalstore/internal/server/errors"
+	"github.com/arsenalzp/keyvalstore/internal/server/identity"
+)
+
+func TestAllow(t *testing.T) {
+	now := time.Now()
+
+	l := New(Config{
+		Default: Budget{Write: Limit{Rate: 1, Burst: 2}},
+		Groups: map[string]Group{
+			"batch": {Members: []string{"ou:batch"}, Budget: Budget{Read: Limit{Rate: 1, Burst: 1}}},
+		},
+		Identities: map[string]Budget{
+			"admin": {},
+		},
+	})
+	l.now = func() time.Time { return now }
+
+	client := identity.Identity{CommonName: "client"}
+	batch := identity.Identity{CommonName: "job", OrganizationalUnit: []string{"batch"}}
+	admin := identity.Identity{CommonName: "admin"}
+
+	// burst of the default write budget
+	for i := 0; i < 2; i++ {
+		if err := l.Allow(client, Write); err != nil {
+			t.Errorf("error allowing request %d: %s\n", i, err)
+			return
+		}
+	}
+
+	err := l.Allow(client, Write)
+	if err == nil || errors.Code(err) != errors.RateLimitErr {
+		t.Errorf("error limiting request, expected code %s, got %v\n", errors.RateLimitErr, err)
+		return
+	}
+
+	if !strings.Contains(err.Error(), "retry after 1s") {
+		t.Errorf("error limiting request, retry interval is missing: %s\n", err)
+		return
+	}
+
+	// read budget isn't limited by default
+	if err := l.Allow(client, Read); err != nil {
+		t.Errorf("error allowing read request: %s\n", err)
+		return
+	}
+
+	// the group read budget
+	if err := l.Allow(batch, Read); err != nil {
+		t.Errorf("error allowing batch request: %s\n", err)
+		return
+	}
+
+	if err := l.Allow(batch, Read); err == nil {
+		t.Errorf("error limiting batch request: request is allowed\n")
+		return
+	}
+
+	// the identity budget is unlimited
+	for i := 0; i < 10; i++ {
+		if err := l.Allow(admin, Write); err != nil {
+			t.Errorf("error allowing admin request: %s\n", err)
+			return
+		}
+	}
+
+	// bucket is refilled over time
+	now = now.Add(time.Second)
+	if err := l.Allow(client, Write); err != nil {
+		t.Errorf("error allowing request after refill: %s\n", err)
+		return
+	}
+}
+
+func TestGroupBudget(t *testing.T) {
+	now := time.Now()
+
+	l := New(Config{
+		Groups: map[string]Group{
+			"batch": {Members: []string{"ou:batch"}, Budget: Budget{Write: Limit{Rate: 1, Burst: 2}}},
+		},
+	})
+	l.now = func() time.Time { return now }
+
+	job1 := identity.Identity{CommonName: "job1", OrganizationalUnit: []string{"batch"}}
+	job2 := identity.Identity{CommonName: "job2", OrganizationalUnit: []string{"batch"}}
+
+	// members of the group share its budget
+	for _, id := range []identity.Identity{job1, job2} {
+		if err := l.Allow(id, Write); err != nil {
+			t.Errorf("error allowing request of %s: %s\n", id.Name(), err)
+			return
+		}
+	}
+
+	if err := l.Allow(job2, Write); errors.Code(err) != errors.RateLimitErr {
+		t.Errorf("error limiting request of the group, expected code %s, got %v\n", errors.RateLimitErr, err)
+		return
+	}
+
+	// idle buckets are evicted once they are refilled
+	now = now.Add(sweepInterval)
+	if err := l.Allow(job1, Write); err != nil {
+		t.Errorf("error allowing request after refill: %s\n", err)
+		return
+	}
+
+	l.sweep(now.Add(sweepInterval))
+	if len(l.buckets) != 0 {
+		t.Errorf("error evicting idle buckets, got %d buckets\n", len(l.buckets))
+		return
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ratelimit.json")
+	data := `{
+		"default": {"read": {"rate": 100, "burst": 200}, "write": {"rate": 10, "burst": 20}},
+		"groups": {"batch": {"members": ["ou:batch"], "write": {"rate": 1, "burst": 1}}}
+	}`
+
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Errorf("error writing config: %s\n", err)
+		return
+	}
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Errorf("error loading config: %s\n", err)
+		return
+	}
+
+	if cfg.Default.Read.Rate != 100 || cfg.Groups["batch"].Write.Burst != 1 {
+		t.Errorf("error loading config, unexpected config: %+v\n", cfg)
+		return
+	}
+
+	if _, err := LoadConfig(filepath.Join(t.TempDir(), "missing.json")); errors.Code(err) != errors.RateLimitCfgErr {
+		t.Errorf("error loading missing config, expected code %s, got %v\n", errors.RateLimitCfgErr, err)
+		return
+	}
+}
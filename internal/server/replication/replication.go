@@ -0,0 +1,328 @@
+// Asynchronous primary/replica replication.
+// A replica connects to the primary by REP command with its position in the
+// primary change log, receives a snapshot of the storage if the position
+// can't be served from the change log, then a stream of change events.
+
+package replication
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arsenalzp/keyvalstore/internal/server/errors"
+	"github.com/arsenalzp/keyvalstore/internal/server/metrics"
+	"github.com/arsenalzp/keyvalstore/internal/server/storage"
+	"github.com/arsenalzp/keyvalstore/internal/server/storage/changelog"
+	entity "github.com/arsenalzp/keyvalstore/internal/server/storage/entity"
+)
+
+const (
+	EOT = '\u0004' // End-Of-Transmission character
+
+	messageSize      = 772
+	heartbeat        = time.Second   // interval of heartbeats of the idle stream
+	readTimeout      = 5 * heartbeat // the primary is considered dead without frames within the timeout
+	dialTimeout      = 10 * time.Second
+	defaultRetry     = 5 * time.Second // delay of reconnection to the primary
+	positionSep      = ":"
+	snapshotFrame    = "snapshot"
+	eventFrame       = "event"
+	heartbeatFrame   = "heartbeat"
+	responseError    = 'N'
+	replicateCommand = "rep"
+)
+
+// Frame of the replication stream
+type Frame struct {
+	Type  string              `json:"type"`            // snapshot, event or heartbeat
+	Log   string              `json:"log"`             // ID of the primary change log
+	Seq   uint64              `json:"seq"`             // sequence number of the frame
+	Head  uint64              `json:"head"`            // sequence number of the last event of the primary
+	Event *changelog.Event    `json:"event,omitempty"` // change of the event frame
+	Data  []entity.ExportData `json:"data,omitempty"`  // content of the snapshot frame
+}
+
+// Stream changes of the log to the replica from its position ("log:seq"),
+// a snapshot is sent first if the position can't be served from the log
+// It returns when sending fails or the context is done
+func Stream(ctx context.Context, log *changelog.Storage, position string, send func(Frame) error) error {
+	seq, ok := parsePosition(log.ID(), position)
+
+	for {
+		if !ok {
+			snapSeq, data, err := log.Snapshot(ctx)
+			if err != nil {
+				return err
+			}
+
+			frame := Frame{Type: snapshotFrame, Log: log.ID(), Seq: snapSeq, Head: snapSeq, Data: data}
+			if err := send(frame); err != nil {
+				return err
+			}
+
+			seq, ok = snapSeq, true
+		}
+
+		hbCtx, cancel := context.WithTimeout(ctx, heartbeat)
+		ev, err := log.Next(hbCtx, seq)
+		cancel()
+
+		switch {
+		case err == nil:
+			if err := send(Frame{Type: eventFrame, Log: log.ID(), Seq: ev.Seq, Head: log.Seq(), Event: &ev}); err != nil {
+				return err
+			}
+			seq = ev.Seq
+
+		case errors.Code(err) == errors.ChangelogGapErr:
+			// the replica is too far behind, start over from a snapshot
+			ok = false
+
+		case ctx.Err() != nil:
+			return ctx.Err()
+
+		default:
+			if err := send(Frame{Type: heartbeatFrame, Log: log.ID(), Seq: seq, Head: log.Seq()}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Parse position of the replica, it's valid only for the same log
+func parsePosition(id, position string) (uint64, bool) {
+	logID, s, found := strings.Cut(position, positionSep)
+	if !found || logID != id {
+		return 0, false
+	}
+
+	seq, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return seq, true
+}
+
+// Status of the replica
+type Status struct {
+	Primary   string        `json:"primary"`
+	Connected bool          `json:"connected"`
+	Synced    bool          `json:"synced"`  // initial snapshot is applied
+	Applied   uint64        `json:"applied"` // sequence number of the last applied event
+	Head      uint64        `json:"head"`    // sequence number of the last event of the primary
+	Lag       time.Duration `json:"lag"`     // age of the last applied event if the replica is behind
+}
+
+// Replica of the primary server, changes are applied to the local storage
+type Replica struct {
+	Primary string      // address of the primary server
+	TLS     *tls.Config // client certificate of the replica and CA of the primary
+	Storage storage.Storage
+	Retry   time.Duration // delay of reconnection, 5s if zero
+
+	mu     sync.Mutex
+	log    string // ID of the primary change log
+	status Status
+
+	dial func(context.Context) (net.Conn, error) // connects to the primary, TLS dialer is used if nil
+}
+
+// Replicate the primary until the context is done, the replica reconnects on failures
+func (r *Replica) Run(ctx context.Context) {
+	retry := r.Retry
+	if retry <= 0 {
+		retry = defaultRetry
+	}
+
+	for {
+		err := r.replicate(ctx)
+		r.setConnected(false)
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		err = errors.New("replication error", errors.ReplicationErr, err)
+		slog.Error("replication interrupted", "primary", r.Primary, "error", err, "code", errors.Code(err))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retry):
+		}
+	}
+}
+
+// Get status of the replica
+func (r *Replica) Status() Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status := r.status
+	status.Primary = r.Primary
+
+	return status
+}
+
+// Readiness check, the replica is ready once the initial snapshot is applied
+func (r *Replica) Check(ctx context.Context) (string, error) {
+	status := r.Status()
+	if !status.Synced {
+		return "", fmt.Errorf("replica isn't synchronized with %s", r.Primary)
+	}
+
+	detail := fmt.Sprintf("lag %d events, %s", status.Head-min(status.Head, status.Applied), status.Lag)
+	if !status.Connected {
+		return "disconnected, " + detail, nil
+	}
+
+	return detail, nil
+}
+
+// Connect to the primary and apply frames of the stream
+func (r *Replica) replicate(ctx context.Context) error {
+	dial := r.dial
+	if dial == nil {
+		dialer := &tls.Dialer{NetDialer: &net.Dialer{Timeout: dialTimeout}, Config: r.TLS}
+		dial = func(ctx context.Context) (net.Conn, error) {
+			return dialer.DialContext(ctx, "tcp", r.Primary)
+		}
+	}
+
+	con, err := dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer con.Close()
+
+	// close the connection to interrupt reading when the context is done
+	stop := context.AfterFunc(ctx, func() { con.Close() })
+	defer stop()
+
+	var buf [messageSize]byte
+	copy(buf[0:3], replicateCommand)
+	copy(buf[3:259], r.position())
+	buf[messageSize-1] = EOT
+
+	if _, err := con.Write(buf[:]); err != nil {
+		return err
+	}
+
+	r.setConnected(true)
+	slog.Info("replicating primary", "primary", r.Primary)
+
+	reader := bufio.NewReader(con)
+	for {
+		con.SetReadDeadline(time.Now().Add(readTimeout))
+
+		resp, err := reader.ReadBytes(EOT)
+		if err != nil {
+			return err
+		}
+
+		if resp[0] == responseError {
+			return fmt.Errorf("primary error: %s", strings.TrimRight(string(resp[1:]), "\x00\u0004"))
+		}
+
+		var frame Frame
+		if err := json.Unmarshal(resp[1:len(resp)-1], &frame); err != nil {
+			return err
+		}
+
+		if err := r.apply(ctx, frame); err != nil {
+			return err
+		}
+	}
+}
+
+// Apply the frame to the local storage
+func (r *Replica) apply(ctx context.Context, frame Frame) error {
+	switch frame.Type {
+	case snapshotFrame:
+		if err := storage.Restore(ctx, r.Storage, frame.Data); err != nil {
+			return err
+		}
+
+		r.mu.Lock()
+		r.log = frame.Log
+		r.status.Synced = true
+		r.mu.Unlock()
+
+		slog.Info("replica synchronized by snapshot", "primary", r.Primary, "keys", len(frame.Data), "seq", frame.Seq)
+
+	case eventFrame:
+		var err error
+
+		if frame.Event == nil {
+			return fmt.Errorf("event frame %d without event", frame.Seq)
+		}
+
+		switch ev := frame.Event; ev.Op {
+		case changelog.Set:
+			_, err = r.Storage.Insert(ctx, ev.Key, entity.StoredValue(ev.Value, ev.Secret))
+		case changelog.Delete:
+			_, err = r.Storage.Delete(ctx, ev.Key)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	r.progress(frame)
+
+	return nil
+}
+
+// Update position and lag of the replica by the applied frame
+func (r *Replica) progress(frame Frame) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.status.Applied = frame.Seq
+	r.status.Head = max(frame.Head, frame.Seq)
+	r.status.Lag = 0
+
+	if frame.Event != nil && r.status.Applied < r.status.Head {
+		r.status.Lag = time.Since(frame.Event.Time)
+	}
+
+	metrics.ReplicationLag.Set(r.status.Lag.Seconds())
+	metrics.ReplicationLagEvents.Set(float64(r.status.Head - r.status.Applied))
+}
+
+func (r *Replica) setConnected(connected bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.status.Connected = connected
+
+	if connected {
+		metrics.ReplicationConnected.Set(1)
+	} else {
+		metrics.ReplicationConnected.Set(0)
+	}
+}
+
+// Position of the replica in the primary change log,
+// it's empty before the initial snapshot
+func (r *Replica) position() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.log == "" {
+		return ""
+	}
+
+	return r.log + positionSep + strconv.FormatUint(r.status.Applied, 10)
+}
@@ -0,0 +1,160 @@
+package replication
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/arsenalzp/keyvalstore/internal/server/storage/changelog"
+	ht "github.com/arsenalzp/keyvalstore/internal/server/storage/hash-table"
+)
+
+// Connect the replica to the primary change log over in-memory connection,
+// number of sent snapshots is counted
+func primary(ctx context.Context, log *changelog.Storage, snapshots *int32) func(context.Context) (net.Conn, error) {
+	return func(context.Context) (net.Conn, error) {
+		client, server := net.Pipe()
+
+		go func() {
+			defer server.Close()
+
+			buf, err := bufio.NewReader(server).ReadBytes(EOT)
+			if err != nil {
+				return
+			}
+
+			position := strings.Trim(string(buf[3:259]), "\x00")
+			Stream(ctx, log, position, func(frame Frame) error {
+				if frame.Type == snapshotFrame {
+					atomic.AddInt32(snapshots, 1)
+				}
+
+				data, err := json.Marshal(frame)
+				if err != nil {
+					return err
+				}
+
+				_, err = server.Write(append(append([]byte{'O'}, data...), EOT))
+				return err
+			})
+		}()
+
+		return client, nil
+	}
+}
+
+// Wait until the condition is met
+func waitFor(t *testing.T, what string, cond func() bool) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Errorf("error waiting for %s\n", what)
+	return false
+}
+
+func TestReplica(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	primaryStorage, _ := ht.NewHT()
+	replicaStorage, _ := ht.NewHT()
+
+	log := changelog.New(primaryStorage, 0)
+	log.Insert(ctx, "k1", "v1")
+	replicaStorage.Insert(ctx, "stale", "v")
+
+	var snapshots int32
+	r := &Replica{Primary: "primary", Storage: replicaStorage, Retry: 10 * time.Millisecond}
+	r.dial = primary(ctx, log, &snapshots)
+
+	runCtx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	done := make(chan struct{})
+	go func() {
+		r.Run(runCtx)
+		close(done)
+	}()
+
+	// the snapshot replaces content of the replica
+	if !waitFor(t, "snapshot", func() bool {
+		value, _ := replicaStorage.Search(ctx, "k1")
+		stale, _ := replicaStorage.Search(ctx, "stale")
+		return r.Status().Synced && value == "v1" && stale == ""
+	}) {
+		return
+	}
+
+	log.Insert(ctx, "k2", "v2")
+	log.Delete(ctx, "k1")
+
+	if !waitFor(t, "events", func() bool {
+		value, _ := replicaStorage.Search(ctx, "k2")
+		deleted, _ := replicaStorage.Search(ctx, "k1")
+		return value == "v2" && deleted == ""
+	}) {
+		return
+	}
+
+	if !waitFor(t, "progress", func() bool { return r.Status().Applied == log.Seq() }) {
+		return
+	}
+
+	if status := r.Status(); !status.Connected || status.Head != log.Seq() || status.Lag != 0 {
+		t.Errorf("error reporting status: %+v\n", status)
+		return
+	}
+
+	// the replica catches up from its position after reconnection
+	stop()
+	<-done
+
+	log.Insert(ctx, "k3", "v3")
+
+	go r.Run(ctx)
+
+	if !waitFor(t, "catching up", func() bool {
+		value, _ := replicaStorage.Search(ctx, "k3")
+		return value == "v3"
+	}) {
+		return
+	}
+
+	if n := atomic.LoadInt32(&snapshots); n != 1 {
+		t.Errorf("error catching up: got %d snapshots, expected 1\n", n)
+		return
+	}
+
+	if _, err := r.Check(ctx); err != nil {
+		t.Errorf("error checking replica: %s\n", err)
+		return
+	}
+}
+
+func TestParsePosition(t *testing.T) {
+	for _, tc := range []struct {
+		position string
+		seq      uint64
+		ok       bool
+	}{
+		{"log:10", 10, true},
+		{"other:10", 0, false},
+		{"log:x", 0, false},
+		{"", 0, false},
+	} {
+		seq, ok := parsePosition("log", tc.position)
+		if seq != tc.seq || ok != tc.ok {
+			t.Errorf("error parsing position %q, got %d %t, expected %d %t\n", tc.position, seq, ok, tc.seq, tc.ok)
+		}
+	}
+}
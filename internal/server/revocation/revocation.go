@@ -0,0 +1,89 @@
+// Revocation checks of client certificates.
+// Certificates are checked against the CRL file and by the OCSP responder,
+// whichever of them are configured.
+
+package revocation
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"os"
+	"time"
+
+	"github.com/arsenalzp/keyvalstore/internal/server/errors"
+	"github.com/arsenalzp/keyvalstore/internal/server/metrics"
+	"github.com/arsenalzp/keyvalstore/internal/server/ocsp"
+)
+
+const ocspTimeout = 5 * time.Second // timeout for OCSP check of a client certificate
+
+// Checker of client certificates
+type Verifier struct {
+	CRLPath string        // path to the CRL file, it isn't checked if empty
+	OCSP    *ocsp.Checker // OCSP checker, it isn't used if nil
+}
+
+// Check the verified client certificate, it's used as VerifyPeerCertificate
+// of the TLS config
+func (v *Verifier) Verify(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	chain := verifiedChains[0]
+
+	if v.CRLPath != "" {
+		crl, err := ParseCRL(v.CRLPath)
+		if err != nil {
+			metrics.CRLRejections.Inc()
+			return err
+		}
+
+		err = CheckCRL(chain[0], crl)
+		if err != nil {
+			metrics.CRLRejections.Inc()
+			return err
+		}
+	}
+
+	if v.OCSP != nil && len(chain) > 1 {
+		ctx, cancel := context.WithTimeout(context.Background(), ocspTimeout)
+		defer cancel()
+
+		if err := v.OCSP.Check(ctx, chain[0], chain[1]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Check provided certificate cert against CRL
+func CheckCRL(cert *x509.Certificate, crl *pkix.CertificateList) error {
+	for _, revokedCertificate := range crl.TBSCertList.RevokedCertificates {
+		if revokedCertificate.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+			err := errors.New("certificate was revoked", errors.CRLCertRevokErr, nil)
+			return err
+		}
+	}
+	return nil
+}
+
+// Parse CRL file which is accessible by crlPath
+func ParseCRL(crlPath string) (*pkix.CertificateList, error) {
+	crlData, err := os.ReadFile(crlPath)
+	if err != nil {
+		err := errors.New("unabel to read CRL file", errors.CRLLoadErr, err)
+		return nil, err
+	}
+
+	crlList, err := x509.ParseCRL(crlData)
+	if err != nil {
+		err := errors.New("unabel to parse CRL data", errors.CRLParseErr, err)
+		return nil, err
+	}
+
+	if crlList.TBSCertList.NextUpdate.Before(time.Now()) {
+		err := errors.New("CRL is outdated", errors.CRLExpiredErr, nil)
+		return nil, err
+	}
+
+	return crlList, nil
+}
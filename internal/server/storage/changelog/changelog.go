@@ -0,0 +1,200 @@
+// Change bus of the underlying storage.
+// Every mutation is numbered by a sequence number and kept in a bounded
+// in-memory history, so readers can follow changes from a known position.
+
+package changelog
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/arsenalzp/keyvalstore/internal/server/errors"
+	"github.com/arsenalzp/keyvalstore/internal/server/storage"
+	"github.com/arsenalzp/keyvalstore/internal/server/storage/counter"
+	entity "github.com/arsenalzp/keyvalstore/internal/server/storage/entity"
+)
+
+// default number of events kept in the history
+const DefaultHistory = 10000
+
+// Operation of the change
+type Op string
+
+const (
+	Set    Op = "set"
+	Delete Op = "del"
+)
+
+// Change of a single key
+type Event struct {
+	Seq    uint64    `json:"seq"`
+	Op     Op        `json:"op"`
+	Key    string    `json:"key"`
+	Value  string    `json:"value,omitempty"`
+	Secret bool      `json:"secret,omitempty"` // the value is secret
+	Time   time.Time `json:"time"`
+}
+
+// Storage publishing its mutations
+// Mutations are serialized to keep order of events the same
+// as order of changes in the underlying storage
+type Storage struct {
+	storage.Storage
+
+	id      string // random ID of the log, sequence numbers are valid within it
+	limit   int    // number of events kept in the history
+	mu      sync.Mutex
+	seq     uint64        // sequence number of the last event
+	history []Event       // the last events, ordered by sequence number
+	notify  chan struct{} // closed and replaced on every event
+	now     func() time.Time
+}
+
+// Publish mutations of the underlying storage, history events are kept
+func New(s storage.Storage, history int) *Storage {
+	if history < 1 {
+		history = DefaultHistory
+	}
+
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	return &Storage{
+		Storage: s,
+		id:      hex.EncodeToString(id),
+		limit:   history,
+		notify:  make(chan struct{}),
+		now:     time.Now,
+	}
+}
+
+// ID of the log, it's changed on every start of the server
+func (s *Storage) ID() string {
+	return s.id
+}
+
+// Sequence number of the last event
+func (s *Storage) Seq() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.seq
+}
+
+func (s *Storage) Insert(ctx context.Context, key, value string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ok, err := s.Storage.Insert(ctx, key, value)
+	if err == nil && ok {
+		value, secret := entity.UnmarkSecret(value)
+		s.publish(Event{Op: Set, Key: key, Value: value, Secret: secret})
+	}
+
+	return ok, err
+}
+
+func (s *Storage) Delete(ctx context.Context, key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ok, err := s.Storage.Delete(ctx, key)
+	if err == nil && ok {
+		s.publish(Event{Op: Delete, Key: key})
+	}
+
+	return ok, err
+}
+
+// The new value of the counter is published as SET
+func (s *Storage) Increment(ctx context.Context, key string, delta int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value, err := storage.Increment(ctx, s.Storage, key, delta)
+	if err == nil {
+		s.publish(Event{Op: Set, Key: key, Value: counter.Format(value)})
+	}
+
+	return value, err
+}
+
+// Every imported key is published as a separate event
+func (s *Storage) Import(ctx context.Context, data []entity.ImportData) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ok, err := s.Storage.Import(ctx, data)
+	if err == nil && ok {
+		for _, item := range data {
+			s.publish(Event{Op: Set, Key: item.Key, Value: item.Value, Secret: item.Secret})
+		}
+	}
+
+	return ok, err
+}
+
+// Export the content of the storage, it includes changes up to the returned
+// sequence number and possibly later ones; mutations aren't blocked while
+// exporting, since events carry whole values and replaying the following
+// ones over the content converges to the storage
+func (s *Storage) Snapshot(ctx context.Context) (uint64, []entity.ExportData, error) {
+	seq := s.Seq()
+
+	data, err := s.Storage.Export(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return seq, data, nil
+}
+
+// Wait for the event following the sequence number
+// Returns error if the event isn't in the history anymore or the sequence
+// number is ahead of the log; the reader has to start over from a snapshot
+func (s *Storage) Next(ctx context.Context, after uint64) (Event, error) {
+	for {
+		s.mu.Lock()
+
+		if after > s.seq || (len(s.history) > 0 && after+1 < s.history[0].Seq) {
+			s.mu.Unlock()
+			err := fmt.Errorf("event %d isn't in the history", after+1)
+			return Event{}, errors.New("change log gap", errors.ChangelogGapErr, err)
+		}
+
+		if after < s.seq {
+			ev := s.history[len(s.history)-int(s.seq-after)]
+			s.mu.Unlock()
+			return ev, nil
+		}
+
+		notify := s.notify
+		s.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return Event{}, ctx.Err()
+		case <-notify:
+		}
+	}
+}
+
+// Number the event, add it to the history and wake up readers
+// It's called with the lock held
+func (s *Storage) publish(ev Event) {
+	s.seq++
+	ev.Seq = s.seq
+	ev.Time = s.now()
+
+	s.history = append(s.history, ev)
+	if len(s.history) >= 2*s.limit {
+		s.history = append([]Event(nil), s.history[len(s.history)-s.limit:]...)
+	}
+
+	close(s.notify)
+	s.notify = make(chan struct{})
+}
@@ -0,0 +1,103 @@
+package changelog
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/arsenalzp/keyvalstore/internal/server/errors"
+	entity "github.com/arsenalzp/keyvalstore/internal/server/storage/entity"
+	ht "github.com/arsenalzp/keyvalstore/internal/server/storage/hash-table"
+)
+
+func TestNext(t *testing.T) {
+	ctx := context.Background()
+
+	storage, err := ht.NewHT()
+	if err != nil {
+		t.Errorf("error creating storage: %s\n", err)
+		return
+	}
+
+	log := New(storage, 3)
+
+	// the reader waits for the next event
+	evCh := make(chan Event, 1)
+	go func() {
+		ev, err := log.Next(ctx, 0)
+		if err != nil {
+			t.Errorf("error waiting for event: %s\n", err)
+		}
+		evCh <- ev
+	}()
+
+	if _, err := log.Insert(ctx, "k1", "v1"); err != nil {
+		t.Errorf("error inserting key: %s\n", err)
+		return
+	}
+
+	select {
+	case ev := <-evCh:
+		if ev.Seq != 1 || ev.Op != Set || ev.Key != "k1" || ev.Value != "v1" {
+			t.Errorf("error publishing event, unexpected event: %+v\n", ev)
+			return
+		}
+	case <-time.After(time.Second):
+		t.Errorf("error publishing event: reader isn't woken up\n")
+		return
+	}
+
+	if _, err := log.Import(ctx, []entity.ImportData{{Key: "k2", Value: "v2"}, {Key: "k3", Value: "v3"}}); err != nil {
+		t.Errorf("error importing keys: %s\n", err)
+		return
+	}
+
+	if _, err := log.Delete(ctx, "k1"); err != nil {
+		t.Errorf("error deleting key: %s\n", err)
+		return
+	}
+
+	// events are read in order from the history
+	for seq, expected := range map[uint64]Event{
+		1: {Seq: 2, Op: Set, Key: "k2", Value: "v2"},
+		3: {Seq: 4, Op: Delete, Key: "k1"},
+	} {
+		ev, err := log.Next(ctx, seq)
+		if err != nil {
+			t.Errorf("error reading event %d: %s\n", seq+1, err)
+			return
+		}
+
+		ev.Time = time.Time{}
+		if ev != expected {
+			t.Errorf("error reading event %d, got %+v, expected %+v\n", seq+1, ev, expected)
+			return
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		log.Insert(ctx, "k4", "v4")
+	}
+
+	// the history is trimmed and the position ahead of the log is invalid
+	for _, seq := range []uint64{0, 100} {
+		if _, err := log.Next(ctx, seq); errors.Code(err) != errors.ChangelogGapErr {
+			t.Errorf("error reading event %d, expected code %s, got %v\n", seq+1, errors.ChangelogGapErr, err)
+			return
+		}
+	}
+
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := log.Next(timeout, log.Seq()); err != context.DeadlineExceeded {
+		t.Errorf("error waiting for event, expected timeout, got %v\n", err)
+		return
+	}
+
+	seq, data, err := log.Snapshot(ctx)
+	if err != nil || seq != 7 || len(data) != 3 {
+		t.Errorf("error taking snapshot: seq %d, %d keys, %v\n", seq, len(data), err)
+		return
+	}
+}
@@ -0,0 +1,49 @@
+// Integer values of counters.
+// Counters are stored as decimal strings without sign "+" and leading zeros,
+// the missing key and the empty value count as zero.
+
+package counter
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/arsenalzp/keyvalstore/internal/server/errors"
+)
+
+// Parse the stored value of the counter
+// Returns error if the value isn't a 64-bit integer
+func Parse(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || strconv.FormatInt(n, 10) != value {
+		return 0, errors.New("value isn't an integer", errors.CounterValueErr, nil)
+	}
+
+	return n, nil
+}
+
+// Add the delta to the stored value of the counter
+// Returns error if the value isn't an integer or the result overflows
+func Add(value string, delta int64) (int64, error) {
+	n, err := Parse(value)
+	if err != nil {
+		return 0, err
+	}
+
+	if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+		err := fmt.Errorf("%d%+d", n, delta)
+		return 0, errors.New("counter overflow", errors.CounterRangeErr, err)
+	}
+
+	return n + delta, nil
+}
+
+// Format the value of the counter to be stored
+func Format(n int64) string {
+	return strconv.FormatInt(n, 10)
+}
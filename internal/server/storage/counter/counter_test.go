@@ -0,0 +1,37 @@
+package counter
+
+import (
+	"math"
+	"testing"
+
+	"github.com/arsenalzp/keyvalstore/internal/server/errors"
+)
+
+func TestAdd(t *testing.T) {
+	tests := []struct {
+		value string
+		delta int64
+		want  int64
+		code  string
+	}{
+		{"", 1, 1, ""},
+		{"41", 1, 42, ""},
+		{"-5", -10, -15, ""},
+		{"9223372036854775806", 1, math.MaxInt64, ""},
+		{"9223372036854775807", 1, 0, errors.CounterRangeErr},
+		{"-9223372036854775808", -1, 0, errors.CounterRangeErr},
+		{"-9223372036854775808", math.MaxInt64, -1, ""},
+		{"abc", 1, 0, errors.CounterValueErr},
+		{"1.5", 1, 0, errors.CounterValueErr},
+		{"007", 1, 0, errors.CounterValueErr},
+		{"+7", 1, 0, errors.CounterValueErr},
+		{"99999999999999999999", 1, 0, errors.CounterValueErr},
+	}
+
+	for _, tt := range tests {
+		n, err := Add(tt.value, tt.delta)
+		if errors.Code(err) != tt.code || (err == nil && n != tt.want) {
+			t.Errorf("error adding %d to %q: got %d, %v, expected %d, code %q\n", tt.delta, tt.value, n, err, tt.want, tt.code)
+		}
+	}
+}
@@ -3,9 +3,40 @@
 
 package entity
 
+import "strings"
+
+// marker of secret values in the storage, values of SET command
+// are trimmed of NULL bytes, so they can't start with it
+// The marker doesn't leave the storage: exported pairs and changes
+// carry the secret flag instead
+const SecretMarker = "\x00secret\x00"
+
+// Value kept by the underlying storage, secret values are marked
+func StoredValue(value string, secret bool) string {
+	if secret {
+		return SecretMarker + value
+	}
+
+	return value
+}
+
+// Get the stored value without the secret marker
+// Returns true if the value is secret
+func UnmarkSecret(stored string) (string, bool) {
+	return strings.CutPrefix(stored, SecretMarker)
+}
+
 type ImportData struct {
-	Key   string `json:"key"`
-	Value string `json:"value"`
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	Secret bool   `json:"secret,omitempty"` // secret key, exported only with export-secrets permission
 }
 
 type ExportData ImportData
+
+// Storage statistics
+// It is used for monitoring of the underlying storage.
+type Stats struct {
+	Keys  uint64 // number of stored keys
+	Bytes uint64 // approximate size of stored keys and values
+}
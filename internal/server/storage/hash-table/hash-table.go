@@ -5,14 +5,19 @@ package ht
 import (
 	"context"
 	"sync"
+	"sync/atomic"
 
 	"github.com/arsenalzp/keyvalstore/internal/server/errors"
+	"github.com/arsenalzp/keyvalstore/internal/server/storage/counter"
 	"github.com/arsenalzp/keyvalstore/internal/server/storage/entity"
 )
 
 // Size of hash table
 const _HT_SIZE uint32 = 1048573
 
+// Number of bucket locks, a lock is shared by buckets with the same remainder
+const _HT_LOCKS uint32 = 4096
+
 type Node struct {
 	sync.Mutex
 
@@ -24,7 +29,9 @@ type Node struct {
 // var hashTable []*Node
 type hashTable struct {
 	table []*Node
-	size  uint64
+	locks []sync.RWMutex // serialize mutations of buckets with their reads
+	size  atomic.Int64   // number of stored keys
+	bytes atomic.Int64   // size of stored keys and values
 }
 
 func (ht *hashTable) Insert(ctx context.Context, k, v string) (bool, error) {
@@ -33,41 +40,10 @@ func (ht *hashTable) Insert(ctx context.Context, k, v string) (bool, error) {
 	go func(h *hashTable, c chan<- struct{}, k string) {
 		i := hash(k)
 
-		var n *Node = ht.table[i]
-		if n == nil {
-			h.table[i] = &Node{
-				key:  k,
-				val:  v,
-				next: nil,
-			}
-			h.table[i].Lock()
-			defer h.table[i].Unlock()
-			h.size++
-			c <- struct{}{}
-			return
-		}
+		mu := h.lock(i)
+		defer mu.Unlock()
 
-		var prev *Node
-		for n != nil {
-			if n.key == k {
-				n.Lock()
-				n.val = v
-				defer n.Unlock()
-				c <- struct{}{}
-				return
-			}
-			prev = n
-			n = n.next
-		}
-
-		prev.next = &Node{
-			key:  k,
-			val:  v,
-			next: nil,
-		}
-		prev.next.Lock()
-		defer prev.next.Unlock()
-		h.size++
+		h.put(i, k, v)
 
 		c <- struct{}{}
 	}(ht, dataCh, k)
@@ -81,12 +57,57 @@ func (ht *hashTable) Insert(ctx context.Context, k, v string) (bool, error) {
 	}
 }
 
+// Add the delta to the integer value of the key, the value is
+// read and replaced under the lock of its bucket
+func (ht *hashTable) Increment(ctx context.Context, k string, delta int64) (int64, error) {
+	dataCh := make(chan int64, 1)
+	errCh := make(chan error, 1)
+
+	go func(h *hashTable, k string) {
+		i := hash(k)
+
+		mu := h.lock(i)
+		defer mu.Unlock()
+
+		var val string
+		for n := h.table[i]; n != nil; n = n.next {
+			if n.key == k {
+				val = n.val
+				break
+			}
+		}
+
+		value, err := counter.Add(val, delta)
+		if err != nil {
+			errCh <- err
+			return
+		}
+
+		h.put(i, k, counter.Format(value))
+
+		dataCh <- value
+	}(ht, k)
+
+	select {
+	case <-ctx.Done():
+		err := errors.New("hash table error: canceled", errors.HashTabIncrErr, nil)
+		return 0, err
+	case err := <-errCh:
+		return 0, err
+	case value := <-dataCh:
+		return value, nil
+	}
+}
+
 func (ht *hashTable) Delete(ctx context.Context, k string) (bool, error) {
 	dataCh := make(chan struct{}, 1)
 
 	go func(h *hashTable, c chan<- struct{}, k string) {
 		i := hash(k)
 
+		mu := h.lock(i)
+		defer mu.Unlock()
+
 		n := h.table[i]
 		if n == nil {
 			c <- struct{}{}
@@ -100,7 +121,8 @@ func (ht *hashTable) Delete(ctx context.Context, k string) (bool, error) {
 					h.table[i].Lock()
 					defer h.table[i].Unlock()
 					h.table[i] = n.next
-					h.size--
+					h.size.Add(-1)
+					h.bytes.Add(-int64(len(n.key) + len(n.val)))
 					c <- struct{}{}
 					return
 				}
@@ -108,13 +130,17 @@ func (ht *hashTable) Delete(ctx context.Context, k string) (bool, error) {
 				prev.Lock()
 				defer prev.Unlock()
 				prev.next = n.next
-				h.size--
+				h.size.Add(-1)
+				h.bytes.Add(-int64(len(n.key) + len(n.val)))
 				c <- struct{}{}
 				return
 			}
 			prev = n
 			n = n.next
 		}
+
+		// the key isn't found in the bucket
+		c <- struct{}{}
 	}(ht, dataCh, k)
 
 	select {
@@ -132,17 +158,14 @@ func (ht *hashTable) Search(ctx context.Context, k string) (string, error) {
 	go func(h *hashTable, c chan<- string, k string) {
 		i := hash(k)
 
-		var n *Node = ht.table[i]
-
-		if n == nil {
-			c <- ""
-		}
+		mu := h.rlock(i)
+		defer mu.RUnlock()
 
-		for n != nil {
+		for n := h.table[i]; n != nil; n = n.next {
 			if n.key == k {
 				c <- n.val
+				return
 			}
-			n = n.next
 		}
 
 		c <- ""
@@ -159,7 +182,7 @@ func (ht *hashTable) Search(ctx context.Context, k string) (string, error) {
 
 func (ht *hashTable) Import(ctx context.Context, data []entity.ImportData) (bool, error) {
 	for _, i := range data {
-		_, err := ht.Insert(ctx, i.Key, i.Value)
+		_, err := ht.Insert(ctx, i.Key, entity.StoredValue(i.Value, i.Secret))
 		if err != nil {
 			return false, err
 		}
@@ -174,14 +197,17 @@ func (ht *hashTable) Export(ctx context.Context) ([]entity.ExportData, error) {
 	go func(h *hashTable, c chan<- []entity.ExportData) {
 		var exportItems []entity.ExportData
 
-		for _, n := range ht.table {
-			if n == nil {
-				continue
-			}
-			for n != nil {
-				exportItems = append(exportItems, entity.ExportData{n.key, n.val})
-				n = n.next
+		// buckets sharing a lock are read together, so mutations
+		// aren't paused by the whole export
+		for l := uint32(0); l < _HT_LOCKS; l++ {
+			mu := h.rlock(l)
+			for i := l; i < _HT_SIZE; i += _HT_LOCKS {
+				for n := h.table[i]; n != nil; n = n.next {
+					value, secret := entity.UnmarkSecret(n.val)
+					exportItems = append(exportItems, entity.ExportData{Key: n.key, Value: value, Secret: secret})
+				}
 			}
+			mu.RUnlock()
 		}
 
 		c <- exportItems
@@ -196,6 +222,70 @@ func (ht *hashTable) Export(ctx context.Context) ([]entity.ExportData, error) {
 	}
 }
 
+func (ht *hashTable) Stats(ctx context.Context) (entity.Stats, error) {
+	return entity.Stats{
+		Keys:  uint64(ht.size.Load()),
+		Bytes: uint64(ht.bytes.Load()),
+	}, nil
+}
+
+// Insert or replace the value of the key in the bucket,
+// the caller holds the lock of the bucket
+func (h *hashTable) put(i uint32, k, v string) {
+	var n *Node = h.table[i]
+	if n == nil {
+		h.table[i] = &Node{
+			key:  k,
+			val:  v,
+			next: nil,
+		}
+		h.table[i].Lock()
+		defer h.table[i].Unlock()
+		h.size.Add(1)
+		h.bytes.Add(int64(len(k) + len(v)))
+		return
+	}
+
+	var prev *Node
+	for n != nil {
+		if n.key == k {
+			n.Lock()
+			h.bytes.Add(int64(len(v) - len(n.val)))
+			n.val = v
+			defer n.Unlock()
+			return
+		}
+		prev = n
+		n = n.next
+	}
+
+	prev.next = &Node{
+		key:  k,
+		val:  v,
+		next: nil,
+	}
+	prev.next.Lock()
+	defer prev.next.Unlock()
+	h.size.Add(1)
+	h.bytes.Add(int64(len(k) + len(v)))
+}
+
+// Lock the bucket, returns the locked mutex
+func (h *hashTable) lock(i uint32) *sync.RWMutex {
+	mu := &h.locks[i%_HT_LOCKS]
+	mu.Lock()
+
+	return mu
+}
+
+// Lock the bucket for reading, returns the read-locked mutex
+func (h *hashTable) rlock(i uint32) *sync.RWMutex {
+	mu := &h.locks[i%_HT_LOCKS]
+	mu.RLock()
+
+	return mu
+}
+
 // Calculate hash function for a string
 func hash(str string) uint32 {
 	var hash uint32
@@ -211,6 +301,7 @@ func hash(str string) uint32 {
 func NewHT() (*hashTable, error) {
 	storage := &hashTable{
 		table: make([]*Node, _HT_SIZE),
+		locks: make([]sync.RWMutex, _HT_LOCKS),
 	}
 
 	return storage, nil
@@ -3,8 +3,11 @@ package ht
 import (
 	"context"
 	"fmt"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/arsenalzp/keyvalstore/internal/server/errors"
 	"github.com/arsenalzp/keyvalstore/internal/server/storage/entity"
 )
 
@@ -118,6 +121,40 @@ func TestDelete(t *testing.T) {
 	}
 }
 
+func TestDeleteMissing(t *testing.T) {
+	hashTbale, err := NewHT()
+	if err != nil {
+		t.Errorf("error creating hash table storage: %s\n", err)
+		return
+	}
+
+	if _, err := hashTbale.Insert(context.Background(), KEY, VALUE); err != nil {
+		t.Errorf("error inserting key-value data: %s\n", err)
+		return
+	}
+
+	// the bucket isn't empty, but the key isn't found in it
+	missing := ""
+	for i := 0; missing == ""; i++ {
+		if k := fmt.Sprintf("key%d", i); k != KEY && hash(k) == hash(KEY) {
+			missing = k
+		}
+	}
+
+	// the search of the colliding key isn't limited by the timeout
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if _, err := hashTbale.Delete(ctx, missing); err != nil {
+		t.Errorf("error deleting missing key: %s\n", err)
+		return
+	}
+
+	if v, _ := hashTbale.Search(ctx, KEY); v != VALUE {
+		t.Errorf("error deleting missing key, expected %s, got %s\n", VALUE, v)
+	}
+}
+
 func TestImport(t *testing.T) {
 	hashTbale, err := NewHT()
 	if err != nil {
@@ -187,6 +224,175 @@ func TestExport(t *testing.T) {
 	}
 }
 
+func TestSecretFlag(t *testing.T) {
+	hashTbale, err := NewHT()
+	if err != nil {
+		t.Errorf("error creating hash table storage: %s\n", err)
+		return
+	}
+
+	ctx := context.Background()
+
+	_, err = hashTbale.Import(ctx, []entity.ImportData{{Key: KEY, Value: VALUE, Secret: true}})
+	if err != nil {
+		t.Errorf("error importing secret key: %s\n", err)
+		return
+	}
+
+	// the value is stored marked, the marker is exported as the flag
+	if v, _ := hashTbale.Search(ctx, KEY); v != entity.SecretMarker+VALUE {
+		t.Errorf("error storing secret key, unexpected value: %q\n", v)
+		return
+	}
+
+	result, err := hashTbale.Export(ctx)
+	if err != nil {
+		t.Errorf("error exporting key-value data: %s\n", err)
+		return
+	}
+
+	if len(result) != 1 || result[0] != (entity.ExportData{Key: KEY, Value: VALUE, Secret: true}) {
+		t.Errorf("error exporting secret key, got %+v\n", result)
+	}
+}
+
+func TestStats(t *testing.T) {
+	hashTbale, err := NewHT()
+	if err != nil {
+		t.Errorf("error creating hash table storage: %s\n", err)
+		return
+	}
+
+	ctx := context.Background()
+
+	testSet := populateTestSet(100)
+	var size int
+	for k, v := range testSet {
+		_, err := hashTbale.Insert(ctx, k, v)
+		if err != nil {
+			t.Errorf("error inserting key-value data: %s\n", err)
+			return
+		}
+		size += len(k) + len(v)
+	}
+
+	// overwrite and delete a key to check incremental accounting
+	hashTbale.Insert(ctx, "key1", "value1")
+	hashTbale.Delete(ctx, "key2")
+	size += len("value1") - len("val1") - len("key2") - len("val2")
+
+	stats, err := hashTbale.Stats(ctx)
+	if err != nil {
+		t.Errorf("error getting statistics: %s\n", err)
+		return
+	}
+
+	if stats.Keys != 99 || stats.Bytes != uint64(size) {
+		t.Errorf("error getting statistics, expected 99 keys and %d bytes, got %d keys and %d bytes\n", size, stats.Keys, stats.Bytes)
+		return
+	}
+}
+
+func TestIncrement(t *testing.T) {
+	ctx := context.Background()
+
+	hashTbale, err := NewHT()
+	if err != nil {
+		t.Errorf("error creating hash table storage: %s\n", err)
+		return
+	}
+
+	// concurrent increments aren't lost
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				hashTbale.Increment(ctx, KEY, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	value, err := hashTbale.Increment(ctx, KEY, -5000)
+	if err != nil || value != 0 {
+		t.Errorf("error incrementing key: expected 0, got %d, %v\n", value, err)
+		return
+	}
+
+	if data, _ := hashTbale.Search(ctx, KEY); data != "0" {
+		t.Errorf("error incrementing key: expected stored value 0, got %q\n", data)
+		return
+	}
+
+	hashTbale.Insert(ctx, "text", VALUE)
+	if _, err := hashTbale.Increment(ctx, "text", 1); errors.Code(err) != errors.CounterValueErr {
+		t.Errorf("error incrementing non-numeric value: expected code %s, got %v\n", errors.CounterValueErr, err)
+		return
+	}
+
+	hashTbale.Insert(ctx, "max", "9223372036854775807")
+	if _, err := hashTbale.Increment(ctx, "max", 1); errors.Code(err) != errors.CounterRangeErr {
+		t.Errorf("error incrementing maximal value: expected code %s, got %v\n", errors.CounterRangeErr, err)
+		return
+	}
+
+	if data, _ := hashTbale.Search(ctx, "max"); data != "9223372036854775807" {
+		t.Errorf("error incrementing maximal value: value is changed to %q\n", data)
+		return
+	}
+}
+
+// Reads run concurrently with increments of the same key, run with -race
+func TestIncrementSearch(t *testing.T) {
+	ctx := context.Background()
+
+	hashTbale, err := NewHT()
+	if err != nil {
+		t.Errorf("error creating hash table storage: %s\n", err)
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			hashTbale.Increment(ctx, KEY, 1)
+		}
+	}()
+
+	var last int
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+
+		data, err := hashTbale.Search(ctx, KEY)
+		if err != nil {
+			t.Errorf("error searching incremented key: %s\n", err)
+			return
+		}
+
+		var value int
+		if data != "" {
+			if _, err := fmt.Sscan(data, &value); err != nil || value < last {
+				t.Errorf("error searching incremented key: got %q after %d\n", data, last)
+				return
+			}
+		}
+		last = value
+	}
+
+	exports, err := hashTbale.Export(ctx)
+	if err != nil || len(exports) != 1 || exports[0].Value != "1000" {
+		t.Errorf("error exporting incremented key: got %v, %v\n", exports, err)
+		return
+	}
+}
+
 func TestNewHt(t *testing.T) {
 	hashTbale, err := NewHT()
 	if err != nil {
@@ -218,7 +424,7 @@ func populateImportData(count int) []entity.ImportData {
 	for i := 1; i <= count; i++ {
 		key := "key" + fmt.Sprint(i)
 		val := "val" + fmt.Sprint(i)
-		testSet = append(testSet, entity.ImportData{key, val})
+		testSet = append(testSet, entity.ImportData{Key: key, Value: val})
 	}
 
 	return testSet
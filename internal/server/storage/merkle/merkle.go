@@ -0,0 +1,319 @@
+// Merkle-tree summaries of a keyspace.
+// Keys are placed into ranges by leading bits of their SHA-256 hash, a range
+// is addressed by its path of bits from the root, e.g. "01". Hash of a leaf
+// range is computed over its pairs, hash of an inner range over hashes of its
+// halves, so two keyspaces are compared by descending into differing ranges.
+
+package merkle
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/arsenalzp/keyvalstore/internal/server/errors"
+	entity "github.com/arsenalzp/keyvalstore/internal/server/storage/entity"
+)
+
+const (
+	MaxDepth  = 16 // depth of leaf ranges
+	MaxLevels = 8  // number of levels below the range returned at once
+)
+
+// Summary of the range
+type Node struct {
+	Path string `json:"path"`
+	Hash string `json:"hash"`
+	Keys int    `json:"keys"` // number of keys within the range
+}
+
+// Hash of the key and its value
+type Entry struct {
+	Key  string `json:"key"`
+	Hash string `json:"hash"`
+}
+
+// Keys of the second keyspace compared with the first one
+type Diff struct {
+	Added   []string `json:"added"`   // keys missing in the first keyspace
+	Removed []string `json:"removed"` // keys missing in the second keyspace
+	Changed []string `json:"changed"` // keys with different values
+}
+
+// Source of summaries of a keyspace, e.g. a tree or a remote server
+type Source interface {
+	// Non-empty ranges the given number of levels below the path
+	Nodes(path string, levels int) ([]Node, error)
+	// Entries of the range ordered by keys
+	Entries(path string) ([]Entry, error)
+}
+
+type item struct {
+	bucket uint32 // leaf range of the key
+	key    string
+	digest [sha256.Size]byte
+}
+
+// Tree of summaries of the keyspace
+type Tree struct {
+	items []item // ordered by bucket and key
+}
+
+// Build the tree of the exported pairs
+func New(data []entity.ExportData) *Tree {
+	items := make([]item, 0, len(data))
+	for _, pair := range data {
+		items = append(items, item{bucket: bucket(pair.Key), key: pair.Key, digest: digest(pair)})
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].bucket != items[j].bucket {
+			return items[i].bucket < items[j].bucket
+		}
+		return items[i].key < items[j].key
+	})
+
+	return &Tree{items: items}
+}
+
+// Check the path of the range
+func ParsePath(path string) error {
+	if len(path) > MaxDepth || strings.Trim(path, "01") != "" {
+		return errors.New("invalid range path", errors.SummaryErr, fmt.Errorf("path %q", path))
+	}
+
+	return nil
+}
+
+func (t *Tree) Nodes(path string, levels int) ([]Node, error) {
+	if err := ParsePath(path); err != nil {
+		return nil, err
+	}
+
+	if levels < 0 || levels > MaxLevels || len(path)+levels > MaxDepth {
+		return nil, errors.New("invalid range levels", errors.SummaryErr, fmt.Errorf("%d levels below %q", levels, path))
+	}
+
+	var nodes []Node
+	lo, hi := t.span(path)
+	t.collect(lo, hi, path, levels, &nodes)
+
+	return nodes, nil
+}
+
+func (t *Tree) Entries(path string) ([]Entry, error) {
+	if err := ParsePath(path); err != nil {
+		return nil, err
+	}
+
+	lo, hi := t.span(path)
+
+	entries := make([]Entry, 0, hi-lo)
+	for _, it := range t.items[lo:hi] {
+		entries = append(entries, Entry{Key: it.key, Hash: hex.EncodeToString(it.digest[:])})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+
+	return entries, nil
+}
+
+// Compare keyspaces of the sources by descending into differing ranges,
+// entries of ranges having up to leafKeys keys are compared directly
+func Compare(a, b Source, leafKeys int) (Diff, error) {
+	var diff Diff
+
+	if err := compare(a, b, "", 0, leafKeys, &diff); err != nil {
+		return Diff{}, err
+	}
+
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Strings(diff.Changed)
+
+	return diff, nil
+}
+
+func compare(a, b Source, path string, levels, leafKeys int, diff *Diff) error {
+	nodesA, err := a.Nodes(path, levels)
+	if err != nil {
+		return err
+	}
+
+	nodesB, err := b.Nodes(path, levels)
+	if err != nil {
+		return err
+	}
+
+	// empty ranges aren't returned, so they have empty hash and no keys
+	ranges := make(map[string][2]Node)
+	for _, n := range nodesA {
+		r := ranges[n.Path]
+		r[0] = n
+		ranges[n.Path] = r
+	}
+	for _, n := range nodesB {
+		r := ranges[n.Path]
+		r[1] = n
+		ranges[n.Path] = r
+	}
+
+	paths := make([]string, 0, len(ranges))
+	for p, r := range ranges {
+		if r[0].Hash != r[1].Hash {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+
+	for _, p := range paths {
+		r := ranges[p]
+
+		if len(p) == MaxDepth || max(r[0].Keys, r[1].Keys) <= leafKeys || r[0].Keys == 0 || r[1].Keys == 0 {
+			if err := compareEntries(a, b, p, diff); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := compare(a, b, p, min(MaxLevels/2, MaxDepth-len(p)), leafKeys, diff); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func compareEntries(a, b Source, path string, diff *Diff) error {
+	entriesA, err := a.Entries(path)
+	if err != nil {
+		return err
+	}
+
+	entriesB, err := b.Entries(path)
+	if err != nil {
+		return err
+	}
+
+	hashes := make(map[string]string, len(entriesA))
+	for _, e := range entriesA {
+		hashes[e.Key] = e.Hash
+	}
+
+	for _, e := range entriesB {
+		hash, ok := hashes[e.Key]
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, e.Key)
+		case hash != e.Hash:
+			diff.Changed = append(diff.Changed, e.Key)
+		}
+		delete(hashes, e.Key)
+	}
+
+	for key := range hashes {
+		diff.Removed = append(diff.Removed, key)
+	}
+
+	return nil
+}
+
+// Append non-empty ranges levels below the range of items[lo:hi]
+func (t *Tree) collect(lo, hi int, path string, levels int, nodes *[]Node) {
+	if lo == hi {
+		return
+	}
+
+	if levels == 0 {
+		hash := t.hash(lo, hi, path)
+		*nodes = append(*nodes, Node{Path: path, Hash: hex.EncodeToString(hash[:]), Keys: hi - lo})
+		return
+	}
+
+	mid := t.split(lo, hi, path)
+	t.collect(lo, mid, path+"0", levels-1, nodes)
+	t.collect(mid, hi, path+"1", levels-1, nodes)
+}
+
+// Hash of the range of items[lo:hi], empty ranges have zero hash
+func (t *Tree) hash(lo, hi int, path string) [sha256.Size]byte {
+	if lo == hi {
+		return [sha256.Size]byte{}
+	}
+
+	h := sha256.New()
+
+	if len(path) == MaxDepth {
+		for _, it := range t.items[lo:hi] {
+			h.Write(it.digest[:])
+		}
+	} else {
+		mid := t.split(lo, hi, path)
+		left, right := t.hash(lo, mid, path+"0"), t.hash(mid, hi, path+"1")
+		h.Write(left[:])
+		h.Write(right[:])
+	}
+
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+
+	return sum
+}
+
+// Bounds of items of the range
+func (t *Tree) span(path string) (int, int) {
+	first, last := bounds(path)
+
+	lo := sort.Search(len(t.items), func(i int) bool { return t.items[i].bucket >= first })
+	hi := sort.Search(len(t.items), func(i int) bool { return t.items[i].bucket > last })
+
+	return lo, hi
+}
+
+// Index of the first item of the right half of the range of items[lo:hi]
+func (t *Tree) split(lo, hi int, path string) int {
+	first, _ := bounds(path + "1")
+
+	return lo + sort.Search(hi-lo, func(i int) bool { return t.items[lo+i].bucket >= first })
+}
+
+// The first and the last leaf range of the path
+func bounds(path string) (uint32, uint32) {
+	var prefix uint32
+	for _, bit := range path {
+		prefix = prefix<<1 | uint32(bit-'0')
+	}
+
+	shift := MaxDepth - len(path)
+	return prefix << shift, (prefix+1)<<shift - 1
+}
+
+func bucket(key string) uint32 {
+	sum := sha256.Sum256([]byte(key))
+	return uint32(binary.BigEndian.Uint16(sum[:2]))
+}
+
+// Hash of the pair, the key and the value are prefixed by their sizes
+func digest(pair entity.ExportData) [sha256.Size]byte {
+	h := sha256.New()
+
+	var size [8]byte
+	binary.BigEndian.PutUint64(size[:], uint64(len(pair.Key)))
+	h.Write(size[:])
+	h.Write([]byte(pair.Key))
+
+	binary.BigEndian.PutUint64(size[:], uint64(len(pair.Value)))
+	h.Write(size[:])
+	h.Write([]byte(pair.Value))
+
+	if pair.Secret {
+		h.Write([]byte{1})
+	}
+
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+
+	return sum
+}
@@ -0,0 +1,94 @@
+package merkle
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	entity "github.com/arsenalzp/keyvalstore/internal/server/storage/entity"
+)
+
+// Source counting requested ranges
+type counter struct {
+	*Tree
+	requests int
+}
+
+func (c *counter) Nodes(path string, levels int) ([]Node, error) {
+	c.requests++
+	return c.Tree.Nodes(path, levels)
+}
+
+func (c *counter) Entries(path string) ([]Entry, error) {
+	c.requests++
+	return c.Tree.Entries(path)
+}
+
+func TestCompare(t *testing.T) {
+	var a, b []entity.ExportData
+	for i := 0; i < 10000; i++ {
+		pair := entity.ExportData{Key: fmt.Sprintf("key-%d", i), Value: "value"}
+		a = append(a, pair)
+		b = append(b, pair)
+	}
+
+	b[10].Value = "changed"
+	b[20].Secret = true
+	b = append(b[:30], b[31:]...)
+	b = append(b, entity.ExportData{Key: "added", Value: "value"})
+
+	src := &counter{Tree: New(a)}
+	diff, err := Compare(src, New(b), 16)
+	if err != nil {
+		t.Errorf("error comparing trees: %s\n", err)
+		return
+	}
+
+	if !slices.Equal(diff.Added, []string{"added"}) ||
+		!slices.Equal(diff.Removed, []string{"key-30"}) ||
+		!slices.Equal(diff.Changed, []string{"key-10", "key-20"}) {
+		t.Errorf("error comparing trees, got %+v\n", diff)
+		return
+	}
+
+	// only differing ranges are requested
+	if src.requests > 20 {
+		t.Errorf("error comparing trees, %d ranges requested\n", src.requests)
+		return
+	}
+
+	diff, err = Compare(New(a), New(a), 16)
+	if err != nil || len(diff.Added)+len(diff.Removed)+len(diff.Changed) != 0 {
+		t.Errorf("error comparing equal trees, got %+v, %v\n", diff, err)
+		return
+	}
+}
+
+func TestNodes(t *testing.T) {
+	tree := New([]entity.ExportData{{Key: "a", Value: "1"}, {Key: "b", Value: "2"}, {Key: "c", Value: "3"}})
+
+	root, _ := tree.Nodes("", 0)
+	leaves, _ := tree.Nodes("", MaxLevels)
+
+	keys := 0
+	for _, n := range leaves {
+		keys += n.Keys
+	}
+
+	if len(root) != 1 || root[0].Keys != 3 || keys != 3 {
+		t.Errorf("error summarizing ranges, got %+v and %+v\n", root, leaves)
+		return
+	}
+
+	for _, path := range []string{"012", "00000000000000000"} {
+		if _, err := tree.Nodes(path, 0); err == nil {
+			t.Errorf("error parsing path: invalid path %q is accepted\n", path)
+			return
+		}
+	}
+
+	if _, err := tree.Nodes("0000000000", MaxLevels); err == nil {
+		t.Errorf("error checking levels: ranges below leaves are accepted\n")
+		return
+	}
+}
@@ -0,0 +1,568 @@
+// Live migration between underlying storages.
+// Mutations are applied to the current storage and, while migrating, to the
+// target storage as well. Content of the current storage is copied to the
+// target in background, keys mutated since the start aren't overwritten by
+// the copy. Then both storages are compared by Merkle-tree summaries and the
+// target replaces the current storage atomically; the kind of the target is
+// recorded in the state file and the replaced storage is closed.
+
+package migrate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/arsenalzp/keyvalstore/internal/server/errors"
+	"github.com/arsenalzp/keyvalstore/internal/server/storage"
+	"github.com/arsenalzp/keyvalstore/internal/server/storage/counter"
+	entity "github.com/arsenalzp/keyvalstore/internal/server/storage/entity"
+	"github.com/arsenalzp/keyvalstore/internal/server/storage/merkle"
+)
+
+// State of the migration
+type State string
+
+const (
+	Idle      State = "idle"
+	Copying   State = "copying"
+	Verifying State = "verifying" // mutations are paused while storages are compared
+	Done      State = "done"
+	Failed    State = "failed"
+)
+
+// number of keys copied at once, mutations wait for the batch
+const batchSize = 1000
+
+// Open the storage of the given kind, e.g. storage.NewStrg
+type Opener func(kind string) (storage.Storage, error)
+
+// Status of the migration reported by the admin listener
+type Status struct {
+	State    State      `json:"state"`
+	Storage  string     `json:"storage"`          // kind of the current storage
+	Target   string     `json:"target,omitempty"` // kind of the target storage
+	Copied   int        `json:"copied"`           // number of copied keys
+	Total    int        `json:"total"`            // number of keys to copy
+	Error    string     `json:"error,omitempty"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+type backend struct {
+	storage.Storage
+	kind string
+
+	mu     sync.RWMutex // held by reads, so the storage isn't closed under them
+	closed bool
+}
+
+// Storage which can be replaced by another one without downtime
+type Storage struct {
+	// Path to the file recording the kind of the storage migrated to,
+	// it isn't recorded if empty
+	StatePath string
+
+	open Opener
+	cur  atomic.Pointer[backend] // reads are served by the current storage
+
+	// mutations share the lock unless a migration is running, then
+	// they are serialized with copying and switching
+	mu        sync.RWMutex
+	target    *backend        // target of the running migration
+	dirty     map[string]bool // keys mutated since the migration started
+	mirrorErr error           // error of the mutation of the target
+
+	smu    sync.Mutex
+	status Status
+}
+
+// Wrap the current storage of the given kind, storages
+// of migration targets are created by open
+func New(kind string, s storage.Storage, open Opener) *Storage {
+	m := &Storage{open: open, status: Status{State: Idle, Storage: kind}}
+	m.cur.Store(&backend{Storage: s, kind: kind})
+
+	return m
+}
+
+// Kind of the current storage
+func (s *Storage) Kind() string {
+	return s.cur.Load().kind
+}
+
+// Check the kind of the storage against the state file, the server
+// serves stale data if it's started with the storage migrated from
+func CheckState(path, kind string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.New("unable to read storage state", errors.StorageStateErr, err)
+	}
+
+	if migrated := strings.TrimSpace(string(data)); migrated != kind {
+		err := fmt.Errorf("storage was migrated to %q, set SERVICE_STORAGE to it or remove %s", migrated, path)
+		return errors.New("storage kind doesn't match its state", errors.StorageStateErr, err)
+	}
+
+	return nil
+}
+
+func (s *Storage) Search(ctx context.Context, key string) (string, error) {
+	b := s.acquire()
+	defer b.mu.RUnlock()
+
+	return b.Search(ctx, key)
+}
+
+func (s *Storage) Export(ctx context.Context) ([]entity.ExportData, error) {
+	b := s.acquire()
+	defer b.mu.RUnlock()
+
+	return b.Export(ctx)
+}
+
+func (s *Storage) Insert(ctx context.Context, key, value string) (bool, error) {
+	defer s.lock()()
+
+	ok, err := s.cur.Load().Insert(ctx, key, value)
+	if err == nil {
+		s.mirror(ctx, []string{key}, func(ctx context.Context, t storage.Storage) error {
+			_, err := t.Insert(ctx, key, value)
+			return err
+		})
+	}
+
+	return ok, err
+}
+
+func (s *Storage) Delete(ctx context.Context, key string) (bool, error) {
+	defer s.lock()()
+
+	ok, err := s.cur.Load().Delete(ctx, key)
+	if err == nil {
+		s.mirror(ctx, []string{key}, func(ctx context.Context, t storage.Storage) error {
+			_, err := t.Delete(ctx, key)
+			return err
+		})
+	}
+
+	return ok, err
+}
+
+func (s *Storage) Import(ctx context.Context, data []entity.ImportData) (bool, error) {
+	defer s.lock()()
+
+	ok, err := s.cur.Load().Import(ctx, data)
+	if err == nil {
+		keys := make([]string, len(data))
+		for i, item := range data {
+			keys[i] = item.Key
+		}
+
+		s.mirror(ctx, keys, func(ctx context.Context, t storage.Storage) error {
+			_, err := t.Import(ctx, data)
+			return err
+		})
+	}
+
+	return ok, err
+}
+
+// The new value of the counter is mirrored to the target
+func (s *Storage) Increment(ctx context.Context, key string, delta int64) (int64, error) {
+	defer s.lock()()
+
+	value, err := storage.Increment(ctx, s.cur.Load().Storage, key, delta)
+	if err == nil {
+		s.mirror(ctx, []string{key}, func(ctx context.Context, t storage.Storage) error {
+			_, err := t.Insert(ctx, key, counter.Format(value))
+			return err
+		})
+	}
+
+	return value, err
+}
+
+func (s *Storage) Stats(ctx context.Context) (entity.Stats, error) {
+	b := s.acquire()
+	defer b.mu.RUnlock()
+
+	stater, ok := b.Storage.(storage.Stater)
+	if !ok {
+		return entity.Stats{}, errors.New("storage doesn't support statistics", errors.StorageStatsErr, nil)
+	}
+
+	return stater.Stats(ctx)
+}
+
+func (s *Storage) Ping(ctx context.Context) error {
+	b := s.acquire()
+	defer b.mu.RUnlock()
+
+	if pinger, ok := b.Storage.(storage.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+
+	return nil
+}
+
+// Lock mutations: they share the lock unless a migration is running,
+// then they are mirrored to the target exclusively
+// Returns the function releasing the lock
+func (s *Storage) lock() func() {
+	s.mu.RLock()
+	if s.target == nil {
+		return s.mu.RUnlock
+	}
+	s.mu.RUnlock()
+
+	s.mu.Lock()
+	return s.mu.Unlock
+}
+
+// Current storage locked for reading, the caller releases its lock
+func (s *Storage) acquire() *backend {
+	for {
+		b := s.cur.Load()
+		b.mu.RLock()
+		if !b.closed {
+			return b
+		}
+		// the storage has been replaced
+		b.mu.RUnlock()
+	}
+}
+
+// Close the storage once its reads are finished
+func (b *backend) close() {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+
+	if c, ok := b.Storage.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			slog.Error("unable to close storage", "storage", b.kind, "error", err)
+		}
+	}
+}
+
+// Status of the last migration
+func (s *Storage) Status() Status {
+	s.smu.Lock()
+	defer s.smu.Unlock()
+
+	status := s.status
+	status.Storage = s.Kind()
+
+	return status
+}
+
+// Start migration to the storage of the given kind in background
+// Returns error if the migration is running or the target can't be opened
+func (s *Storage) Start(kind string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.target != nil {
+		return errors.New("storage migration is running", errors.StorageMigrateErr, fmt.Errorf("migration to %q", s.target.kind))
+	}
+
+	if kind == s.Kind() {
+		return errors.New("storage is already used", errors.StorageMigrateErr, fmt.Errorf("storage %q", kind))
+	}
+
+	target, err := s.open(kind)
+	if err != nil {
+		return errors.New("unable to open target storage", errors.StorageMigrateErr, err)
+	}
+
+	// mutations are mirrored from now on, so the copy may start at any moment
+	s.target = &backend{Storage: target, kind: kind}
+	s.dirty = make(map[string]bool)
+	s.mirrorErr = nil
+
+	now := time.Now()
+	s.setStatus(func(st *Status) {
+		*st = Status{State: Copying, Target: kind, Started: &now}
+	})
+
+	go s.run(context.Background(), s.target)
+
+	return nil
+}
+
+// Admin handler reporting status of the migration (GET)
+// and starting migration to {"storage": "kind"} (POST)
+func (s *Storage) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var req struct {
+				Storage string `json:"storage"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "invalid migration: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			if err := s.Start(req.Storage); err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Status())
+	})
+}
+
+// Copy, verify and switch to the target storage
+func (s *Storage) run(ctx context.Context, target *backend) {
+	err := s.copy(ctx, target)
+	if err == nil {
+		s.setStatus(func(st *Status) { st.State = Verifying })
+		err = s.verify(ctx, target)
+	}
+
+	now := time.Now()
+	if err != nil {
+		s.mu.Lock()
+		if s.target == target {
+			s.target, s.dirty = nil, nil
+		}
+		s.mu.Unlock()
+		go target.close()
+
+		slog.Error("storage migration failed", "target", target.kind, "error", err, "code", errors.Code(err))
+		s.setStatus(func(st *Status) { st.State, st.Error, st.Finished = Failed, err.Error(), &now })
+		return
+	}
+
+	slog.Info("storage migrated, set SERVICE_STORAGE to keep it after restart", "storage", target.kind, "state", s.StatePath)
+	s.setStatus(func(st *Status) { st.State, st.Finished = Done, &now })
+}
+
+// Copy the snapshot of the current storage to the target in batches,
+// keys of the target missing in the snapshot are deleted
+func (s *Storage) copy(ctx context.Context, target *backend) error {
+	snapshot, err := s.cur.Load().Export(ctx)
+	if err != nil {
+		return errors.New("unable to export current storage", errors.StorageMigrateErr, err)
+	}
+
+	existing, err := target.Export(ctx)
+	if err != nil {
+		return errors.New("unable to export target storage", errors.StorageMigrateErr, err)
+	}
+
+	s.setStatus(func(st *Status) { st.Total = len(snapshot) })
+
+	keys := make(map[string]bool, len(snapshot))
+	for _, item := range snapshot {
+		keys[item.Key] = true
+	}
+
+	var stale []string
+	for _, item := range existing {
+		if !keys[item.Key] {
+			stale = append(stale, item.Key)
+		}
+	}
+
+	for len(stale) > 0 {
+		n := min(batchSize, len(stale))
+		err := s.batch(target, func() error {
+			for _, key := range stale[:n] {
+				if s.dirty[key] {
+					continue
+				}
+				if _, err := target.Delete(ctx, key); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		stale = stale[n:]
+	}
+
+	for len(snapshot) > 0 {
+		n := min(batchSize, len(snapshot))
+		err := s.batch(target, func() error {
+			items := make([]entity.ImportData, 0, n)
+			for _, item := range snapshot[:n] {
+				if !s.dirty[item.Key] {
+					items = append(items, entity.ImportData(item))
+				}
+			}
+			if len(items) == 0 {
+				return nil
+			}
+			_, err := target.Import(ctx, items)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		snapshot = snapshot[n:]
+		s.setStatus(func(st *Status) { st.Copied += n })
+	}
+
+	return nil
+}
+
+// Apply the batch to the target while mutations wait
+func (s *Storage) batch(target *backend, apply func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.target != target {
+		return errors.New("mirroring to target storage failed", errors.StorageMigrateErr, s.mirrorErr)
+	}
+
+	if err := apply(); err != nil {
+		return errors.New("unable to copy keys", errors.StorageMigrateErr, err)
+	}
+
+	return nil
+}
+
+// Compare storages and switch to the target if they are equal. Storages
+// are compared while mutations continue, keys mutated meanwhile are
+// compared again while mutations wait for the switch
+func (s *Storage) verify(ctx context.Context, target *backend) error {
+	s.mu.Lock()
+	if s.target != target {
+		s.mu.Unlock()
+		return errors.New("mirroring to target storage failed", errors.StorageMigrateErr, s.mirrorErr)
+	}
+	old := s.cur.Load()
+	s.dirty = make(map[string]bool)
+	s.mu.Unlock()
+
+	current, err := old.Export(ctx)
+	if err != nil {
+		return errors.New("unable to export current storage", errors.StorageMigrateErr, err)
+	}
+
+	copied, err := target.Export(ctx)
+	if err != nil {
+		return errors.New("unable to export target storage", errors.StorageMigrateErr, err)
+	}
+
+	diff, err := merkle.Compare(merkle.New(current), merkle.New(copied), batchSize)
+	if err != nil {
+		return errors.New("unable to compare storages", errors.StorageMigrateErr, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.target != target {
+		return errors.New("mirroring to target storage failed", errors.StorageMigrateErr, s.mirrorErr)
+	}
+
+	var differ int
+	for _, keys := range [][]string{diff.Added, diff.Removed, diff.Changed} {
+		for _, key := range keys {
+			equal, err := s.equal(ctx, old, target, key)
+			if err != nil {
+				return errors.New("unable to compare storages", errors.StorageMigrateErr, err)
+			}
+			if !equal {
+				differ++
+			}
+		}
+	}
+
+	if differ > 0 {
+		err := fmt.Errorf("%d keys differ", differ)
+		return errors.New("storages differ", errors.StorageMigrateErr, err)
+	}
+
+	if s.StatePath != "" {
+		if err := writeState(s.StatePath, target.kind); err != nil {
+			return errors.New("unable to record storage state", errors.StorageMigrateErr, err)
+		}
+	}
+
+	s.cur.Store(target)
+	s.target, s.dirty = nil, nil
+	go old.close()
+
+	return nil
+}
+
+// Keys differing in the comparison are equal only if they were mutated
+// meanwhile and values of both storages are equal now; the caller holds the lock
+func (s *Storage) equal(ctx context.Context, a, b *backend, key string) (bool, error) {
+	if !s.dirty[key] {
+		return false, nil
+	}
+
+	va, err := a.Search(ctx, key)
+	if err != nil {
+		return false, err
+	}
+
+	vb, err := b.Search(ctx, key)
+	if err != nil {
+		return false, err
+	}
+
+	return va == vb, nil
+}
+
+// Record the kind of the storage, the file is replaced atomically
+func writeState(path, kind string) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(kind+"\n"), 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// Apply the mutation of the keys to the target of the running migration,
+// the migration is aborted if it fails; the caller holds the lock
+func (s *Storage) mirror(ctx context.Context, keys []string, apply func(context.Context, storage.Storage) error) {
+	if s.target == nil {
+		return
+	}
+
+	for _, key := range keys {
+		s.dirty[key] = true
+	}
+
+	// the mutation of the current storage is done, so it's completed
+	// even if the client doesn't wait anymore
+	if err := apply(context.WithoutCancel(ctx), s.target); err != nil {
+		s.mirrorErr = err
+		s.target, s.dirty = nil, nil
+	}
+}
+
+func (s *Storage) setStatus(update func(*Status)) {
+	s.smu.Lock()
+	defer s.smu.Unlock()
+
+	update(&s.status)
+}
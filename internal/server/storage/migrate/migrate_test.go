@@ -0,0 +1,170 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/arsenalzp/keyvalstore/internal/server/storage"
+	entity "github.com/arsenalzp/keyvalstore/internal/server/storage/entity"
+	ht "github.com/arsenalzp/keyvalstore/internal/server/storage/hash-table"
+)
+
+// Storage failing imports
+type failing struct {
+	storage.Storage
+}
+
+func (f *failing) Import(context.Context, []entity.ImportData) (bool, error) {
+	return false, fmt.Errorf("disk is full")
+}
+
+// Storage recording that it's closed
+type closing struct {
+	storage.Storage
+	closed atomic.Bool
+}
+
+func (c *closing) Increment(ctx context.Context, key string, delta int64) (int64, error) {
+	return storage.Increment(ctx, c.Storage, key, delta)
+}
+
+func (c *closing) Close() error {
+	c.closed.Store(true)
+	return nil
+}
+
+// Wait until the migration is finished
+func wait(t *testing.T, s *Storage) Status {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if st := s.Status(); st.State == Done || st.State == Failed {
+			return st
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("timeout waiting for migration\n")
+	return Status{}
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+
+	source, _ := ht.NewHT()
+	for i := 0; i < 5000; i++ {
+		source.Insert(ctx, fmt.Sprintf("key%d", i), "value")
+	}
+
+	target, _ := ht.NewHT()
+	target.Insert(ctx, "stale", "value")
+
+	current := &closing{Storage: source}
+	s := New("hash", current, func(kind string) (storage.Storage, error) {
+		if kind != "sqlite" {
+			return nil, fmt.Errorf("unknown storage %q", kind)
+		}
+		return target, nil
+	})
+	s.StatePath = filepath.Join(t.TempDir(), "storage.state")
+
+	if err := s.Start("hash"); err == nil {
+		t.Errorf("error starting migration: migration to the current storage is accepted\n")
+		return
+	}
+
+	if err := s.Start("sqlite"); err != nil {
+		t.Errorf("error starting migration: %s\n", err)
+		return
+	}
+
+	// mutations during the migration are applied to both storages
+	for i := 0; i < 1000; i++ {
+		s.Insert(ctx, fmt.Sprintf("key%d", i), "changed")
+		s.Delete(ctx, fmt.Sprintf("key%d", 4999-i))
+		s.Insert(ctx, fmt.Sprintf("new%d", i), "value")
+		s.Increment(ctx, "counter", 1)
+	}
+
+	if st := wait(t, s); st.State != Done || st.Storage != "sqlite" || st.Copied != st.Total {
+		t.Errorf("error migrating storage, got %+v\n", st)
+		return
+	}
+
+	data, _ := s.Export(ctx)
+	values := make(map[string]string, len(data))
+	for _, item := range data {
+		values[item.Key] = item.Value
+	}
+
+	if len(values) != 5001 || values["key0"] != "changed" || values["key1000"] != "value" || values["new999"] != "value" || values["counter"] != "1000" {
+		t.Errorf("error migrating storage, got %d keys\n", len(values))
+		return
+	}
+
+	if _, ok := values["stale"]; ok {
+		t.Errorf("error migrating storage: stale key of the target is kept\n")
+		return
+	}
+
+	// the target serves reads and writes after the switch
+	s.Insert(ctx, "after", "value")
+	if value, _ := target.Search(ctx, "after"); value != "value" {
+		t.Errorf("error switching storage: writes aren't applied to the target\n")
+		return
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !current.closed.Load() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !current.closed.Load() {
+		t.Errorf("error switching storage: the previous storage isn't closed\n")
+		return
+	}
+
+	// the server isn't started with the previous storage
+	if err := CheckState(s.StatePath, "hash"); err == nil {
+		t.Errorf("error checking storage state: the previous storage is accepted\n")
+		return
+	}
+	if err := CheckState(s.StatePath, "sqlite"); err != nil {
+		t.Errorf("error checking storage state: %s\n", err)
+		return
+	}
+}
+
+func TestMigrateFailure(t *testing.T) {
+	ctx := context.Background()
+
+	source, _ := ht.NewHT()
+	source.Import(ctx, []entity.ImportData{{Key: "a", Value: "1"}, {Key: "b", Value: "2"}})
+
+	empty, _ := ht.NewHT()
+	s := New("hash", source, func(string) (storage.Storage, error) { return &failing{Storage: empty}, nil })
+
+	if err := s.Start("sqlite"); err != nil {
+		t.Errorf("error starting migration: %s\n", err)
+		return
+	}
+
+	if st := wait(t, s); st.State != Failed || st.Storage != "hash" || st.Error == "" {
+		t.Errorf("error failing migration, got %+v\n", st)
+		return
+	}
+
+	// the current storage is kept and mutations aren't mirrored anymore
+	s.Insert(ctx, "c", "3")
+	if value, _ := source.Search(ctx, "c"); value != "3" {
+		t.Errorf("error failing migration: writes aren't applied to the current storage\n")
+		return
+	}
+
+	if value, _ := empty.Search(ctx, "c"); value != "" {
+		t.Errorf("error failing migration: writes are mirrored to the target\n")
+		return
+	}
+}
@@ -0,0 +1,593 @@
+// Storage quotas of namespaces and identities.
+// Number of keys and total size of keys and values are counted per namespace
+// (the tenant keyspace or the shared keyspace if tenants aren't isolated)
+// on every write applied to the storage, including writes replicated through
+// Raft or from the primary; writes of clients exceeding the limit are rejected.
+// Identities with their own limits are additionally charged for keys they
+// have written through the node, owners of keys aren't stored nor replicated,
+// so their usage is tracked by the node since the start.
+
+package quota
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/arsenalzp/keyvalstore/internal/server/errors"
+	"github.com/arsenalzp/keyvalstore/internal/server/identity"
+	"github.com/arsenalzp/keyvalstore/internal/server/metrics"
+	"github.com/arsenalzp/keyvalstore/internal/server/storage"
+	"github.com/arsenalzp/keyvalstore/internal/server/storage/counter"
+	entity "github.com/arsenalzp/keyvalstore/internal/server/storage/entity"
+)
+
+// Limit of a namespace, zero means unlimited
+type Limit struct {
+	Keys  int64 `json:"keys"`  // number of keys
+	Bytes int64 `json:"bytes"` // total size of keys and values
+}
+
+// Configuration of quotas
+type Config struct {
+	Default    Limit            `json:"default"`    // limit of namespaces without explicit configuration
+	Namespaces map[string]Limit `json:"namespaces"` // limits of namespaces by tenant name
+	Identities map[string]Limit `json:"identities"` // limits applied to writes of identities by name (CN or SAN)
+}
+
+// Usage of a namespace or an identity
+type Usage struct {
+	Keys  int64 `json:"keys"`
+	Bytes int64 `json:"bytes"`
+}
+
+// Usage and limit of a namespace or an identity reported by the admin listener
+type Report struct {
+	Usage Usage `json:"usage"`
+	Limit Limit `json:"limit"`
+}
+
+// Usage of namespaces and identities with their own limits
+type Reports struct {
+	Namespaces map[string]Report `json:"namespaces"`
+	Identities map[string]Report `json:"identities"`
+}
+
+type namespace struct {
+	mu     sync.Mutex        // serializes writes of clients to keep owners consistent
+	owners map[string]string // keys written by identities with their own limits
+}
+
+// Tracker keeps usage of namespaces and identities
+type Tracker struct {
+	mu         sync.Mutex
+	cfg        Config
+	namespaces map[string]*namespace
+	usage      map[string]Usage // usage of namespaces, counted by applied writes
+	identities map[string]Usage // usage of identities with their own limits
+}
+
+func New(cfg Config) *Tracker {
+	return &Tracker{
+		cfg:        cfg,
+		namespaces: make(map[string]*namespace),
+		usage:      make(map[string]Usage),
+		identities: make(map[string]Usage),
+	}
+}
+
+// Load configuration of quotas from the JSON file
+func LoadConfig(path string) (Config, error) {
+	var cfg Config
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, errors.New("unable to read quota config", errors.QuotaCfgErr, err)
+	}
+
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, errors.New("unable to parse quota config", errors.QuotaCfgErr, err)
+	}
+
+	return cfg, nil
+}
+
+// Replace configuration of quotas, e.g. on reload
+func (t *Tracker) SetConfig(cfg Config) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.cfg = cfg
+}
+
+// Calculate initial usage of namespaces from the content of the storage,
+// split returns namespace and key of the stored key
+func (t *Tracker) Load(ctx context.Context, s storage.Storage, split func(string) (string, string)) error {
+	data, err := s.Export(ctx)
+	if err != nil {
+		return errors.New("unable to calculate quota usage", errors.QuotaCfgErr, err)
+	}
+
+	for _, item := range data {
+		name, key := split(item.Key)
+		t.count(name, Usage{Keys: 1, Bytes: size(key, item.Value)})
+	}
+
+	return nil
+}
+
+// Add the change to usage of the namespace
+func (t *Tracker) count(name string, d Usage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	cur := t.usage[name]
+	t.usage[name] = Usage{Keys: cur.Keys + d.Keys, Bytes: cur.Bytes + d.Bytes}
+}
+
+// Usage of the namespace
+func (t *Tracker) namespaceUsage(name string) Usage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.usage[name]
+}
+
+// Usage and limits of all the namespaces and identities with their own limits
+func (t *Tracker) Usage() Reports {
+	t.mu.Lock()
+	usage := make(map[string]Usage, len(t.usage)+len(t.namespaces))
+	for name := range t.namespaces {
+		usage[name] = t.usage[name]
+	}
+	for name, u := range t.usage {
+		usage[name] = u
+	}
+
+	reports := Reports{
+		Namespaces: make(map[string]Report, len(usage)),
+		Identities: make(map[string]Report, len(t.cfg.Identities)),
+	}
+	for id, limit := range t.cfg.Identities {
+		reports.Identities[id] = Report{Usage: t.identities[id], Limit: limit}
+	}
+	t.mu.Unlock()
+
+	for name, u := range usage {
+		reports.Namespaces[name] = Report{Usage: u, Limit: t.limit(name)}
+	}
+
+	return reports
+}
+
+// Admin handler reporting usage of namespaces and identities in JSON,
+// the shared keyspace is reported by the empty name
+func (t *Tracker) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(t.Usage())
+	})
+}
+
+// Limit the storage scoped to the namespace, writes of the identity are
+// checked against the namespace limit or the default one and the namespace
+// usage, and against its own limit and usage if it's configured
+// Usage of the namespace is counted by the storage wrapped by Count
+func (t *Tracker) Storage(s storage.Storage, name string, id identity.Identity) *Storage {
+	return &Storage{Storage: s, t: t, ns: t.namespace(name), name: name, id: id.Name()}
+}
+
+func (t *Tracker) namespace(name string) *namespace {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ns, ok := t.namespaces[name]
+	if !ok {
+		ns = &namespace{owners: make(map[string]string)}
+		t.namespaces[name] = ns
+	}
+
+	return ns
+}
+
+// Get limit of the namespace: the namespace limit, then the default one
+func (t *Tracker) limit(name string) Limit {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if limit, ok := t.cfg.Namespaces[name]; ok {
+		return limit
+	}
+
+	return t.cfg.Default
+}
+
+// Get own limit of the identity
+func (t *Tracker) identityLimit(id string) (Limit, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	limit, ok := t.cfg.Identities[id]
+
+	return limit, ok && id != ""
+}
+
+// Storage limited by the quota of the namespace
+type Storage struct {
+	storage.Storage
+	t    *Tracker
+	ns   *namespace
+	name string
+	id   string
+}
+
+func (s *Storage) Insert(ctx context.Context, key, value string) (bool, error) {
+	s.ns.mu.Lock()
+	defer s.ns.mu.Unlock()
+
+	delta, err := s.delta(ctx, key, &value)
+	if err != nil {
+		return false, err
+	}
+
+	if err := s.check(delta); err != nil {
+		return false, err
+	}
+
+	ok, err := s.Storage.Insert(ctx, key, value)
+	if err == nil && ok {
+		s.apply(delta)
+	}
+
+	return ok, err
+}
+
+func (s *Storage) Delete(ctx context.Context, key string) (bool, error) {
+	s.ns.mu.Lock()
+	defer s.ns.mu.Unlock()
+
+	delta, err := s.delta(ctx, key, nil)
+	if err != nil {
+		return false, err
+	}
+
+	ok, err := s.Storage.Delete(ctx, key)
+	if err == nil && ok {
+		s.apply(delta)
+	}
+
+	return ok, err
+}
+
+// The counter is checked against the quota by its expected value
+func (s *Storage) Increment(ctx context.Context, key string, delta int64) (int64, error) {
+	s.ns.mu.Lock()
+	defer s.ns.mu.Unlock()
+
+	old, err := s.Storage.Search(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+
+	expected, err := counter.Add(old, delta)
+	if err != nil {
+		return 0, err
+	}
+
+	next := counter.Format(expected)
+	if err := s.check(s.change(key, old, &next)); err != nil {
+		return 0, err
+	}
+
+	value, err := storage.Increment(ctx, s.Storage, key, delta)
+	if err == nil {
+		next = counter.Format(value)
+		s.apply(s.change(key, old, &next))
+	}
+
+	return value, err
+}
+
+// Import is rejected as a whole if it exceeds the quota
+func (s *Storage) Import(ctx context.Context, data []entity.ImportData) (bool, error) {
+	s.ns.mu.Lock()
+	defer s.ns.mu.Unlock()
+
+	// the last value of a repeated key is stored
+	values := make(map[string]string, len(data))
+	for _, item := range data {
+		values[item.Key] = item.Value
+	}
+
+	delta := newDelta()
+	for key, value := range values {
+		d, err := s.delta(ctx, key, &value)
+		if err != nil {
+			return false, err
+		}
+
+		delta.merge(d)
+	}
+
+	if err := s.check(delta); err != nil {
+		return false, err
+	}
+
+	ok, err := s.Storage.Import(ctx, data)
+	if err == nil && ok {
+		s.apply(delta)
+	}
+
+	return ok, err
+}
+
+// Change of usage of the namespace and of identities owning keys,
+// the namespace usage is checked only, it's counted by applied writes
+type delta struct {
+	Usage                    // change of the namespace usage
+	ids    map[string]Usage  // change of usage of identities with their own limits
+	owners map[string]string // new owners of keys, empty owner isn't tracked
+}
+
+func newDelta() delta {
+	return delta{ids: make(map[string]Usage), owners: make(map[string]string)}
+}
+
+func (d delta) add(id string, u Usage) {
+	cur := d.ids[id]
+	d.ids[id] = Usage{Keys: cur.Keys + u.Keys, Bytes: cur.Bytes + u.Bytes}
+}
+
+func (d *delta) merge(other delta) {
+	d.Keys += other.Keys
+	d.Bytes += other.Bytes
+
+	for id, u := range other.ids {
+		d.add(id, u)
+	}
+
+	for key, owner := range other.owners {
+		d.owners[key] = owner
+	}
+}
+
+// Change of usage by replacing the current value of the key,
+// nil value means deletion
+// Missing keys and empty values aren't distinguished by the storage,
+// so keys with empty values aren't counted
+func (s *Storage) delta(ctx context.Context, key string, value *string) (delta, error) {
+	old, err := s.Storage.Search(ctx, key)
+	if err != nil {
+		return delta{}, err
+	}
+
+	return s.change(key, old, value), nil
+}
+
+// Change of usage by replacing the old value of the key, the new value
+// is charged to the writing identity if it has its own limit
+func (s *Storage) change(key, old string, value *string) delta {
+	d := newDelta()
+	d.Usage = change(key, old, value)
+
+	if owner, ok := s.ns.owners[key]; ok && old != "" {
+		d.add(owner, Usage{Keys: -1, Bytes: -size(key, old)})
+	}
+
+	d.owners[key] = ""
+	if _, limited := s.t.identityLimit(s.id); limited && value != nil && *value != "" {
+		d.add(s.id, Usage{Keys: 1, Bytes: size(key, *value)})
+		d.owners[key] = s.id
+	}
+
+	return d
+}
+
+// Change of usage by replacing the old value of the key
+func change(key, old string, value *string) Usage {
+	var delta Usage
+
+	if old != "" {
+		delta.Keys--
+		delta.Bytes -= size(key, old)
+	}
+
+	if value != nil && *value != "" {
+		delta.Keys++
+		delta.Bytes += size(key, *value)
+	}
+
+	return delta
+}
+
+// Check whether the change fits the limit of the identity and the namespace,
+// usage is allowed to decrease even if it exceeds the limit
+func (s *Storage) check(d delta) error {
+	if limit, ok := s.t.identityLimit(s.id); ok {
+		s.t.mu.Lock()
+		usage := s.t.identities[s.id]
+		s.t.mu.Unlock()
+
+		if err := exceeds(limit, usage, d.ids[s.id]); err != nil {
+			return err
+		}
+	}
+
+	return exceeds(s.t.limit(s.name), s.t.namespaceUsage(s.name), d.Usage)
+}
+
+func exceeds(limit Limit, usage, delta Usage) error {
+	if limit.Keys > 0 && delta.Keys > 0 && usage.Keys+delta.Keys > limit.Keys {
+		metrics.QuotaExceeded.Inc("keys")
+		msg := fmt.Sprintf("quota exceeded, limit %d keys", limit.Keys)
+		return errors.New(msg, errors.QuotaErr, nil)
+	}
+
+	if limit.Bytes > 0 && delta.Bytes > 0 && usage.Bytes+delta.Bytes > limit.Bytes {
+		metrics.QuotaExceeded.Inc("bytes")
+		msg := fmt.Sprintf("quota exceeded, limit %d bytes", limit.Bytes)
+		return errors.New(msg, errors.QuotaErr, nil)
+	}
+
+	return nil
+}
+
+// Apply the change of owners and usage of identities
+func (s *Storage) apply(d delta) {
+	for key, owner := range d.owners {
+		if owner == "" {
+			delete(s.ns.owners, key)
+			continue
+		}
+		s.ns.owners[key] = owner
+	}
+
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+
+	for id, u := range d.ids {
+		cur := s.t.identities[id]
+		s.t.identities[id] = Usage{Keys: cur.Keys + u.Keys, Bytes: cur.Bytes + u.Bytes}
+	}
+}
+
+// number of lock stripes of keys written to the counted storage
+const stripes = 64
+
+// Storage counting usage of namespaces by applied writes
+type Counter struct {
+	storage.Storage
+	t     *Tracker
+	split func(string) (string, string)
+	locks [stripes]sync.Mutex // writes of the same key are serialized to count the replaced value once
+}
+
+// Count usage of namespaces by every write applied to the storage,
+// split returns namespace and key of the stored key
+// The storage is wrapped below replication and Raft, so writes applied
+// on the node by any of them are counted
+func (t *Tracker) Count(s storage.Storage, split func(string) (string, string)) *Counter {
+	return &Counter{Storage: s, t: t, split: split}
+}
+
+func (c *Counter) Insert(ctx context.Context, key, value string) (bool, error) {
+	defer c.lock(key)()
+
+	old, err := c.Storage.Search(ctx, key)
+	if err != nil {
+		return false, err
+	}
+
+	ok, err := c.Storage.Insert(ctx, key, value)
+	if err == nil && ok {
+		c.count(key, old, &value)
+	}
+
+	return ok, err
+}
+
+func (c *Counter) Delete(ctx context.Context, key string) (bool, error) {
+	defer c.lock(key)()
+
+	old, err := c.Storage.Search(ctx, key)
+	if err != nil {
+		return false, err
+	}
+
+	ok, err := c.Storage.Delete(ctx, key)
+	if err == nil && ok {
+		c.count(key, old, nil)
+	}
+
+	return ok, err
+}
+
+func (c *Counter) Increment(ctx context.Context, key string, delta int64) (int64, error) {
+	defer c.lock(key)()
+
+	old, err := c.Storage.Search(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+
+	value, err := storage.Increment(ctx, c.Storage, key, delta)
+	if err == nil {
+		next := counter.Format(value)
+		c.count(key, old, &next)
+	}
+
+	return value, err
+}
+
+func (c *Counter) Import(ctx context.Context, data []entity.ImportData) (bool, error) {
+	// the last value of a repeated key is stored
+	values := make(map[string]string, len(data))
+	keys := make([]string, 0, len(data))
+	for _, item := range data {
+		if _, ok := values[item.Key]; !ok {
+			keys = append(keys, item.Key)
+		}
+		values[item.Key] = item.Value
+	}
+
+	defer c.lock(keys...)()
+
+	old := make(map[string]string, len(keys))
+	for _, key := range keys {
+		value, err := c.Storage.Search(ctx, key)
+		if err != nil {
+			return false, err
+		}
+		old[key] = value
+	}
+
+	ok, err := c.Storage.Import(ctx, data)
+	if err == nil && ok {
+		for _, key := range keys {
+			value := values[key]
+			c.count(key, old[key], &value)
+		}
+	}
+
+	return ok, err
+}
+
+// Count the change of usage by replacing the old value of the stored key
+func (c *Counter) count(key, old string, value *string) {
+	name, key := c.split(key)
+	c.t.count(name, change(key, old, value))
+}
+
+// Lock stripes of the keys in ascending order, returns the unlock function
+func (c *Counter) lock(keys ...string) func() {
+	var locked [stripes]bool
+	for _, key := range keys {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		locked[h.Sum32()%stripes] = true
+	}
+
+	for i := range locked {
+		if locked[i] {
+			c.locks[i].Lock()
+		}
+	}
+
+	return func() {
+		for i := range locked {
+			if locked[i] {
+				c.locks[i].Unlock()
+			}
+		}
+	}
+}
+
+// size of the key and its value, the secret marker isn't counted
+func size(key, value string) int64 {
+	value, _ = entity.UnmarkSecret(value)
+	return int64(len(key) + len(value))
+}
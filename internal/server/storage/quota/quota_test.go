@@ -0,0 +1,255 @@
+package quota
+
+import (
+	"context"
+	"testing"
+
+	"github.com/arsenalzp/keyvalstore/internal/server/errors"
+	"github.com/arsenalzp/keyvalstore/internal/server/identity"
+	"github.com/arsenalzp/keyvalstore/internal/server/storage"
+	entity "github.com/arsenalzp/keyvalstore/internal/server/storage/entity"
+	ht "github.com/arsenalzp/keyvalstore/internal/server/storage/hash-table"
+	"github.com/arsenalzp/keyvalstore/internal/server/storage/tenant"
+)
+
+func TestQuota(t *testing.T) {
+	ctx := context.Background()
+
+	shared, err := ht.NewHT()
+	if err != nil {
+		t.Errorf("error creating storage: %s\n", err)
+		return
+	}
+
+	tracker := New(Config{
+		Default:    Limit{Keys: 2},
+		Namespaces: map[string]Limit{"team-b": {Bytes: 10}},
+	})
+
+	counted := tracker.Count(shared, tenant.Split)
+
+	client := identity.Identity{CommonName: "client"}
+	a := tracker.Storage(tenant.New(counted, "team-a"), "team-a", client)
+	b := tracker.Storage(tenant.New(counted, "team-b"), "team-b", client)
+
+	for _, key := range []string{"k1", "k2"} {
+		if _, err := a.Insert(ctx, key, "value"); err != nil {
+			t.Errorf("error inserting key %s: %s\n", key, err)
+			return
+		}
+	}
+
+	// overwriting a key doesn't change number of keys
+	if _, err := a.Insert(ctx, "k1", "new value"); err != nil {
+		t.Errorf("error overwriting key: %s\n", err)
+		return
+	}
+
+	if _, err := a.Insert(ctx, "k3", "value"); errors.Code(err) != errors.QuotaErr {
+		t.Errorf("error limiting keys, expected code %s, got %v\n", errors.QuotaErr, err)
+		return
+	}
+
+	// deletion frees the quota
+	if _, err := a.Delete(ctx, "k2"); err != nil {
+		t.Errorf("error deleting key: %s\n", err)
+		return
+	}
+
+	if _, err := a.Insert(ctx, "k3", "value"); err != nil {
+		t.Errorf("error inserting key after deletion: %s\n", err)
+		return
+	}
+
+	// the namespace limit of bytes, import is rejected as a whole
+	_, err = b.Import(ctx, []entity.ImportData{{Key: "k1", Value: "abc"}, {Key: "k2", Value: "abcd"}})
+	if errors.Code(err) != errors.QuotaErr {
+		t.Errorf("error limiting import, expected code %s, got %v\n", errors.QuotaErr, err)
+		return
+	}
+
+	if value, _ := b.Search(ctx, "k1"); value != "" {
+		t.Errorf("error limiting import, key is imported\n")
+		return
+	}
+
+	if _, err := b.Import(ctx, []entity.ImportData{{Key: "k1", Value: "abc"}}); err != nil {
+		t.Errorf("error importing keys: %s\n", err)
+		return
+	}
+
+	usage := tracker.Usage().Namespaces
+	if u := usage["team-a"].Usage; u.Keys != 2 || u.Bytes != int64(len("k1new value")+len("k3value")) {
+		t.Errorf("error tracking usage of team-a: %+v\n", u)
+		return
+	}
+
+	if u := usage["team-b"].Usage; u.Keys != 1 || u.Bytes != 5 {
+		t.Errorf("error tracking usage of team-b: %+v\n", u)
+		return
+	}
+
+	// usage calculated from the storage content matches the tracked one
+	loaded := New(Config{})
+	if err := loaded.Load(ctx, shared, tenant.Split); err != nil {
+		t.Errorf("error loading usage: %s\n", err)
+		return
+	}
+
+	for name, report := range loaded.Usage().Namespaces {
+		if report.Usage != usage[name].Usage {
+			t.Errorf("error loading usage of %s: got %+v, expected %+v\n", name, report.Usage, usage[name].Usage)
+			return
+		}
+	}
+}
+
+func TestIdentityLimit(t *testing.T) {
+	ctx := context.Background()
+
+	shared, err := ht.NewHT()
+	if err != nil {
+		t.Errorf("error creating storage: %s\n", err)
+		return
+	}
+
+	tracker := New(Config{
+		Default:    Limit{Keys: 2},
+		Identities: map[string]Limit{"importer": {Keys: 10}},
+	})
+
+	counted := tracker.Count(shared, tenant.Split)
+	importer := tracker.Storage(counted, "", identity.Identity{CommonName: "importer"})
+	client := tracker.Storage(counted, "", identity.Identity{CommonName: "client"})
+
+	data := []entity.ImportData{{Key: "k1", Value: "v"}, {Key: "k2", Value: "v"}}
+	if _, err := importer.Import(ctx, data); err != nil {
+		t.Errorf("error importing keys: %s\n", err)
+		return
+	}
+
+	// the namespace limit applies to the identity within its own limit
+	if _, err := importer.Insert(ctx, "k3", "v"); errors.Code(err) != errors.QuotaErr {
+		t.Errorf("error limiting keys of the identity, expected code %s, got %v\n", errors.QuotaErr, err)
+		return
+	}
+
+	if _, err := client.Insert(ctx, "k3", "v"); errors.Code(err) != errors.QuotaErr {
+		t.Errorf("error limiting keys, expected code %s, got %v\n", errors.QuotaErr, err)
+		return
+	}
+
+	// shrinking usage is allowed over the limit
+	if _, err := client.Insert(ctx, "k1", ""); err != nil {
+		t.Errorf("error overwriting key over the limit: %s\n", err)
+		return
+	}
+}
+
+func TestIdentityUsage(t *testing.T) {
+	ctx := context.Background()
+
+	shared, err := ht.NewHT()
+	if err != nil {
+		t.Errorf("error creating storage: %s\n", err)
+		return
+	}
+
+	tracker := New(Config{
+		Default:    Limit{Keys: 100},
+		Identities: map[string]Limit{"batch": {Keys: 2}},
+	})
+
+	counted := tracker.Count(shared, tenant.Split)
+	batch := tracker.Storage(counted, "", identity.Identity{CommonName: "batch"})
+	client := tracker.Storage(counted, "", identity.Identity{CommonName: "client"})
+
+	// keys of other identities aren't charged to the identity
+	for _, key := range []string{"c1", "c2", "c3"} {
+		if _, err := client.Insert(ctx, key, "v"); err != nil {
+			t.Errorf("error inserting key %s: %s\n", key, err)
+			return
+		}
+	}
+
+	for _, key := range []string{"b1", "b2"} {
+		if _, err := batch.Insert(ctx, key, "v"); err != nil {
+			t.Errorf("error inserting key %s of the identity: %s\n", key, err)
+			return
+		}
+	}
+
+	if _, err := batch.Insert(ctx, "b3", "v"); errors.Code(err) != errors.QuotaErr {
+		t.Errorf("error limiting keys of the identity, expected code %s, got %v\n", errors.QuotaErr, err)
+		return
+	}
+
+	// the key taken over by another identity isn't charged to the identity anymore
+	if _, err := client.Insert(ctx, "b1", "value"); err != nil {
+		t.Errorf("error overwriting key: %s\n", err)
+		return
+	}
+
+	if _, err := batch.Insert(ctx, "b3", "v"); err != nil {
+		t.Errorf("error inserting key after it's freed: %s\n", err)
+		return
+	}
+
+	reports := tracker.Usage()
+	if u := reports.Identities["batch"].Usage; u.Keys != 2 || u.Bytes != int64(len("b2v")+len("b3v")) {
+		t.Errorf("error tracking usage of the identity: %+v\n", u)
+		return
+	}
+
+	if u := reports.Namespaces[""].Usage; u.Keys != 6 {
+		t.Errorf("error tracking usage of the namespace: %+v\n", u)
+		return
+	}
+}
+
+func TestAppliedWrites(t *testing.T) {
+	ctx := context.Background()
+
+	shared, err := ht.NewHT()
+	if err != nil {
+		t.Errorf("error creating storage: %s\n", err)
+		return
+	}
+
+	tracker := New(Config{Default: Limit{Keys: 3}})
+	counted := tracker.Count(shared, tenant.Split)
+
+	// writes applied by replication or Raft don't pass the client storage
+	applied := tenant.New(counted, "team-a")
+	if _, err := applied.Insert(ctx, "k1", "value"); err != nil {
+		t.Errorf("error applying insert: %s\n", err)
+		return
+	}
+
+	if _, err := applied.Increment(ctx, "k2", 10); err != nil {
+		t.Errorf("error applying increment: %s\n", err)
+		return
+	}
+
+	data := []entity.ExportData{{Key: "k2", Value: "10"}, {Key: "k3", Value: "v"}}
+	if err := storage.Restore(ctx, applied, data); err != nil {
+		t.Errorf("error restoring snapshot: %s\n", err)
+		return
+	}
+
+	if u := tracker.Usage().Namespaces["team-a"].Usage; u.Keys != 2 || u.Bytes != int64(len("k210")+len("k3v")) {
+		t.Errorf("error counting applied writes: %+v\n", u)
+		return
+	}
+
+	a := tracker.Storage(tenant.New(counted, "team-a"), "team-a", identity.Identity{CommonName: "client"})
+	if _, err := a.Insert(ctx, "k4", "v"); err != nil {
+		t.Errorf("error inserting key: %s\n", err)
+		return
+	}
+
+	if _, err := a.Insert(ctx, "k5", "v"); errors.Code(err) != errors.QuotaErr {
+		t.Errorf("error limiting keys, expected code %s, got %v\n", errors.QuotaErr, err)
+		return
+	}
+}
@@ -5,8 +5,12 @@ package sqlite
 import (
 	"context"
 	"database/sql"
+	"math"
 	"os"
 
+	"github.com/arsenalzp/keyvalstore/internal/server/crypt"
+	"github.com/arsenalzp/keyvalstore/internal/server/errors"
+	"github.com/arsenalzp/keyvalstore/internal/server/storage/counter"
 	entity "github.com/arsenalzp/keyvalstore/internal/server/storage/entity"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -17,14 +21,30 @@ const schemaSQL string = `
 CREATE TABLE IF NOT EXISTS "gokeyval" (
 	"key"	TEXT(256) UNIQUE,
 	"value"	TEXT(512) NOT NULL,
+	"key_id"	TEXT,
+	"dek"	BLOB,
 	UNIQUE(key)
 );
 `
 
+// columns of encrypted values added to tables created before encryption support,
+// key_id is ID of the master key and dek is the wrapped data key, both are NULL for plaintext values
+var migrationSQL = map[string]string{
+	"key_id": `ALTER TABLE gokeyval ADD COLUMN "key_id" TEXT;`,
+	"dek":    `ALTER TABLE gokeyval ADD COLUMN "dek" BLOB;`,
+}
+
+// query for table columns
+const columnsSQL string = `
+SELECT
+	name
+FROM pragma_table_info('gokeyval');
+`
+
 // query for key searching operation
 const searchSQL string = `
 SELECT 
-	value 
+	value, key_id, dek
 FROM gokeyval
 WHERE key = ?;
 `
@@ -32,11 +52,13 @@ WHERE key = ?;
 // query for either insert key or update key operations
 const insertSQL string = `
 INSERT INTO
-	gokeyval(key, value) 
+	gokeyval(key, value, key_id, dek) 
 VALUES
-	(?, ?)
+	(?, ?, ?, ?)
 ON CONFLICT(key) DO UPDATE SET
-	value=excluded.value;
+	value=excluded.value,
+	key_id=excluded.key_id,
+	dek=excluded.dek;
 `
 
 // query for key delition operation
@@ -48,10 +70,75 @@ WHERE key = ?;
 // query for selecting all rows in a table
 const searchAllSQL string = `
 SELECT
-	*
+	key, value, key_id, dek
+FROM gokeyval;
+`
+
+// query for selecting rows which aren't encrypted by the primary master key
+const searchStaleSQL string = `
+SELECT
+	rowid, key, value, key_id, dek
+FROM gokeyval
+WHERE (key_id IS NULL OR key_id != ?) AND rowid > ?
+ORDER BY rowid
+LIMIT ?;
+`
+
+// query for replacing encryption of the row unless it was changed concurrently
+const rewrapSQL string = `
+UPDATE gokeyval SET
+	value = ?, key_id = ?, dek = ?
+WHERE rowid = ? AND CAST(value AS BLOB) = ? AND key_id IS ? AND dek IS ?;
+`
+
+// query for adding the delta (?2) to the integer value of the key, the missing key
+// is inserted; the row isn't updated if the value isn't an integer, it's encrypted
+// or the sum overflows, i.e. the value is out of range of ?3 and ?4
+const incrementSQL string = `
+INSERT INTO
+	gokeyval(key, value)
+VALUES
+	(?1, CAST(?2 AS TEXT))
+ON CONFLICT(key) DO UPDATE SET
+	value = CAST(CAST(value AS INTEGER) + ?2 AS TEXT)
+WHERE key_id IS NULL
+	AND (value = '' OR CAST(CAST(value AS INTEGER) AS TEXT) = value)
+	AND CAST(value AS INTEGER) BETWEEN ?3 AND ?4
+RETURNING CAST(value AS INTEGER);
+`
+
+// query for inserting the encrypted counter unless it was inserted concurrently
+const insertCounterSQL string = `
+INSERT INTO
+	gokeyval(key, value, key_id, dek)
+VALUES
+	(?, ?, ?, ?)
+ON CONFLICT(key) DO NOTHING;
+`
+
+// query for replacing the encrypted counter unless it was changed concurrently
+const updateCounterSQL string = `
+UPDATE gokeyval SET
+	value = ?, key_id = ?, dek = ?
+WHERE key = ? AND CAST(value AS BLOB) = ? AND key_id IS ? AND dek IS ?;
+`
+
+// query for counting rows and their size
+const statsSQL string = `
+SELECT
+	COUNT(*),
+	COALESCE(SUM(LENGTH(key) + LENGTH(value)), 0)
 FROM gokeyval;
 `
 
+// query for checking availability of the table
+const pingSQL string = `
+SELECT
+	1
+FROM gokeyval
+LIMIT 1;
+`
+
 // sqlite3 database structure
 type Db struct {
 	sql           *sql.DB   // sqlite3 connection
@@ -59,12 +146,23 @@ type Db struct {
 	insertStmt    *sql.Stmt // perapared statemnt for INSERT query
 	deleteStmt    *sql.Stmt // perapared statemnt for DELETE query
 	searchAllStmt *sql.Stmt // prepared statement for SELECL * query
+	statsStmt     *sql.Stmt // prepared statement for statistics query
+	incrementStmt *sql.Stmt // prepared statement for counters query
 
-	dbName string // database name
+	dbName  string         // database name
+	keyring *crypt.Keyring // master keys of encrypted values, values aren't encrypted if nil
 }
 
+// size of the batch of rows rewrapped at once
+const rewrapBatch = 100
+
 func (db *Db) Insert(ctx context.Context, k, v string) (bool, error) {
-	res, err := db.insertStmt.ExecContext(ctx, k, v)
+	value, keyID, dek, err := db.encrypt(k, []byte(v))
+	if err != nil {
+		return false, err
+	}
+
+	res, err := db.insertStmt.ExecContext(ctx, k, value, keyID, dek)
 	if err != nil {
 		return false, err
 	}
@@ -100,12 +198,16 @@ func (db *Db) Delete(ctx context.Context, k string) (bool, error) {
 }
 
 func (db *Db) Search(ctx context.Context, k string) (string, error) {
-	var value *string = new(string)
+	var value, dek []byte
+	var keyID sql.NullString
 
 	row := db.searchStmt.QueryRowContext(ctx, k)
 	//row := db.sql.QueryRowContext(ctx, "select value from gokeyval where key = ?", k)
-	err := row.Scan(value)
-	if err != nil && err != sql.ErrNoRows {
+	err := row.Scan(&value, &keyID, &dek)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
 		return "", err
 	}
 
@@ -113,12 +215,12 @@ func (db *Db) Search(ctx context.Context, k string) (string, error) {
 		return "", err
 	}
 
-	return *value, nil
+	return db.decrypt(k, value, keyID, dek)
 }
 
 func (db *Db) Import(ctx context.Context, data []entity.ImportData) (bool, error) {
 	for _, item := range data {
-		_, err := db.Insert(ctx, item.Key, item.Value)
+		_, err := db.Insert(ctx, item.Key, entity.StoredValue(item.Value, item.Secret))
 		if err != nil {
 			return false, err
 		}
@@ -139,9 +241,19 @@ func (db *Db) Export(ctx context.Context) ([]entity.ExportData, error) {
 
 	for rows.Next() {
 		var expRow entity.ExportData
-		if err := rows.Scan(&expRow.Key, &expRow.Value); err != nil {
+		var value, dek []byte
+		var keyID sql.NullString
+
+		if err := rows.Scan(&expRow.Key, &value, &keyID, &dek); err != nil {
 			return nil, err
 		}
+
+		stored, err := db.decrypt(expRow.Key, value, keyID, dek)
+		if err != nil {
+			return nil, err
+		}
+		expRow.Value, expRow.Secret = entity.UnmarkSecret(stored)
+
 		exportRows = append(exportRows, expRow)
 	}
 
@@ -152,6 +264,269 @@ func (db *Db) Export(ctx context.Context) ([]entity.ExportData, error) {
 	return exportRows, nil
 }
 
+// Add the delta to the integer value of the key by a single statement,
+// encrypted values are decrypted and replaced unless they are changed concurrently
+func (db *Db) Increment(ctx context.Context, k string, delta int64) (int64, error) {
+	if db.keyring != nil {
+		return db.incrementSealed(ctx, k, delta)
+	}
+
+	low, high := int64(math.MinInt64), int64(math.MaxInt64)
+	if delta < 0 {
+		low -= delta
+	} else {
+		high -= delta
+	}
+
+	for {
+		var value int64
+		err := db.incrementStmt.QueryRowContext(ctx, k, delta, low, high).Scan(&value)
+		if err == nil {
+			return value, nil
+		}
+		if err != sql.ErrNoRows {
+			return 0, err
+		}
+
+		// the row isn't updated, the current value tells why
+		current, err := db.Search(ctx, k)
+		if err != nil {
+			return 0, err
+		}
+
+		if _, err := counter.Add(current, delta); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Add the delta to the encrypted integer value of the key
+func (db *Db) incrementSealed(ctx context.Context, k string, delta int64) (int64, error) {
+	for {
+		var stored, dek []byte
+		var keyID sql.NullString
+
+		err := db.searchStmt.QueryRowContext(ctx, k).Scan(&stored, &keyID, &dek)
+		if err != nil && err != sql.ErrNoRows {
+			return 0, err
+		}
+		found := err == nil
+
+		var current string
+		if found {
+			if current, err = db.decrypt(k, stored, keyID, dek); err != nil {
+				return 0, err
+			}
+		}
+
+		n, err := counter.Add(current, delta)
+		if err != nil {
+			return 0, err
+		}
+
+		value, newKeyID, newDEK, err := db.encrypt(k, []byte(counter.Format(n)))
+		if err != nil {
+			return 0, err
+		}
+
+		var res sql.Result
+		if found {
+			res, err = db.sql.ExecContext(ctx, updateCounterSQL, value, newKeyID, newDEK, k, stored, keyID, dek)
+		} else {
+			res, err = db.sql.ExecContext(ctx, insertCounterSQL, k, value, newKeyID, newDEK)
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		if i, _ := res.RowsAffected(); i > 0 {
+			return n, nil
+		}
+	}
+}
+
+// Close prepared statements and the database
+func (db *Db) Close() error {
+	for _, stmt := range []*sql.Stmt{db.searchStmt, db.insertStmt, db.deleteStmt, db.searchAllStmt, db.statsStmt, db.incrementStmt} {
+		stmt.Close()
+	}
+
+	return db.sql.Close()
+}
+
+func (db *Db) Stats(ctx context.Context) (entity.Stats, error) {
+	var stats entity.Stats
+
+	row := db.statsStmt.QueryRowContext(ctx)
+	if err := row.Scan(&stats.Keys, &stats.Bytes); err != nil {
+		return entity.Stats{}, err
+	}
+
+	return stats, nil
+}
+
+func (db *Db) Ping(ctx context.Context) error {
+	if err := db.sql.PingContext(ctx); err != nil {
+		return err
+	}
+
+	var one int
+	err := db.sql.QueryRowContext(ctx, pingSQL).Scan(&one)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	return nil
+}
+
+// Encrypt rows which are plaintext or wrapped by an old master key
+// by the primary master key, returns number of updated rows
+func (db *Db) Rewrap(ctx context.Context) (int, error) {
+	if db.keyring == nil {
+		return 0, nil
+	}
+
+	var updated int
+	var last int64
+
+	for {
+		rows, err := db.staleRows(ctx, last)
+		if err != nil {
+			return updated, err
+		}
+
+		if len(rows) == 0 {
+			return updated, nil
+		}
+
+		for _, r := range rows {
+			last = r.rowid
+
+			var s crypt.Sealed
+			var ok bool
+
+			if r.keyID.Valid {
+				s, ok, err = db.keyring.Rewrap(crypt.Sealed{KeyID: r.keyID.String, DEK: r.dek, Data: r.value})
+			} else {
+				s, err = db.keyring.Seal(r.value, []byte(r.key))
+				ok = true
+			}
+			if err != nil {
+				return updated, err
+			}
+			if !ok {
+				continue
+			}
+
+			res, err := db.sql.ExecContext(ctx, rewrapSQL, s.Data, s.KeyID, s.DEK, r.rowid, r.value, r.keyID, r.dek)
+			if err != nil {
+				return updated, err
+			}
+
+			if n, _ := res.RowsAffected(); n > 0 {
+				updated++
+			}
+		}
+	}
+}
+
+// row of the table with encryption details
+type row struct {
+	rowid int64
+	key   string
+	value []byte
+	keyID sql.NullString
+	dek   []byte
+}
+
+// Get batch of rows after the rowid which aren't encrypted by the primary master key
+func (db *Db) staleRows(ctx context.Context, after int64) ([]row, error) {
+	rows, err := db.sql.QueryContext(ctx, searchStaleSQL, db.keyring.Primary(), after, rewrapBatch)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batch []row
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.rowid, &r.key, &r.value, &r.keyID, &r.dek); err != nil {
+			return nil, err
+		}
+		batch = append(batch, r)
+	}
+
+	return batch, rows.Err()
+}
+
+// Encrypt the value of the key if master keys are loaded
+// Returns the stored value, ID of the master key and the wrapped data key
+// Plaintext values are stored as text, encrypted ones are stored as blobs
+func (db *Db) encrypt(k string, v []byte) (any, sql.NullString, []byte, error) {
+	if db.keyring == nil {
+		return string(v), sql.NullString{}, nil, nil
+	}
+
+	s, err := db.keyring.Seal(v, []byte(k))
+	if err != nil {
+		return nil, sql.NullString{}, nil, err
+	}
+
+	return s.Data, sql.NullString{String: s.KeyID, Valid: true}, s.DEK, nil
+}
+
+// Decrypt the stored value of the key, plaintext values are returned as is
+func (db *Db) decrypt(k string, value []byte, keyID sql.NullString, dek []byte) (string, error) {
+	if !keyID.Valid {
+		return string(value), nil
+	}
+
+	if db.keyring == nil {
+		return "", errors.New("value is encrypted, master keys aren't loaded", errors.CryptKeyErr, nil)
+	}
+
+	v, err := db.keyring.Open(crypt.Sealed{KeyID: keyID.String, DEK: dek, Data: value}, []byte(k))
+	if err != nil {
+		return "", err
+	}
+
+	return string(v), nil
+}
+
+// Add columns missing in the table created by the previous version
+func migrate(sqlDb *sql.DB) error {
+	rows, err := sqlDb.Query(columnsSQL)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		columns[name] = true
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, column := range []string{"key_id", "dek"} {
+		if columns[column] {
+			continue
+		}
+
+		if _, err := sqlDb.Exec(migrationSQL[column]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func isDbExist(fname string) bool {
 	if _, err := os.Stat(fname); err == os.ErrNotExist {
 		return false
@@ -197,6 +572,15 @@ func NewDb() (*Db, error) {
 		return nil, err
 	}
 
+	if err := migrate(sqlDb); err != nil {
+		return nil, err
+	}
+
+	keyring, err := crypt.LoadKeyring()
+	if err != nil {
+		return nil, err
+	}
+
 	searchStmt, err := sqlDb.Prepare(searchSQL)
 	if err != nil {
 		return nil, err
@@ -217,6 +601,16 @@ func NewDb() (*Db, error) {
 		return nil, err
 	}
 
+	statsStmt, err := sqlDb.Prepare(statsSQL)
+	if err != nil {
+		return nil, err
+	}
+
+	incrementStmt, err := sqlDb.Prepare(incrementSQL)
+	if err != nil {
+		return nil, err
+	}
+
 	db = &Db{
 		sql:           sqlDb,
 		dbName:        fName,
@@ -224,6 +618,9 @@ func NewDb() (*Db, error) {
 		insertStmt:    insertStmt,
 		deleteStmt:    deleteStmt,
 		searchAllStmt: searchAllStmt,
+		statsStmt:     statsStmt,
+		incrementStmt: incrementStmt,
+		keyring:       keyring,
 	}
 
 	return db, nil
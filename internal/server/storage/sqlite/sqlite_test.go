@@ -1,11 +1,17 @@
 package sqlite
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
 	"fmt"
 	"os"
+	"sync"
 	"testing"
 
+	"github.com/arsenalzp/keyvalstore/internal/server/errors"
 	entity "github.com/arsenalzp/keyvalstore/internal/server/storage/entity"
 )
 
@@ -170,13 +176,58 @@ func cleanUp() error {
 	return nil
 }
 
+func TestStats(t *testing.T) {
+	defer cleanUp()
+
+	db, err := NewDb()
+	if err != nil {
+		t.Errorf("error creating DB storage: %s\n", err)
+		return
+	}
+
+	ctx := context.Background()
+
+	_, err = db.Insert(ctx, KEY, VALUE)
+	if err != nil {
+		t.Errorf("error inserting into DB storage: %s\n", err)
+		return
+	}
+
+	stats, err := db.Stats(ctx)
+	if err != nil {
+		t.Errorf("error getting statistics of DB storage: %s\n", err)
+		return
+	}
+
+	if stats.Keys != 1 || stats.Bytes != uint64(len(KEY)+len(VALUE)) {
+		t.Errorf("error getting statistics of DB storage, expected 1 key and %d bytes, got %d keys and %d bytes\n",
+			len(KEY)+len(VALUE), stats.Keys, stats.Bytes)
+		return
+	}
+}
+
+func TestPing(t *testing.T) {
+	defer cleanUp()
+
+	db, err := NewDb()
+	if err != nil {
+		t.Errorf("error creating DB storage: %s\n", err)
+		return
+	}
+
+	if err := db.Ping(context.Background()); err != nil {
+		t.Errorf("error checking availability of DB storage: %s\n", err)
+		return
+	}
+}
+
 func populateImportData(count int) []entity.ImportData {
 	var testSet []entity.ImportData
 
 	for i := 1; i <= count; i++ {
 		key := "key" + fmt.Sprint(i)
 		val := "val" + fmt.Sprint(i)
-		testSet = append(testSet, entity.ImportData{key, val})
+		testSet = append(testSet, entity.ImportData{Key: key, Value: val})
 	}
 
 	return testSet
@@ -193,3 +244,164 @@ func populateTestSet(count int) map[string]string {
 
 	return testSet
 }
+
+func TestEncryption(t *testing.T) {
+	defer cleanUp()
+
+	k1 := make([]byte, 32)
+	k2 := make([]byte, 32)
+	rand.Read(k1)
+	rand.Read(k2)
+
+	t.Setenv("SERVICE_MASTER_KEYS", "k1:"+base64.StdEncoding.EncodeToString(k1))
+
+	db, err := NewDb()
+	if err != nil {
+		t.Errorf("error creating DB storage: %s\n", err)
+		return
+	}
+
+	ctx := context.Background()
+
+	if _, err := db.Insert(ctx, KEY, VALUE); err != nil {
+		t.Errorf("error inserting into DB storage: %s\n", err)
+		return
+	}
+
+	var stored []byte
+	db.sql.QueryRow("SELECT value FROM gokeyval WHERE key = ?", KEY).Scan(&stored)
+	if bytes.Contains(stored, []byte(VALUE)) {
+		t.Errorf("error encrypting value: value is stored in plaintext\n")
+		return
+	}
+
+	if result, err := db.Search(ctx, KEY); err != nil || result != VALUE {
+		t.Errorf("error searching encrypted value, expected %s, got %s, %v\n", VALUE, result, err)
+		return
+	}
+
+	// rotate master keys
+	t.Setenv("SERVICE_MASTER_KEYS", fmt.Sprintf("k2:%s,k1:%s",
+		base64.StdEncoding.EncodeToString(k2), base64.StdEncoding.EncodeToString(k1)))
+
+	db, err = NewDb()
+	if err != nil {
+		t.Errorf("error creating DB storage: %s\n", err)
+		return
+	}
+
+	if n, err := db.Rewrap(ctx); err != nil || n != 1 {
+		t.Errorf("error rewrapping values, expected 1 row, got %d, %v\n", n, err)
+		return
+	}
+
+	var keyID string
+	db.sql.QueryRow("SELECT key_id FROM gokeyval WHERE key = ?", KEY).Scan(&keyID)
+	if keyID != "k2" {
+		t.Errorf("error rewrapping value, expected key k2, got %s\n", keyID)
+		return
+	}
+
+	if result, err := db.Search(ctx, KEY); err != nil || result != VALUE {
+		t.Errorf("error searching rewrapped value, expected %s, got %s, %v\n", VALUE, result, err)
+		return
+	}
+
+	// modified value fails integrity check
+	db.sql.Exec("UPDATE gokeyval SET value = ? WHERE key = ?", append(stored[:len(stored)-1], stored[len(stored)-1]^1), KEY)
+
+	if _, err := db.Search(ctx, KEY); errors.Code(err) != errors.CryptIntegrityErr {
+		t.Errorf("error searching modified value, expected code %s, got %v\n", errors.CryptIntegrityErr, err)
+		return
+	}
+}
+
+func TestIncrement(t *testing.T) {
+	defer cleanUp()
+
+	db, err := NewDb()
+	if err != nil {
+		t.Errorf("error creating DB storage: %s\n", err)
+		return
+	}
+
+	ctx := context.Background()
+
+	// concurrent increments aren't lost
+	var wg sync.WaitGroup
+	errs := make(chan error, 1000)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if _, err := db.Increment(ctx, KEY, 1); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("error incrementing key: %s\n", err)
+		return
+	}
+
+	if value, err := db.Increment(ctx, KEY, -1001); err != nil || value != -1 {
+		t.Errorf("error incrementing key: expected -1, got %d, %v\n", value, err)
+		return
+	}
+
+	if result, _ := db.Search(ctx, KEY); result != "-1" {
+		t.Errorf("error incrementing key: expected stored value -1, got %q\n", result)
+		return
+	}
+
+	db.Insert(ctx, "text", VALUE)
+	if _, err := db.Increment(ctx, "text", 1); errors.Code(err) != errors.CounterValueErr {
+		t.Errorf("error incrementing non-numeric value: expected code %s, got %v\n", errors.CounterValueErr, err)
+		return
+	}
+
+	db.Insert(ctx, "min", "-9223372036854775808")
+	if _, err := db.Increment(ctx, "min", -1); errors.Code(err) != errors.CounterRangeErr {
+		t.Errorf("error decrementing minimal value: expected code %s, got %v\n", errors.CounterRangeErr, err)
+		return
+	}
+
+	// encrypted counters
+	k1 := make([]byte, 32)
+	rand.Read(k1)
+	t.Setenv("SERVICE_MASTER_KEYS", "k1:"+base64.StdEncoding.EncodeToString(k1))
+
+	db, err = NewDb()
+	if err != nil {
+		t.Errorf("error creating DB storage: %s\n", err)
+		return
+	}
+
+	if value, err := db.Increment(ctx, "sealed", 41); err != nil || value != 41 {
+		t.Errorf("error incrementing encrypted key: expected 41, got %d, %v\n", value, err)
+		return
+	}
+
+	if value, err := db.Increment(ctx, "sealed", 1); err != nil || value != 42 {
+		t.Errorf("error incrementing encrypted key: expected 42, got %d, %v\n", value, err)
+		return
+	}
+
+	var keyID sql.NullString
+	db.sql.QueryRow("SELECT key_id FROM gokeyval WHERE key = ?", "sealed").Scan(&keyID)
+	if !keyID.Valid {
+		t.Errorf("error incrementing encrypted key: value is stored in plaintext\n")
+		return
+	}
+
+	// plaintext counters are encrypted once they are changed
+	if value, err := db.Increment(ctx, KEY, 1); err != nil || value != 0 {
+		t.Errorf("error incrementing plaintext key: expected 0, got %d, %v\n", value, err)
+		return
+	}
+}
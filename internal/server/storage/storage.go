@@ -21,6 +21,28 @@ type Storage interface {
 	Export(context.Context) ([]entity.ExportData, error)
 }
 
+// Interface of underlying storage which is able to report its size
+type Stater interface {
+	Stats(context.Context) (entity.Stats, error)
+}
+
+// Interface of underlying storage which is able to check its availability
+type Pinger interface {
+	Ping(context.Context) error
+}
+
+// Interface of underlying storage which encrypts values by master keys
+// and is able to re-encrypt them by the primary master key
+type Rewrapper interface {
+	Rewrap(context.Context) (int, error)
+}
+
+// Interface of underlying storage which is able to change integer values
+// atomically, the new value is returned
+type Counter interface {
+	Increment(context.Context, string, int64) (int64, error)
+}
+
 // Initialize the underlying storage defined by storage variable
 // Returns initialized storage
 func NewStrg(kind string) (Storage, error) {
@@ -45,3 +67,74 @@ func NewStrg(kind string) (Storage, error) {
 		return nil, errors.New("storage type is unknown", errors.StorageKindErr, nil)
 	}
 }
+
+// Get statistics of the underlying storage
+// Returns error if the storage doesn't report its size
+func Stats(ctx context.Context, s Storage) (entity.Stats, error) {
+	stater, ok := s.(Stater)
+	if !ok {
+		return entity.Stats{}, errors.New("storage doesn't support statistics", errors.StorageStatsErr, nil)
+	}
+
+	return stater.Stats(ctx)
+}
+
+// Check availability of the underlying storage
+// Storages which don't implement Pinger are considered always available
+func Ping(ctx context.Context, s Storage) error {
+	pinger, ok := s.(Pinger)
+	if !ok {
+		return nil
+	}
+
+	if err := pinger.Ping(ctx); err != nil {
+		return errors.New("storage is unavailable", errors.StoragePingErr, err)
+	}
+
+	return nil
+}
+
+// Add the delta to the integer value of the key atomically
+// Returns error if the storage doesn't support counters
+func Increment(ctx context.Context, s Storage, key string, delta int64) (int64, error) {
+	counter, ok := s.(Counter)
+	if !ok {
+		return 0, errors.New("storage doesn't support counters", errors.IncrOpErr, nil)
+	}
+
+	return counter.Increment(ctx, key, delta)
+}
+
+// Replace content of the storage by the data,
+// keys missing in the data are deleted
+func Restore(ctx context.Context, s Storage, data []entity.ExportData) error {
+	keys := make(map[string]bool, len(data))
+	items := make([]entity.ImportData, len(data))
+	for i, item := range data {
+		keys[item.Key] = true
+		items[i] = entity.ImportData(item)
+	}
+
+	local, err := s.Export(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range local {
+		if keys[item.Key] {
+			continue
+		}
+
+		if _, err := s.Delete(ctx, item.Key); err != nil {
+			return err
+		}
+	}
+
+	if len(items) == 0 {
+		return nil
+	}
+
+	_, err = s.Import(ctx, items)
+
+	return err
+}
@@ -0,0 +1,129 @@
+// Per-tenant isolation of the underlying storage.
+// Keys of a tenant are transparently prefixed by the tenant name,
+// so tenants sharing the storage don't see keys of each other.
+
+package tenant
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/arsenalzp/keyvalstore/internal/server/errors"
+	"github.com/arsenalzp/keyvalstore/internal/server/identity"
+	"github.com/arsenalzp/keyvalstore/internal/server/storage"
+	entity "github.com/arsenalzp/keyvalstore/internal/server/storage/entity"
+)
+
+// separator of the tenant name and the key,
+// tenant names can't contain it, so prefixes of tenants don't overlap
+const separator = "\x1f"
+
+// Certificate field the tenant is derived from
+type Field string
+
+const (
+	FieldO  Field = "o"
+	FieldOU Field = "ou"
+	FieldCN Field = "cn"
+)
+
+// Parse name of the certificate field
+func ParseField(s string) (Field, error) {
+	switch f := Field(strings.ToLower(s)); f {
+	case FieldO, FieldOU, FieldCN:
+		return f, nil
+	default:
+		err := fmt.Errorf("unknown certificate field %q", s)
+		return "", errors.New("invalid tenant field", errors.TenantCfgErr, err)
+	}
+}
+
+// Get tenant of the identity, the first value is used for multi-valued fields
+func (f Field) Tenant(id identity.Identity) (string, error) {
+	var name string
+
+	switch f {
+	case FieldO:
+		if len(id.Organization) > 0 {
+			name = id.Organization[0]
+		}
+	case FieldOU:
+		if len(id.OrganizationalUnit) > 0 {
+			name = id.OrganizationalUnit[0]
+		}
+	case FieldCN:
+		name = id.CommonName
+	}
+
+	if name == "" || strings.Contains(name, separator) {
+		err := fmt.Errorf("certificate field %s is empty or invalid", strings.ToUpper(string(f)))
+		return "", errors.New("unable to resolve tenant", errors.TenantErr, err)
+	}
+
+	return name, nil
+}
+
+// Split the stored key into the tenant and the key of the tenant,
+// keys stored without tenant have the empty tenant
+func Split(key string) (string, string) {
+	tenant, k, ok := strings.Cut(key, separator)
+	if !ok {
+		return "", key
+	}
+
+	return tenant, k
+}
+
+// Storage scoped to the tenant
+type Storage struct {
+	storage.Storage
+	prefix string
+}
+
+// Scope the underlying storage to the tenant
+func New(s storage.Storage, tenant string) *Storage {
+	return &Storage{Storage: s, prefix: tenant + separator}
+}
+
+func (s *Storage) Search(ctx context.Context, key string) (string, error) {
+	return s.Storage.Search(ctx, s.prefix+key)
+}
+
+func (s *Storage) Insert(ctx context.Context, key, value string) (bool, error) {
+	return s.Storage.Insert(ctx, s.prefix+key, value)
+}
+
+func (s *Storage) Delete(ctx context.Context, key string) (bool, error) {
+	return s.Storage.Delete(ctx, s.prefix+key)
+}
+
+func (s *Storage) Increment(ctx context.Context, key string, delta int64) (int64, error) {
+	return storage.Increment(ctx, s.Storage, s.prefix+key, delta)
+}
+
+func (s *Storage) Import(ctx context.Context, data []entity.ImportData) (bool, error) {
+	scoped := make([]entity.ImportData, len(data))
+	for i, item := range data {
+		scoped[i] = entity.ImportData{Key: s.prefix + item.Key, Value: item.Value, Secret: item.Secret}
+	}
+
+	return s.Storage.Import(ctx, scoped)
+}
+
+// Export keys of the tenant only
+func (s *Storage) Export(ctx context.Context) ([]entity.ExportData, error) {
+	data, err := s.Storage.Export(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	scoped := make([]entity.ExportData, 0, len(data))
+	for _, item := range data {
+		if key, ok := strings.CutPrefix(item.Key, s.prefix); ok {
+			scoped = append(scoped, entity.ExportData{Key: key, Value: item.Value, Secret: item.Secret})
+		}
+	}
+
+	return scoped, nil
+}
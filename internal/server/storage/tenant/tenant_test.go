@@ -0,0 +1,153 @@
+package tenant
+
+import (
+	"context"
+	"testing"
+
+	"github.com/arsenalzp/keyvalstore/internal/server/errors"
+	"github.com/arsenalzp/keyvalstore/internal/server/identity"
+	entity "github.com/arsenalzp/keyvalstore/internal/server/storage/entity"
+	ht "github.com/arsenalzp/keyvalstore/internal/server/storage/hash-table"
+)
+
+func TestIsolation(t *testing.T) {
+	ctx := context.Background()
+
+	shared, err := ht.NewHT()
+	if err != nil {
+		t.Errorf("error creating storage: %s\n", err)
+		return
+	}
+
+	a := New(shared, "team-a")
+	b := New(shared, "team-b")
+
+	if _, err := a.Insert(ctx, "foo", "a"); err != nil {
+		t.Errorf("error inserting key: %s\n", err)
+		return
+	}
+
+	if _, err := b.Insert(ctx, "foo", "b"); err != nil {
+		t.Errorf("error inserting key: %s\n", err)
+		return
+	}
+
+	if _, err := b.Import(ctx, []entity.ImportData{{Key: "bar", Value: "b"}}); err != nil {
+		t.Errorf("error importing keys: %s\n", err)
+		return
+	}
+
+	if value, err := a.Search(ctx, "foo"); err != nil || value != "a" {
+		t.Errorf("error searching key of tenant a, expected: a, got: %s, %v\n", value, err)
+		return
+	}
+
+	if value, err := b.Search(ctx, "foo"); err != nil || value != "b" {
+		t.Errorf("error searching key of tenant b, expected: b, got: %s, %v\n", value, err)
+		return
+	}
+
+	if value, _ := a.Search(ctx, "bar"); value != "" {
+		t.Errorf("error searching key of another tenant, expected: \"\", got: %s\n", value)
+		return
+	}
+
+	exports, err := a.Export(ctx)
+	if err != nil {
+		t.Errorf("error exporting keys: %s\n", err)
+		return
+	}
+
+	if len(exports) != 1 || exports[0] != (entity.ExportData{Key: "foo", Value: "a"}) {
+		t.Errorf("error exporting keys of tenant a, got: %v\n", exports)
+		return
+	}
+
+	if _, err := a.Delete(ctx, "foo"); err != nil {
+		t.Errorf("error deleting key: %s\n", err)
+		return
+	}
+
+	if value, err := b.Search(ctx, "foo"); err != nil || value != "b" {
+		t.Errorf("error searching key of tenant b after delete, expected: b, got: %s, %v\n", value, err)
+		return
+	}
+}
+
+func TestSecret(t *testing.T) {
+	ctx := context.Background()
+
+	shared, err := ht.NewHT()
+	if err != nil {
+		t.Errorf("error creating storage: %s\n", err)
+		return
+	}
+
+	a := New(shared, "team-a")
+
+	data := []entity.ImportData{{Key: "password", Value: "s3cr3t", Secret: true}, {Key: "user", Value: "admin"}}
+	if _, err := a.Import(ctx, data); err != nil {
+		t.Errorf("error importing keys: %s\n", err)
+		return
+	}
+
+	// the imported secret is stored as a secret
+	if value, _ := a.Search(ctx, "password"); value != entity.StoredValue("s3cr3t", true) {
+		t.Errorf("error importing secret, got: %q\n", value)
+		return
+	}
+
+	exports, err := a.Export(ctx)
+	if err != nil {
+		t.Errorf("error exporting keys: %s\n", err)
+		return
+	}
+
+	secrets := make(map[string]bool)
+	for _, item := range exports {
+		secrets[item.Key] = item.Secret
+	}
+
+	if len(secrets) != 2 || !secrets["password"] || secrets["user"] {
+		t.Errorf("error exporting secret flags of tenant a, got: %v\n", exports)
+		return
+	}
+}
+
+func TestTenant(t *testing.T) {
+	id := identity.Identity{
+		CommonName:         "svc",
+		Organization:       []string{"acme"},
+		OrganizationalUnit: []string{"payments", "billing"},
+	}
+
+	for _, tc := range []struct {
+		field  string
+		tenant string
+	}{
+		{"O", "acme"},
+		{"ou", "payments"},
+		{"cn", "svc"},
+	} {
+		f, err := ParseField(tc.field)
+		if err != nil {
+			t.Errorf("error parsing field %s: %s\n", tc.field, err)
+			return
+		}
+
+		if name, err := f.Tenant(id); err != nil || name != tc.tenant {
+			t.Errorf("error resolving tenant by %s, expected: %s, got: %s, %v\n", tc.field, tc.tenant, name, err)
+			return
+		}
+	}
+
+	if _, err := FieldO.Tenant(identity.Identity{CommonName: "svc"}); errors.Code(err) != errors.TenantErr {
+		t.Errorf("error resolving missing tenant, expected code %s, got %v\n", errors.TenantErr, err)
+		return
+	}
+
+	if _, err := ParseField("serial"); errors.Code(err) != errors.TenantCfgErr {
+		t.Errorf("error parsing unknown field, expected code %s, got %v\n", errors.TenantCfgErr, err)
+		return
+	}
+}
@@ -0,0 +1,662 @@
+// Webhook notifications of storage mutations.
+// Registered webhooks are called with a signed JSON payload for every change
+// of the change log matching their filters. Deliveries are kept in the queue
+// directory until they succeed, failed ones are retried with exponential
+// backoff and appended to the dead-letter log after the last attempt.
+
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arsenalzp/keyvalstore/internal/server/crypt"
+	"github.com/arsenalzp/keyvalstore/internal/server/errors"
+	"github.com/arsenalzp/keyvalstore/internal/server/metrics"
+	"github.com/arsenalzp/keyvalstore/internal/server/storage/changelog"
+	"github.com/arsenalzp/keyvalstore/internal/server/storage/tenant"
+)
+
+const (
+	DefaultMaxAttempts = 10
+	DefaultTimeout     = 10 * time.Second // timeout of a single delivery attempt
+	DefaultBackoff     = time.Second      // delay after the first failed attempt, it's doubled on every next one
+	DefaultMaxBackoff  = 5 * time.Minute
+
+	SignatureHeader = "X-Keyval-Signature" // "sha256=" and hex HMAC-SHA256 of the body by the webhook secret
+	EventHeader     = "X-Keyval-Event"
+	DeliveryHeader  = "X-Keyval-Delivery"
+
+	workers        = 4 // number of deliveries sent concurrently
+	hooksFile      = "webhooks.json"
+	queueDir       = "queue"
+	deadLetterFile = "dead-letter.log"
+	maxResponse    = 64 << 10 // size of the response body read to reuse the connection
+)
+
+// Registered webhook
+type Hook struct {
+	ID     string         `json:"id"`
+	URL    string         `json:"url"`
+	Tenant string         `json:"tenant,omitempty"` // namespace of keys, all namespaces if it's empty
+	Prefix string         `json:"prefix,omitempty"` // prefix of keys within the namespace
+	Events []changelog.Op `json:"events,omitempty"` // set and del, all events if it's empty
+	Secret string         `json:"secret,omitempty"` // key of the payload signature, it isn't reported back
+}
+
+// Payload sent to the webhook
+type Payload struct {
+	ID      string       `json:"id"` // ID of the delivery, it's the same for all attempts
+	Webhook string       `json:"webhook"`
+	Event   changelog.Op `json:"event"`
+	Tenant  string       `json:"tenant,omitempty"`
+	Key     string       `json:"key"`
+	Value   string       `json:"value,omitempty"`
+	Secret  bool         `json:"secret,omitempty"` // value of the secret key isn't sent
+	Seq     uint64       `json:"seq"`              // sequence number of the change
+	Time    time.Time    `json:"time"`
+}
+
+// Delivery of the payload, it's persisted in the queue directory
+type Delivery struct {
+	Payload  Payload   `json:"payload"`
+	Attempts int       `json:"attempts"`
+	Next     time.Time `json:"next"`            // time of the next attempt
+	Error    string    `json:"error,omitempty"` // error of the last attempt
+}
+
+// Configuration of deliveries
+type Config struct {
+	Dir         string // directory of registered webhooks, the queue and the dead-letter log
+	MaxAttempts int
+	Timeout     time.Duration
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+	Keys        *crypt.Keyring // master keys encrypting the queue, values are omitted from the dead-letter log
+}
+
+// Dispatcher delivers changes to registered webhooks
+type Dispatcher struct {
+	cfg    Config
+	client *http.Client
+	now    func() time.Time
+
+	mu    sync.Mutex
+	hooks map[string]Hook      // registered webhooks by ID
+	queue map[string]*Delivery // pending deliveries by ID
+	busy  map[string]bool      // deliveries being sent
+	dead  *os.File             // dead-letter log
+	wake  chan struct{}        // signaled on new and finished deliveries
+}
+
+// Create the dispatcher, registered webhooks and pending deliveries
+// are loaded from the directory
+func New(cfg Config) (*Dispatcher, error) {
+	if cfg.MaxAttempts < 1 {
+		cfg.MaxAttempts = DefaultMaxAttempts
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	if cfg.Backoff <= 0 {
+		cfg.Backoff = DefaultBackoff
+	}
+	if cfg.MaxBackoff < cfg.Backoff {
+		cfg.MaxBackoff = max(DefaultMaxBackoff, cfg.Backoff)
+	}
+
+	if err := os.MkdirAll(filepath.Join(cfg.Dir, queueDir), 0700); err != nil {
+		return nil, errors.New("unable to create webhook directory", errors.WebhookCfgErr, err)
+	}
+
+	d := &Dispatcher{
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+		now:    time.Now,
+		hooks:  make(map[string]Hook),
+		queue:  make(map[string]*Delivery),
+		busy:   make(map[string]bool),
+		wake:   make(chan struct{}, 1),
+	}
+
+	if err := d.loadHooks(); err != nil {
+		return nil, err
+	}
+
+	if err := d.loadQueue(); err != nil {
+		return nil, err
+	}
+
+	dead, err := os.OpenFile(filepath.Join(cfg.Dir, deadLetterFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, errors.New("unable to open dead-letter log", errors.WebhookCfgErr, err)
+	}
+	d.dead = dead
+
+	return d, nil
+}
+
+// Sign the body by the secret, the value of the signature header is returned
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Follow changes of the log and deliver them until the context is done
+func (d *Dispatcher) Run(ctx context.Context, log *changelog.Storage) {
+	go d.follow(ctx, log)
+	d.deliver(ctx)
+}
+
+// Close the dead-letter log
+func (d *Dispatcher) Close() error {
+	return d.dead.Close()
+}
+
+// Register the webhook, the webhook with the same ID is replaced
+// Returns the registered webhook or error if it's invalid
+func (d *Dispatcher) Add(hook Hook) (Hook, error) {
+	if err := validate(hook); err != nil {
+		return Hook{}, err
+	}
+
+	if hook.ID == "" {
+		hook.ID = randomID()
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.hooks[hook.ID] = hook
+	if err := d.saveHooks(); err != nil {
+		return Hook{}, err
+	}
+
+	return hook, nil
+}
+
+// Remove the webhook and its pending deliveries
+func (d *Dispatcher) Remove(id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.hooks[id]; !ok {
+		return errors.New("webhook isn't registered", errors.WebhookErr, fmt.Errorf("webhook %q", id))
+	}
+
+	delete(d.hooks, id)
+	if err := d.saveHooks(); err != nil {
+		return err
+	}
+
+	for did, dl := range d.queue {
+		if dl.Payload.Webhook == id && !d.busy[did] {
+			d.drop(did)
+		}
+	}
+
+	return nil
+}
+
+// Registered webhooks ordered by ID, secrets are omitted
+func (d *Dispatcher) Hooks() []Hook {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	hooks := make([]Hook, 0, len(d.hooks))
+	for _, hook := range d.hooks {
+		hook.Secret = ""
+		hooks = append(hooks, hook)
+	}
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].ID < hooks[j].ID })
+
+	return hooks
+}
+
+// Admin handler listing (GET), registering (POST) and removing (DELETE ?id=) webhooks
+func (d *Dispatcher) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, d.Hooks())
+		case http.MethodPost:
+			var hook Hook
+			if err := json.NewDecoder(r.Body).Decode(&hook); err != nil {
+				http.Error(w, "invalid webhook: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			hook, err := d.Add(hook)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			hook.Secret = ""
+			writeJSON(w, hook)
+		case http.MethodDelete:
+			if err := d.Remove(r.URL.Query().Get("id")); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+
+			writeJSON(w, d.Hooks())
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// Queue deliveries of changes following the current end of the log,
+// changes missed by falling behind the log history are skipped
+func (d *Dispatcher) follow(ctx context.Context, log *changelog.Storage) {
+	seq := log.Seq()
+
+	for {
+		ev, err := log.Next(ctx, seq)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			head := log.Seq()
+			slog.Error("webhook changes skipped", "changes", head-seq, "error", err, "code", errors.Code(err))
+			seq = head
+			continue
+		}
+
+		seq = ev.Seq
+		d.enqueue(ev)
+	}
+}
+
+// Queue deliveries of the change to matching webhooks
+func (d *Dispatcher) enqueue(ev changelog.Event) {
+	name, key := tenant.Split(ev.Key)
+	value, secret := ev.Value, ev.Secret
+	if secret {
+		value = ""
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, hook := range d.hooks {
+		if !hook.matches(ev.Op, name, key) {
+			continue
+		}
+
+		dl := &Delivery{
+			Payload: Payload{
+				ID:      randomID(),
+				Webhook: hook.ID,
+				Event:   ev.Op,
+				Tenant:  name,
+				Key:     key,
+				Value:   value,
+				Secret:  secret,
+				Seq:     ev.Seq,
+				Time:    ev.Time,
+			},
+			Next: d.now(),
+		}
+
+		// the delivery is still sent if it can't be persisted
+		if err := d.persist(dl); err != nil {
+			slog.Error("unable to persist webhook delivery", "webhook", hook.ID, "error", err, "code", errors.Code(err))
+		}
+
+		d.queue[dl.Payload.ID] = dl
+	}
+
+	metrics.WebhookQueue.Set(float64(len(d.queue)))
+	d.signal()
+}
+
+// Send due deliveries by workers until the context is done
+func (d *Dispatcher) deliver(ctx context.Context) {
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		wait := d.cfg.MaxBackoff
+
+		d.mu.Lock()
+		now := d.now()
+		for id, dl := range d.queue {
+			if d.busy[id] {
+				continue
+			}
+
+			if dl.Next.After(now) {
+				wait = min(wait, dl.Next.Sub(now))
+				continue
+			}
+
+			// the rest is started when a worker is free
+			if len(sem) == cap(sem) {
+				break
+			}
+
+			sem <- struct{}{}
+			d.busy[id] = true
+			wg.Add(1)
+			go func(dl *Delivery) {
+				defer wg.Done()
+				d.attempt(ctx, dl)
+				<-sem
+				d.signal()
+			}(dl)
+		}
+		d.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.wake:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Send the delivery, it's rescheduled or moved to the dead-letter log on failure
+func (d *Dispatcher) attempt(ctx context.Context, dl *Delivery) {
+	id := dl.Payload.ID
+
+	d.mu.Lock()
+	hook, ok := d.hooks[dl.Payload.Webhook]
+	d.mu.Unlock()
+
+	var err error
+	if ok {
+		err = d.send(ctx, hook, dl.Payload)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.busy, id)
+
+	switch {
+	case !ok:
+		// the webhook was removed
+		d.drop(id)
+	case ctx.Err() != nil:
+		// the attempt is repeated after restart
+	case err == nil:
+		metrics.WebhookDeliveries.Inc("ok")
+		d.drop(id)
+	default:
+		dl.Attempts++
+		dl.Error = err.Error()
+
+		if dl.Attempts >= d.cfg.MaxAttempts {
+			metrics.WebhookDeliveries.Inc("dead")
+			slog.Warn("webhook delivery failed", "webhook", hook.ID, "delivery", id, "attempts", dl.Attempts, "error", err, "code", errors.Code(err))
+			if err := d.deadLetter(dl); err != nil {
+				slog.Error("unable to write dead-letter log", "error", err, "code", errors.Code(err))
+			}
+			d.drop(id)
+			return
+		}
+
+		metrics.WebhookDeliveries.Inc("retry")
+		dl.Next = d.now().Add(d.backoff(dl.Attempts))
+		if err := d.persist(dl); err != nil {
+			slog.Error("unable to persist webhook delivery", "webhook", hook.ID, "error", err, "code", errors.Code(err))
+		}
+	}
+}
+
+// POST the payload to the webhook, responses other than 2xx are failures
+func (d *Dispatcher) send(ctx context.Context, hook Hook, payload Payload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return errors.New("invalid webhook payload", errors.WebhookErr, err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return errors.New("invalid webhook request", errors.WebhookErr, err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, string(payload.Event))
+	req.Header.Set(DeliveryHeader, payload.ID)
+	if hook.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(hook.Secret, body))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return errors.New("webhook request failed", errors.WebhookErr, err)
+	}
+	defer resp.Body.Close()
+
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxResponse))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New("webhook request failed", errors.WebhookErr, fmt.Errorf("unexpected status %s", resp.Status))
+	}
+
+	return nil
+}
+
+// Delay after the given number of failed attempts
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	delay := d.cfg.Backoff
+	for i := 1; i < attempts && delay < d.cfg.MaxBackoff; i++ {
+		delay *= 2
+	}
+
+	return min(delay, d.cfg.MaxBackoff)
+}
+
+// Remove the delivery from the queue, the caller holds the lock
+func (d *Dispatcher) drop(id string) {
+	delete(d.queue, id)
+	metrics.WebhookQueue.Set(float64(len(d.queue)))
+
+	if err := os.Remove(d.queuePath(id)); err != nil && !os.IsNotExist(err) {
+		slog.Error("unable to remove webhook delivery", "delivery", id, "error", err)
+	}
+}
+
+// Append the failed delivery to the dead-letter log as a JSON line,
+// the value is omitted if the queue is encrypted
+func (d *Dispatcher) deadLetter(dl *Delivery) error {
+	entry := *dl
+	if d.cfg.Keys != nil {
+		entry.Payload.Value = ""
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return errors.New("invalid webhook delivery", errors.WebhookErr, err)
+	}
+
+	if _, err := d.dead.Write(append(data, '\n')); err != nil {
+		return errors.New("unable to write dead-letter log", errors.WebhookErr, err)
+	}
+
+	return nil
+}
+
+// Write the delivery into the queue directory, it's encrypted if master keys are given
+func (d *Dispatcher) persist(dl *Delivery) error {
+	data, err := json.Marshal(dl)
+	if err != nil {
+		return errors.New("invalid webhook delivery", errors.WebhookErr, err)
+	}
+
+	if d.cfg.Keys != nil {
+		if data, err = d.cfg.Keys.SealText(data); err != nil {
+			return err
+		}
+	}
+
+	return writeFile(d.queuePath(dl.Payload.ID), data)
+}
+
+func (d *Dispatcher) queuePath(id string) string {
+	return filepath.Join(d.cfg.Dir, queueDir, id+".json")
+}
+
+// Load pending deliveries of the queue directory
+func (d *Dispatcher) loadQueue() error {
+	files, err := filepath.Glob(filepath.Join(d.cfg.Dir, queueDir, "*.json"))
+	if err != nil {
+		return errors.New("unable to read webhook queue", errors.WebhookCfgErr, err)
+	}
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return errors.New("unable to read webhook queue", errors.WebhookCfgErr, err)
+		}
+
+		// deliveries queued before encryption is enabled are plain
+		if !crypt.IsPlain(data) {
+			if d.cfg.Keys == nil {
+				return errors.New("unable to read webhook queue", errors.WebhookCfgErr, fmt.Errorf("%s is encrypted, but master keys aren't configured", file))
+			}
+
+			if data, err = d.cfg.Keys.OpenText(data); err != nil {
+				return err
+			}
+		}
+
+		var dl Delivery
+		if err := json.Unmarshal(data, &dl); err != nil || dl.Payload.ID == "" {
+			slog.Error("invalid webhook delivery skipped", "file", file, "error", err)
+			continue
+		}
+
+		d.queue[dl.Payload.ID] = &dl
+	}
+
+	metrics.WebhookQueue.Set(float64(len(d.queue)))
+	return nil
+}
+
+// Load registered webhooks
+func (d *Dispatcher) loadHooks() error {
+	data, err := os.ReadFile(filepath.Join(d.cfg.Dir, hooksFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.New("unable to read webhooks", errors.WebhookCfgErr, err)
+	}
+
+	var hooks []Hook
+	if err := json.Unmarshal(data, &hooks); err != nil {
+		return errors.New("invalid webhooks", errors.WebhookCfgErr, err)
+	}
+
+	for _, hook := range hooks {
+		d.hooks[hook.ID] = hook
+	}
+
+	return nil
+}
+
+// Save registered webhooks, the caller holds the lock
+func (d *Dispatcher) saveHooks() error {
+	hooks := make([]Hook, 0, len(d.hooks))
+	for _, hook := range d.hooks {
+		hooks = append(hooks, hook)
+	}
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].ID < hooks[j].ID })
+
+	data, err := json.MarshalIndent(hooks, "", "  ")
+	if err != nil {
+		return errors.New("invalid webhooks", errors.WebhookErr, err)
+	}
+
+	return writeFile(filepath.Join(d.cfg.Dir, hooksFile), data)
+}
+
+func (d *Dispatcher) signal() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (h Hook) matches(op changelog.Op, name, key string) bool {
+	if h.Tenant != "" && h.Tenant != name {
+		return false
+	}
+
+	if len(h.Events) > 0 && !slices.Contains(h.Events, op) {
+		return false
+	}
+
+	return strings.HasPrefix(key, h.Prefix)
+}
+
+func validate(hook Hook) error {
+	u, err := url.Parse(hook.URL)
+	if err != nil {
+		return errors.New("invalid webhook URL", errors.WebhookErr, err)
+	}
+
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("invalid webhook URL", errors.WebhookErr, fmt.Errorf("%q isn't an HTTP URL", hook.URL))
+	}
+
+	for _, op := range hook.Events {
+		if op != changelog.Set && op != changelog.Delete {
+			return errors.New("invalid webhook event", errors.WebhookErr, fmt.Errorf("event %q", op))
+		}
+	}
+
+	return nil
+}
+
+// Replace the file atomically, so a crash doesn't leave it half-written
+func writeFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return errors.New("unable to write webhook file", errors.WebhookErr, err)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return errors.New("unable to write webhook file", errors.WebhookErr, err)
+	}
+
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func randomID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,280 @@
+package webhook
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/arsenalzp/keyvalstore/internal/server/crypt"
+	"github.com/arsenalzp/keyvalstore/internal/server/storage/changelog"
+	entity "github.com/arsenalzp/keyvalstore/internal/server/storage/entity"
+	ht "github.com/arsenalzp/keyvalstore/internal/server/storage/hash-table"
+)
+
+// Webhook receiver failing the given number of requests of every delivery
+type receiver struct {
+	mu       sync.Mutex
+	failures int
+	attempts map[string]int
+	payloads []Payload
+	badSigns int
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	var p Payload
+	json.Unmarshal(body, &p)
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if r.Header.Get(SignatureHeader) != Sign("secret", body) {
+		rc.badSigns++
+	}
+
+	rc.attempts[p.ID]++
+	if rc.attempts[p.ID] <= rc.failures {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	rc.payloads = append(rc.payloads, p)
+}
+
+func (rc *receiver) received() []Payload {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	return append([]Payload(nil), rc.payloads...)
+}
+
+// Wait until the condition is met
+func waitFor(t *testing.T, what string, cond func() bool) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Errorf("timeout waiting for %s\n", what)
+	return false
+}
+
+func queued(dir string) int {
+	files, _ := filepath.Glob(filepath.Join(dir, queueDir, "*.json"))
+	return len(files)
+}
+
+func TestDelivery(t *testing.T) {
+	rc := &receiver{failures: 2, attempts: make(map[string]int)}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	dir := t.TempDir()
+	d, err := New(Config{Dir: dir, Backoff: 10 * time.Millisecond})
+	if err != nil {
+		t.Errorf("error creating dispatcher: %s\n", err)
+		return
+	}
+	defer d.Close()
+
+	if _, err := d.Add(Hook{URL: "ftp://example.com"}); err == nil {
+		t.Errorf("error adding webhook: invalid URL is accepted\n")
+		return
+	}
+
+	hook, err := d.Add(Hook{URL: srv.URL, Prefix: "user/", Events: []changelog.Op{changelog.Set}, Secret: "secret"})
+	if err != nil {
+		t.Errorf("error adding webhook: %s\n", err)
+		return
+	}
+
+	strg, _ := ht.NewHT()
+	log := changelog.New(strg, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx, log)
+
+	// wait for the dispatcher to follow the log
+	time.Sleep(50 * time.Millisecond)
+
+	log.Insert(ctx, "user/1", "value")
+	log.Insert(ctx, "user/2", entity.SecretMarker+"password")
+	log.Insert(ctx, "other", "value")
+	log.Delete(ctx, "user/1")
+
+	if !waitFor(t, "deliveries", func() bool { return len(rc.received()) == 2 && queued(dir) == 0 }) {
+		return
+	}
+
+	payloads := rc.received()
+	byKey := map[string]Payload{payloads[0].Key: payloads[0], payloads[1].Key: payloads[1]}
+
+	if p := byKey["user/1"]; p.Webhook != hook.ID || p.Event != changelog.Set || p.Value != "value" {
+		t.Errorf("error delivering change, got %+v\n", p)
+		return
+	}
+
+	if p := byKey["user/2"]; !p.Secret || p.Value != "" {
+		t.Errorf("error delivering secret change, got %+v\n", p)
+		return
+	}
+
+	if rc.badSigns != 0 {
+		t.Errorf("error signing payloads, %d invalid signatures\n", rc.badSigns)
+		return
+	}
+
+	for _, h := range d.Hooks() {
+		if h.Secret != "" {
+			t.Errorf("error listing webhooks: secret is reported\n")
+			return
+		}
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	rc := &receiver{failures: 100, attempts: make(map[string]int)}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	dir := t.TempDir()
+	d, err := New(Config{Dir: dir, MaxAttempts: 3, Backoff: 10 * time.Millisecond})
+	if err != nil {
+		t.Errorf("error creating dispatcher: %s\n", err)
+		return
+	}
+
+	d.Add(Hook{ID: "hook", URL: srv.URL, Secret: "secret"})
+
+	// the delivery queued before restart is sent by the next dispatcher
+	d.enqueue(changelog.Event{Seq: 1, Op: changelog.Delete, Key: "key"})
+	d.Close()
+
+	if n := queued(dir); n != 1 {
+		t.Errorf("error persisting delivery, %d deliveries queued\n", n)
+		return
+	}
+
+	d, err = New(Config{Dir: dir, MaxAttempts: 3, Backoff: 10 * time.Millisecond})
+	if err != nil {
+		t.Errorf("error creating dispatcher: %s\n", err)
+		return
+	}
+	defer d.Close()
+
+	if hooks := d.Hooks(); len(hooks) != 1 || hooks[0].ID != "hook" {
+		t.Errorf("error loading webhooks, got %+v\n", hooks)
+		return
+	}
+
+	strg, _ := ht.NewHT()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx, changelog.New(strg, 0))
+
+	if !waitFor(t, "dead letter", func() bool { return queued(dir) == 0 }) {
+		return
+	}
+
+	f, err := os.Open(filepath.Join(dir, deadLetterFile))
+	if err != nil {
+		t.Errorf("error opening dead-letter log: %s\n", err)
+		return
+	}
+	defer f.Close()
+
+	var dead []Delivery
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var dl Delivery
+		json.Unmarshal(scanner.Bytes(), &dl)
+		dead = append(dead, dl)
+	}
+
+	if len(dead) != 1 || dead[0].Attempts != 3 || dead[0].Payload.Key != "key" || dead[0].Error == "" {
+		t.Errorf("error writing dead-letter log, got %+v\n", dead)
+		return
+	}
+}
+
+func TestEncryptedQueue(t *testing.T) {
+	keys, err := crypt.ReadKeyring(strings.NewReader("k1:" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("k"), 32))))
+	if err != nil {
+		t.Fatalf("error reading master keys: %s\n", err)
+	}
+
+	dir := t.TempDir()
+	d, err := New(Config{Dir: dir, Keys: keys})
+	if err != nil {
+		t.Errorf("error creating dispatcher: %s\n", err)
+		return
+	}
+
+	d.Add(Hook{ID: "hook", URL: "http://127.0.0.1:1"})
+	d.enqueue(changelog.Event{Seq: 1, Op: changelog.Set, Key: "key", Value: "secret-value"})
+
+	for _, dl := range d.queue {
+		d.deadLetter(dl)
+	}
+	d.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, queueDir, "*.json"))
+	files = append(files, filepath.Join(dir, deadLetterFile))
+	for _, file := range files {
+		data, _ := os.ReadFile(file)
+		if bytes.Contains(data, []byte("secret-value")) {
+			t.Errorf("error encrypting webhook deliveries, %s contains the value\n", file)
+			return
+		}
+	}
+
+	d, err = New(Config{Dir: dir, Keys: keys})
+	if err != nil {
+		t.Errorf("error loading encrypted queue: %s\n", err)
+		return
+	}
+	d.Close()
+
+	if len(d.queue) != 1 {
+		t.Errorf("error loading encrypted queue, %d deliveries loaded\n", len(d.queue))
+		return
+	}
+
+	for _, dl := range d.queue {
+		if dl.Payload.Value != "secret-value" {
+			t.Errorf("error loading encrypted queue, got value %q\n", dl.Payload.Value)
+			return
+		}
+	}
+
+	if _, err := New(Config{Dir: dir}); err == nil {
+		t.Errorf("error loading encrypted queue without master keys: no error\n")
+		return
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	d := &Dispatcher{cfg: Config{Backoff: time.Second, MaxBackoff: 5 * time.Second}}
+
+	for attempts, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 60: 5 * time.Second} {
+		if got := d.backoff(attempts); got != want {
+			t.Errorf("error computing backoff of %d attempts, got %s, expected %s\n", attempts, got, want)
+		}
+	}
+}